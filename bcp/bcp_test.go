@@ -0,0 +1,236 @@
+package bcp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mssql "github.com/wang-xuemin/go-mssqldb"
+)
+
+func TestNativeRoundTrip(t *testing.T) {
+	f, err := NativeFormat([]mssql.BulkColumn{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "nvarchar", Length: 20, Nullable: true},
+		{Name: "price", Type: "decimal", Precision: 10, Scale: 2},
+		{Name: "created", Type: "datetime2", Scale: 7},
+		{Name: "data", Type: "varbinary", Nullable: true},
+	})
+	if err != nil {
+		t.Fatal("NativeFormat failed:", err)
+	}
+	created := time.Date(2021, 3, 4, 5, 6, 7, 123456700, time.UTC)
+	rows := [][]interface{}{
+		{int64(1), "café", []byte("12.50"), created, []byte{1, 2}},
+		{int64(-2), nil, []byte("0.00"), created, nil},
+	}
+	var b bytes.Buffer
+	w := NewWriter(&b, f)
+	for _, row := range rows {
+		if err = w.Write(row); err != nil {
+			t.Fatal("Write failed:", err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal("Flush failed:", err)
+	}
+	expected := []byte{1, 0, 0, 0, 8, 0, 'c', 0, 'a', 0, 'f', 0, 0xe9, 0, 19, 10, 2, 1, 0xe2, 4}
+	if !bytes.HasPrefix(b.Bytes(), expected) {
+		t.Errorf("native data starts with % x, expected % x", b.Bytes()[:len(expected)], expected)
+	}
+
+	r := NewReader(&b, f)
+	if columns := r.Columns(); !reflect.DeepEqual(columns, []string{"id", "name", "price", "created", "data"}) {
+		t.Errorf("columns are %v", columns)
+	}
+	for _, row := range rows {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatal("Read failed:", err)
+		}
+		if !reflect.DeepEqual(got, row) {
+			t.Errorf("read %v, expected %v", got, row)
+		}
+	}
+	if _, err = r.Read(); err != io.EOF {
+		t.Errorf("read %v after the last row", err)
+	}
+}
+
+func TestNativeTimeFormatRoundTrip(t *testing.T) {
+	f, err := NativeFormat([]mssql.BulkColumn{
+		{Name: "t", Type: "time", Scale: 0},
+		{Name: "d", Type: "datetime2", Scale: 3},
+		{Name: "o", Type: "datetimeoffset", Scale: 2},
+	})
+	if err != nil {
+		t.Fatal("NativeFormat failed:", err)
+	}
+	for i, length := range []int{5, 8, 10} {
+		if f.Fields[i].Length != length {
+			t.Errorf("field %s is %d bytes long, expected %d", f.Fields[i].Name, f.Fields[i].Length, length)
+		}
+	}
+	row := []interface{}{
+		time.Date(1, 1, 1, 13, 14, 15, 0, time.UTC),
+		time.Date(2021, 3, 4, 5, 6, 7, 123000000, time.UTC),
+		time.Date(2021, 3, 4, 5, 6, 7, 120000000, time.FixedZone("", 90*60)),
+	}
+	var data bytes.Buffer
+	w := NewWriter(&data, f)
+	if err = w.Write(row); err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal("Flush failed:", err)
+	}
+
+	// the format file does not keep the scale of the columns
+	var format bytes.Buffer
+	if err = f.WriteFormat(&format); err != nil {
+		t.Fatal("WriteFormat failed:", err)
+	}
+	if f, err = ReadFormat(&format); err != nil {
+		t.Fatal("ReadFormat failed:", err)
+	}
+	got, err := NewReader(&data, f).Read()
+	if err != nil {
+		t.Fatal("Read failed:", err)
+	}
+	for i, v := range row {
+		if tm, ok := got[i].(time.Time); !ok || !tm.Equal(v.(time.Time)) {
+			t.Errorf("read %v for %s, expected %v", got[i], f.Fields[i].Name, v)
+		}
+	}
+}
+
+func TestCharacterRoundTrip(t *testing.T) {
+	f := CharacterFormat([]string{"id", "name", "note"}, ",", "")
+	var b bytes.Buffer
+	w := NewWriter(&b, f)
+	if err := w.Write([]interface{}{int64(1), "a", nil}); err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	if err := w.Write([]interface{}{int64(2), "", true}); err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	w.Flush()
+	if b.String() != "1,a,\n2,\x00,1\n" {
+		t.Errorf("character data is %q", b.String())
+	}
+	r := NewReader(&b, f)
+	for _, expected := range [][]interface{}{{"1", "a", nil}, {"2", "", "1"}} {
+		row, err := r.Read()
+		if err != nil {
+			t.Fatal("Read failed:", err)
+		}
+		if !reflect.DeepEqual(row, expected) {
+			t.Errorf("read %q, expected %q", row, expected)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("read %v after the last row", err)
+	}
+
+	r = NewReader(strings.NewReader("3,b"), f)
+	if _, err := r.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("read %v from a truncated row", err)
+	}
+}
+
+func TestReadFormat(t *testing.T) {
+	text := `14.0
+3
+1       SQLCHAR             0       12      "\t"     1     id                 ""
+2       SQLCHAR             0       0       "\t"     0     skipped            ""
+3       SQLNCHAR            2       100     "\r\n"   2     name               SQL_Latin1_General_CP1_CI_AS
+`
+	f, err := ReadFormat(strings.NewReader(text))
+	if err != nil {
+		t.Fatal("ReadFormat failed:", err)
+	}
+	expected := &Format{Version: "14.0", Fields: []Field{
+		{Type: TypeChar, Length: 12, Terminator: "\t", Column: 1, Name: "id"},
+		{Type: TypeChar, Terminator: "\t", Name: "skipped"},
+		{Type: TypeNChar, PrefixLength: 2, Length: 100, Terminator: "\r\n", Column: 2, Name: "name", Collation: "SQL_Latin1_General_CP1_CI_AS"},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("read %+v, expected %+v", f, expected)
+	}
+	var b bytes.Buffer
+	if err = f.WriteFormat(&b); err != nil {
+		t.Fatal("WriteFormat failed:", err)
+	}
+	if f, err = ReadFormat(&b); err != nil || !reflect.DeepEqual(f, expected) {
+		t.Errorf("read back %+v, %v", f, err)
+	}
+
+	if _, err = ReadFormat(strings.NewReader("14.0\n2\n1 SQLCHAR 0 0 \"\\t\" 1 id \"\"\n")); err == nil {
+		t.Error("a format file with a missing field should fail")
+	}
+}
+
+func TestReadXMLFormat(t *testing.T) {
+	text := `<?xml version="1.0"?>
+<BCPFORMAT xmlns="http://schemas.microsoft.com/sqlserver/2004/bulkload/format" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+ <RECORD>
+  <FIELD ID="1" xsi:type="NativeFixed" LENGTH="4"/>
+  <FIELD ID="2" xsi:type="CharTerm" TERMINATOR="\r\n" MAX_LENGTH="30" COLLATION="Latin1_General_CI_AS"/>
+ </RECORD>
+ <ROW>
+  <COLUMN SOURCE="1" NAME="id" xsi:type="SQLINT"/>
+  <COLUMN SOURCE="2" NAME="name" xsi:type="SQLVARYCHAR" NULLABLE="YES"/>
+ </ROW>
+</BCPFORMAT>`
+	f, err := ReadFormat(strings.NewReader(text))
+	if err != nil {
+		t.Fatal("ReadFormat failed:", err)
+	}
+	expected := &Format{Fields: []Field{
+		{Type: TypeInt, Length: 4, Column: 1, Name: "id", ColumnType: TypeInt},
+		{Type: TypeChar, Length: 30, Terminator: "\r\n", Column: 2, Name: "name", Collation: "Latin1_General_CI_AS", ColumnType: TypeVaryChar, Nullable: true},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("read %+v, expected %+v", f, expected)
+	}
+	var b bytes.Buffer
+	if err = f.WriteXMLFormat(&b); err != nil {
+		t.Fatal("WriteXMLFormat failed:", err)
+	}
+	if f, err = ReadFormat(&b); err != nil || !reflect.DeepEqual(f, expected) {
+		t.Errorf("read back %+v, %v", f, err)
+	}
+
+	row, err := NewReader(strings.NewReader("\x07\x00\x00\x00bob\r\n"), f).Read()
+	if err != nil || !reflect.DeepEqual(row, []interface{}{int64(7), "bob"}) {
+		t.Errorf("read %v, %v", row, err)
+	}
+}
+
+func TestReadBogusLength(t *testing.T) {
+	f, err := NativeFormat([]mssql.BulkColumn{
+		{Name: "name", Type: "nvarchar", Length: 20},
+		{Name: "data", Type: "varbinary"},
+	})
+	if err != nil {
+		t.Fatal("NativeFormat failed:", err)
+	}
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"\xfe\xff", "length 65534 of a value of column name is more than 40"},
+		{"\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00", "length 1099511627776 of a value of column data is more than 2147483647"},
+	}
+	for _, test := range tests {
+		if _, err = NewReader(strings.NewReader(test.data), f).Read(); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("read % x with %v, expected %s", test.data, err, test.expected)
+		}
+	}
+	if _, err = NewReader(strings.NewReader("\x04\x00a\x00"), f).Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("read a truncated value with %v", err)
+	}
+}
@@ -0,0 +1,663 @@
+// Package bcp reads and writes the data files and format files of the bcp
+// utility of SQL Server, so that data files can be loaded with the bulk
+// copy of the driver and written without the utility.
+//
+// The rows read from a data file hold the values of its columns in the
+// order of the columns, ready for Bulk.AddRow:
+//
+//	f, err := bcp.ReadFormatFile("orders.fmt")
+//	...
+//	r := bcp.NewReader(data, f)
+//	bulk := conn.CreateBulk("dbo.orders", r.Columns())
+//	for {
+//		row, err := r.Read()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//		err = bulk.AddRow(row)
+//	}
+//	rowcount, err := bulk.Done()
+package bcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	mssql "github.com/wang-xuemin/go-mssqldb"
+)
+
+// Host data types of the fields of data files.
+const (
+	TypeChar           = "SQLCHAR"
+	TypeVaryChar       = "SQLVARYCHAR"
+	TypeNChar          = "SQLNCHAR"
+	TypeNVarChar       = "SQLNVARCHAR"
+	TypeText           = "SQLTEXT"
+	TypeNText          = "SQLNTEXT"
+	TypeBinary         = "SQLBINARY"
+	TypeVaryBin        = "SQLVARYBIN"
+	TypeImage          = "SQLIMAGE"
+	TypeTinyInt        = "SQLTINYINT"
+	TypeSmallInt       = "SQLSMALLINT"
+	TypeInt            = "SQLINT"
+	TypeBigInt         = "SQLBIGINT"
+	TypeBit            = "SQLBIT"
+	TypeFloat4         = "SQLFLT4"
+	TypeFloat8         = "SQLFLT8"
+	TypeMoney          = "SQLMONEY"
+	TypeMoney4         = "SQLMONEY4"
+	TypeDecimal        = "SQLDECIMAL"
+	TypeNumeric        = "SQLNUMERIC"
+	TypeDateTime       = "SQLDATETIME"
+	TypeDateTim4       = "SQLDATETIM4"
+	TypeDate           = "SQLDATE"
+	TypeTime           = "SQLTIME"
+	TypeDateTime2      = "SQLDATETIME2"
+	TypeDateTimeOffset = "SQLDATETIMEOFFSET"
+	TypeUniqueID       = "SQLUNIQUEID"
+	TypeXML            = "SQLXML"
+	TypeUDT            = "SQLUDT"
+	TypeVariant        = "SQLVARIANT"
+)
+
+// Format describes the fields of the records of a data file and the
+// columns they are copied to, like a format file.
+type Format struct {
+	// Version is the version of bcp of non-XML format files, 14.0 when
+	// empty.
+	Version string
+	Fields  []Field
+}
+
+// Field is a field of the records of a data file.
+type Field struct {
+	// Type is the host data type of the field, one of the Type constants.
+	// Character data is SQLCHAR, or SQLNCHAR for UTF-16 data.
+	Type string
+	// PrefixLength is the size of the length prefix of the values, 0, 1,
+	// 2, 4 or 8. A prefix of all one bits is NULL.
+	PrefixLength int
+	// Length is the size of the values of fixed length fields, which
+	// have neither a length prefix nor a terminator, and the maximum size
+	// of the others, when not zero.
+	Length int
+	// Terminator ends the values of the field, when not empty.
+	Terminator string
+	// Column is the order of the column of the field, from 1, or 0 when
+	// the field is not copied. Name is the name of the column.
+	Column int
+	Name   string
+	// Collation is the collation of character data, when not empty.
+	Collation string
+	// ColumnType is the type of the column in XML format files, like
+	// SQLINT or SQLVARYCHAR. It is the host type of native fields when
+	// empty.
+	ColumnType string
+	// Precision and Scale are those of decimal columns. Without them,
+	// the precision and scale of decimal values are kept. Native time,
+	// datetime2 and datetimeoffset values are always at scale 7.
+	Precision uint8
+	Scale     uint8
+	// Nullable tells whether the column accepts NULL, in XML format files.
+	Nullable bool
+}
+
+// isChar tells whether the values of a field are character data.
+func (f Field) isChar() bool {
+	switch f.Type {
+	case TypeChar, TypeVaryChar, TypeText, TypeNChar, TypeNVarChar, TypeNText:
+		return true
+	}
+	return false
+}
+
+// isWide tells whether the values of a field are UTF-16 data.
+func (f Field) isWide() bool {
+	switch f.Type {
+	case TypeNChar, TypeNVarChar, TypeNText, TypeXML:
+		return true
+	}
+	return false
+}
+
+// columnType is the type of the column of a field.
+func (f Field) columnType() string {
+	switch {
+	case f.ColumnType != "":
+		return f.ColumnType
+	case f.Type == TypeChar:
+		return TypeVaryChar
+	case f.Type == TypeNChar:
+		return TypeNVarChar
+	}
+	return f.Type
+}
+
+// Columns returns the names of the columns of the fields copied, in
+// their order.
+func (f *Format) Columns() []string {
+	fields := f.columnFields()
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = f.Fields[field].Name
+	}
+	return names
+}
+
+// columnFields returns the indexes of the fields copied, in the order of
+// their columns.
+func (f *Format) columnFields() []int {
+	var fields []int
+	for i, field := range f.Fields {
+		if field.Column > 0 {
+			fields = append(fields, i)
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return f.Fields[fields[i]].Column < f.Fields[fields[j]].Column
+	})
+	return fields
+}
+
+// NativeFormat returns the format of data files written by bcp -n for a
+// table of the given columns.
+func NativeFormat(columns []mssql.BulkColumn) (*Format, error) {
+	f := &Format{Fields: make([]Field, len(columns))}
+	for i, c := range columns {
+		field := Field{Column: i + 1, Name: c.Name, Collation: c.Collation}
+		fixed := func(typ string, length int) {
+			field.Type, field.Length = typ, length
+			if c.Nullable {
+				field.PrefixLength = 1
+			}
+		}
+		variable := func(typ string, length, max int) {
+			field.Type, field.PrefixLength = typ, 2
+			if c.Length <= 0 || c.Length > max {
+				field.PrefixLength = 8
+			} else {
+				field.Length = length
+			}
+		}
+		switch strings.ToLower(c.Type) {
+		case "tinyint":
+			fixed(TypeTinyInt, 1)
+		case "smallint":
+			fixed(TypeSmallInt, 2)
+		case "int":
+			fixed(TypeInt, 4)
+		case "bigint":
+			fixed(TypeBigInt, 8)
+		case "bit":
+			fixed(TypeBit, 1)
+		case "real":
+			fixed(TypeFloat4, 4)
+		case "float":
+			fixed(TypeFloat8, 8)
+		case "smallmoney":
+			fixed(TypeMoney4, 4)
+		case "money":
+			fixed(TypeMoney, 8)
+		case "smalldatetime":
+			fixed(TypeDateTim4, 4)
+		case "datetime":
+			fixed(TypeDateTime, 8)
+		case "decimal", "numeric":
+			field.Type, field.PrefixLength, field.Length = TypeDecimal, 1, 19
+			if strings.EqualFold(c.Type, "numeric") {
+				field.Type = TypeNumeric
+			}
+			field.Precision, field.Scale = c.Precision, c.Scale
+			if field.Precision == 0 {
+				field.Precision = 18
+			}
+		case "date":
+			field.Type, field.PrefixLength, field.Length = TypeDate, 1, 3
+		case "time":
+			// time values are written at scale 7 whatever the scale
+			// of the column, like bcp does
+			field.Type, field.PrefixLength, field.Length = TypeTime, 1, 5
+		case "datetime2":
+			field.Type, field.PrefixLength, field.Length = TypeDateTime2, 1, 8
+		case "datetimeoffset":
+			field.Type, field.PrefixLength, field.Length = TypeDateTimeOffset, 1, 10
+		case "uniqueidentifier":
+			field.Type, field.PrefixLength, field.Length = TypeUniqueID, 1, 16
+		case "char", "varchar":
+			variable(TypeChar, c.Length, 8000)
+		case "nchar", "nvarchar":
+			variable(TypeNChar, 2*c.Length, 4000)
+		case "binary", "varbinary":
+			variable(TypeBinary, c.Length, 8000)
+		case "text":
+			field.Type, field.PrefixLength = TypeChar, 4
+		case "ntext":
+			field.Type, field.PrefixLength = TypeNChar, 4
+		case "image":
+			field.Type, field.PrefixLength = TypeBinary, 4
+		case "xml":
+			field.Type, field.PrefixLength = TypeNChar, 8
+		default:
+			return nil, fmt.Errorf("bcp: type %s of column %s is not supported", c.Type, c.Name)
+		}
+		f.Fields[i] = field
+	}
+	return f, nil
+}
+
+// CharacterFormat returns the format of data files written by bcp -c for
+// the given columns, the fields separated by fieldTerminator and the
+// rows ended by rowTerminator. They are a tab and a new line when empty.
+func CharacterFormat(columns []string, fieldTerminator, rowTerminator string) *Format {
+	if fieldTerminator == "" {
+		fieldTerminator = "\t"
+	}
+	if rowTerminator == "" {
+		rowTerminator = "\n"
+	}
+	f := &Format{Fields: make([]Field, len(columns))}
+	for i, name := range columns {
+		f.Fields[i] = Field{Type: TypeChar, Terminator: fieldTerminator, Column: i + 1, Name: name}
+	}
+	if len(columns) > 0 {
+		f.Fields[len(columns)-1].Terminator = rowTerminator
+	}
+	return f
+}
+
+// ReadFormatFile reads a format file, XML or not.
+func ReadFormatFile(name string) (*Format, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadFormat(file)
+}
+
+// ReadFormat reads a format file, XML or not.
+func ReadFormat(r io.Reader) (*Format, error) {
+	br := bufio.NewReader(r)
+	for {
+		ch, _, err := br.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("bcp: the format file is empty")
+			}
+			return nil, err
+		}
+		// skip a byte order mark too
+		if !unicode.IsSpace(ch) && ch != '\uFEFF' {
+			br.UnreadRune()
+			if ch == '<' {
+				return readXMLFormat(br)
+			}
+			return readTextFormat(br)
+		}
+	}
+}
+
+// readTextFormat reads a non-XML format file.
+func readTextFormat(r io.Reader) (*Format, error) {
+	scanner := bufio.NewScanner(r)
+	var lines [][]string
+	for scanner.Scan() {
+		tokens, err := formatTokens(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) > 0 {
+			lines = append(lines, tokens)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) < 2 || len(lines[0]) != 1 || len(lines[1]) != 1 {
+		return nil, errors.New("bcp: a format file starts with its version and number of fields")
+	}
+	count, err := strconv.Atoi(lines[1][0])
+	if err != nil || count != len(lines)-2 {
+		return nil, fmt.Errorf("bcp: the format file has %d fields, not %s", len(lines)-2, lines[1][0])
+	}
+	f := &Format{Version: lines[0][0], Fields: make([]Field, count)}
+	for i, tokens := range lines[2:] {
+		if len(tokens) < 7 || len(tokens) > 8 {
+			return nil, fmt.Errorf("bcp: field %d of the format file has %d values", i+1, len(tokens))
+		}
+		var numbers [4]int
+		for j, k := range []int{0, 2, 3, 5} {
+			if numbers[j], err = strconv.Atoi(tokens[k]); err != nil {
+				return nil, fmt.Errorf("bcp: invalid number %q in field %d of the format file", tokens[k], i+1)
+			}
+		}
+		if numbers[0] != i+1 {
+			return nil, fmt.Errorf("bcp: field %d of the format file is numbered %d", i+1, numbers[0])
+		}
+		field := Field{
+			Type:         strings.ToUpper(tokens[1]),
+			PrefixLength: numbers[1],
+			Length:       numbers[2],
+			Terminator:   tokens[4],
+			Column:       numbers[3],
+			Name:         tokens[6],
+		}
+		if len(tokens) == 8 {
+			field.Collation = tokens[7]
+		}
+		if err = field.check(); err != nil {
+			return nil, err
+		}
+		f.Fields[i] = field
+	}
+	return f, nil
+}
+
+// formatTokens splits a line of a non-XML format file, terminators and
+// empty collations are quoted.
+func formatTokens(line string) ([]string, error) {
+	var tokens []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return tokens, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			tokens = append(tokens, line[:end])
+			line = line[end:]
+			continue
+		}
+		var token []byte
+		i := 1
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+				token = append(token, unescape(line[i]))
+				continue
+			}
+			token = append(token, line[i])
+		}
+		if i == len(line) {
+			return nil, fmt.Errorf("bcp: unterminated string in format file line %q", line)
+		}
+		tokens = append(tokens, string(token))
+		line = line[i+1:]
+	}
+}
+
+// unescape returns the character of an escape sequence of terminators.
+func unescape(ch byte) byte {
+	switch ch {
+	case 't':
+		return '\t'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case '0':
+		return 0
+	}
+	return ch
+}
+
+// escape returns a terminator with the escape sequences of format files.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case 0:
+			b.WriteString(`\0`)
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// unescapeString returns a terminator given with escape sequences.
+func unescapeString(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			b = append(b, unescape(s[i]))
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// check checks that the values of a field can be read.
+func (f Field) check() error {
+	switch f.PrefixLength {
+	case 0, 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("bcp: invalid prefix length %d of column %s", f.PrefixLength, f.Name)
+	}
+	if f.PrefixLength == 0 && f.Terminator == "" && f.Length <= 0 {
+		return fmt.Errorf("bcp: the field of column %s has no length, prefix or terminator", f.Name)
+	}
+	return nil
+}
+
+// WriteFormat writes a non-XML format file.
+func (f *Format) WriteFormat(w io.Writer) error {
+	version := f.Version
+	if version == "" {
+		version = "14.0"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n%d\n", version, len(f.Fields))
+	for i, field := range f.Fields {
+		name := field.Name
+		if name == "" {
+			name = `""`
+		}
+		collation := field.Collation
+		if collation == "" {
+			collation = `""`
+		}
+		fmt.Fprintf(&b, "%-7d %-17s %-7d %-7d %-10s %-5d %-20s %s\n", i+1, field.Type, field.PrefixLength,
+			field.Length, `"`+escape(field.Terminator)+`"`, field.Column, name, collation)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// xmlFormat is an XML format file.
+type xmlFormat struct {
+	XMLName xml.Name    `xml:"BCPFORMAT"`
+	Fields  []xmlField  `xml:"RECORD>FIELD"`
+	Columns []xmlColumn `xml:"ROW>COLUMN"`
+}
+
+type xmlField struct {
+	ID           string `xml:"ID,attr"`
+	Type         string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+	PrefixLength int    `xml:"PREFIX_LENGTH,attr,omitempty"`
+	Length       int    `xml:"LENGTH,attr,omitempty"`
+	MaxLength    int    `xml:"MAX_LENGTH,attr,omitempty"`
+	Terminator   string `xml:"TERMINATOR,attr,omitempty"`
+	Collation    string `xml:"COLLATION,attr,omitempty"`
+}
+
+type xmlColumn struct {
+	Source    string `xml:"SOURCE,attr"`
+	Name      string `xml:"NAME,attr"`
+	Type      string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+	Precision uint8  `xml:"PRECISION,attr,omitempty"`
+	Scale     uint8  `xml:"SCALE,attr,omitempty"`
+	Nullable  string `xml:"NULLABLE,attr,omitempty"`
+}
+
+// readXMLFormat reads an XML format file.
+func readXMLFormat(r io.Reader) (*Format, error) {
+	var x xmlFormat
+	if err := xml.NewDecoder(r).Decode(&x); err != nil {
+		return nil, fmt.Errorf("bcp: invalid XML format file: %v", err)
+	}
+	f := &Format{Fields: make([]Field, len(x.Fields))}
+	ids := make(map[string]int, len(x.Fields))
+	for i, xf := range x.Fields {
+		ids[xf.ID] = i
+		field := Field{
+			PrefixLength: xf.PrefixLength,
+			Length:       xf.Length,
+			Terminator:   unescapeString(xf.Terminator),
+			Collation:    xf.Collation,
+		}
+		if field.Length == 0 {
+			field.Length = xf.MaxLength
+		}
+		switch xf.Type {
+		case "CharTerm", "CharFixed", "CharPrefix":
+			field.Type = TypeChar
+		case "NCharTerm", "NCharFixed", "NCharPrefix":
+			field.Type = TypeNChar
+		case "NativeFixed", "NativePrefix":
+			// the type of the column is the one of the data
+			field.Type = TypeBinary
+		default:
+			return nil, fmt.Errorf("bcp: unknown type %s of field %s", xf.Type, xf.ID)
+		}
+		f.Fields[i] = field
+	}
+	for i, xc := range x.Columns {
+		fi, ok := ids[xc.Source]
+		if !ok {
+			return nil, fmt.Errorf("bcp: column %s has no field %s", xc.Name, xc.Source)
+		}
+		field := &f.Fields[fi]
+		field.Column = i + 1
+		field.Name = xc.Name
+		field.ColumnType = xc.Type
+		field.Precision, field.Scale = xc.Precision, xc.Scale
+		field.Nullable = xc.Nullable == "YES"
+		if strings.HasPrefix(x.Fields[fi].Type, "Native") {
+			field.Type = xc.Type
+		}
+	}
+	for _, field := range f.Fields {
+		if err := field.check(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// WriteXMLFormat writes an XML format file.
+func (f *Format) WriteXMLFormat(w io.Writer) error {
+	var x xmlFormat
+	var columns []xmlColumn
+	for i, field := range f.Fields {
+		id := strconv.Itoa(i + 1)
+		xf := xmlField{ID: id, PrefixLength: field.PrefixLength, Collation: field.Collation}
+		kind := "Native"
+		if field.isChar() {
+			kind = "Char"
+			if field.isWide() {
+				kind = "NChar"
+			}
+		}
+		switch {
+		case field.Terminator != "":
+			xf.Type, xf.Terminator, xf.MaxLength = kind+"Term", escape(field.Terminator), field.Length
+		case field.PrefixLength > 0:
+			xf.Type, xf.MaxLength = kind+"Prefix", field.Length
+		default:
+			xf.Type, xf.Length = kind+"Fixed", field.Length
+		}
+		if kind == "Native" && xf.Type == "NativeTerm" {
+			return fmt.Errorf("bcp: the native field of column %s cannot have a terminator", field.Name)
+		}
+		x.Fields = append(x.Fields, xf)
+		if field.Column > 0 {
+			xc := xmlColumn{Source: id, Name: field.Name, Type: field.columnType(), Precision: field.Precision, Scale: field.Scale}
+			if field.Nullable {
+				xc.Nullable = "YES"
+			}
+			columns = append(columns, xc)
+		}
+	}
+	sort.SliceStable(columns, func(i, j int) bool {
+		return f.Fields[mustAtoi(columns[i].Source)-1].Column < f.Fields[mustAtoi(columns[j].Source)-1].Column
+	})
+	x.Columns = columns
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<BCPFORMAT xmlns="http://schemas.microsoft.com/sqlserver/2004/bulkload/format" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` + "\n")
+	b.WriteString(" <RECORD>\n")
+	for _, xf := range x.Fields {
+		fmt.Fprintf(&b, `  <FIELD ID="%s" xsi:type="%s"`, xf.ID, xf.Type)
+		writeAttr(&b, "PREFIX_LENGTH", xf.PrefixLength)
+		writeAttr(&b, "LENGTH", xf.Length)
+		writeAttr(&b, "MAX_LENGTH", xf.MaxLength)
+		if xf.Terminator != "" {
+			writeAttr(&b, "TERMINATOR", xf.Terminator)
+		}
+		if xf.Collation != "" {
+			writeAttr(&b, "COLLATION", xf.Collation)
+		}
+		b.WriteString("/>\n")
+	}
+	b.WriteString(" </RECORD>\n <ROW>\n")
+	for _, xc := range x.Columns {
+		fmt.Fprintf(&b, `  <COLUMN SOURCE="%s"`, xc.Source)
+		writeAttr(&b, "NAME", xc.Name)
+		fmt.Fprintf(&b, ` xsi:type="%s"`, xc.Type)
+		writeAttr(&b, "PRECISION", int(xc.Precision))
+		writeAttr(&b, "SCALE", int(xc.Scale))
+		if xc.Nullable != "" {
+			writeAttr(&b, "NULLABLE", xc.Nullable)
+		}
+		b.WriteString("/>\n")
+	}
+	b.WriteString(" </ROW>\n</BCPFORMAT>\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeAttr writes an attribute of an XML element, numbers only when
+// they are not zero.
+func writeAttr(b *bytes.Buffer, name string, value interface{}) {
+	switch v := value.(type) {
+	case int:
+		if v != 0 {
+			fmt.Fprintf(b, ` %s="%d"`, name, v)
+		}
+	case string:
+		fmt.Fprintf(b, ` %s="`, name)
+		xml.EscapeText(b, []byte(v))
+		b.WriteByte('"')
+	}
+}
+
+func mustAtoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
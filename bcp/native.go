@@ -0,0 +1,80 @@
+package bcp
+
+import (
+	"fmt"
+	"strings"
+
+	mssql "github.com/wang-xuemin/go-mssqldb"
+)
+
+// nativeTypes are the SQL types of the native host types.
+var nativeTypes = map[string]string{
+	TypeChar:           "varchar",
+	TypeVaryChar:       "varchar",
+	TypeText:           "varchar",
+	TypeNChar:          "nvarchar",
+	TypeNVarChar:       "nvarchar",
+	TypeNText:          "nvarchar",
+	TypeXML:            "xml",
+	TypeBinary:         "varbinary",
+	TypeVaryBin:        "varbinary",
+	TypeImage:          "varbinary",
+	TypeUDT:            "varbinary",
+	TypeTinyInt:        "tinyint",
+	TypeSmallInt:       "smallint",
+	TypeInt:            "int",
+	TypeBigInt:         "bigint",
+	TypeBit:            "bit",
+	TypeFloat4:         "real",
+	TypeFloat8:         "float",
+	TypeMoney4:         "smallmoney",
+	TypeMoney:          "money",
+	TypeDecimal:        "decimal",
+	TypeNumeric:        "numeric",
+	TypeDateTim4:       "smalldatetime",
+	TypeDateTime:       "datetime",
+	TypeDate:           "date",
+	TypeTime:           "time",
+	TypeDateTime2:      "datetime2",
+	TypeDateTimeOffset: "datetimeoffset",
+	TypeUniqueID:       "uniqueidentifier",
+}
+
+// bulkColumn returns the column the native values of a field are
+// encoded like.
+func (f Field) bulkColumn() (mssql.BulkColumn, error) {
+	typ, ok := nativeTypes[strings.ToUpper(f.Type)]
+	if !ok {
+		return mssql.BulkColumn{}, fmt.Errorf("bcp: type %s of column %s is not supported", f.Type, f.Name)
+	}
+	c := mssql.BulkColumn{Name: f.Name, Type: typ, Precision: f.Precision, Scale: f.Scale}
+	if c.Precision == 0 {
+		c.Precision = 38
+	}
+	switch typ {
+	case "time", "datetime2", "datetimeoffset":
+		// native time values are always at scale 7, whatever the scale
+		// of their column
+		c.Scale = 7
+	}
+	return c, nil
+}
+
+// valueScale returns the number of digits after the decimal point of a
+// decimal value given as text, 0 for other values.
+func valueScale(v interface{}) uint8 {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return 0
+	}
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '.'); i >= 0 {
+		return uint8(len(s) - i - 1)
+	}
+	return 0
+}
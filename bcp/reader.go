@@ -0,0 +1,187 @@
+package bcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	mssql "github.com/wang-xuemin/go-mssqldb"
+)
+
+// Reader reads the rows of a data file of a format.
+//
+// The values of fields with a length prefix or of native types are read
+// like bcp -n writes them, char values in the code page of
+// Latin1_General. The other character values are read as UTF-8 text,
+// or UTF-16 text for SQLNCHAR fields, an empty value being NULL and a
+// NUL character an empty string.
+type Reader struct {
+	r      *bufio.Reader
+	f      *Format
+	fields []int
+	terms  [][]byte
+}
+
+// NewReader returns a reader of the rows of r, a data file of format f.
+func NewReader(r io.Reader, f *Format) *Reader {
+	terms := make([][]byte, len(f.Fields))
+	for i, field := range f.Fields {
+		terms[i] = field.terminator()
+	}
+	return &Reader{r: bufio.NewReader(r), f: f, fields: f.columnFields(), terms: terms}
+}
+
+// Columns returns the names of the columns of the rows.
+func (r *Reader) Columns() []string {
+	return r.f.Columns()
+}
+
+// Read returns the values of the columns of the next row, in their order,
+// or io.EOF after the last row.
+func (r *Reader) Read() ([]interface{}, error) {
+	values := make([]interface{}, len(r.f.Fields))
+	for i, field := range r.f.Fields {
+		data, null, err := r.readField(i)
+		if err == io.EOF && i > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if null || field.Column == 0 {
+			continue
+		}
+		if values[i], err = field.value(data); err != nil {
+			return nil, err
+		}
+	}
+	row := make([]interface{}, len(r.fields))
+	for i, field := range r.fields {
+		row[i] = values[field]
+	}
+	return row, nil
+}
+
+// maxValueLength is the largest length prefix read for fields without a
+// maximum length, the size of the largest values of SQL Server.
+const maxValueLength = 1<<31 - 1
+
+// readField reads the data of a field, and whether it is NULL.
+func (r *Reader) readField(i int) (data []byte, null bool, err error) {
+	field := r.f.Fields[i]
+	term := r.terms[i]
+	length := field.Length
+	if field.PrefixLength > 0 {
+		var prefix [8]byte
+		if _, err = io.ReadFull(r.r, prefix[:field.PrefixLength]); err != nil {
+			return nil, false, err
+		}
+		n := binary.LittleEndian.Uint64(prefix[:])
+		if n == 1<<uint(8*field.PrefixLength)-1 {
+			// a length of -1
+			null = true
+			n = 0
+		}
+		max := maxValueLength
+		if field.Length > 0 {
+			max = field.Length
+		}
+		if n > uint64(max) {
+			return nil, false, fmt.Errorf("bcp: length %d of a value of column %s is more than %d", n, field.Name, max)
+		}
+		length = int(n)
+	} else if len(term) > 0 {
+		data, err = r.readTerminated(term, field.isWide())
+		// empty data is NULL
+		null = err == nil && len(data) == 0
+		return data, null, err
+	}
+	// the buffer grows with the data read, not with the length, and
+	// empty values are not nil
+	buf := bytes.NewBuffer([]byte{})
+	if _, err = io.CopyN(buf, r.r, int64(length)); err != nil {
+		if err == io.EOF && (field.PrefixLength > 0 || buf.Len() > 0) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
+	}
+	data = buf.Bytes()
+	if len(term) > 0 {
+		end := make([]byte, len(term))
+		if _, err = io.ReadFull(r.r, end); err != nil || !bytes.Equal(end, term) {
+			return nil, false, fmt.Errorf("bcp: the value of column %s is not terminated by %q", field.Name, field.Terminator)
+		}
+	}
+	return data, null, nil
+}
+
+// readTerminated reads data up to a terminator, which is dropped.
+func (r *Reader) readTerminated(term []byte, wide bool) ([]byte, error) {
+	var data []byte
+	last := term[len(term)-1]
+	for {
+		chunk, err := r.r.ReadBytes(last)
+		data = append(data, chunk...)
+		if err == io.EOF && len(data) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		// UTF-16 terminators start at even offsets
+		if end := len(data) - len(term); end >= 0 && bytes.Equal(data[end:], term) && (!wide || end%2 == 0) {
+			return data[:end], nil
+		}
+	}
+}
+
+// native tells whether the values of a field are in the native format.
+func (f Field) native() bool {
+	return f.PrefixLength > 0 || !f.isChar()
+}
+
+// terminator returns the terminator of a field as it is written.
+func (f Field) terminator() []byte {
+	if f.isWide() {
+		return utf16Bytes(f.Terminator)
+	}
+	return []byte(f.Terminator)
+}
+
+// value returns the value of the data of a field.
+func (f Field) value(data []byte) (interface{}, error) {
+	if f.native() {
+		c, err := f.bulkColumn()
+		if err != nil {
+			return nil, err
+		}
+		return mssql.DecodeBulkNative(c, data)
+	}
+	if len(data) == 1 && data[0] == 0 || len(data) == 2 && data[0] == 0 && data[1] == 0 && f.isWide() {
+		return "", nil
+	}
+	if f.isWide() {
+		if len(data)%2 != 0 {
+			return nil, fmt.Errorf("bcp: odd length %d of the UTF-16 value of column %s", len(data), f.Name)
+		}
+		u := make([]uint16, len(data)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(data[2*i:])
+		}
+		return string(utf16.Decode(u)), nil
+	}
+	return string(data), nil
+}
+
+// utf16Bytes returns the UTF-16LE encoding of s.
+func utf16Bytes(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
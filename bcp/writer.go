@@ -0,0 +1,144 @@
+package bcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	mssql "github.com/wang-xuemin/go-mssqldb"
+)
+
+// Writer writes rows to a data file of a format, the way Reader reads
+// them.
+type Writer struct {
+	w      *bufio.Writer
+	f      *Format
+	fields []int
+	terms  [][]byte
+}
+
+// NewWriter returns a writer of rows to w, a data file of format f.
+func NewWriter(w io.Writer, f *Format) *Writer {
+	terms := make([][]byte, len(f.Fields))
+	for i, field := range f.Fields {
+		terms[i] = field.terminator()
+	}
+	return &Writer{w: bufio.NewWriter(w), f: f, fields: f.columnFields(), terms: terms}
+}
+
+// Write writes a row, the values of the columns in their order. The
+// fields which are not copied are written as NULL.
+func (w *Writer) Write(row []interface{}) error {
+	if len(row) != len(w.fields) {
+		return fmt.Errorf("bcp: the row has %d values, not %d", len(row), len(w.fields))
+	}
+	values := make([]interface{}, len(w.f.Fields))
+	for i, field := range w.fields {
+		values[field] = row[i]
+	}
+	for i, field := range w.f.Fields {
+		if err := w.writeField(field, w.terms[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes the buffered rows.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// writeField writes a value of a field.
+func (w *Writer) writeField(field Field, term []byte, v interface{}) error {
+	data, err := field.data(v)
+	if err != nil {
+		return err
+	}
+	var prefix [8]byte
+	switch {
+	case data == nil && field.PrefixLength > 0:
+		// a length of -1
+		binary.LittleEndian.PutUint64(prefix[:], 1<<64-1)
+	case data == nil && len(term) == 0:
+		return fmt.Errorf("bcp: the field of column %s cannot be NULL", field.Name)
+	case field.PrefixLength == 0 && len(term) == 0 && len(data) != field.Length:
+		return fmt.Errorf("bcp: the value of column %s is %d bytes long, not %d", field.Name, len(data), field.Length)
+	default:
+		binary.LittleEndian.PutUint64(prefix[:], uint64(len(data)))
+	}
+	w.w.Write(prefix[:field.PrefixLength])
+	w.w.Write(data)
+	_, err = w.w.Write(term)
+	return err
+}
+
+// data returns the data of a value of a field, nil for NULL.
+func (f Field) data(v interface{}) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if f.native() {
+		c, err := f.bulkColumn()
+		if err != nil {
+			return nil, err
+		}
+		if (c.Type == "decimal" || c.Type == "numeric") && f.Precision == 0 {
+			// keep the scale of the value
+			c.Scale = valueScale(v)
+		}
+		data, err := mssql.EncodeBulkNative(c, v)
+		if err == nil && data == nil {
+			data = []byte{}
+		}
+		return data, err
+	}
+	s := f.text(v)
+	if s == "" {
+		// empty text is told from NULL by a NUL character
+		s = "\x00"
+	}
+	if f.isWide() {
+		return utf16Bytes(s), nil
+	}
+	return []byte(s), nil
+}
+
+// text returns the text of a value of a character field.
+func (f Field) text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		switch f.columnType() {
+		case TypeDecimal, TypeNumeric, TypeMoney, TypeMoney4:
+			return string(v)
+		case TypeUniqueID:
+			var u mssql.UniqueIdentifier
+			if err := u.Scan(v); err == nil {
+				return u.String()
+			}
+		}
+		return strings.ToUpper(hex.EncodeToString(v))
+	case time.Time:
+		switch f.columnType() {
+		case TypeDate:
+			return v.Format("2006-01-02")
+		case TypeTime:
+			return v.Format("15:04:05.9999999")
+		case TypeDateTimeOffset:
+			return v.Format("2006-01-02 15:04:05.9999999 -07:00")
+		}
+		return v.Format("2006-01-02 15:04:05.9999999")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,270 @@
+package mssql
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// StreamBlobs, passed as a query argument, makes the query return the
+// last column of its result sets as *BlobReader when the column is
+// varchar(max), nvarchar(max), varbinary(max) or xml. The value is then
+// read from the connection while the BlobReader is read, instead of
+// being buffered in memory.
+//
+//	rows, err := db.QueryContext(ctx, "select name, document from docs", mssql.StreamBlobs{})
+//	for rows.Next() {
+//		var name string
+//		var doc io.Reader
+//		err = rows.Scan(&name, &doc)
+//		...
+//	}
+//
+// A NULL value is returned as nil.
+type StreamBlobs struct{}
+
+var errBlobReaderReleased = errors.New("mssql: BlobReader read after its row was left by Rows.Next or Rows.Close")
+
+// BlobReader reads a value of a column streamed because of StreamBlobs.
+// varbinary(max) values are returned as is, text is decoded to UTF-8.
+//
+// A BlobReader is only valid until the next call of Rows.Next or
+// Rows.Close. The part of the value which was not read by then is
+// skipped and later reads fail.
+type BlobReader struct {
+	plp      *plpReader
+	r        io.Reader
+	released chan struct{}
+}
+
+func (b *BlobReader) Read(p []byte) (int, error) {
+	select {
+	case <-b.released:
+		return 0, errBlobReaderReleased
+	default:
+	}
+	return b.r.Read(p)
+}
+
+// release lets the goroutine reading the response go on with the
+// rest of the response.
+func (b *BlobReader) release() {
+	select {
+	case <-b.released:
+	default:
+		close(b.released)
+	}
+}
+
+// plpReader reads the chunks of a partially length-prefixed value.
+type plpReader struct {
+	buf  *tdsBuffer
+	left uint32 // bytes left in the current chunk
+	err  error
+}
+
+func (r *plpReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.left == 0 {
+		var chunk [4]byte
+		if _, err := io.ReadFull(r.buf, chunk[:]); err != nil {
+			r.err = unexpectedEOF(err)
+			return 0, r.err
+		}
+		r.left = binary.LittleEndian.Uint32(chunk[:])
+		if r.left == _PLP_TERMINATOR {
+			r.err = io.EOF
+			return 0, r.err
+		}
+	}
+	if uint32(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.buf.Read(p)
+	r.left -= uint32(n)
+	if err != nil {
+		r.err = unexpectedEOF(err)
+	}
+	return n, r.err
+}
+
+// discard skips the rest of the value.
+func (r *plpReader) discard() {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		badStreamPanicf("Reading PLP type failed: %s", err.Error())
+	}
+}
+
+// the stream must not end within a value
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readPLPStream is the Reader of streamed columns, it only reads the
+// length of the value and leaves its chunks to the returned BlobReader.
+func readPLPStream(ti *typeInfo, r *tdsBuffer, c *cryptoMetadata) interface{} {
+	if r.uint64() == _PLP_NULL {
+		return nil
+	}
+	b := &BlobReader{
+		plp:      &plpReader{buf: r},
+		released: make(chan struct{}),
+	}
+	switch ti.TypeId {
+	case typeNVarChar, typeXml:
+		b.r = transform.NewReader(b.plp, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder())
+	case typeBigVarChar:
+		b.r = transform.NewReader(b.plp, cp.NewDecoder(ti.Collation))
+	default:
+		b.r = b.plp
+	}
+	return b
+}
+
+// streamLastColumn makes the last column of a result set return a
+// BlobReader, when it is of a type which can be streamed. Only the last
+// column is streamed, so that the values of the others are known before
+// the BlobReader is read.
+func streamLastColumn(columns []columnStruct) {
+	if len(columns) == 0 {
+		return
+	}
+	col := &columns[len(columns)-1]
+	if col.isEncrypted() {
+		return
+	}
+	switch col.ti.TypeId {
+	case typeBigVarBin, typeBigVarChar, typeNVarChar:
+		if col.ti.Size != 0xffff {
+			return
+		}
+	case typeXml:
+	default:
+		return
+	}
+	col.ti.Reader = readPLPStream
+}
+
+// rowBlob returns the BlobReader of a row, nil if it has none.
+func rowBlob(row []interface{}) *BlobReader {
+	if len(row) == 0 {
+		return nil
+	}
+	b, _ := row[len(row)-1].(*BlobReader)
+	return b
+}
+
+// releaseBlob releases the BlobReader of a row token being skipped.
+func releaseBlob(tok tokenStruct) {
+	if row, ok := tok.([]interface{}); ok {
+		if b := rowBlob(row); b != nil {
+			b.release()
+		}
+	}
+}
+
+// waitBlob waits until the consumer of a row is done with its BlobReader,
+// then skips what was not read of the value.
+func waitBlob(row []interface{}) {
+	if b := rowBlob(row); b != nil {
+		<-b.released
+		b.plp.discard()
+	}
+}
+
+// StreamType is the type a StreamParam is sent as.
+type StreamType int
+
+const (
+	// StreamVarBinary sends the bytes read as varbinary(max).
+	StreamVarBinary StreamType = iota
+	// StreamNVarChar sends the UTF-8 text read as nvarchar(max).
+	StreamNVarChar
+	// StreamVarChar sends the text read as varchar(max), like VarChar.
+	StreamVarChar
+)
+
+// StreamParam is a parameter value read from Reader while the request is
+// sent, so that large values do not need to be held in memory. An io.Reader
+// passed as parameter is sent as StreamParam of type StreamVarBinary.
+//
+// Cancelling the context of the query stops reading Reader, the part of
+// the request that was sent already is discarded by the server and the
+// connection is closed. Queries with StreamParam values are not sent again
+// on a recovered session.
+type StreamParam struct {
+	Reader io.Reader
+	Type   StreamType
+}
+
+// plpChunkSize is the size of the chunks StreamParam values are sent in.
+const plpChunkSize = 32 * 1024
+
+// paramReadError is returned by sendRpc when reading a StreamParam failed.
+type paramReadError struct {
+	err error
+}
+
+func (e paramReadError) Error() string {
+	return e.err.Error()
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// writePLPReader writes the value read from r as PLP of unknown length.
+func writePLPReader(w io.Writer, r io.Reader) (err error) {
+	if err = binary.Write(w, binary.LittleEndian, uint64(_UNKNOWN_PLP_LEN)); err != nil {
+		return
+	}
+	chunk := make([]byte, plpChunkSize)
+	for {
+		n, rerr := r.Read(chunk)
+		if n > 0 {
+			if err = binary.Write(w, binary.LittleEndian, uint32(n)); err != nil {
+				return
+			}
+			if _, err = w.Write(chunk[:n]); err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return paramReadError{rerr}
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, uint32(_PLP_TERMINATOR))
+}
+
+// hasStreamArgs reports whether a query argument is read from a reader.
+func hasStreamArgs(args []namedValue) bool {
+	for _, arg := range args {
+		if _, ok := arg.Value.(StreamParam); ok {
+			return true
+		}
+	}
+	return false
+}
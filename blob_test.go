@@ -0,0 +1,181 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+)
+
+// plpBuffer returns a buffer holding a PLP value split in chunks,
+// followed by a trailing byte.
+func plpBuffer(chunks ...[]byte) *tdsBuffer {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, uint64(_UNKNOWN_PLP_LEN))
+	for _, chunk := range chunks {
+		_ = binary.Write(&b, binary.LittleEndian, uint32(len(chunk)))
+		b.Write(chunk)
+	}
+	_ = binary.Write(&b, binary.LittleEndian, uint32(_PLP_TERMINATOR))
+	b.WriteByte(0xfd)
+	data := b.Bytes()
+	return &tdsBuffer{
+		packetSize: len(data),
+		rbuf:       data,
+		rpos:       0,
+		rsize:      len(data),
+		final:      true,
+	}
+}
+
+func TestBlobReaderDecodesChunks(t *testing.T) {
+	text := str2ucs2("héllo wörld")
+	// split within a character
+	r := plpBuffer(text[:3], text[3:9], text[9:])
+	ti := typeInfo{TypeId: typeNVarChar, Size: 0xffff}
+	b, ok := readPLPStream(&ti, r, nil).(*BlobReader)
+	if !ok {
+		t.Fatal("readPLPStream did not return a BlobReader")
+	}
+	got, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatal("ReadAll failed:", err)
+	}
+	if string(got) != "héllo wörld" {
+		t.Errorf("read %q", got)
+	}
+	if r.byte() != 0xfd {
+		t.Error("the value was not read up to its end")
+	}
+}
+
+func TestBlobReaderDecodesCodePage(t *testing.T) {
+	// 日本 in code page 932, split within the first character
+	data := []byte{0x93, 0xfa, 0x96, 0x7b}
+	col := cp.Collation{LcidAndFlags: 0x0411}
+	r := plpBuffer(data[:1], data[1:])
+	ti := typeInfo{TypeId: typeBigVarChar, Size: 0xffff, Collation: col}
+	got, err := ioutil.ReadAll(readPLPStream(&ti, r, nil).(*BlobReader))
+	if err != nil {
+		t.Fatal("ReadAll failed:", err)
+	}
+	if expected := cp.CharsetToUTF8(col, data); string(got) != expected {
+		t.Errorf("read %q, expected %q", got, expected)
+	}
+}
+
+func TestBlobReaderNull(t *testing.T) {
+	data := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	r := &tdsBuffer{packetSize: len(data), rbuf: data, rsize: len(data), final: true}
+	ti := typeInfo{TypeId: typeBigVarBin, Size: 0xffff}
+	if v := readPLPStream(&ti, r, nil); v != nil {
+		t.Errorf("NULL returned as %v", v)
+	}
+}
+
+func TestBlobReaderSkipsUnreadPart(t *testing.T) {
+	r := plpBuffer([]byte{1, 2, 3}, []byte{4, 5})
+	ti := typeInfo{TypeId: typeBigVarBin, Size: 0xffff}
+	row := []interface{}{int64(1), readPLPStream(&ti, r, nil)}
+	b := rowBlob(row)
+	if b == nil {
+		t.Fatal("row has no BlobReader")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		waitBlob(row)
+		close(done)
+	}()
+	var p [2]byte
+	if n, err := b.Read(p[:]); n != 2 || err != nil || p != [2]byte{1, 2} {
+		t.Fatalf("Read returned %d %v %v", n, err, p)
+	}
+	releaseBlob(row)
+	<-done
+	if r.byte() != 0xfd {
+		t.Error("the unread part of the value was not skipped")
+	}
+	if _, err := b.Read(p[:]); err != errBlobReaderReleased {
+		t.Errorf("Read after release returned %v", err)
+	}
+}
+
+func TestStreamLastColumn(t *testing.T) {
+	streamed := func(col columnStruct) bool {
+		return reflect.ValueOf(col.ti.Reader).Pointer() == reflect.ValueOf(readPLPStream).Pointer()
+	}
+	columns := []columnStruct{
+		{ti: typeInfo{TypeId: typeNVarChar, Size: 0xffff, Reader: readPLPType}},
+		{ti: typeInfo{TypeId: typeNVarChar, Size: 100, Reader: readShortLenType}},
+	}
+	streamLastColumn(columns)
+	if streamed(columns[0]) || streamed(columns[1]) {
+		t.Error("only a last column of a (max) type should be streamed")
+	}
+
+	columns[1].ti = typeInfo{TypeId: typeXml, Reader: readPLPType}
+	streamLastColumn(columns)
+	if streamed(columns[0]) || !streamed(columns[1]) {
+		t.Error("the last xml column should be streamed")
+	}
+}
+
+func TestWritePLPReader(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3}, plpChunkSize)
+	var b bytes.Buffer
+	if err := writePLPReader(&b, bytes.NewReader(data)); err != nil {
+		t.Fatal("writePLPReader failed:", err)
+	}
+	b.WriteByte(0xfd)
+	r := &tdsBuffer{packetSize: b.Len(), rbuf: b.Bytes(), rsize: b.Len(), final: true}
+	ti := typeInfo{TypeId: typeBigVarBin, Size: 0xffff}
+	got, err := ioutil.ReadAll(readPLPStream(&ti, r, nil).(*BlobReader))
+	if err != nil {
+		t.Fatal("ReadAll failed:", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, expected %d", len(got), len(data))
+	}
+	if r.byte() != 0xfd {
+		t.Error("the terminator was not written")
+	}
+}
+
+func TestWritePLPReaderCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var b bytes.Buffer
+	err := writePLPReader(&b, contextReader{ctx, bytes.NewReader([]byte{1})})
+	if perr, ok := err.(paramReadError); !ok || perr.err != context.Canceled {
+		t.Errorf("writePLPReader returned %v, expected the context error", err)
+	}
+}
+
+func TestReaderParameter(t *testing.T) {
+	v, err := convertInputParameter(strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal("convertInputParameter failed:", err)
+	}
+	sp, ok := v.(StreamParam)
+	if !ok || sp.Type != StreamVarBinary {
+		t.Fatalf("io.Reader converted to %#v", v)
+	}
+
+	s := &Stmt{c: &Conn{sess: &tdsSession{}}}
+	p, err := s.makeParam(StreamParam{Reader: strings.NewReader("é"), Type: StreamNVarChar})
+	if err != nil {
+		t.Fatal("makeParam failed:", err)
+	}
+	if p.ti.TypeId != typeNVarChar || makeDecl(p.ti) != "nvarchar(max)" {
+		t.Errorf("unexpected type %s", makeDecl(p.ti))
+	}
+	if got, _ := ioutil.ReadAll(p.reader); !bytes.Equal(got, str2ucs2("é")) {
+		t.Errorf("nvarchar stream is % x", got)
+	}
+}
@@ -134,6 +134,19 @@ func (w *tdsBuffer) FinishPacket() error {
 	return w.flush()
 }
 
+// AbortPacket ends the message being written without completing it.
+// Unless no packet of the message was sent yet, the last packet is sent
+// with the ignore flag, which makes the server discard the message.
+// sent reports whether a part of the message was sent.
+func (w *tdsBuffer) AbortPacket() (sent bool, err error) {
+	if w.wPacketSeq == 1 {
+		w.wpos = 8
+		return false, nil
+	}
+	w.wbuf[1] |= 1 | 2 // Last packet of the message, ignore the message.
+	return true, w.flush()
+}
+
 var headerSize = binary.Size(header{})
 
 func (r *tdsBuffer) readNextPacket() error {
@@ -200,6 +213,13 @@ func (r *tdsBuffer) byte() byte {
 	return b
 }
 
+// peekByte returns the next byte without consuming it.
+func (r *tdsBuffer) peekByte() byte {
+	b := r.byte()
+	r.rpos--
+	return b
+}
+
 func (r *tdsBuffer) ReadFull(buf []byte) {
 	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
@@ -314,3 +314,30 @@ func TestReadBVarCharOrPanic(t *testing.T) {
 	_ = readBVarCharOrPanic(memBuf)
 	t.Fatal("readBVarCharOrPanic() should panic on empty buffer, but it didn't")
 }
+
+func TestAbortPacket(t *testing.T) {
+	memBuf := bytes.NewBuffer([]byte{})
+	buf := newTdsBuffer(100, closableBuffer{memBuf})
+
+	buf.BeginPacket(packRPCRequest, false)
+	buf.Write([]byte{1, 2, 3})
+	if sent, err := buf.AbortPacket(); sent || err != nil {
+		t.Fatalf("AbortPacket returned %v %v for a message not sent yet", sent, err)
+	}
+	if memBuf.Len() != 0 {
+		t.Fatalf("nothing should be written, got % x", memBuf.Bytes())
+	}
+
+	buf.BeginPacket(packRPCRequest, false)
+	buf.Write(make([]byte, 150))
+	if sent, err := buf.AbortPacket(); !sent || err != nil {
+		t.Fatalf("AbortPacket returned %v %v for a message sent partially", sent, err)
+	}
+	packets := memBuf.Bytes()
+	if len(packets) != 100+8+58 {
+		t.Fatalf("expected two packets, got %d bytes", len(packets))
+	}
+	if packets[1] != 0 || packets[101] != 3 {
+		t.Errorf("unexpected packet status %x %x, the last packet should be ignored", packets[1], packets[101])
+	}
+}
@@ -3,14 +3,20 @@ package mssql
 import (
 	"bytes"
 	"context"
+	"database/sql/driver"
 	"encoding/binary"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/golang-sql/civil"
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
 	"github.com/wang-xuemin/go-mssqldb/internal/decimal"
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 type Bulk struct {
@@ -24,12 +30,40 @@ type Bulk struct {
 	metadata    []columnStruct
 	bulkColumns []columnStruct
 	columnsName []string
+	// encryptions tells how the values of the bulk columns encrypted with
+	// Always Encrypted are encrypted, it is nil for the other columns.
+	encryptions []*paramEncryption
 	tablename   string
 	numRows     int
+	// collation is the collation of strings in sql_variant columns, the
+	// collation of the database.
+	collation cp.Collation
+	// rowType and rowFields are the struct type of the last row added by
+	// AddStructs or CopyFromIterator and its fields holding the columns.
+	rowType   reflect.Type
+	rowFields []int
+
+	// query is the INSERT BULK statement starting each batch, made with
+	// the first one.
+	query string
+	// sourceIndexes are the indexes in the rows of the values of the bulk
+	// columns, nil when rows hold them in order.
+	sourceIndexes []int
+	// batchRows is the number of rows of the current batch, copied the
+	// number of rows copied by the batches already ended.
+	batchRows int
+	copied    int64
 
 	headerSent bool
 	Options    BulkOptions
 	Debug      bool
+
+	// OnBatch is called after each batch of Options.BatchSize rows, and
+	// after the last one by Done, with the number of rows it copied.
+	OnBatch func(rowcount int64)
+	// OnProgress is called after each Options.NotifyAfter rows added,
+	// with the number of rows added so far.
+	OnProgress func(rows int64)
 }
 type BulkOptions struct {
 	CheckConstraints  bool
@@ -39,6 +73,35 @@ type BulkOptions struct {
 	RowsPerBatch      int
 	Order             []string
 	Tablock           bool
+	// Columns declares the columns of the destination table. When set,
+	// the metadata of the table is not queried, and the bulk columns are
+	// all the declared ones unless given.
+	Columns []BulkColumn
+	// KeepIdentity inserts the values given for identity columns, in
+	// place of the values generated by the server.
+	KeepIdentity bool
+	// ColumnMappings maps the columns of the rows to the columns of the
+	// destination table. Without mappings the bulk columns are the ones
+	// of the destination table.
+	ColumnMappings []BulkColumnMapping
+	// BatchSize is the number of rows copied by each INSERT BULK. Each
+	// batch is committed when it ends, unless the copy is part of a
+	// transaction. All rows are copied by one INSERT BULK when zero.
+	BatchSize int
+	// NotifyAfter is the number of rows between calls to Bulk.OnProgress.
+	NotifyAfter int
+}
+
+// BulkColumnMapping maps a column of the rows of a bulk copy to a column
+// of the destination table.
+type BulkColumnMapping struct {
+	// SourceName is the name of the column of the rows, one of the bulk
+	// columns. SourceOrdinal is its index in the rows, used when
+	// SourceName is empty.
+	SourceName    string
+	SourceOrdinal int
+	// Destination is the name of the column of the destination table.
+	Destination string
 }
 
 type DataValue interface{}
@@ -50,26 +113,67 @@ const (
 )
 
 func (cn *Conn) CreateBulk(table string, columns []string) (_ *Bulk) {
-	b := Bulk{ctx: context.Background(), cn: cn, tablename: table, headerSent: false, columnsName: columns}
+	b := Bulk{ctx: context.Background(), cn: cn, tablename: table, headerSent: false, columnsName: columns, collation: cn.sess.collation}
 	b.Debug = false
 	return &b
 }
 
 func (cn *Conn) CreateBulkContext(ctx context.Context, table string, columns []string) (_ *Bulk) {
-	b := Bulk{ctx: ctx, cn: cn, tablename: table, headerSent: false, columnsName: columns}
+	b := Bulk{ctx: ctx, cn: cn, tablename: table, headerSent: false, columnsName: columns, collation: cn.sess.collation}
 	b.Debug = false
 	return &b
 }
 
+// sendBulkCommand starts a batch.
 func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
+	if b.query == "" {
+		if err = b.prepareBulkCommand(ctx); err != nil {
+			return err
+		}
+	}
+
+	stmt, err := b.cn.PrepareContext(ctx, b.query)
+	if err != nil {
+		return fmt.Errorf("Prepare failed: %s", err.Error())
+	}
+	b.dlogf(b.query)
+
+	_, err = stmt.(*Stmt).ExecContext(ctx, nil)
+	if err != nil {
+		// the cached metadata may be the cause
+		cache, key := b.metadataCache()
+		cache.remove(key)
+		return err
+	}
+
+	b.headerSent = true
+
+	var buf = b.cn.sess.buf
+	buf.BeginPacket(packBulkLoadBCP, false)
+
+	// Send the columns metadata.
+	columnMetadata := b.createColMetadata()
+	_, err = buf.Write(columnMetadata)
+
+	return
+}
+
+// prepareBulkCommand matches the bulk columns with the columns of the
+// destination table and makes the INSERT BULK statement.
+func (b *Bulk) prepareBulkCommand(ctx context.Context) (err error) {
 	//get table columns info
-	err = b.getMetadata(ctx)
+	err = b.loadMetadata(ctx)
+	if err != nil {
+		return err
+	}
+
+	destinations, err := b.mapColumns()
 	if err != nil {
 		return err
 	}
 
 	//match the columns
-	for _, colname := range b.columnsName {
+	for _, colname := range destinations {
 		var bulkCol *columnStruct
 
 		for _, m := range b.metadata {
@@ -84,7 +188,14 @@ func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
 				//send udt as binary
 				bulkCol.ti.TypeId = typeBigVarBin
 			}
+			var enc *paramEncryption
+			if bulkCol.cryptoMeta != nil {
+				if enc, err = b.columnEncryption(*bulkCol); err != nil {
+					return err
+				}
+			}
 			b.bulkColumns = append(b.bulkColumns, *bulkCol)
+			b.encryptions = append(b.encryptions, enc)
 			b.dlogf("Adding column %s %s %#x", colname, bulkCol.ColName, bulkCol.ti.TypeId)
 		} else {
 			return fmt.Errorf("column %s does not exist in destination table %s", colname, b.tablename)
@@ -99,7 +210,15 @@ func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
 		if i != 0 {
 			col_defs.WriteString(", ")
 		}
-		col_defs.WriteString("[" + col.ColName + "] " + makeDecl(col.ti))
+		ti := col.ti
+		if col.cryptoMeta != nil {
+			// encrypted columns are declared with the type of their values
+			ti = col.cryptoMeta.typeInfo
+		}
+		col_defs.WriteString("[" + col.ColName + "] " + makeDecl(ti))
+		if c := b.declaredColumn(col.ColName); c != nil && c.Collation != "" {
+			col_defs.WriteString(" COLLATE " + c.Collation)
+		}
 	}
 
 	//options
@@ -126,34 +245,59 @@ func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
 	if b.Options.Tablock {
 		with_opts = append(with_opts, "TABLOCK")
 	}
+	if b.Options.KeepIdentity {
+		with_opts = append(with_opts, "KEEP_IDENTITY")
+	}
 	var with_part string
 	if len(with_opts) > 0 {
 		with_part = fmt.Sprintf("WITH (%s)", strings.Join(with_opts, ","))
 	}
 
-	query := fmt.Sprintf("INSERT BULK %s (%s) %s", b.tablename, col_defs.String(), with_part)
+	b.query = fmt.Sprintf("INSERT BULK %s (%s) %s", b.tablename, col_defs.String(), with_part)
+	return nil
+}
 
-	stmt, err := b.cn.PrepareContext(ctx, query)
-	if err != nil {
-		return fmt.Errorf("Prepare failed: %s", err.Error())
+// mapColumns returns the destination columns of the bulk columns, and
+// sets the indexes of their values in the rows.
+func (b *Bulk) mapColumns() ([]string, error) {
+	if len(b.Options.ColumnMappings) == 0 {
+		return b.columnsName, nil
 	}
-	b.dlogf(query)
-
-	_, err = stmt.(*Stmt).ExecContext(ctx, nil)
-	if err != nil {
-		return err
+	destinations := make([]string, len(b.Options.ColumnMappings))
+	b.sourceIndexes = make([]int, len(b.Options.ColumnMappings))
+	for i, m := range b.Options.ColumnMappings {
+		source := m.SourceOrdinal
+		if m.SourceName != "" {
+			source = matchColumnName(b.columnsName, m.SourceName)
+			if source < 0 {
+				return nil, fmt.Errorf("mssql: source column %s of the mapping to %s is not a bulk column", m.SourceName, m.Destination)
+			}
+		} else if source < 0 || len(b.columnsName) > 0 && source >= len(b.columnsName) {
+			return nil, fmt.Errorf("mssql: source ordinal %d of the mapping to %s is out of range", source, m.Destination)
+		}
+		destinations[i] = m.Destination
+		b.sourceIndexes[i] = source
 	}
+	return destinations, nil
+}
 
-	b.headerSent = true
-
-	var buf = b.cn.sess.buf
-	buf.BeginPacket(packBulkLoadBCP, false)
-
-	// Send the columns metadata.
-	columnMetadata := b.createColMetadata()
-	_, err = buf.Write(columnMetadata)
-
-	return
+// mappedRow returns the values of the bulk columns in a row.
+func (b *Bulk) mappedRow(row []interface{}) ([]interface{}, error) {
+	if b.sourceIndexes == nil {
+		return row, nil
+	}
+	if len(b.columnsName) > 0 && len(row) != len(b.columnsName) {
+		return nil, fmt.Errorf("row does not have the same number of columns than the bulk %d %d",
+			len(row), len(b.columnsName))
+	}
+	values := make([]interface{}, len(b.sourceIndexes))
+	for i, source := range b.sourceIndexes {
+		if source >= len(row) {
+			return nil, fmt.Errorf("row does not have the column %d mapped to %s", source, b.bulkColumns[i].ColName)
+		}
+		values[i] = row[source]
+	}
+	return values, nil
 }
 
 // AddRow immediately writes the row to the destination table.
@@ -166,6 +310,9 @@ func (b *Bulk) AddRow(row []interface{}) (err error) {
 		}
 	}
 
+	if row, err = b.mappedRow(row); err != nil {
+		return
+	}
 	if len(row) != len(b.bulkColumns) {
 		return fmt.Errorf("row does not have the same number of columns than the destination table %d %d",
 			len(row), len(b.bulkColumns))
@@ -182,6 +329,13 @@ func (b *Bulk) AddRow(row []interface{}) (err error) {
 	}
 
 	b.numRows = b.numRows + 1
+	b.batchRows++
+	if b.Options.NotifyAfter > 0 && b.numRows%b.Options.NotifyAfter == 0 && b.OnProgress != nil {
+		b.OnProgress(int64(b.numRows))
+	}
+	if b.Options.BatchSize > 0 && b.batchRows >= b.Options.BatchSize {
+		_, err = b.endBatch()
+	}
 	return
 }
 
@@ -195,7 +349,15 @@ func (b *Bulk) makeRowData(row []interface{}) ([]byte, error) {
 		if b.Debug {
 			logcol.WriteString(fmt.Sprintf(" col[%d]='%v' ", i, row[i]))
 		}
-		param, err := b.makeParam(row[i], col)
+		enc := b.encryptions[i]
+		valueCol := col
+		if enc != nil {
+			valueCol.ti = col.cryptoMeta.typeInfo
+		}
+		param, err := b.makeParam(row[i], valueCol)
+		if err == nil && enc != nil {
+			param, err = encryptParam(param, enc)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("bulkcopy: %s", err.Error())
 		}
@@ -215,11 +377,22 @@ func (b *Bulk) makeRowData(row []interface{}) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// Done ends the copy and returns the number of rows copied by all its
+// batches.
 func (b *Bulk) Done() (rowcount int64, err error) {
 	if !b.headerSent {
-		//no rows had been sent
-		return 0, nil
+		//no rows had been sent since the last batch
+		return b.copied, nil
 	}
+	if _, err = b.endBatch(); err != nil {
+		return 0, err
+	}
+	return b.copied, nil
+}
+
+// endBatch ends the current batch and returns the number of rows it
+// copied.
+func (b *Bulk) endBatch() (rowcount int64, err error) {
 	var buf = b.cn.sess.buf
 	buf.WriteByte(byte(tokenDone))
 
@@ -234,12 +407,18 @@ func (b *Bulk) Done() (rowcount int64, err error) {
 
 	buf.FinishPacket()
 
-	reader := startReading(b.cn.sess, b.ctx, nil)
+	b.headerSent = false
+	b.batchRows = 0
+	reader := startReading(b.cn.sess, b.ctx, outputs{})
 	err = reader.iterateResponse()
 	if err != nil {
-		return 0, b.cn.checkBadConn(err)
+		return 0, b.cn.checkBadConn(b.ctx, err, false)
 	}
 
+	b.copied += reader.rowCount
+	if b.OnBatch != nil {
+		b.OnBatch(reader.rowCount)
+	}
 	return reader.rowCount, nil
 }
 
@@ -248,6 +427,11 @@ func (b *Bulk) createColMetadata() []byte {
 	buf.WriteByte(byte(tokenColMetadata))                              // token
 	binary.Write(buf, binary.LittleEndian, uint16(len(b.bulkColumns))) // column count
 
+	var cekOrdinals map[*cekTableEntry]uint16
+	if b.cn.sess.alwaysEncrypted {
+		cekOrdinals = b.writeCekTable(buf)
+	}
+
 	for i, col := range b.bulkColumns {
 
 		if b.cn.sess.loginAck.TDSVersion >= verTDS72 {
@@ -267,6 +451,9 @@ func (b *Bulk) createColMetadata() []byte {
 			binary.Write(buf, binary.LittleEndian, uint16(len(tablename_ucs2)/2))
 			buf.Write(tablename_ucs2)
 		}
+		if col.cryptoMeta != nil {
+			writeCryptoMetadata(buf, col.cryptoMeta, cekOrdinals[col.cryptoMeta.entry])
+		}
 		colname_ucs2 := str2ucs2(col.ColName)
 		buf.WriteByte(uint8(len(colname_ucs2) / 2))
 		buf.Write(colname_ucs2)
@@ -275,6 +462,70 @@ func (b *Bulk) createColMetadata() []byte {
 	return buf.Bytes()
 }
 
+// writeCekTable writes the column encryption keys of the encrypted bulk
+// columns and returns their ordinals. The encrypted values of the keys
+// are not sent, the server has them.
+func (b *Bulk) writeCekTable(buf *bytes.Buffer) map[*cekTableEntry]uint16 {
+	ordinals := make(map[*cekTableEntry]uint16)
+	var entries []*cekTableEntry
+	for _, col := range b.bulkColumns {
+		if col.cryptoMeta == nil {
+			continue
+		}
+		if _, ok := ordinals[col.cryptoMeta.entry]; !ok {
+			ordinals[col.cryptoMeta.entry] = uint16(len(entries))
+			entries = append(entries, col.cryptoMeta.entry)
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(buf, binary.LittleEndian, []uint32{uint32(entry.databaseID), uint32(entry.keyId), uint32(entry.keyVersion)})
+		buf.Write(entry.mdVersion)
+		buf.WriteByte(0) // count of encrypted values
+	}
+	return ordinals
+}
+
+// writeCryptoMetadata writes how the values of an encrypted column are
+// encrypted, ordinal is the one of its key in the CEK table.
+func writeCryptoMetadata(buf *bytes.Buffer, cm *cryptoMetadata, ordinal uint16) {
+	binary.Write(buf, binary.LittleEndian, ordinal)
+	binary.Write(buf, binary.LittleEndian, uint32(cm.typeInfo.UserType))
+	ti := cm.typeInfo
+	writeTypeInfo(buf, &ti)
+	buf.WriteByte(cm.algorithmId)
+	if cm.algorithmId == cipherAlgCustom && cm.algorithmName != nil {
+		name := str2ucs2(*cm.algorithmName)
+		buf.WriteByte(uint8(len(name) / 2))
+		buf.Write(name)
+	}
+	buf.WriteByte(cm.encType)
+	buf.WriteByte(cm.normRuleVer)
+}
+
+// columnEncryption returns how the values of an encrypted column are
+// encrypted, with the column encryption key of the destination table.
+func (b *Bulk) columnEncryption(col columnStruct) (*paramEncryption, error) {
+	cm := col.cryptoMeta
+	if cm.algorithmId != cipherAlgAeadAes256CbcHmacSha256 {
+		return nil, fmt.Errorf("mssql: encryption algorithm %d of column %s is not supported", cm.algorithmId, col.ColName)
+	}
+	if cm.entry == nil {
+		return nil, fmt.Errorf("mssql: no column encryption key was returned for column %s", col.ColName)
+	}
+	cek, rootKey, err := b.cn.sess.decryptCEKEntry(cm.entry)
+	if err != nil {
+		return nil, fmt.Errorf("mssql: decrypting the column encryption key of column %s failed: %v", col.ColName, err)
+	}
+	return &paramEncryption{
+		cek:         cek,
+		rootKey:     rootKey,
+		algorithmId: cm.algorithmId,
+		encType:     cm.encType,
+		normRuleVer: cm.normRuleVer,
+	}, nil
+}
+
 func (b *Bulk) getMetadata(ctx context.Context) (err error) {
 	stmt, err := b.cn.prepareContext(ctx, "SET FMTONLY ON")
 	if err != nil {
@@ -312,6 +563,9 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 	res.ti.Size = col.ti.Size
 	res.ti.TypeId = col.ti.TypeId
 
+	if val, err = bulkValue(val); err != nil {
+		return
+	}
 	if val == nil {
 		res.ti.Size = 0
 		return
@@ -320,17 +574,13 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 	switch col.ti.TypeId {
 
 	case typeInt1, typeInt2, typeInt4, typeInt8, typeIntN:
-		var intvalue int64
-
-		switch val := val.(type) {
-		case int:
-			intvalue = int64(val)
-		case int32:
-			intvalue = int64(val)
-		case int64:
-			intvalue = val
-		default:
-			err = fmt.Errorf("mssql: invalid type for int column: %T", val)
+		intvalue, ok := bulkInt64(val)
+		if !ok {
+			err = bulkTypeError(col, "int", val)
+			return
+		}
+		if !intFitsSize(intvalue, col.ti.Size) {
+			err = fmt.Errorf("mssql: value %d is out of range for column %s", intvalue, col.ColName)
 			return
 		}
 
@@ -345,19 +595,9 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			binary.LittleEndian.PutUint64(res.buffer, uint64(intvalue))
 		}
 	case typeFlt4, typeFlt8, typeFltN:
-		var floatvalue float64
-
-		switch val := val.(type) {
-		case float32:
-			floatvalue = float64(val)
-		case float64:
-			floatvalue = val
-		case int:
-			floatvalue = float64(val)
-		case int64:
-			floatvalue = float64(val)
-		default:
-			err = fmt.Errorf("mssql: invalid type for float column: %T %s", val, val)
+		floatvalue, ok := bulkFloat64(val)
+		if !ok {
+			err = bulkTypeError(col, "float", val)
 			return
 		}
 
@@ -368,101 +608,97 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			res.buffer = make([]byte, 8)
 			binary.LittleEndian.PutUint64(res.buffer, math.Float64bits(floatvalue))
 		}
-	case typeNVarChar, typeNText, typeNChar:
-
+	case typeMoney, typeMoney4, typeMoneyN:
+		// money is stored as an integer of ten-thousandths
+		dec, ok, decErr := bulkDecimal(val, 4)
+		if !ok {
+			err = bulkTypeError(col, "money", val)
+			return
+		}
+		if decErr != nil {
+			err = fmt.Errorf("mssql: invalid value for column %s: %v", col.ColName, decErr)
+			return
+		}
+		unscaled := dec.BigInt()
+		if !unscaled.IsInt64() || col.ti.Size == 4 && !intFitsSize(unscaled.Int64(), 4) {
+			err = fmt.Errorf("mssql: value %s is out of range for column %s", dec, col.ColName)
+			return
+		}
+		if col.ti.Size == 4 {
+			res.buffer = encodeMoney4(int32(unscaled.Int64()))
+		} else {
+			res.buffer = encodeMoney(unscaled.Int64())
+		}
+		res.ti.Size = len(res.buffer)
+	case typeNVarChar, typeNText, typeNChar, typeXml:
 		switch val := val.(type) {
-		case string:
-			res.buffer = str2ucs2(val)
 		case []byte:
-			res.buffer = val
+			if col.ti.TypeId == typeXml {
+				// xml documents are given in UTF-8
+				res.buffer = str2ucs2(string(val))
+			} else {
+				res.buffer = val
+			}
 		default:
-			err = fmt.Errorf("mssql: invalid type for nvarchar column: %T %s", val, val)
-			return
+			s, ok := bulkString(val)
+			if !ok {
+				err = bulkTypeError(col, "nvarchar", val)
+				return
+			}
+			res.buffer = str2ucs2(s)
 		}
 		res.ti.Size = len(res.buffer)
 
 	case typeVarChar, typeBigVarChar, typeText, typeChar, typeBigChar:
 		switch val := val.(type) {
-		case string:
-			res.buffer = []byte(val)
 		case []byte:
 			res.buffer = val
 		default:
-			err = fmt.Errorf("mssql: invalid type for varchar column: %T %s", val, val)
-			return
+			s, ok := bulkString(val)
+			if !ok {
+				err = bulkTypeError(col, "varchar", val)
+				return
+			}
+			res.buffer = []byte(s)
 		}
 		res.ti.Size = len(res.buffer)
 
 	case typeBit, typeBitN:
-		if reflect.TypeOf(val).Kind() != reflect.Bool {
-			err = fmt.Errorf("mssql: invalid type for bit column: %T %s", val, val)
+		bitvalue, ok := bulkBool(val)
+		if !ok {
+			err = bulkTypeError(col, "bit", val)
 			return
 		}
 		res.ti.TypeId = typeBitN
 		res.ti.Size = 1
 		res.buffer = make([]byte, 1)
-		if val.(bool) {
+		if bitvalue {
 			res.buffer[0] = 1
 		}
 	case typeDateTime2N:
-		switch val := val.(type) {
-		case time.Time:
-			res.buffer = encodeDateTime2(val, int(col.ti.Scale))
-			res.ti.Size = len(res.buffer)
-		case string:
-			var t time.Time
-			if t, err = time.Parse(sqlDateTimeFormat, val); err != nil {
-				return res, fmt.Errorf("bulk: unable to convert string to date: %v", err)
-			}
-			res.buffer = encodeDateTime2(t, int(col.ti.Scale))
-			res.ti.Size = len(res.buffer)
-		default:
-			err = fmt.Errorf("mssql: invalid type for datetime2 column: %T %s", val, val)
+		var t time.Time
+		if t, err = bulkTime(col, "datetime2", val, sqlDateTimeLayouts); err != nil {
 			return
 		}
+		res.buffer = encodeDateTime2(t, int(col.ti.Scale))
+		res.ti.Size = len(res.buffer)
 	case typeDateTimeOffsetN:
-		switch val := val.(type) {
-		case time.Time:
-			res.buffer = encodeDateTimeOffset(val, int(col.ti.Scale))
-			res.ti.Size = len(res.buffer)
-		case string:
-			var t time.Time
-			if t, err = time.Parse(sqlDateTimeFormat, val); err != nil {
-				return res, fmt.Errorf("bulk: unable to convert string to date: %v", err)
-			}
-			res.buffer = encodeDateTimeOffset(t, int(col.ti.Scale))
-			res.ti.Size = len(res.buffer)
-		default:
-			err = fmt.Errorf("mssql: invalid type for datetimeoffset column: %T %s", val, val)
+		var t time.Time
+		if t, err = bulkTime(col, "datetimeoffset", val, sqlDateTimeLayouts); err != nil {
 			return
 		}
+		res.buffer = encodeDateTimeOffset(t, int(col.ti.Scale))
+		res.ti.Size = len(res.buffer)
 	case typeDateN:
-		switch val := val.(type) {
-		case time.Time:
-			res.buffer = encodeDate(val)
-			res.ti.Size = len(res.buffer)
-		case string:
-			var t time.Time
-			if t, err = time.ParseInLocation(sqlDateFormat, val, time.UTC); err != nil {
-				return res, fmt.Errorf("bulk: unable to convert string to date: %v", err)
-			}
-			res.buffer = encodeDate(t)
-			res.ti.Size = len(res.buffer)
-		default:
-			err = fmt.Errorf("mssql: invalid type for date column: %T %s", val, val)
+		var t time.Time
+		if t, err = bulkTime(col, "date", val, []string{sqlDateFormat}); err != nil {
 			return
 		}
+		res.buffer = encodeDate(t)
+		res.ti.Size = len(res.buffer)
 	case typeDateTime, typeDateTimeN, typeDateTim4:
 		var t time.Time
-		switch val := val.(type) {
-		case time.Time:
-			t = val
-		case string:
-			if t, err = time.Parse(sqlDateTimeFormat, val); err != nil {
-				return res, fmt.Errorf("bulk: unable to convert string to date: %v", err)
-			}
-		default:
-			err = fmt.Errorf("mssql: invalid type for datetime column: %T %s", val, val)
+		if t, err = bulkTime(col, "datetime", val, sqlDateTimeLayouts); err != nil {
 			return
 		}
 
@@ -477,48 +713,20 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 		}
 	case typeTimeN:
 		var t time.Time
-		switch val := val.(type) {
-		case time.Time:
-			res.buffer = encodeTime(val.Hour(), val.Minute(), val.Second(), val.Nanosecond(), int(col.ti.Scale))
-			res.ti.Size = len(res.buffer)
-		case string:
-			if t, err = time.Parse(sqlTimeFormat, val); err != nil {
-				return res, fmt.Errorf("bulk: unable to convert string to time: %v", err)
-			}
-			res.buffer = encodeTime(t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), int(col.ti.Scale))
-			res.ti.Size = len(res.buffer)
-		default:
-			err = fmt.Errorf("mssql: invalid type for time column: %T %s", val, val)
+		if t, err = bulkTime(col, "time", val, []string{sqlTimeFormat}); err != nil {
 			return
 		}
-	// case typeMoney, typeMoney4, typeMoneyN:
+		res.buffer = encodeTime(t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), int(col.ti.Scale))
+		res.ti.Size = len(res.buffer)
 	case typeDecimal, typeDecimalN, typeNumeric, typeNumericN:
 		prec := col.ti.Prec
 		scale := col.ti.Scale
-		var dec decimal.Decimal
-		switch v := val.(type) {
-		case int:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case int8:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case int16:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case int32:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case int64:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case float32:
-			dec, err = decimal.Float64ToDecimalScale(float64(v), scale)
-		case float64:
-			dec, err = decimal.Float64ToDecimalScale(float64(v), scale)
-		case string:
-			dec, err = decimal.StringToDecimalScale(v, scale)
-		default:
-			return res, fmt.Errorf("unknown value for decimal: %T %#v", v, v)
+		dec, ok, decErr := bulkDecimal(val, scale)
+		if !ok {
+			return res, bulkTypeError(col, "decimal", val)
 		}
-
-		if err != nil {
-			return res, err
+		if decErr != nil {
+			return res, fmt.Errorf("mssql: invalid value for column %s: %v", col.ColName, decErr)
 		}
 		dec.SetPrec(prec)
 
@@ -555,34 +763,305 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			buf[i] = ub[j]
 		}
 		res.buffer = buf
-	case typeBigVarBin, typeBigBinary:
-		switch val := val.(type) {
-		case []byte:
-			res.ti.Size = len(val)
-			res.buffer = val
-		default:
-			err = fmt.Errorf("mssql: invalid type for Binary column: %T %s", val, val)
+	case typeBigVarBin, typeBigBinary, typeImage, typeUdt:
+		bytesvalue, ok := bulkBytes(val)
+		if !ok {
+			err = bulkTypeError(col, "binary", val)
 			return
 		}
+		res.ti.Size = len(bytesvalue)
+		res.buffer = bytesvalue
 	case typeGuid:
 		switch val := val.(type) {
 		case []byte:
-			res.ti.Size = len(val)
 			res.buffer = val
+		case string:
+			var u UniqueIdentifier
+			if err = u.Scan(val); err != nil {
+				return res, fmt.Errorf("mssql: invalid value for column %s: %v", col.ColName, err)
+			}
+			v, _ := u.Value()
+			res.buffer = v.([]byte)
 		default:
-			err = fmt.Errorf("mssql: invalid type for Guid column: %T %s", val, val)
+			err = bulkTypeError(col, "uniqueidentifier", val)
+			return
+		}
+		if len(res.buffer) != 16 {
+			err = fmt.Errorf("mssql: invalid length %d of uniqueidentifier for column %s", len(res.buffer), col.ColName)
+			return
+		}
+		res.ti.Size = len(res.buffer)
+	case typeVariant:
+		if res.buffer, err = bulkVariant(col, val, b.collation); err != nil {
 			return
 		}
+		res.ti.Size = len(res.buffer)
 
 	default:
-		err = fmt.Errorf("mssql: type %x not implemented", col.ti.TypeId)
+		err = fmt.Errorf("mssql: type %x of column %s not implemented", col.ti.TypeId, col.ColName)
 	}
 	return
 
 }
 
+// sqlDateTimeLayouts are the layouts strings are parsed with for datetime
+// columns.
+var sqlDateTimeLayouts = []string{
+	sqlDateTimeFormat,
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+}
+
+// bulkTypeError returns the error of a value which cannot be converted to
+// the type of the column col, typeName.
+func bulkTypeError(col columnStruct, typeName string, val DataValue) error {
+	return fmt.Errorf("mssql: cannot convert %T to %s for column %s", val, typeName, col.ColName)
+}
+
+// bulkValue returns the value a bulk column is set to: nil for nil
+// pointers, the value of a driver.Valuer or the value a pointer points to.
+func bulkValue(val DataValue) (DataValue, error) {
+	if val == nil {
+		return nil, nil
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, nil
+	}
+	switch v := val.(type) {
+	case *big.Int, *big.Rat:
+		return val, nil
+	case driver.Valuer:
+		return v.Value()
+	}
+	if rv.Kind() == reflect.Ptr {
+		return bulkValue(rv.Elem().Interface())
+	}
+	return val, nil
+}
+
+// bulkInt64 converts integers, and strings holding one, to int64.
+func bulkInt64(val DataValue) (int64, bool) {
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(rv.Uint()), true
+	case reflect.String:
+		v, err := strconv.ParseInt(strings.TrimSpace(rv.String()), 10, 64)
+		return v, err == nil
+	}
+	return 0, false
+}
+
+// intFitsSize reports whether v can be stored in an integer of size bytes,
+// the one byte tinyint being unsigned.
+func intFitsSize(v int64, size int) bool {
+	switch size {
+	case 1:
+		return v >= 0 && v <= math.MaxUint8
+	case 2:
+		return v >= math.MinInt16 && v <= math.MaxInt16
+	case 4:
+		return v >= math.MinInt32 && v <= math.MaxInt32
+	}
+	return true
+}
+
+// bulkFloat64 converts numbers, and strings holding one, to float64.
+func bulkFloat64(val DataValue) (float64, bool) {
+	switch v := val.(type) {
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, true
+	case *big.Rat:
+		f, _ := v.Float64()
+		return f, true
+	case []byte:
+		// decimal and money values are read as []byte
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(rv.String()), 64)
+		return f, err == nil
+	}
+	if v, ok := bulkInt64(val); ok {
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// bulkDecimal converts numbers, and strings holding one, to a decimal of
+// the given scale. ok is false for other types, err is set when the value
+// does not fit.
+func bulkDecimal(val DataValue, scale uint8) (dec decimal.Decimal, ok bool, err error) {
+	switch v := val.(type) {
+	case *big.Int:
+		dec, err = decimal.StringToDecimalScale(v.String(), scale)
+		return dec, true, err
+	case *big.Rat:
+		dec, err = decimal.StringToDecimalScale(v.FloatString(int(scale)), scale)
+		return dec, true, err
+	case []byte:
+		// decimal and money values are read as []byte
+		dec, err = decimal.StringToDecimalScale(string(v), scale)
+		return dec, true, err
+	}
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		dec, err = decimal.StringToDecimalScale(strconv.FormatInt(rv.Int(), 10), scale)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		dec, err = decimal.StringToDecimalScale(strconv.FormatUint(rv.Uint(), 10), scale)
+	case reflect.Float32, reflect.Float64:
+		dec, err = decimal.Float64ToDecimalScale(rv.Float(), scale)
+	case reflect.String:
+		dec, err = decimal.StringToDecimalScale(strings.TrimSpace(rv.String()), scale)
+	default:
+		return dec, false, nil
+	}
+	return dec, true, err
+}
+
+// bulkBool converts booleans, integers and strings like "true" or "1"
+// to bool.
+func bulkBool(val DataValue) (bool, bool) {
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), true
+	case reflect.String:
+		v, err := strconv.ParseBool(strings.TrimSpace(rv.String()))
+		return v, err == nil
+	}
+	if v, ok := bulkInt64(val); ok {
+		return v != 0, true
+	}
+	return false, false
+}
+
+// bulkString converts strings, including the string types of the
+// driver like VarChar, to string.
+func bulkString(val DataValue) (string, bool) {
+	rv := reflect.ValueOf(val)
+	if rv.Kind() == reflect.String {
+		return rv.String(), true
+	}
+	return "", false
+}
+
+// bulkBytes converts byte slices and arrays to []byte.
+func bulkBytes(val DataValue) ([]byte, bool) {
+	if v, ok := val.([]byte); ok {
+		return v, true
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8 {
+		res := make([]byte, rv.Len())
+		reflect.Copy(reflect.ValueOf(res), rv)
+		return res, true
+	}
+	return nil, false
+}
+
+// bulkTime converts times and the civil types to time.Time, and parses
+// strings with the first of layouts which matches.
+func bulkTime(col columnStruct, typeName string, val DataValue, layouts []string) (time.Time, error) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, nil
+	case civil.Date:
+		return v.In(time.UTC), nil
+	case civil.DateTime:
+		return v.In(time.UTC), nil
+	case civil.Time:
+		return time.Date(1, 1, 1, v.Hour, v.Minute, v.Second, v.Nanosecond, time.UTC), nil
+	case string:
+		var err error
+		for _, layout := range layouts {
+			var t time.Time
+			if t, err = time.ParseInLocation(layout, v, time.UTC); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("mssql: unable to convert %q to %s for column %s: %v", v, typeName, col.ColName, err)
+	}
+	return time.Time{}, bulkTypeError(col, typeName, val)
+}
+
+// bulkVariant encodes a value of a sql_variant column, with the type its
+// Go type is sent as in parameters.
+func bulkVariant(col columnStruct, val DataValue, collation cp.Collation) ([]byte, error) {
+	var baseType byte
+	var props, data []byte
+	switch v := val.(type) {
+	case bool:
+		baseType = typeBit
+		data = []byte{0}
+		if v {
+			data[0] = 1
+		}
+	case time.Time:
+		baseType = typeDateTimeOffsetN
+		props = []byte{7}
+		data = encodeDateTimeOffset(v, 7)
+	case civil.Date:
+		baseType = typeDateN
+		data = encodeDate(v.In(time.UTC))
+	case civil.DateTime:
+		baseType = typeDateTime2N
+		props = []byte{7}
+		data = encodeDateTime2(v.In(time.UTC), 7)
+	case civil.Time:
+		baseType = typeTimeN
+		props = []byte{7}
+		data = encodeTime(v.Hour, v.Minute, v.Second, v.Nanosecond, 7)
+	case []byte:
+		baseType = typeBigVarBin
+		props = []byte{0x40, 0x1f} // max length 8000
+		data = v
+	default:
+		if i, ok := bulkInt64(val); ok && reflect.ValueOf(val).Kind() != reflect.String {
+			baseType = typeInt8
+			data = make([]byte, 8)
+			binary.LittleEndian.PutUint64(data, uint64(i))
+		} else if f, ok := bulkFloat64(val); ok && reflect.ValueOf(val).Kind() != reflect.String {
+			baseType = typeFlt8
+			data = make([]byte, 8)
+			binary.LittleEndian.PutUint64(data, math.Float64bits(f))
+		} else if s, ok := bulkString(val); ok {
+			baseType = typeNVarChar
+			// collation and max length 8000
+			props = make([]byte, 7)
+			binary.LittleEndian.PutUint32(props, collation.LcidAndFlags)
+			props[4] = collation.SortId
+			binary.LittleEndian.PutUint16(props[5:], 8000)
+			data = str2ucs2(s)
+		} else {
+			return nil, bulkTypeError(col, "sql_variant", val)
+		}
+	}
+	if len(data) > 8000 {
+		return nil, fmt.Errorf("mssql: value of %d bytes is too long for sql_variant column %s", len(data), col.ColName)
+	}
+	res := make([]byte, 0, 2+len(props)+len(data))
+	res = append(res, baseType, byte(len(props)))
+	res = append(res, props...)
+	return append(res, data...), nil
+}
+
 func (b *Bulk) dlogf(format string, v ...interface{}) {
 	if b.Debug {
-		b.cn.sess.log.Printf(format, v...)
+		b.cn.sess.logger.Log(b.ctx, msdsn.LogDebug, fmt.Sprintf(format, v...))
 	}
 }
@@ -0,0 +1,255 @@
+package mssql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+)
+
+// BulkColumn declares a column of the destination table of a bulk copy,
+// so that its metadata is not queried from the server.
+type BulkColumn struct {
+	// Name is the name of the column.
+	Name string
+	// Type is the SQL type of the column without its length, like int,
+	// nvarchar or datetime2. User defined types are declared with their
+	// base type, and columns encrypted with Always Encrypted cannot be
+	// declared.
+	Type string
+	// Length is the length of char, varchar, nchar, nvarchar, binary and
+	// varbinary columns, in characters or bytes. It is max for the var
+	// types when zero or negative, and 1 for the others.
+	Length int
+	// Precision and Scale are those of decimal and numeric columns, the
+	// precision is 18 when zero. The scale of time, datetime2 and
+	// datetimeoffset columns is the number of digits of their fractions
+	// of seconds, it is 7 when zero like in SQL unless ZeroScale is set.
+	Precision uint8
+	Scale     uint8
+	// ZeroScale declares time, datetime2 and datetimeoffset columns
+	// with scale 0.
+	ZeroScale bool
+	// Collation is the collation of char, varchar, text, nchar, nvarchar
+	// and ntext columns. It is the collation of the database when empty.
+	Collation string
+	// Nullable tells whether the column accepts NULL.
+	Nullable bool
+}
+
+// bulkColumnTypes are the type ids of the declared columns, by SQL type.
+var bulkColumnTypes = map[string]uint8{
+	"tinyint":          typeIntN,
+	"smallint":         typeIntN,
+	"int":              typeIntN,
+	"bigint":           typeIntN,
+	"bit":              typeBitN,
+	"real":             typeFltN,
+	"float":            typeFltN,
+	"smallmoney":       typeMoneyN,
+	"money":            typeMoneyN,
+	"decimal":          typeDecimalN,
+	"numeric":          typeNumericN,
+	"smalldatetime":    typeDateTimeN,
+	"datetime":         typeDateTimeN,
+	"date":             typeDateN,
+	"time":             typeTimeN,
+	"datetime2":        typeDateTime2N,
+	"datetimeoffset":   typeDateTimeOffsetN,
+	"char":             typeBigChar,
+	"varchar":          typeBigVarChar,
+	"text":             typeText,
+	"nchar":            typeNChar,
+	"nvarchar":         typeNVarChar,
+	"ntext":            typeNText,
+	"binary":           typeBigBinary,
+	"varbinary":        typeBigVarBin,
+	"image":            typeImage,
+	"xml":              typeXml,
+	"uniqueidentifier": typeGuid,
+	"sql_variant":      typeVariant,
+}
+
+// declaredMetadata returns the metadata of declared columns, with the
+// collation of the database for character columns.
+func declaredMetadata(columns []BulkColumn, collation cp.Collation) ([]columnStruct, error) {
+	metadata := make([]columnStruct, len(columns))
+	for i, c := range columns {
+		typeName := strings.ToLower(c.Type)
+		typeID, ok := bulkColumnTypes[typeName]
+		if !ok {
+			return nil, fmt.Errorf("mssql: type %s of column %s is not supported", c.Type, c.Name)
+		}
+		col := columnStruct{ColName: c.Name, ti: typeInfo{TypeId: typeID}}
+		if c.Nullable {
+			col.Flags = colFlagNullable
+		}
+		switch typeName {
+		case "tinyint", "bit":
+			col.ti.Size = 1
+		case "smallint":
+			col.ti.Size = 2
+		case "int", "real", "smallmoney", "smalldatetime":
+			col.ti.Size = 4
+		case "bigint", "float", "money", "datetime":
+			col.ti.Size = 8
+		case "decimal", "numeric":
+			col.ti.Size = 17
+			col.ti.Prec = c.Precision
+			if col.ti.Prec == 0 {
+				col.ti.Prec = 18
+			}
+			col.ti.Scale = c.Scale
+		case "date":
+			col.ti.Size = 3
+		case "time", "datetime2", "datetimeoffset":
+			if c.Scale > 7 {
+				return nil, fmt.Errorf("mssql: scale %d of column %s is more than 7", c.Scale, c.Name)
+			}
+			col.ti.Scale = c.Scale
+			if col.ti.Scale == 0 && !c.ZeroScale {
+				col.ti.Scale = 7
+			}
+			col.ti.Size = timeSize(col.ti.Scale)
+			switch typeID {
+			case typeDateTime2N:
+				col.ti.Size += 3
+			case typeDateTimeOffsetN:
+				col.ti.Size += 5
+			}
+		case "char", "varchar", "binary", "varbinary":
+			col.ti.Size = declaredLength(typeID, c.Length, 8000)
+		case "nchar", "nvarchar":
+			col.ti.Size = declaredLength(typeID, c.Length, 4000)
+			if col.ti.Size != 0xffff {
+				col.ti.Size *= 2
+			}
+		case "text", "ntext", "image":
+			col.ti.Size = 0x7fffffff
+		case "uniqueidentifier":
+			col.ti.Size = 16
+		case "sql_variant":
+			col.ti.Size = 8009
+		}
+		switch typeID {
+		case typeBigChar, typeBigVarChar, typeText, typeNChar, typeNVarChar, typeNText:
+			col.ti.Collation = collation
+		}
+		metadata[i] = col
+	}
+	return metadata, nil
+}
+
+// timeSize is the size of the time part of time, datetime2 and
+// datetimeoffset values of a scale.
+func timeSize(scale uint8) int {
+	switch {
+	case scale <= 2:
+		return 3
+	case scale <= 4:
+		return 4
+	}
+	return 5
+}
+
+// declaredLength returns the size of a column of a declared length,
+// 0xffff for max.
+func declaredLength(typeID uint8, length, max int) int {
+	switch {
+	case length > max:
+		return 0xffff
+	case length > 0:
+		return length
+	case typeID == typeBigVarChar || typeID == typeNVarChar || typeID == typeBigVarBin:
+		return 0xffff
+	}
+	return 1
+}
+
+// declaredColumn returns the declared column of a name, or nil.
+func (b *Bulk) declaredColumn(name string) *BulkColumn {
+	for i := range b.Options.Columns {
+		if b.Options.Columns[i].Name == name {
+			return &b.Options.Columns[i]
+		}
+	}
+	return nil
+}
+
+// loadMetadata sets the metadata of the destination table, from the
+// declared columns, the cache of the connector or the server.
+func (b *Bulk) loadMetadata(ctx context.Context) (err error) {
+	if len(b.Options.Columns) > 0 {
+		if b.metadata, err = declaredMetadata(b.Options.Columns, b.cn.sess.collation); err != nil {
+			return err
+		}
+		if len(b.columnsName) == 0 && len(b.Options.ColumnMappings) == 0 {
+			for _, c := range b.Options.Columns {
+				b.columnsName = append(b.columnsName, c.Name)
+			}
+		}
+		return nil
+	}
+	cache, key := b.metadataCache()
+	if metadata, ok := cache.get(key); ok {
+		b.metadata = metadata
+		return nil
+	}
+	if err = b.getMetadata(ctx); err != nil {
+		return err
+	}
+	cache.put(key, b.metadata)
+	return nil
+}
+
+// metadataCache returns the metadata cache of the connector and the key
+// of the destination table, or nil when the metadata is not cached.
+// Temporary tables belong to their session, they are never cached.
+func (b *Bulk) metadataCache() (*bulkMetadataCache, string) {
+	c := b.cn.connector
+	if c == nil || !c.CacheBulkMetadata || strings.Contains(b.tablename, "#") {
+		return nil, ""
+	}
+	return &c.bulkMetadata, b.cn.sess.database + "\x00" + b.tablename
+}
+
+// bulkMetadataCache holds the metadata of the destination tables of bulk
+// copies, by database and table name. A nil cache holds nothing.
+type bulkMetadataCache struct {
+	mu     sync.Mutex
+	tables map[string][]columnStruct
+}
+
+func (c *bulkMetadataCache) get(key string) ([]columnStruct, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	metadata, ok := c.tables[key]
+	return metadata, ok
+}
+
+func (c *bulkMetadataCache) put(key string, metadata []columnStruct) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tables == nil {
+		c.tables = make(map[string][]columnStruct)
+	}
+	c.tables[key] = metadata
+}
+
+// remove drops the metadata of a table, after the table was changed.
+func (c *bulkMetadataCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tables, key)
+}
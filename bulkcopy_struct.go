@@ -0,0 +1,172 @@
+package mssql
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+const (
+	mssqlTag = "mssql"
+	dbTag    = "db"
+)
+
+// BulkIterator provides the rows copied by Bulk.CopyFromIterator one at
+// a time, so that they need not be held in memory together.
+type BulkIterator interface {
+	// Next returns the next row, as a struct, a pointer to a struct or
+	// the values of the columns in the order of the bulk columns. It
+	// returns io.EOF after the last row.
+	Next() (interface{}, error)
+}
+
+// BulkIteratorFunc is a function used as a BulkIterator.
+type BulkIteratorFunc func() (interface{}, error)
+
+func (f BulkIteratorFunc) Next() (interface{}, error) {
+	return f()
+}
+
+// AddStructs immediately writes the rows of a slice of structs, or of
+// pointers to structs, to the destination table.
+//
+// The value of a column is the field tagged with its name by an mssql
+// tag, a db tag when the field has no mssql tag, or the field with the
+// name of the column when it has neither. Names are matched without
+// regard to case when no field matches exactly. Fields tagged "-" and
+// unexported fields are skipped, nil pointers are written as NULL.
+// When the bulk was created without columns, its columns are the
+// fields of the struct.
+func (b *Bulk) AddStructs(rows interface{}) error {
+	val := reflect.ValueOf(rows)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return fmt.Errorf("mssql: AddStructs needs a slice of structs, got %T", rows)
+	}
+	for i := 0; i < val.Len(); i++ {
+		if err := b.addStruct(val.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyFromIterator writes the rows of it to the destination table as
+// they are read, and returns the number of rows written. Structs are
+// mapped to the columns like by AddStructs. Done must still be called
+// to end the copy.
+func (b *Bulk) CopyFromIterator(it BulkIterator) (int, error) {
+	n := 0
+	for {
+		row, err := it.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if values, ok := row.([]interface{}); ok {
+			err = b.AddRow(values)
+		} else {
+			err = b.addStruct(row)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// addStruct writes a row given as a struct or a pointer to a struct.
+func (b *Bulk) addStruct(row interface{}) error {
+	val := reflect.ValueOf(row)
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return fmt.Errorf("mssql: bulk row is a nil %T", row)
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return fmt.Errorf("mssql: bulk row of type %T is not a struct", row)
+	}
+	fields, err := b.structFields(val.Type())
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		values[i] = val.Field(field).Interface()
+	}
+	return b.AddRow(values)
+}
+
+// structFields returns the indexes of the fields of a struct type
+// holding the values of the bulk columns. The fields of the last type
+// are kept, rows usually all have the same type.
+func (b *Bulk) structFields(t reflect.Type) ([]int, error) {
+	if t == b.rowType {
+		return b.rowFields, nil
+	}
+	var names []string
+	var indexes []int
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := bulkFieldColumn(t.Field(i)); ok {
+			names = append(names, name)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(b.columnsName) == 0 && !b.headerSent {
+		if len(names) == 0 {
+			return nil, fmt.Errorf("mssql: %v has no field to copy", t)
+		}
+		b.columnsName = names
+	}
+	fields := make([]int, len(b.columnsName))
+	for i, column := range b.columnsName {
+		j := matchColumnName(names, column)
+		if j < 0 {
+			return nil, fmt.Errorf("mssql: %v has no field for column %s", t, column)
+		}
+		fields[i] = indexes[j]
+	}
+	b.rowType, b.rowFields = t, fields
+	return fields, nil
+}
+
+// bulkFieldColumn returns the name of the column of a struct field, and
+// false when the field is not copied.
+func bulkFieldColumn(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+	tag, ok := field.Tag.Lookup(mssqlTag)
+	if !ok {
+		tag = field.Tag.Get(dbTag)
+	}
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		tag = tag[:i]
+	}
+	switch {
+	case tag == skipTagValue:
+		return "", false
+	case tag == "":
+		return field.Name, true
+	}
+	return tag, true
+}
+
+// matchColumnName returns the index of the name of a column in names,
+// or -1.
+func matchColumnName(names []string, column string) int {
+	for i, name := range names {
+		if name == column {
+			return i
+		}
+	}
+	for i, name := range names {
+		if strings.EqualFold(name, column) {
+			return i
+		}
+	}
+	return -1
+}
@@ -3,14 +3,22 @@
 package mssql
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"math"
+	"math/big"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/golang-sql/civil"
+	"github.com/swisscom/mssql-always-encrypted/pkg/encryption"
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
 )
 
 func TestBulkcopy(t *testing.T) {
@@ -281,3 +289,375 @@ func setupTable(ctx context.Context, t *testing.T, conn *sql.Conn, tableName str
 	}
 	return
 }
+
+func TestBulkEncryptedColumns(t *testing.T) {
+	entry := &cekTableEntry{databaseID: 5, keyId: 2, keyVersion: 1, mdVersion: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	sess := &tdsSession{alwaysEncrypted: true, loginAck: loginAckStruct{TDSVersion: verTDS74}}
+	b := &Bulk{
+		cn:        &Conn{sess: sess},
+		tablename: "t",
+		bulkColumns: []columnStruct{
+			{ColName: "id", ti: typeInfo{TypeId: typeIntN, Size: 4}},
+			{ColName: "ssn", Flags: colFlagEncrypted, ti: typeInfo{TypeId: typeBigVarBin, Size: 8000}, cryptoMeta: &cryptoMetadata{
+				entry:       entry,
+				algorithmId: cipherAlgAeadAes256CbcHmacSha256,
+				encType:     encryption.Deterministic.Value,
+				normRuleVer: 1,
+				typeInfo:    typeInfo{TypeId: typeIntN, Size: 4},
+			}},
+		},
+		encryptions: []*paramEncryption{nil, {
+			rootKey:     testRootKey(),
+			algorithmId: cipherAlgAeadAes256CbcHmacSha256,
+			encType:     encryption.Deterministic.Value,
+			normRuleVer: 1,
+		}},
+	}
+
+	// the metadata is read back the way the server sends it
+	r := replyBuffer(b.createColMetadata())
+	if _, err := r.BeginRead(); err != nil {
+		t.Fatal("BeginRead failed:", err)
+	}
+	if tok := token(r.byte()); tok != tokenColMetadata {
+		t.Fatalf("expected COLMETADATA, got %v", tok)
+	}
+	cols := parseColMetadata72(r, sess)
+	if len(cols) != 2 || cols[0].cryptoMeta != nil || cols[1].cryptoMeta == nil {
+		t.Fatalf("unexpected columns %+v", cols)
+	}
+	cm := cols[1].cryptoMeta
+	if cm.ordinal != 0 || cm.entry.keyId != 2 || !bytes.Equal(cm.entry.mdVersion, entry.mdVersion) ||
+		cm.typeInfo.TypeId != typeIntN || cm.encType != encryption.Deterministic.Value || cols[1].ColName != "ssn" {
+		t.Errorf("unexpected crypto metadata %+v", cm)
+	}
+
+	data, err := b.makeRowData([]interface{}{1, 42})
+	if err != nil {
+		t.Fatal("makeRowData failed:", err)
+	}
+	r = replyBuffer(data)
+	r.BeginRead()
+	r.byte()
+	row := make([]interface{}, 2)
+	parseRow(r, &tdsSession{}, cols, row)
+	if row[0] != int64(1) {
+		t.Errorf("id is %v", row[0])
+	}
+	expected := []byte{42, 0, 0, 0, 0, 0, 0, 0}
+	if got := decryptAead(t, testRootKey(), encryption.Deterministic.Value, row[1].([]byte)); !bytes.Equal(got, expected) {
+		t.Errorf("ssn decrypted as % x", got)
+	}
+
+	if data, err = b.makeRowData([]interface{}{2, nil}); err != nil {
+		t.Fatal("makeRowData of NULL failed:", err)
+	}
+	r = replyBuffer(data)
+	r.BeginRead()
+	r.byte()
+	parseRow(r, &tdsSession{}, cols, row)
+	if row[1] != nil {
+		t.Errorf("NULL sent as % x", row[1])
+	}
+}
+
+func TestBulkMakeParam(t *testing.T) {
+	b := &Bulk{collation: cp.Collation{LcidAndFlags: 0x00d00409, SortId: 52}}
+	money := columnStruct{ColName: "amount", ti: typeInfo{TypeId: typeMoneyN, Size: 8}}
+	smallmoney := columnStruct{ColName: "fee", ti: typeInfo{TypeId: typeMoney4, Size: 4}}
+	dec := columnStruct{ColName: "rate", ti: typeInfo{TypeId: typeDecimalN, Size: 5, Prec: 9, Scale: 2}}
+	tests := []struct {
+		col      columnStruct
+		val      interface{}
+		expected string
+	}{
+		{money, "-12.34", "-12.3400"},
+		{money, 15, "15.0000"},
+		{money, 0.5, "0.5000"},
+		{money, big.NewRat(1, 8), "0.1250"},
+		{smallmoney, int64(214748), "214748.0000"},
+		{dec, 7, "7.00"},
+		{dec, []byte("1.5"), "1.50"},
+		{dec, new(big.Int).SetInt64(-3), "-3.00"},
+	}
+	for _, test := range tests {
+		p, err := b.makeParam(test.val, test.col)
+		if err != nil {
+			t.Errorf("%T %v: %v", test.val, test.val, err)
+			continue
+		}
+		var got []byte
+		switch test.col.ti.TypeId {
+		case typeMoneyN:
+			got = decodeMoney(p.buffer)
+		case typeMoney4:
+			got = decodeMoney4(p.buffer)
+		default:
+			got = decodeDecimal(test.col.ti.Prec, test.col.ti.Scale, p.buffer)
+		}
+		if string(got) != test.expected {
+			t.Errorf("%T %v sent as %s, expected %s", test.val, test.val, got, test.expected)
+		}
+	}
+
+	bit := columnStruct{ColName: "active", ti: typeInfo{TypeId: typeBitN, Size: 1}}
+	for _, val := range []interface{}{"true", "1", 1, true} {
+		if p, err := b.makeParam(val, bit); err != nil || p.buffer[0] != 1 {
+			t.Errorf("bit %T %v sent as % x, %v", val, val, p.buffer, err)
+		}
+	}
+
+	tinyint := columnStruct{ColName: "level", ti: typeInfo{TypeId: typeIntN, Size: 1}}
+	if _, err := b.makeParam(256, tinyint); err == nil {
+		t.Error("256 should be out of range for tinyint")
+	}
+	if p, err := b.makeParam(uint8(200), tinyint); err != nil || p.buffer[0] != 200 {
+		t.Errorf("tinyint sent as % x, %v", p.buffer, err)
+	}
+	var nilInt *int64
+	if p, err := b.makeParam(nilInt, tinyint); err != nil || p.buffer != nil {
+		t.Errorf("nil pointer sent as % x, %v", p.buffer, err)
+	}
+	if p, err := b.makeParam(sql.NullInt64{Int64: 3, Valid: true}, tinyint); err != nil || p.buffer[0] != 3 {
+		t.Errorf("sql.NullInt64 sent as % x, %v", p.buffer, err)
+	}
+
+	date := columnStruct{ColName: "day", ti: typeInfo{TypeId: typeDateN, Size: 3}}
+	p, err := b.makeParam(civil.Date{Year: 2021, Month: 3, Day: 4}, date)
+	if err != nil || decodeDate(p.buffer) != time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("civil.Date sent as % x, %v", p.buffer, err)
+	}
+
+	guid := columnStruct{ColName: "id", ti: typeInfo{TypeId: typeGuid, Size: 16}}
+	u := UniqueIdentifier{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10}
+	expected, _ := u.Value()
+	if p, err = b.makeParam(u.String(), guid); err != nil || !bytes.Equal(p.buffer, expected.([]byte)) {
+		t.Errorf("uniqueidentifier string sent as % x, %v", p.buffer, err)
+	}
+
+	xml := columnStruct{ColName: "doc", ti: typeInfo{TypeId: typeXml}}
+	if p, err = b.makeParam([]byte("<a/>"), xml); err != nil || decodeNChar(p.buffer) != "<a/>" {
+		t.Errorf("xml sent as % x, %v", p.buffer, err)
+	}
+
+	variant := columnStruct{ColName: "v", ti: typeInfo{TypeId: typeVariant, Size: 8016}}
+	for _, val := range []interface{}{int64(-5), 2.5, "text", true, []byte{1, 2}, civil.Date{Year: 2020, Month: 1, Day: 2}} {
+		p, err = b.makeParam(val, variant)
+		if err != nil {
+			t.Errorf("sql_variant %T: %v", val, err)
+			continue
+		}
+		var w bytes.Buffer
+		writeVariantType(&w, p.ti, p.buffer)
+		r := replyBuffer(w.Bytes())
+		r.BeginRead()
+		got := readVariantType(&variant.ti, r, nil)
+		if fmt.Sprint(got) != fmt.Sprint(val) && !(val == civil.Date{Year: 2020, Month: 1, Day: 2} && got == time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("sql_variant %T %v read back as %v", val, val, got)
+		}
+	}
+	if p, err = b.makeParam("text", variant); err != nil || !bytes.Equal(p.buffer[:9], []byte{typeNVarChar, 7, 0x09, 0x04, 0xd0, 0x00, 52, 0x40, 0x1f}) {
+		t.Errorf("sql_variant nvarchar sent as % x, %v", p.buffer, err)
+	}
+
+	if _, err = b.makeParam(time.Now(), money); err == nil || !strings.Contains(err.Error(), "time.Time") || !strings.Contains(err.Error(), "amount") {
+		t.Errorf("the error should name the Go type and the column, got %v", err)
+	}
+}
+
+func TestBulkStructFields(t *testing.T) {
+	type row struct {
+		ID      int
+		Name    *string `db:"name"`
+		Code    string  `mssql:"code" db:"other"`
+		Skipped string  `mssql:"-"`
+		Note    string  `db:"note,omitempty"`
+		hidden  int
+	}
+	typ := reflect.TypeOf(row{})
+
+	b := &Bulk{columnsName: []string{"note", "id", "code", "name"}}
+	fields, err := b.structFields(typ)
+	if err != nil {
+		t.Fatal("structFields failed:", err)
+	}
+	if expected := []int{4, 0, 2, 1}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("fields %v, expected %v", fields, expected)
+	}
+
+	b = &Bulk{}
+	if _, err = b.structFields(typ); err != nil {
+		t.Fatal("structFields failed:", err)
+	}
+	if expected := []string{"ID", "name", "code", "note"}; !reflect.DeepEqual(b.columnsName, expected) {
+		t.Errorf("columns %v, expected %v", b.columnsName, expected)
+	}
+
+	b = &Bulk{columnsName: []string{"id", "Skipped"}}
+	if _, err = b.structFields(typ); err == nil {
+		t.Error("a skipped field should not hold a column")
+	}
+
+	for _, rows := range []interface{}{row{}, []int{1}, []*row{nil}} {
+		if err = (&Bulk{columnsName: []string{"id"}}).AddStructs(rows); err == nil {
+			t.Errorf("AddStructs(%#v) should fail", rows)
+		}
+	}
+
+	failure := fmt.Errorf("read failed")
+	it := BulkIteratorFunc(func() (interface{}, error) { return nil, failure })
+	if n, err := (&Bulk{}).CopyFromIterator(it); n != 0 || err != failure {
+		t.Errorf("CopyFromIterator returned %d, %v", n, err)
+	}
+	it = BulkIteratorFunc(func() (interface{}, error) { return nil, io.EOF })
+	if n, err := (&Bulk{}).CopyFromIterator(it); n != 0 || err != nil {
+		t.Errorf("CopyFromIterator returned %d, %v", n, err)
+	}
+}
+
+func TestBulkDeclaredColumns(t *testing.T) {
+	collation := cp.Collation{LcidAndFlags: 0x00d00409, SortId: 52}
+	columns := []BulkColumn{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "NVarChar", Length: 50, Nullable: true},
+		{Name: "notes", Type: "varchar"},
+		{Name: "code", Type: "char", Collation: "Latin1_General_BIN2"},
+		{Name: "price", Type: "decimal", Precision: 10, Scale: 2},
+		{Name: "amount", Type: "numeric"},
+		{Name: "created", Type: "datetime2", Scale: 3},
+		{Name: "at", Type: "time", Scale: 7},
+		{Name: "body", Type: "ntext"},
+		{Name: "flag", Type: "bit"},
+		{Name: "updated", Type: "datetimeoffset"},
+		{Name: "day", Type: "datetime2", ZeroScale: true},
+	}
+	expected := []string{"int", "nvarchar(50)", "varchar(max)", "char(1)", "decimal(10, 2)",
+		"numeric(18, 0)", "datetime2(3)", "time", "ntext", "bit", "datetimeoffset(7)", "datetime2(0)"}
+	metadata, err := declaredMetadata(columns, collation)
+	if err != nil {
+		t.Fatal("declaredMetadata failed:", err)
+	}
+	for i, col := range metadata {
+		if decl := makeDecl(col.ti); decl != expected[i] {
+			t.Errorf("column %s declared as %s, expected %s", col.ColName, decl, expected[i])
+		}
+		var buf bytes.Buffer
+		if err := writeTypeInfo(&buf, &col.ti); err != nil {
+			t.Errorf("writeTypeInfo of column %s failed: %v", col.ColName, err)
+		}
+	}
+	if metadata[1].Flags != colFlagNullable || metadata[0].Flags != 0 {
+		t.Errorf("unexpected flags %d %d", metadata[0].Flags, metadata[1].Flags)
+	}
+	if metadata[1].ti.Collation != collation || metadata[0].ti.Collation != (cp.Collation{}) {
+		t.Errorf("unexpected collations %v %v", metadata[0].ti.Collation, metadata[1].ti.Collation)
+	}
+	if metadata[6].ti.Size != 7 || metadata[7].ti.Size != 5 || metadata[10].ti.Size != 10 || metadata[11].ti.Size != 6 {
+		t.Errorf("unexpected sizes %d %d %d %d", metadata[6].ti.Size, metadata[7].ti.Size, metadata[10].ti.Size, metadata[11].ti.Size)
+	}
+
+	for _, c := range []BulkColumn{{Name: "g", Type: "geography"}, {Name: "t", Type: "time", Scale: 8}} {
+		if _, err := declaredMetadata([]BulkColumn{c}, collation); err == nil {
+			t.Errorf("declaring %+v should fail", c)
+		}
+	}
+
+	b := &Bulk{Options: BulkOptions{Columns: columns}, cn: &Conn{sess: &tdsSession{collation: collation}}}
+	if err := b.loadMetadata(context.Background()); err != nil {
+		t.Fatal("loadMetadata failed:", err)
+	}
+	if len(b.columnsName) != len(columns) || b.columnsName[4] != "price" {
+		t.Errorf("bulk columns %v", b.columnsName)
+	}
+	if c := b.declaredColumn("code"); c == nil || c.Collation != "Latin1_General_BIN2" {
+		t.Errorf("declaredColumn returned %+v", c)
+	}
+}
+
+func TestBulkMetadataCache(t *testing.T) {
+	connector := &Connector{CacheBulkMetadata: true}
+	cn := &Conn{connector: connector, sess: &tdsSession{database: "sales"}}
+	metadata := []columnStruct{{ColName: "id", ti: typeInfo{TypeId: typeIntN, Size: 4}}}
+
+	b := &Bulk{cn: cn, tablename: "dbo.orders"}
+	cache, key := b.metadataCache()
+	cache.put(key, metadata)
+	if err := b.loadMetadata(context.Background()); err != nil {
+		t.Fatal("loadMetadata failed:", err)
+	}
+	if !reflect.DeepEqual(b.metadata, metadata) {
+		t.Errorf("metadata %v", b.metadata)
+	}
+	cn.sess.database = "other"
+	if _, key = b.metadataCache(); key == "" {
+		t.Fatal("the table should be cached")
+	} else if _, ok := cache.get(key); ok {
+		t.Error("the tables of another database should not share metadata")
+	}
+	cn.sess.database = "sales"
+	_, key = b.metadataCache()
+	cache.remove(key)
+	if _, ok := cache.get(key); ok {
+		t.Error("removed metadata should not be returned")
+	}
+
+	if cache, _ := (&Bulk{cn: cn, tablename: "#orders"}).metadataCache(); cache != nil {
+		t.Error("temporary tables should not be cached")
+	}
+	connector.CacheBulkMetadata = false
+	if cache, _ := b.metadataCache(); cache != nil {
+		t.Error("metadata should not be cached unless asked")
+	}
+}
+
+func TestBulkColumnMappings(t *testing.T) {
+	b := &Bulk{
+		cn:          &Conn{sess: &tdsSession{}},
+		tablename:   "dbo.people",
+		columnsName: []string{"person_id", "full_name", "ignored"},
+		Options: BulkOptions{
+			Columns: []BulkColumn{
+				{Name: "id", Type: "int"},
+				{Name: "name", Type: "nvarchar", Length: 20},
+			},
+			ColumnMappings: []BulkColumnMapping{
+				{SourceName: "Full_Name", Destination: "name"},
+				{SourceOrdinal: 0, Destination: "id"},
+			},
+			KeepIdentity: true,
+			Tablock:      true,
+		},
+	}
+	if err := b.prepareBulkCommand(context.Background()); err != nil {
+		t.Fatal("prepareBulkCommand failed:", err)
+	}
+	if expected := "INSERT BULK dbo.people ([name] nvarchar(20), [id] int) WITH (TABLOCK,KEEP_IDENTITY)"; b.query != expected {
+		t.Errorf("query %q, expected %q", b.query, expected)
+	}
+	row, err := b.mappedRow([]interface{}{7, "Ann", "x"})
+	if err != nil {
+		t.Fatal("mappedRow failed:", err)
+	}
+	if expected := []interface{}{"Ann", 7}; !reflect.DeepEqual(row, expected) {
+		t.Errorf("mapped row %v, expected %v", row, expected)
+	}
+	if _, err = b.mappedRow([]interface{}{7, "Ann"}); err == nil {
+		t.Error("a row without all the bulk columns should fail")
+	}
+
+	for _, m := range []BulkColumnMapping{
+		{SourceName: "missing", Destination: "id"},
+		{SourceOrdinal: 3, Destination: "id"},
+		{SourceOrdinal: -1, Destination: "id"},
+	} {
+		b := &Bulk{columnsName: []string{"a", "b", "c"}, Options: BulkOptions{ColumnMappings: []BulkColumnMapping{m}}}
+		if _, err := b.mapColumns(); err == nil {
+			t.Errorf("mapping %+v should fail", m)
+		}
+	}
+
+	b = &Bulk{columnsName: []string{"a", "b"}}
+	if destinations, err := b.mapColumns(); err != nil || !reflect.DeepEqual(destinations, b.columnsName) || b.sourceIndexes != nil {
+		t.Errorf("mapColumns without mappings returned %v, %v", destinations, err)
+	}
+}
@@ -0,0 +1,340 @@
+package mssql
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+)
+
+// BulkExportFormat is the format rows are written in by BulkExport.
+type BulkExportFormat int
+
+const (
+	// BulkExportNative is the native format of bcp, as written by
+	// bcp queryout -n. Values are written in their binary form, with
+	// a length prefix for the types which have one.
+	BulkExportNative BulkExportFormat = iota
+	// BulkExportCharacter is the character format of bcp, as written by
+	// bcp queryout -c. Values are written as text followed by the field
+	// terminator, or the row terminator for the last one of a row. NULL
+	// is written as an empty field and empty text as a NUL character.
+	BulkExportCharacter
+	// BulkExportCSV is CSV as described by RFC 4180, values are written
+	// as text like in the character format and NULL as an empty field.
+	BulkExportCSV
+)
+
+// BulkExportOptions tells how BulkExport writes rows.
+type BulkExportOptions struct {
+	Format BulkExportFormat
+	// FieldTerminator separates the fields of the character and CSV
+	// formats, it is a tab for the character format and a comma for CSV
+	// when empty. The one of CSV must be a single character.
+	FieldTerminator string
+	// RowTerminator ends the rows of the character format, it is a new
+	// line when empty. Rows of CSV end with a carriage return and a new
+	// line.
+	RowTerminator string
+	// Header writes the names of the columns first, in CSV.
+	Header bool
+}
+
+// BulkExport runs query and writes the rows of its first result set to w
+// in the format of options, as they are read. args are the arguments of
+// the query, sql.NamedArg values are passed by name. It returns the
+// number of rows written.
+func (c *Conn) BulkExport(ctx context.Context, w io.Writer, query string, options BulkExportOptions, args ...interface{}) (rowcount int64, err error) {
+	stmt, err := c.prepareContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	params := make([]namedValue, len(args))
+	for i, arg := range args {
+		params[i] = namedValue{Ordinal: i + 1, Value: arg}
+		if named, ok := arg.(sql.NamedArg); ok {
+			params[i].Name, params[i].Value = named.Name, named.Value
+		}
+	}
+	res, err := stmt.queryContext(ctx, params)
+	if err != nil {
+		return 0, err
+	}
+	rows, ok := res.(*Rows)
+	if !ok {
+		res.Close()
+		return 0, fmt.Errorf("mssql: BulkExport cannot read the rows of a message queue")
+	}
+	defer rows.Close()
+
+	ew := &exportWriter{w: w}
+	out := bufio.NewWriter(ew)
+	var write func(values []driver.Value) error
+	switch options.Format {
+	case BulkExportNative:
+		write = func(values []driver.Value) error {
+			return writeNativeRow(out, rows.cols, values)
+		}
+	case BulkExportCharacter:
+		fieldTerm, rowTerm := options.FieldTerminator, options.RowTerminator
+		if fieldTerm == "" {
+			fieldTerm = "\t"
+		}
+		if rowTerm == "" {
+			rowTerm = "\n"
+		}
+		write = func(values []driver.Value) error {
+			writeCharacterRow(out, rows.cols, values, fieldTerm, rowTerm)
+			return nil
+		}
+	case BulkExportCSV:
+		cw := csv.NewWriter(out)
+		cw.UseCRLF = true
+		if options.FieldTerminator != "" {
+			comma, size := utf8.DecodeRuneInString(options.FieldTerminator)
+			if size != len(options.FieldTerminator) {
+				return 0, fmt.Errorf("mssql: the field terminator of CSV must be a single character, not %q", options.FieldTerminator)
+			}
+			cw.Comma = comma
+		}
+		if options.Header {
+			if err = cw.Write(rows.Columns()); err != nil {
+				return 0, err
+			}
+		}
+		record := make([]string, len(rows.cols))
+		write = func(values []driver.Value) error {
+			for i, v := range values {
+				record[i] = ""
+				if v != nil {
+					record[i] = exportText(exportTypeInfo(rows.cols[i]), v)
+				}
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+			// keep the writer of the CSV from holding rows
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return 0, fmt.Errorf("mssql: unknown bulk export format %d", options.Format)
+	}
+
+	values := make([]driver.Value, len(rows.cols))
+	for {
+		if err = rows.Next(values); err == io.EOF {
+			break
+		} else if err != nil {
+			return rowcount, err
+		}
+		if err = write(values); err != nil {
+			return rowcount, err
+		}
+		if ew.err != nil {
+			return rowcount, ew.err
+		}
+		rowcount++
+	}
+	return rowcount, out.Flush()
+}
+
+// exportWriter keeps the first error of its writer, so that the export
+// stops when the rows cannot be written.
+type exportWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.err = err
+	return n, err
+}
+
+// exportTypeInfo returns the type of the values of a column, the type of
+// the decrypted values for columns encrypted with Always Encrypted.
+func exportTypeInfo(col columnStruct) typeInfo {
+	if col.cryptoMeta != nil {
+		return col.cryptoMeta.typeInfo
+	}
+	return col.ti
+}
+
+// writeCharacterRow writes a row in the character format of bcp.
+func writeCharacterRow(w *bufio.Writer, cols []columnStruct, values []driver.Value, fieldTerm, rowTerm string) {
+	for i, v := range values {
+		switch {
+		case v == nil:
+		case v == "":
+			// empty text is told from NULL by a NUL character
+			w.WriteByte(0)
+		default:
+			w.WriteString(exportText(exportTypeInfo(cols[i]), v))
+		}
+		if i == len(values)-1 {
+			w.WriteString(rowTerm)
+		} else {
+			w.WriteString(fieldTerm)
+		}
+	}
+}
+
+// exportText returns the text of a value of a column, the way SQL Server
+// converts it to varchar.
+func exportText(ti typeInfo, v driver.Value) string {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		if ti.TypeId == typeFltN && ti.Size == 4 {
+			return strconv.FormatFloat(v, 'g', -1, 32)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	case []byte:
+		switch ti.TypeId {
+		case typeDecimal, typeDecimalN, typeNumeric, typeNumericN, typeMoney, typeMoney4, typeMoneyN:
+			return string(v)
+		case typeGuid:
+			var u UniqueIdentifier
+			if err := u.Scan(v); err == nil {
+				return u.String()
+			}
+		}
+		return strings.ToUpper(hex.EncodeToString(v))
+	case time.Time:
+		return v.Format(exportTimeLayout(ti))
+	}
+	return fmt.Sprint(v)
+}
+
+// exportTimeLayout returns the layout of the text of date and time values
+// of a type.
+func exportTimeLayout(ti typeInfo) string {
+	fraction := ""
+	if ti.Scale > 0 {
+		fraction = "." + strings.Repeat("0", int(ti.Scale))
+	}
+	switch ti.TypeId {
+	case typeDateN:
+		return "2006-01-02"
+	case typeTimeN:
+		return "15:04:05" + fraction
+	case typeDateTime2N:
+		return "2006-01-02 15:04:05" + fraction
+	case typeDateTimeOffsetN:
+		return "2006-01-02 15:04:05" + fraction + " -07:00"
+	case typeDateTim4:
+		return "2006-01-02 15:04:05"
+	case typeDateTime:
+		return "2006-01-02 15:04:05.000"
+	case typeDateTimeN:
+		if ti.Size == 4 {
+			return "2006-01-02 15:04:05"
+		}
+		return "2006-01-02 15:04:05.000"
+	}
+	return "2006-01-02 15:04:05.9999999Z07:00"
+}
+
+// writeNativeRow writes a row in the native format of bcp.
+func writeNativeRow(w *bufio.Writer, cols []columnStruct, values []driver.Value) error {
+	for i, v := range values {
+		col := cols[i]
+		col.ti = exportTypeInfo(col)
+		prefix := nativePrefixSize(col.ti)
+		if v == nil {
+			if prefix == 0 {
+				return fmt.Errorf("mssql: column %s of type %s cannot be NULL", col.ColName, makeDecl(col.ti))
+			}
+			// NULL is a length of -1
+			for j := 0; j < prefix; j++ {
+				w.WriteByte(0xff)
+			}
+			continue
+		}
+		data, err := nativeValue(col, v)
+		if err != nil {
+			return err
+		}
+		var length [8]byte
+		binary.LittleEndian.PutUint64(length[:], uint64(len(data)))
+		w.Write(length[:prefix])
+		w.Write(data)
+	}
+	return nil
+}
+
+// nativePrefixSize returns the size of the length prefix of the values
+// of a type in the native format.
+func nativePrefixSize(ti typeInfo) int {
+	switch ti.TypeId {
+	case typeInt1, typeInt2, typeInt4, typeInt8, typeBit, typeFlt4, typeFlt8,
+		typeMoney, typeMoney4, typeDateTime, typeDateTim4:
+		return 0
+	case typeBigVarChar, typeBigChar, typeNVarChar, typeNChar, typeBigVarBin, typeBigBinary, typeUdt:
+		if ti.Size == 0xffff {
+			return 8
+		}
+		return 2
+	case typeXml:
+		return 8
+	case typeText, typeNText, typeImage:
+		return 4
+	}
+	return 1
+}
+
+// nativeValue returns the native form of a value of a column, which is
+// the form it is sent in by TDS except for decimal, char and time values.
+func nativeValue(col columnStruct, v driver.Value) ([]byte, error) {
+	switch col.ti.TypeId {
+	case typeVariant:
+		return nil, fmt.Errorf("mssql: sql_variant column %s cannot be exported in native format", col.ColName)
+	case typeBigVarChar, typeBigChar, typeText:
+		if s, ok := v.(string); ok {
+			return cp.UTF8ToCharset(col.ti.Collation, s), nil
+		}
+	case typeTimeN, typeDateTime2N, typeDateTimeOffsetN:
+		// like bcp, time values are written at scale 7 whatever the
+		// scale of the column, so they always have the same length
+		col.ti.Scale = 7
+	}
+	p, err := (&Bulk{}).makeParam(v, col)
+	if err != nil {
+		return nil, err
+	}
+	switch col.ti.TypeId {
+	case typeDecimal, typeDecimalN, typeNumeric, typeNumericN:
+		// precision, scale, sign and the value on 16 bytes
+		data := make([]byte, 19)
+		data[0], data[1] = col.ti.Prec, col.ti.Scale
+		copy(data[2:], p.buffer)
+		return data, nil
+	}
+	return p.buffer, nil
+}
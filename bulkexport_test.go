@@ -0,0 +1,98 @@
+package mssql
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+)
+
+func exportColumns() []columnStruct {
+	latin1 := cp.Collation{LcidAndFlags: 0x00d00409, SortId: 52}
+	return []columnStruct{
+		{ColName: "id", ti: typeInfo{TypeId: typeInt4, Size: 4}},
+		{ColName: "n", ti: typeInfo{TypeId: typeIntN, Size: 2}},
+		{ColName: "name", ti: typeInfo{TypeId: typeBigVarChar, Size: 20, Collation: latin1}},
+		{ColName: "price", ti: typeInfo{TypeId: typeDecimalN, Size: 17, Prec: 10, Scale: 2}},
+		{ColName: "day", ti: typeInfo{TypeId: typeDateN, Size: 3}},
+		{ColName: "at", ti: typeInfo{TypeId: typeDateTime2N, Scale: 3, Size: 7}},
+		{ColName: "data", ti: typeInfo{TypeId: typeBigVarBin, Size: 0xffff}},
+	}
+}
+
+func TestWriteNativeRow(t *testing.T) {
+	values := []driver.Value{
+		int64(7), nil, "café", []byte("-12.34"),
+		time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 2, 3, 4, 5, 600000000, time.UTC),
+		[]byte{1, 2},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeNativeRow(w, exportColumns(), values); err != nil {
+		t.Fatal("writeNativeRow failed:", err)
+	}
+	w.Flush()
+
+	var expected bytes.Buffer
+	expected.Write([]byte{7, 0, 0, 0})                // int without a prefix
+	expected.WriteByte(0xff)                          // NULL smallint
+	expected.Write([]byte{4, 0, 'c', 'a', 'f', 0xe9}) // varchar in code page 1252
+	expected.Write([]byte{19, 10, 2, 0, 0xd2, 4})     // decimal -1234 at scale 2
+	expected.Write(make([]byte, 14))                  // rest of the decimal value
+	expected.Write(append([]byte{3}, encodeDate(values[4].(time.Time))...))
+	// datetime2(3) is exported at scale 7
+	expected.Write(append([]byte{8}, encodeDateTime2(values[5].(time.Time), 7)...))
+	expected.Write([]byte{2, 0, 0, 0, 0, 0, 0, 0, 1, 2}) // varbinary(max)
+	if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+		t.Errorf("native row\n% x\nexpected\n% x", buf.Bytes(), expected.Bytes())
+	}
+
+	values[0] = nil
+	if err := writeNativeRow(w, exportColumns(), values); err == nil {
+		t.Error("NULL in a column without a length prefix should fail")
+	}
+}
+
+func TestWriteCharacterRow(t *testing.T) {
+	values := []driver.Value{
+		int64(7), nil, "", []byte("-12.34"),
+		time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 2, 3, 4, 5, 600000000, time.UTC),
+		[]byte{0xab, 2},
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeCharacterRow(w, exportColumns(), values, "|", "\r\n")
+	w.Flush()
+	if expected := "7||\x00|-12.34|2020-01-02|2020-01-02 03:04:05.600|AB02\r\n"; buf.String() != expected {
+		t.Errorf("character row %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestExportText(t *testing.T) {
+	offset := time.FixedZone("", -90*60)
+	tests := []struct {
+		ti       typeInfo
+		value    driver.Value
+		expected string
+	}{
+		{typeInfo{TypeId: typeBitN}, true, "1"},
+		{typeInfo{TypeId: typeFltN, Size: 4}, float64(float32(0.1)), "0.1"},
+		{typeInfo{TypeId: typeFlt8}, 0.1, "0.1"},
+		{typeInfo{TypeId: typeMoneyN, Size: 8}, []byte("1.5000"), "1.5000"},
+		{typeInfo{TypeId: typeGuid}, []byte{0x6F, 0x96, 0x19, 0xFF, 0x8B, 0x86, 0xD0, 0x11, 0xB4, 0x2D, 0x00, 0xC0, 0x4F, 0xC9, 0x64, 0xFF},
+			"FF19966F-868B-11D0-B42D-00C04FC964FF"},
+		{typeInfo{TypeId: typeTimeN, Scale: 7}, time.Date(1, 1, 1, 13, 14, 15, 1200, time.UTC), "13:14:15.0000012"},
+		{typeInfo{TypeId: typeDateTimeN, Size: 4}, time.Date(2010, 11, 12, 13, 14, 0, 0, time.UTC), "2010-11-12 13:14:00"},
+		{typeInfo{TypeId: typeDateTimeOffsetN, Scale: 0}, time.Date(2010, 11, 12, 13, 14, 15, 0, offset), "2010-11-12 13:14:15 -01:30"},
+	}
+	for _, test := range tests {
+		if got := exportText(test.ti, test.value); got != test.expected {
+			t.Errorf("text of %v of type %#x is %q, expected %q", test.value, test.ti.TypeId, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package mssql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+)
+
+// The functions of this file encode and decode single values in the
+// native format of bcp. They exist for package bcp, which reads and
+// writes bcp data files, and share the encoding of bulk copy and bulk
+// export.
+
+// EncodeBulkNative returns a value of a column in the native format of
+// bcp, without its length prefix, or nil for NULL. The value is encoded
+// like by Bulk.AddRow, char values in the code page of Latin1_General.
+func EncodeBulkNative(column BulkColumn, v interface{}) ([]byte, error) {
+	metadata, err := declaredMetadata([]BulkColumn{column}, cp.Collation{})
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+	return nativeValue(metadata[0], v)
+}
+
+// DecodeBulkNative returns a value of a column read in the native format
+// of bcp, without its length prefix, as it is read from rows: integers
+// as int64, decimal and money values as []byte holding their text and
+// uniqueidentifier values as []byte in the order of TDS.
+func DecodeBulkNative(column BulkColumn, data []byte) (interface{}, error) {
+	metadata, err := declaredMetadata([]BulkColumn{column}, cp.Collation{})
+	if err != nil {
+		return nil, err
+	}
+	ti := metadata[0].ti
+	size := ti.Size
+	switch ti.TypeId {
+	case typeDecimalN, typeNumericN:
+		// precision, scale, sign and the value on 16 bytes
+		size = 19
+	case typeBigChar, typeBigVarChar, typeText, typeNChar, typeNVarChar, typeNText, typeXml,
+		typeBigBinary, typeBigVarBin, typeImage, typeVariant:
+		size = len(data)
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("mssql: invalid length %d of %s value of column %s", len(data), column.Type, column.Name)
+	}
+	switch ti.TypeId {
+	case typeIntN:
+		switch size {
+		case 1:
+			return int64(data[0]), nil
+		case 2:
+			return int64(int16(binary.LittleEndian.Uint16(data))), nil
+		case 4:
+			return int64(int32(binary.LittleEndian.Uint32(data))), nil
+		}
+		return int64(binary.LittleEndian.Uint64(data)), nil
+	case typeBitN:
+		return data[0] != 0, nil
+	case typeFltN:
+		if size == 4 {
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(data))), nil
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+	case typeMoneyN:
+		if size == 4 {
+			return decodeMoney4(data), nil
+		}
+		return decodeMoney(data), nil
+	case typeDecimalN, typeNumericN:
+		return decodeDecimal(data[0], data[1], data[2:]), nil
+	case typeDateTimeN:
+		if size == 4 {
+			return decodeDateTim4(data), nil
+		}
+		return decodeDateTime(data), nil
+	case typeDateN:
+		return decodeDate(data), nil
+	case typeTimeN:
+		return decodeTime(ti.Scale, data), nil
+	case typeDateTime2N:
+		return decodeDateTime2(ti.Scale, data), nil
+	case typeDateTimeOffsetN:
+		return decodeDateTimeOffset(ti.Scale, data), nil
+	case typeGuid:
+		return decodeGuid(data), nil
+	case typeBigChar, typeBigVarChar, typeText:
+		return cp.CharsetToUTF8(ti.Collation, data), nil
+	case typeNChar, typeNVarChar, typeNText, typeXml:
+		return ucs22str(data)
+	case typeBigBinary, typeBigVarBin, typeImage:
+		return append([]byte(nil), data...), nil
+	}
+	return nil, fmt.Errorf("mssql: %s column %s cannot be read in native format", column.Type, column.Name)
+}
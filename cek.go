@@ -1,5 +1,12 @@
 package mssql
 
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
 type cekTable struct {
 	entries []cekTableEntry
 }
@@ -26,4 +33,114 @@ type cekTableEntry struct {
 
 func newCekTable(size uint16) cekTable {
 	return cekTable{entries: make([]cekTableEntry, size)}
-}
\ No newline at end of file
+}
+
+// provider returns the key store provider of the column master keys
+// of a key store. Keys of key stores without a registered provider are
+// decrypted with the key store of the connection string, if it has one.
+func (s *aeSettings) provider(keyStoreName string) (ColumnEncryptionKeyStoreProvider, error) {
+	if p, ok := s.providers[keyStoreName]; ok {
+		return p, nil
+	}
+	if s.keyStore != nil {
+		return s.keyStore, nil
+	}
+	return nil, fmt.Errorf("no key store provider is registered for %s", keyStoreName)
+}
+
+// decryptCEK decrypts a column encryption key value with the provider
+// of its column master key. Decrypted keys are kept in the cache of the
+// connector for cacheTTL.
+func (s *aeSettings) decryptCEK(value encryptionKeyInfo) ([]byte, error) {
+	ttl := s.cacheTTL
+	if ttl == 0 {
+		ttl = defaultCEKCacheTTL
+	}
+	cacheKey := value.keyStoreName + "\x00" + value.keyPath + "\x00" + string(value.encryptedKey)
+	if ttl > 0 {
+		if key, ok := s.cache.get(cacheKey, time.Now()); ok {
+			return key, nil
+		}
+	}
+	p, err := s.provider(value.keyStoreName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.DecryptColumnEncryptionKey(value.keyPath, value.algorithmName, value.encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		s.cache.put(cacheKey, key, time.Now().Add(ttl))
+	}
+	return key, nil
+}
+
+// defaultCEKCacheTTL is how long decrypted column encryption keys are
+// kept when Connector.ColumnEncryptionKeyCacheTTL is not set.
+const defaultCEKCacheTTL = 2 * time.Hour
+
+// cekCache holds the column encryption keys decrypted by the connections
+// of a connector, so that the column master key is not used for each
+// value. The zero value is an empty cache, a nil cache holds nothing.
+type cekCache struct {
+	mu      sync.Mutex
+	entries map[string]cekCacheEntry
+}
+
+type cekCacheEntry struct {
+	key     []byte
+	expires time.Time
+}
+
+func (c *cekCache) get(cacheKey string, now time.Time) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey]
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+	return e.key, true
+}
+
+// put adds a key to the cache and drops the expired ones.
+func (c *cekCache) put(cacheKey string, key []byte, expires time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]cekCacheEntry)
+	}
+	c.entries[cacheKey] = cekCacheEntry{key: key, expires: expires}
+}
+
+// decryptCEKEntry decrypts a column encryption key, which is stored
+// once for each column master key it is encrypted with. The first value
+// which can be decrypted is used.
+func (s *tdsSession) decryptCEKEntry(entry *cekTableEntry) (encryptionKeyInfo, []byte, error) {
+	if s.alwaysEncryptedSettings == nil {
+		return encryptionKeyInfo{}, nil, errors.New("column encryption is not enabled")
+	}
+	var err error
+	for _, value := range entry.cekValues {
+		var rootKey []byte
+		if rootKey, err = s.alwaysEncryptedSettings.decryptCEK(value); err == nil {
+			return value, rootKey, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("the key has no encrypted value")
+	}
+	return encryptionKeyInfo{}, nil, err
+}
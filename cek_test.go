@@ -0,0 +1,131 @@
+package mssql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/swisscom/mssql-always-encrypted/pkg/encryption"
+)
+
+// countingKeyStoreProvider counts the keys it decrypts.
+type countingKeyStoreProvider struct {
+	ColumnEncryptionKeyStoreProvider
+	decrypted int
+}
+
+func (p *countingKeyStoreProvider) DecryptColumnEncryptionKey(masterKeyPath string, algorithm string, encryptedKey []byte) ([]byte, error) {
+	p.decrypted++
+	return p.ColumnEncryptionKeyStoreProvider.DecryptColumnEncryptionKey(masterKeyPath, algorithm, encryptedKey)
+}
+
+func TestCEKCache(t *testing.T) {
+	mem := NewMemoryKeyStoreProvider()
+	mem.AddKey("key", testRSAKey(t))
+	encrypted, err := mem.EncryptColumnEncryptionKey("key", cekAlgorithmRSAOAEP, testRootKey())
+	if err != nil {
+		t.Fatal("EncryptColumnEncryptionKey failed:", err)
+	}
+	value := encryptionKeyInfo{encryptedKey: encrypted, keyStoreName: "CUSTOM_HSM", keyPath: "key", algorithmName: cekAlgorithmRSAOAEP}
+
+	for _, test := range []struct {
+		ttl       time.Duration
+		decrypted int
+	}{
+		{0, 1},
+		{time.Minute, 1},
+		{-1, 3},
+	} {
+		p := &countingKeyStoreProvider{ColumnEncryptionKeyStoreProvider: mem}
+		c := &Connector{ColumnEncryptionKeyCacheTTL: test.ttl}
+		c.RegisterKeyStoreProvider("CUSTOM_HSM", p)
+		for i := 0; i < 3; i++ {
+			// each connection has its own settings, the cache is the connector's
+			settings := newAESettings(c, c.params)
+			if cek, err := settings.decryptCEK(value); err != nil || !bytes.Equal(cek, testRootKey()) {
+				t.Fatalf("decryptCEK returned % x, %v", cek, err)
+			}
+		}
+		if p.decrypted != test.decrypted {
+			t.Errorf("with a TTL of %v the key was decrypted %d times, expected %d", test.ttl, p.decrypted, test.decrypted)
+		}
+	}
+
+	var cache cekCache
+	now := time.Now()
+	cache.put("k", []byte{1}, now.Add(time.Minute))
+	if key, ok := cache.get("k", now); !ok || !bytes.Equal(key, []byte{1}) {
+		t.Errorf("get returned % x, %v", key, ok)
+	}
+	if _, ok := cache.get("k", now.Add(time.Minute)); ok {
+		t.Error("an expired key should not be returned")
+	}
+	var none *cekCache
+	none.put("k", []byte{1}, now.Add(time.Minute))
+	if _, ok := none.get("k", now); ok {
+		t.Error("a nil cache should hold nothing")
+	}
+}
+
+func TestDecryptColumnValue(t *testing.T) {
+	mem := NewMemoryKeyStoreProvider()
+	mem.AddKey("CurrentUser/My/ae", testRSAKey(t))
+	encryptedKey, err := mem.EncryptColumnEncryptionKey("CurrentUser/My/ae", cekAlgorithmRSAOAEP, testRootKey())
+	if err != nil {
+		t.Fatal("EncryptColumnEncryptionKey failed:", err)
+	}
+	entry := &cekTableEntry{cekValues: []encryptionKeyInfo{
+		{encryptedKey: encryptedKey, keyStoreName: "CUSTOM_HSM", keyPath: "CurrentUser/My/ae", algorithmName: cekAlgorithmRSAOAEP},
+	}}
+	plaintext := make([]byte, 4)
+	binary.LittleEndian.PutUint32(plaintext, 42)
+	ciphertext, err := encryptAead(testRootKey(), encryption.Deterministic.Value, plaintext)
+	if err != nil {
+		t.Fatal("encryptAead failed:", err)
+	}
+	column := columnStruct{
+		ColName: "ssn",
+		cryptoMeta: &cryptoMetadata{
+			entry:    entry,
+			encType:  encryption.Deterministic.Value,
+			typeInfo: readTypeInfo(nil, typeInt4, nil),
+		},
+	}
+
+	c := &Connector{}
+	sess := &tdsSession{alwaysEncrypted: true, alwaysEncryptedSettings: newAESettings(c, c.params)}
+	v := decryptColumnValue(column, sess, ciphertext)
+	decErr, ok := v.(ErrColumnDecryption)
+	if !ok {
+		t.Fatalf("decrypting without a provider returned %v", v)
+	}
+	if decErr.Column != "ssn" || decErr.KeyPath != "CurrentUser/My/ae" || decErr.Err == nil {
+		t.Errorf("unexpected error %#v", decErr)
+	}
+	row := []interface{}{int64(1), v}
+	if _, ok := rowDecryptionError(row).(ErrColumnDecryption); !ok {
+		t.Error("rowDecryptionError should return the error of the column")
+	}
+
+	c.ReturnCiphertextOnDecryptionError = true
+	sess.alwaysEncryptedSettings = newAESettings(c, c.params)
+	if v = decryptColumnValue(column, sess, ciphertext); !bytes.Equal(v.([]byte), ciphertext) {
+		t.Errorf("expected the ciphertext, got %v", v)
+	}
+
+	c.RegisterKeyStoreProvider("CUSTOM_HSM", mem)
+	sess.alwaysEncryptedSettings = newAESettings(c, c.params)
+	if v = decryptColumnValue(column, sess, ciphertext); v != int64(42) {
+		t.Errorf("decrypted %v", v)
+	}
+	if err := rowDecryptionError([]interface{}{v}); err != nil {
+		t.Errorf("rowDecryptionError returned %v", err)
+	}
+
+	c.ReturnCiphertextOnDecryptionError = false
+	sess.alwaysEncryptedSettings = newAESettings(c, c.params)
+	if v = decryptColumnValue(column, sess, ciphertext[:len(ciphertext)-1]); rowDecryptionError([]interface{}{v}) == nil {
+		t.Errorf("decrypting a damaged value returned %v", v)
+	}
+}
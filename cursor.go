@@ -0,0 +1,356 @@
+package mssql
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
+)
+
+// Server cursors, opened and used through the sp_cursor system procedures.
+// https://docs.microsoft.com/en-us/sql/relational-databases/system-stored-procedures/cursors-and-system-stored-procedures
+
+// CursorType is the kind of a server cursor.
+type CursorType int
+
+const (
+	CursorKeyset      CursorType = 0x1
+	CursorDynamic     CursorType = 0x2
+	CursorForwardOnly CursorType = 0x4
+	CursorStatic      CursorType = 0x8
+)
+
+// scrollopt flags of sp_cursoropen besides the cursor type
+const (
+	cursorParameterizedStmt = 0x1000
+	cursorTypeMask          = 0xff
+)
+
+// CursorConcurrency is the concurrency control of a server cursor.
+type CursorConcurrency int
+
+const (
+	CursorReadOnly    CursorConcurrency = 0x1
+	CursorScrollLocks CursorConcurrency = 0x2
+	CursorOptimistic  CursorConcurrency = 0x4
+)
+
+// FetchType selects the rows returned by Cursor.Fetch.
+type FetchType int
+
+const (
+	FetchFirst    FetchType = 0x1
+	FetchNext     FetchType = 0x2
+	FetchPrev     FetchType = 0x4
+	FetchLast     FetchType = 0x8
+	FetchAbsolute FetchType = 0x10
+	FetchRelative FetchType = 0x20
+)
+
+// sp_cursor optype values
+const (
+	cursorOpUpdate = 0x1
+	cursorOpDelete = 0x2
+)
+
+var errCursorClosed = errors.New("cursor is closed")
+
+// Cursor is a server cursor opened with Conn.OpenCursor.
+// Unlike Rows it does not keep the connection busy, rows are
+// transferred only when fetched.
+type Cursor struct {
+	c      *Conn
+	handle int32
+	// allCols are all columns of the rows, hidden ones included,
+	// cols only the visible ones.
+	allCols []columnStruct
+	cols    []columnStruct
+
+	// Type and Concurrency are the cursor type and concurrency the
+	// server used, it may pick others than requested when the query
+	// does not support them.
+	Type        CursorType
+	Concurrency CursorConcurrency
+
+	// RowCount is the number of rows of the cursor, -1 when not known
+	// or the cursor is populated asynchronously.
+	RowCount int64
+}
+
+// cursorResponse holds the parts of a response to a cursor procedure call.
+type cursorResponse struct {
+	cols []columnStruct
+	rows [][]interface{}
+	outs []interface{}
+}
+
+func makeIntParam(val int32) (res param) {
+	res.ti.TypeId = typeIntN
+	res.ti.Size = 4
+	res.buffer = make([]byte, 4)
+	binary.LittleEndian.PutUint32(res.buffer, uint32(val))
+	return
+}
+
+func makeOutIntParam(val int32) param {
+	res := makeIntParam(val)
+	res.Flags = fByRevValue
+	return res
+}
+
+// cursorRpc calls a cursor procedure and reads its complete response.
+func (c *Conn) cursorRpc(ctx context.Context, proc procId, params []param) (res cursorResponse, err error) {
+	if !c.connectionGood {
+		return res, driver.ErrBadConn
+	}
+	sess, err := c.acquireSession()
+	if err != nil {
+		c.connectionGood = false
+		return res, fmt.Errorf("failed to open MARS session: %v", err)
+	}
+	defer c.releaseSession(sess)
+
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{sess.tranid, 1}.pack()},
+	}
+	reset := c.resetSession
+	c.resetSession = false
+	if err = sendRpc(sess.buf, headers, proc, 0, params, reset); err != nil {
+		if sess.logFlags&logErrors != 0 {
+			sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send Rpc with %v", err))
+		}
+		c.connectionGood = false
+		return res, fmt.Errorf("failed to send RPC: %v", err)
+	}
+
+	reader := startReading(sess, ctx, outputs{})
+	var firstError error
+	for {
+		tok, err := reader.nextToken()
+		if err != nil {
+			return res, c.checkBadConn(ctx, err, false)
+		}
+		if tok == nil {
+			break
+		}
+		switch token := tok.(type) {
+		case []columnStruct:
+			res.cols = token
+		case []interface{}:
+			res.rows = append(res.rows, token)
+		case namedValue:
+			res.outs = append(res.outs, token.Value)
+		case doneStruct:
+			if token.isError() && firstError == nil {
+				firstError = token.getError()
+			}
+		case ReturnStatus:
+			sess.setReturnStatus(token)
+		}
+	}
+	return res, firstError
+}
+
+// OpenCursor opens a server cursor for query. Arguments are passed to
+// the query as parameters, the same way as for Stmt.QueryContext.
+// The cursor must be closed with Cursor.Close.
+//
+// OpenCursor is available through sql.Conn.Raw:
+//
+//	err = conn.Raw(func(driverConn interface{}) error {
+//		cur, err := driverConn.(*mssql.Conn).OpenCursor(ctx, "select * from t", mssql.CursorKeyset, mssql.CursorOptimistic)
+//		...
+//	})
+func (c *Conn) OpenCursor(ctx context.Context, query string, typ CursorType, concurrency CursorConcurrency, args ...driver.NamedValue) (*Cursor, error) {
+	s := &Stmt{c: c, query: query}
+	scrollopt := int32(typ)
+	var argParams []param
+	var decls []string
+	if len(args) > 0 {
+		list := make([]namedValue, len(args))
+		for i, nv := range args {
+			list[i] = namedValue(nv)
+		}
+		var err error
+		argParams, decls, err = s.makeRPCParams(list, false)
+		if err != nil {
+			return nil, err
+		}
+		// makeRPCParams reserves room for statement and declarations
+		argParams = argParams[2:]
+		scrollopt |= cursorParameterizedStmt
+	}
+
+	params := []param{
+		makeOutIntParam(0), // cursor handle
+		makeStrParam(query),
+		makeOutIntParam(scrollopt),
+		makeOutIntParam(int32(concurrency)),
+		makeOutIntParam(0), // row count
+	}
+	if len(args) > 0 {
+		params = append(params, makeStrParam(strings.Join(decls, ",")))
+		params = append(params, argParams...)
+	}
+
+	if c.sess.logFlags&logSQL != 0 {
+		c.sess.logger.Log(ctx, msdsn.LogSQL, query)
+	}
+	res, err := c.cursorRpc(ctx, sp_CursorOpen, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.outs) < 4 {
+		return nil, fmt.Errorf("sp_cursoropen returned %d output parameters, expected 4", len(res.outs))
+	}
+	var outs [4]int64
+	for i := range outs {
+		v, ok := res.outs[i].(int64)
+		if !ok {
+			return nil, fmt.Errorf("sp_cursoropen returned an invalid output parameter %v", res.outs[i])
+		}
+		outs[i] = v
+	}
+	cur := &Cursor{
+		c:           c,
+		handle:      int32(outs[0]),
+		allCols:     res.cols,
+		cols:        visibleColumns(res.cols),
+		Type:        CursorType(outs[1] & cursorTypeMask),
+		Concurrency: CursorConcurrency(outs[2] & cursorTypeMask),
+		RowCount:    outs[3],
+	}
+	return cur, nil
+}
+
+// visibleColumns drops columns the server only sends for its own use,
+// like the row status of keyset and dynamic cursors.
+func visibleColumns(cols []columnStruct) []columnStruct {
+	res := make([]columnStruct, 0, len(cols))
+	for _, col := range cols {
+		if col.Flags&colFlagHidden == 0 {
+			res = append(res, col)
+		}
+	}
+	return res
+}
+
+// Columns returns the names of the cursor columns.
+func (cur *Cursor) Columns() []string {
+	res := make([]string, len(cur.cols))
+	for i, col := range cur.cols {
+		res[i] = col.ColName
+	}
+	return res
+}
+
+// Fetch fetches up to nrows rows and makes them the current block of
+// the cursor. rownum is the row number for FetchAbsolute, counting
+// from 1, or the offset for FetchRelative, it is ignored otherwise.
+// An empty result means no rows are left in the requested direction.
+func (cur *Cursor) Fetch(ctx context.Context, how FetchType, rownum int, nrows int) ([][]driver.Value, error) {
+	if cur.c == nil {
+		return nil, errCursorClosed
+	}
+	params := []param{
+		makeIntParam(cur.handle),
+		makeIntParam(int32(how)),
+		makeIntParam(int32(rownum)),
+		makeIntParam(int32(nrows)),
+	}
+	res, err := cur.c.cursorRpc(ctx, sp_CursorFetch, params)
+	if err != nil {
+		return nil, err
+	}
+	return cur.fetchedRows(res)
+}
+
+// fetchedRows returns the visible values of the fetched rows. The server
+// sends no column metadata when it did not change since the last fetch,
+// the columns of the cursor are only updated when it does.
+func (cur *Cursor) fetchedRows(res cursorResponse) ([][]driver.Value, error) {
+	if res.cols != nil {
+		cur.allCols = res.cols
+		cur.cols = visibleColumns(res.cols)
+	}
+	rows := make([][]driver.Value, len(res.rows))
+	for i, row := range res.rows {
+		if err := rowDecryptionError(row); err != nil {
+			return nil, err
+		}
+		values := make([]driver.Value, 0, len(cur.cols))
+		for j, col := range cur.allCols {
+			if col.Flags&colFlagHidden == 0 && j < len(row) {
+				values = append(values, row[j])
+			}
+		}
+		rows[i] = values
+	}
+	return rows, nil
+}
+
+// Update changes the columns in values of a row in the block returned
+// by the last Fetch. row counts from 1 within the block, values maps
+// column names to their new values.
+func (cur *Cursor) Update(ctx context.Context, row int, values map[string]driver.Value) error {
+	if len(values) == 0 {
+		return errors.New("no values to update")
+	}
+	s := &Stmt{c: cur.c}
+	params, err := cur.positionedParams(cursorOpUpdate, row)
+	if err != nil {
+		return err
+	}
+	for name, v := range values {
+		p, err := s.makeParam(v)
+		if err != nil {
+			return err
+		}
+		p.Name = "@" + name
+		params = append(params, p)
+	}
+	_, err = cur.c.cursorRpc(ctx, sp_Cursor, params)
+	return err
+}
+
+// Delete deletes a row in the block returned by the last Fetch.
+// row counts from 1 within the block.
+func (cur *Cursor) Delete(ctx context.Context, row int) error {
+	params, err := cur.positionedParams(cursorOpDelete, row)
+	if err != nil {
+		return err
+	}
+	_, err = cur.c.cursorRpc(ctx, sp_Cursor, params)
+	return err
+}
+
+func (cur *Cursor) positionedParams(optype int32, row int) ([]param, error) {
+	if cur.c == nil {
+		return nil, errCursorClosed
+	}
+	if cur.Concurrency == CursorReadOnly {
+		return nil, errors.New("cursor is read only")
+	}
+	return []param{
+		makeIntParam(cur.handle),
+		makeIntParam(optype),
+		makeIntParam(int32(row)),
+		makeStrParam(""), // table, only needed for cursors over joins
+	}, nil
+}
+
+// Close closes the cursor and frees its server resources.
+func (cur *Cursor) Close(ctx context.Context) error {
+	if cur.c == nil {
+		return nil
+	}
+	c := cur.c
+	cur.c = nil
+	_, err := c.cursorRpc(ctx, sp_CursorClose, []param{makeIntParam(cur.handle)})
+	return err
+}
@@ -0,0 +1,124 @@
+package mssql
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+)
+
+func TestVisibleColumns(t *testing.T) {
+	cols := []columnStruct{
+		{ColName: "a"},
+		{ColName: "ROWSTAT", Flags: colFlagHidden},
+		{ColName: "b", Flags: colFlagNullable},
+	}
+	res := visibleColumns(cols)
+	if len(res) != 2 || res[0].ColName != "a" || res[1].ColName != "b" {
+		t.Errorf("unexpected visible columns %+v", res)
+	}
+}
+
+func TestCursorFetchWithoutMetadata(t *testing.T) {
+	cols := []columnStruct{
+		{ColName: "a"},
+		{ColName: "b"},
+		{ColName: "ROWSTAT", Flags: colFlagHidden},
+	}
+	cur := &Cursor{allCols: cols, cols: visibleColumns(cols)}
+	// fetches after the first one send no COLMETADATA
+	rows, err := cur.fetchedRows(cursorResponse{rows: [][]interface{}{{int64(1), "one", int64(1)}}})
+	if err != nil {
+		t.Fatal("fetchedRows failed:", err)
+	}
+	if !reflect.DeepEqual(rows, [][]driver.Value{{int64(1), "one"}}) {
+		t.Errorf("unexpected rows %v", rows)
+	}
+
+	rows, err = cur.fetchedRows(cursorResponse{cols: cols[:1], rows: [][]interface{}{{int64(2)}}})
+	if err != nil {
+		t.Fatal("fetchedRows failed:", err)
+	}
+	if !reflect.DeepEqual(rows, [][]driver.Value{{int64(2)}}) || len(cur.Columns()) != 1 {
+		t.Errorf("unexpected rows %v and columns %v", rows, cur.Columns())
+	}
+}
+
+func openCursorConn(t *testing.T) *Conn {
+	checkConnStr(t)
+	SetLogger(testLogger{t})
+	connector, err := NewConnector(makeConnStr(t).String())
+	if err != nil {
+		t.Fatal("NewConnector failed:", err)
+	}
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal("Open connection failed:", err)
+	}
+	return conn.(*Conn)
+}
+
+func cursorExec(t *testing.T, conn *Conn, query string) {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		t.Fatal("Prepare failed:", err)
+	}
+	defer stmt.Close()
+	if _, err = stmt.Exec(nil); err != nil {
+		t.Fatalf("%s failed: %v", query, err)
+	}
+}
+
+func TestCursorFetchAndUpdate(t *testing.T) {
+	conn := openCursorConn(t)
+	defer conn.Close()
+	ctx := context.Background()
+
+	cursorExec(t, conn, "create table #cursor_test (id int primary key, name nvarchar(20))")
+	cursorExec(t, conn, "insert into #cursor_test values (1, 'one'), (2, 'two'), (3, 'three'), (4, 'four')")
+
+	cur, err := conn.OpenCursor(ctx, "select id, name from #cursor_test where id >= @p1 order by id",
+		CursorKeyset, CursorOptimistic, driver.NamedValue{Ordinal: 1, Value: int64(2)})
+	if err != nil {
+		t.Fatal("OpenCursor failed:", err)
+	}
+	defer cur.Close(ctx)
+	if cur.Type != CursorKeyset || cur.Concurrency != CursorOptimistic {
+		t.Errorf("unexpected cursor type %d and concurrency %d", cur.Type, cur.Concurrency)
+	}
+	if cur.RowCount != 3 {
+		t.Errorf("cursor has %d rows, expected 3", cur.RowCount)
+	}
+
+	rows, err := cur.Fetch(ctx, FetchAbsolute, 2, 1)
+	if err != nil {
+		t.Fatal("Fetch failed:", err)
+	}
+	if cols := cur.Columns(); len(cols) != 2 || cols[0] != "id" || cols[1] != "name" {
+		t.Errorf("unexpected columns %v", cols)
+	}
+	if len(rows) != 1 || rows[0][0] != int64(3) || rows[0][1] != "three" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+	if err = cur.Update(ctx, 1, map[string]driver.Value{"name": "drei"}); err != nil {
+		t.Fatal("Update failed:", err)
+	}
+
+	rows, err = cur.Fetch(ctx, FetchRelative, -1, 2)
+	if err != nil {
+		t.Fatal("Fetch failed:", err)
+	}
+	if len(rows) != 2 || rows[0][0] != int64(2) || rows[1][1] != "drei" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+	if err = cur.Delete(ctx, 1); err != nil {
+		t.Fatal("Delete failed:", err)
+	}
+
+	if err = cur.Close(ctx); err != nil {
+		t.Fatal("Close failed:", err)
+	}
+	if _, err = cur.Fetch(ctx, FetchNext, 0, 1); err != errCursorClosed {
+		t.Errorf("Fetch on a closed cursor returned %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package mssql
+
+// Data classification, the sensitivity labels assigned with
+// ADD SENSITIVITY CLASSIFICATION, is returned with result sets
+// when the client requests the DATACLASSIFICATION feature at login.
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-tds/fe2ad22d-4d5a-4ebe-8fe0-a4d9f7d0e1b0
+
+// dataClassificationVersion is the highest version of the
+// DATACLASSIFICATION token the driver understands.
+// Version 2 adds sensitivity ranks.
+const dataClassificationVersion = 2
+
+// SensitivityRank is the rank of a sensitivity classification.
+type SensitivityRank int
+
+const (
+	SensitivityRankNotDefined SensitivityRank = -1
+	SensitivityRankNone       SensitivityRank = 0
+	SensitivityRankLow        SensitivityRank = 10
+	SensitivityRankMedium     SensitivityRank = 20
+	SensitivityRankHigh       SensitivityRank = 30
+	SensitivityRankCritical   SensitivityRank = 40
+)
+
+// SensitivityLabel is a label such as "Confidential" assigned to columns.
+type SensitivityLabel struct {
+	Name string
+	ID   string
+}
+
+// InformationType is the kind of data stored in a column, such as "Financial".
+type InformationType struct {
+	Name string
+	ID   string
+}
+
+// SensitivityProperty is a single classification of a column.
+// Label and InformationType are nil when not set.
+type SensitivityProperty struct {
+	Label           *SensitivityLabel
+	InformationType *InformationType
+	Rank            SensitivityRank
+}
+
+// ColumnSensitivity holds the classifications of a result set column.
+type ColumnSensitivity struct {
+	Properties []SensitivityProperty
+}
+
+// DataClassification describes the sensitivity classification of a result set.
+// Columns has one entry for each column of the result set.
+// Ranks are SensitivityRankNotDefined when the server does not send them.
+type DataClassification struct {
+	Labels           []SensitivityLabel
+	InformationTypes []InformationType
+	Rank             SensitivityRank
+	Columns          []ColumnSensitivity
+}
+
+type featureExtDataClassification struct {
+}
+
+func (f *featureExtDataClassification) featureID() byte {
+	return featExtDATACLASSIFICATION
+}
+
+func (f *featureExtDataClassification) toBytes() []byte {
+	return []byte{dataClassificationVersion}
+}
+
+type dataClassificationAckStruct struct {
+	Version int
+	Enabled bool
+}
+
+// DATACLASSIFICATION stream, follows COLMETADATA
+func parseDataClassification(r *tdsBuffer, version int) *DataClassification {
+	dc := &DataClassification{Rank: SensitivityRankNotDefined}
+	dc.Labels = make([]SensitivityLabel, r.uint16())
+	for i := range dc.Labels {
+		dc.Labels[i].Name = r.UsVarChar()
+		dc.Labels[i].ID = r.UsVarChar()
+	}
+	dc.InformationTypes = make([]InformationType, r.uint16())
+	for i := range dc.InformationTypes {
+		dc.InformationTypes[i].Name = r.UsVarChar()
+		dc.InformationTypes[i].ID = r.UsVarChar()
+	}
+	if version >= 2 {
+		dc.Rank = SensitivityRank(r.int32())
+	}
+	dc.Columns = make([]ColumnSensitivity, r.uint16())
+	for i := range dc.Columns {
+		props := make([]SensitivityProperty, r.uint16())
+		for j := range props {
+			labelIndex := r.uint16()
+			typeIndex := r.uint16()
+			props[j].Rank = SensitivityRankNotDefined
+			if version >= 2 {
+				props[j].Rank = SensitivityRank(r.int32())
+			}
+			if labelIndex != 0xffff {
+				if int(labelIndex) >= len(dc.Labels) {
+					badStreamPanicf("invalid sensitivity label index %d", labelIndex)
+				}
+				props[j].Label = &dc.Labels[labelIndex]
+			}
+			if typeIndex != 0xffff {
+				if int(typeIndex) >= len(dc.InformationTypes) {
+					badStreamPanicf("invalid information type index %d", typeIndex)
+				}
+				props[j].InformationType = &dc.InformationTypes[typeIndex]
+			}
+		}
+		dc.Columns[i].Properties = props
+	}
+	return dc
+}
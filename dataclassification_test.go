@@ -0,0 +1,91 @@
+package mssql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseDataClassification(t *testing.T) {
+	var b bytes.Buffer
+	writeString := func(s string) {
+		_ = binary.Write(&b, binary.LittleEndian, uint16(len(s)))
+		b.Write(str2ucs2(s))
+	}
+	writeUint16 := func(v uint16) {
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+	writeInt32 := func(v int32) {
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+
+	writeUint16(1) // labels
+	writeString("Confidential")
+	writeString("331F0B13-76B5-2F1B-A77B-DEF5A73C73C2")
+	writeUint16(2) // information types
+	writeString("Financial")
+	writeString("C44193E1-0E58-4B2A-9001-F7D6E7BC1373")
+	writeString("Contact Info")
+	writeString("5C503E21-22C6-81FA-620B-F369B8EC38D1")
+	writeInt32(30) // result set rank
+	writeUint16(2) // columns
+	writeUint16(0) // first column is not classified
+	writeUint16(1) // second column
+	writeUint16(0)
+	writeUint16(1)
+	writeInt32(20)
+
+	data := b.Bytes()
+	r := &tdsBuffer{
+		packetSize: len(data),
+		rbuf:       data,
+		rpos:       0,
+		rsize:      len(data),
+		final:      true,
+	}
+	dc := parseDataClassification(r, 2)
+	if r.rpos != len(data) {
+		t.Errorf("parsed %d bytes of %d", r.rpos, len(data))
+	}
+	if dc.Rank != SensitivityRankHigh {
+		t.Errorf("result set rank is %d, expected %d", dc.Rank, SensitivityRankHigh)
+	}
+	if len(dc.Columns) != 2 || len(dc.Columns[0].Properties) != 0 || len(dc.Columns[1].Properties) != 1 {
+		t.Fatalf("unexpected columns %+v", dc.Columns)
+	}
+	p := dc.Columns[1].Properties[0]
+	if p.Label == nil || p.Label.Name != "Confidential" {
+		t.Errorf("unexpected label %+v", p.Label)
+	}
+	if p.InformationType == nil || p.InformationType.Name != "Contact Info" {
+		t.Errorf("unexpected information type %+v", p.InformationType)
+	}
+	if p.Rank != SensitivityRankMedium {
+		t.Errorf("column rank is %d, expected %d", p.Rank, SensitivityRankMedium)
+	}
+}
+
+func TestParseDataClassificationVersion1(t *testing.T) {
+	data := []byte{
+		0, 0, // labels
+		0, 0, // information types
+		1, 0, // columns
+		1, 0, // properties
+		0xff, 0xff, 0xff, 0xff, // no label, no information type
+	}
+	r := &tdsBuffer{
+		packetSize: len(data),
+		rbuf:       data,
+		rpos:       0,
+		rsize:      len(data),
+		final:      true,
+	}
+	dc := parseDataClassification(r, 1)
+	if dc.Rank != SensitivityRankNotDefined {
+		t.Errorf("version 1 has no rank, got %d", dc.Rank)
+	}
+	p := dc.Columns[0].Properties[0]
+	if p.Label != nil || p.InformationType != nil || p.Rank != SensitivityRankNotDefined {
+		t.Errorf("unexpected property %+v", p)
+	}
+}
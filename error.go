@@ -1,6 +1,7 @@
 package mssql
 
 import (
+	"database/sql/driver"
 	"fmt"
 )
 
@@ -23,6 +24,12 @@ func (e Error) Error() string {
 	return "mssql: " + e.Message
 }
 
+// String returns the message text, informational messages are passed
+// on as sqlexp.MsgNotice with an Error as their Message.
+func (e Error) String() string {
+	return e.Message
+}
+
 // SQLErrorNumber returns the SQL Server error number.
 func (e Error) SQLErrorNumber() int32 {
 	return e.Number
@@ -52,16 +59,83 @@ func (e Error) SQLErrorLineNo() int32 {
 	return e.LineNo
 }
 
+// StreamError is returned when the response of the server could not be
+// read, the connection can not be used anymore.
 type StreamError struct {
-	Message string
+	InnerError error
 }
 
 func (e StreamError) Error() string {
-	return e.Message
+	return "Invalid TDS stream: " + e.InnerError.Error()
+}
+
+func (e StreamError) Unwrap() error {
+	return e.InnerError
 }
 
 func streamErrorf(format string, v ...interface{}) StreamError {
-	return StreamError{"Invalid TDS stream: " + fmt.Sprintf(format, v...)}
+	return StreamError{InnerError: fmt.Errorf(format, v...)}
+}
+
+// ServerError is returned when the server got a fatal error that aborted
+// the request and severed the connection. The last error the server sent
+// before is returned by Unwrap.
+type ServerError struct {
+	sqlError Error
+}
+
+func (e ServerError) Error() string {
+	return "SQL Server had internal error"
+}
+
+func (e ServerError) Unwrap() error {
+	return e.sqlError
+}
+
+// RetryableError is returned when a request failed on a bad connection
+// before the server could have run it, so that database/sql retries it on
+// another connection. When all the retries fail, the error of the last
+// one is returned by Unwrap. Retries are disabled by the disableretry
+// connection parameter.
+type RetryableError struct {
+	err error
+}
+
+func (r RetryableError) Error() string {
+	return r.err.Error()
+}
+
+func (r RetryableError) Unwrap() error {
+	return r.err
+}
+
+// Is reports the error as driver.ErrBadConn, which makes database/sql
+// retry the request.
+func (r RetryableError) Is(err error) bool {
+	return err == driver.ErrBadConn
+}
+
+// ErrColumnDecryption is returned when a value of a column encrypted with
+// Always Encrypted cannot be decrypted, like when the column master key
+// is not found or is the wrong one. The rows before can be read, and the
+// connection can still be used. Set
+// Connector.ReturnCiphertextOnDecryptionError to get the encrypted value
+// of such columns in place of the error.
+type ErrColumnDecryption struct {
+	// Column is the name of the column.
+	Column string
+	// KeyPath is the path of the column master key the column encryption
+	// key is encrypted with.
+	KeyPath string
+	Err     error
+}
+
+func (e ErrColumnDecryption) Error() string {
+	return fmt.Sprintf("mssql: decrypting column %s with column master key %s failed: %v", e.Column, e.KeyPath, e.Err)
+}
+
+func (e ErrColumnDecryption) Unwrap() error {
+	return e.Err
 }
 
 func badStreamPanic(err error) {
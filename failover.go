@@ -0,0 +1,210 @@
+package mssql
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
+)
+
+// Database mirroring failover.
+// https://docs.microsoft.com/en-us/sql/database-engine/database-mirroring/connect-clients-to-a-database-mirroring-session-sql-server
+
+const (
+	// failoverTimeoutStep is the share of the login timeout added to
+	// the time each round of attempts on principal and partner is given.
+	failoverTimeoutStep = 0.08
+
+	// defaultFailoverTimeout bounds failover when dial timeout is 0.
+	defaultFailoverTimeout = 15 * time.Second
+)
+
+// mirrorServer is a server taking part in a database mirroring session.
+type mirrorServer struct {
+	host     string
+	instance string
+	port     uint64
+}
+
+// parseMirrorServer parses a server name of the form host, host\instance
+// or host,port as sent by the server in the mirroring partner ENVCHANGE.
+func parseMirrorServer(name string) mirrorServer {
+	var s mirrorServer
+	if i := strings.LastIndex(name, ","); i >= 0 {
+		if port, err := strconv.ParseUint(strings.TrimSpace(name[i+1:]), 10, 16); err == nil {
+			s.port = port
+			name = name[:i]
+		}
+	}
+	parts := strings.SplitN(name, `\`, 2)
+	s.host = parts[0]
+	if len(parts) > 1 {
+		s.instance = parts[1]
+	}
+	return s
+}
+
+func (s mirrorServer) String() string {
+	name := s.host
+	if s.instance != "" {
+		name += `\` + s.instance
+	}
+	if s.port != 0 {
+		name += "," + strconv.FormatUint(s.port, 10)
+	}
+	return name
+}
+
+// apply makes p connect to s.
+func (s mirrorServer) apply(p *msdsn.Config) {
+	if p.ServerSPN == generateSpn(p.Host, resolveServerPort(p.Port)) {
+		p.ServerSPN = generateSpn(s.host, resolveServerPort(s.port))
+	}
+	setHost(p, s.host)
+	p.Instance = s.instance
+	p.Port = s.port
+}
+
+// mirrorState remembers the servers of a mirroring session between
+// connections, so that new connections go to the server which accepted
+// the last one and use the partner the server announced.
+type mirrorState struct {
+	mu          sync.Mutex
+	initialized bool
+	principal   mirrorServer
+	partner     mirrorServer
+}
+
+// servers returns the server to try first and its partner.
+// The partner is empty when there is none.
+func (m *mirrorState) servers(p msdsn.Config) (principal, partner mirrorServer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.initialized {
+		m.principal = mirrorServer{host: p.Host, instance: p.Instance, port: p.Port}
+		if p.FailOverPartner != "" {
+			m.partner = parseMirrorServer(p.FailOverPartner)
+			if m.partner.port == 0 {
+				m.partner.port = p.FailOverPort
+			}
+		}
+		m.initialized = true
+	}
+	return m.principal, m.partner
+}
+
+// connected records that s accepted a connection and announced partner.
+func (m *mirrorState) connected(s mirrorServer, partner string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s != m.principal {
+		// The servers switched roles.
+		m.principal, m.partner = s, m.principal
+	}
+	if partner == "" {
+		return
+	}
+	announced := parseMirrorServer(partner)
+	if announced.port == 0 && announced.instance == "" && strings.EqualFold(announced.host, m.partner.host) {
+		// Keep the port of a configured partner.
+		return
+	}
+	m.partner = announced
+}
+
+// MirroringServers returns the database mirroring principal the last
+// connection was made to and its failover partner. The partner is the one
+// announced by the server, or the failoverpartner connection parameter
+// until the server announced one. partner is empty when there is none.
+func (c *Connector) MirroringServers() (principal, partner string) {
+	pr, pa := c.mirror.servers(c.params)
+	if pa.host != "" {
+		partner = pa.String()
+	}
+	return pr.String(), partner
+}
+
+// connectMirror opens a session on the database mirroring principal, or
+// on its failover partner when the principal does not accept it, and
+// returns the parameters of the server it connected to. When recovery
+// holds the state of a dropped session, the state is restored.
+func connectMirror(ctx context.Context, c *Connector, logger optionalLogger, params msdsn.Config, recovery *sessionRecovery) (*tdsSession, msdsn.Config, error) {
+	mirror := &mirrorState{}
+	if c != nil {
+		mirror = &c.mirror
+	}
+	principal, partner := mirror.servers(params)
+	var sess *tdsSession
+	var err error
+	if partner.host == "" {
+		principal.apply(&params)
+		sess, err = connectSession(ctx, c, logger, params, recovery.clone())
+	} else {
+		// try the server which accepted the last connection first,
+		// then alternate with its fail-over partner
+		sess, principal, err = connectWithFailover(ctx, c, logger, params, [2]mirrorServer{principal, partner}, recovery)
+		principal.apply(&params)
+	}
+	if err != nil {
+		return nil, params, err
+	}
+	mirror.connected(principal, sess.partner)
+	return sess, params, nil
+}
+
+// connectWithFailover alternates between principal and partner until one
+// of them accepts the connection or the login timeout expires. Each round
+// of attempts is given a larger slice of the timeout, so that an
+// unresponsive server does not use all of it.
+func connectWithFailover(ctx context.Context, c *Connector, logger optionalLogger, params msdsn.Config, servers [2]mirrorServer, recovery *sessionRecovery) (*tdsSession, mirrorServer, error) {
+	total := params.DialTimeout
+	if total <= 0 {
+		total = defaultFailoverTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, total)
+	defer cancel()
+	step := time.Duration(float64(total) * failoverTimeoutStep)
+	sleep := 100 * time.Millisecond
+
+	var errs [2]error
+	for attempt := 0; ; attempt++ {
+		i := attempt % 2
+		p := params
+		servers[i].apply(&p)
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, step*time.Duration(attempt/2+1))
+		sess, err := connectSession(attemptCtx, c, logger, p, recovery.clone())
+		attemptCancel()
+		if err == nil {
+			return sess, servers[i], nil
+		}
+		errs[i] = err
+		if ctx.Err() != nil {
+			break
+		}
+		if params.LogFlags&msdsn.LogRetries != 0 {
+			logger.Log(ctx, msdsn.LogRetries, fmt.Sprintf("connecting to %v failed, trying %v: %v", servers[i], servers[1-i], err))
+		}
+		if i == 1 {
+			select {
+			case <-time.After(sleep):
+			case <-ctx.Done():
+			}
+			if sleep < 500*time.Millisecond {
+				sleep *= 2
+			} else {
+				sleep = time.Second
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if errs[1] == nil {
+		return nil, servers[0], errs[0]
+	}
+	return nil, servers[0], fmt.Errorf("unable to connect to %v or its failover partner %v: %v; %v", servers[0], servers[1], errs[0], errs[1])
+}
@@ -0,0 +1,88 @@
+package mssql
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
+)
+
+func TestParseMirrorServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected mirrorServer
+	}{
+		{"host", mirrorServer{host: "host"}},
+		{`host\inst`, mirrorServer{host: "host", instance: "inst"}},
+		{"host,1500", mirrorServer{host: "host", port: 1500}},
+		{`host\inst,1500`, mirrorServer{host: "host", instance: "inst", port: 1500}},
+	}
+	for _, tst := range tests {
+		s := parseMirrorServer(tst.name)
+		if s != tst.expected {
+			t.Errorf("parseMirrorServer(%q) = %+v, expected %+v", tst.name, s, tst.expected)
+		}
+		if s.String() != tst.name {
+			t.Errorf("%+v formatted as %q, expected %q", s, s.String(), tst.name)
+		}
+	}
+}
+
+func TestMirrorStateTracksPrincipalAndPartner(t *testing.T) {
+	c, err := NewConnector("server=primary;failoverpartner=mirror;failoverport=1500")
+	if err != nil {
+		t.Fatal("NewConnector failed:", err)
+	}
+	principal, partner := c.MirroringServers()
+	if principal != "primary" || partner != "mirror,1500" {
+		t.Fatalf("unexpected servers %q %q", principal, partner)
+	}
+
+	// The announced partner matches the configured one, its port is kept.
+	pr, pa := c.mirror.servers(c.params)
+	c.mirror.connected(pr, "MIRROR")
+	if principal, partner = c.MirroringServers(); principal != "primary" || partner != "mirror,1500" {
+		t.Errorf("unexpected servers after connecting to principal %q %q", principal, partner)
+	}
+
+	// Failover, the partner accepted the connection and announces the old principal.
+	c.mirror.connected(pa, `primary\inst`)
+	if principal, partner = c.MirroringServers(); principal != "mirror,1500" || partner != `primary\inst` {
+		t.Errorf("unexpected servers after failover %q %q", principal, partner)
+	}
+}
+
+func TestConnectWithFailoverAlternates(t *testing.T) {
+	p, _, err := msdsn.Parse("server=10.0.0.1;dial timeout=1")
+	if err != nil {
+		t.Fatal("msdsn.Parse failed:", err)
+	}
+	d := &addrDialer{
+		fail: map[string]bool{"10.0.0.1:1433": true, "10.0.0.2:1500": true},
+	}
+	c := &Connector{params: p, Dialer: d}
+	servers := [2]mirrorServer{{host: "10.0.0.1"}, {host: "10.0.0.2", port: 1500}}
+
+	start := time.Now()
+	_, _, err = connectWithFailover(context.Background(), c, driverInstanceNoProcess.logger, p, servers, nil)
+	if err == nil {
+		t.Fatal("connectWithFailover should fail when both servers fail")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("connectWithFailover took %v, longer than the login timeout", elapsed)
+	}
+	if !strings.Contains(err.Error(), "10.0.0.1") || !strings.Contains(err.Error(), "10.0.0.2") {
+		t.Errorf("error should mention both servers: %v", err)
+	}
+	if len(d.dialed) < 4 {
+		t.Fatalf("expected several rounds of attempts, dialed %v", d.dialed)
+	}
+	for i, addr := range d.dialed {
+		expected := []string{"10.0.0.1:1433", "10.0.0.2:1500"}[i%2]
+		if addr != expected {
+			t.Errorf("attempt %d dialed %s, expected %s", i, addr, expected)
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.11
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang-sql/civil v0.0.0-20190719163853-cb61b32ac6fe
+	github.com/golang-sql/sqlexp v0.1.0
 	github.com/stretchr/testify v1.7.0
 	github.com/swisscom/mssql-always-encrypted v0.1.3
 	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
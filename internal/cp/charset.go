@@ -1,11 +1,25 @@
 package cp
 
+import (
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/transform"
+)
+
 type charsetMap struct {
 	sb [256]rune    // single byte runes, -1 for a double byte character lead byte
 	db map[int]rune // double byte runes
+
+	encodeOnce sync.Once
+	codes      map[rune]int // codes of the runes, made by encoder
 }
 
 func collation2charset(col Collation) *charsetMap {
+	// code page 65001, data is already UTF-8
+	if col.IsUTF8() {
+		return nil
+	}
 	// http://msdn.microsoft.com/en-us/library/ms144250.aspx
 	// http://msdn.microsoft.com/en-us/library/ms144250(v=sql.105).aspx
 	switch col.SortId {
@@ -111,3 +125,91 @@ func CharsetToUTF8(col Collation, s []byte) string {
 	}
 	return string(buf)
 }
+
+// charsetDecoder decodes text in a code page to UTF-8 as a transformer,
+// for text which is not available at once.
+type charsetDecoder struct {
+	transform.NopResetter
+	cm *charsetMap
+}
+
+func (d charsetDecoder) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		n := 1
+		ch := d.cm.sb[src[nSrc]]
+		if ch == -1 {
+			if nSrc+1 == len(src) {
+				if !atEOF {
+					// the second byte is in the next part
+					return nDst, nSrc, transform.ErrShortSrc
+				}
+				ch = 0xfffd
+			} else {
+				var ok bool
+				ch, ok = d.cm.db[int(src[nSrc+1])+(int(src[nSrc])<<8)]
+				if !ok {
+					ch = 0xfffd
+				}
+				n = 2
+			}
+		}
+		if nDst+utf8.RuneLen(ch) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], ch)
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+// NewDecoder returns a transformer decoding text of collation col to UTF-8,
+// it gives the same result as CharsetToUTF8.
+func NewDecoder(col Collation) transform.Transformer {
+	cm := collation2charset(col)
+	if cm == nil {
+		return transform.Nop
+	}
+	return charsetDecoder{cm: cm}
+}
+
+// UTF8ToCharset encodes text in the code page of collation col. Characters
+// the code page does not have are replaced by ?, like SQL Server does.
+func UTF8ToCharset(col Collation, s string) []byte {
+	cm := collation2charset(col)
+	if cm == nil {
+		return []byte(s)
+	}
+	codes := cm.encoder()
+	buf := make([]byte, 0, len(s))
+	for _, ch := range s {
+		code, ok := codes[ch]
+		switch {
+		case !ok:
+			buf = append(buf, '?')
+		case code > 0xff:
+			buf = append(buf, byte(code>>8), byte(code))
+		default:
+			buf = append(buf, byte(code))
+		}
+	}
+	return buf
+}
+
+// encoder returns the codes of the runes of the code page, the lowest
+// one when a rune has several.
+func (cm *charsetMap) encoder() map[rune]int {
+	cm.encodeOnce.Do(func() {
+		cm.codes = make(map[rune]int, len(cm.sb)+len(cm.db))
+		for code, ch := range cm.sb {
+			if _, ok := cm.codes[ch]; !ok && ch != -1 && ch != 0xfffd {
+				cm.codes[ch] = code
+			}
+		}
+		for code, ch := range cm.db {
+			if prev, ok := cm.codes[ch]; !ok || code < prev {
+				cm.codes[ch] = code
+			}
+		}
+	})
+	return cm.codes
+}
@@ -18,3 +18,14 @@ func (c Collation) getFlags() uint32 {
 func (c Collation) getVersion() uint32 {
 	return (c.LcidAndFlags & 0xf0000000) >> 28
 }
+
+// collation flags, stored in bits 20-27 of LcidAndFlags
+const (
+	flagUTF8 = 0x40
+)
+
+// IsUTF8 reports whether the collation uses the UTF-8 code page 65001,
+// like collations with the _UTF8 suffix in SQL Server 2019 and later.
+func (c Collation) IsUTF8() bool {
+	return c.getFlags()&flagUTF8 != 0
+}
@@ -0,0 +1,270 @@
+package mssql
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	alwaysencrypted "github.com/swisscom/mssql-always-encrypted/pkg"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ColumnEncryptionKeyStoreProvider gives access to the column master keys
+// of a key store, which the column encryption keys of Always Encrypted
+// are encrypted with. The key store holding a column master key is
+// named by the KEY_STORE_PROVIDER_NAME of its definition, the key by
+// its KEY_PATH.
+//
+// Providers are registered with Connector.RegisterKeyStoreProvider and
+// must be safe for concurrent use.
+type ColumnEncryptionKeyStoreProvider interface {
+	// DecryptColumnEncryptionKey decrypts a column encryption key, as
+	// stored by the server, with the column master key at masterKeyPath.
+	// algorithm is the algorithm it was encrypted with, like RSA_OAEP.
+	DecryptColumnEncryptionKey(masterKeyPath string, algorithm string, encryptedKey []byte) ([]byte, error)
+	// EncryptColumnEncryptionKey encrypts a column encryption key with
+	// the column master key at masterKeyPath, the way the server
+	// stores it.
+	EncryptColumnEncryptionKey(masterKeyPath string, algorithm string, columnEncryptionKey []byte) ([]byte, error)
+}
+
+// cekAlgorithmRSAOAEP is the algorithm column encryption keys are
+// encrypted with by RSA column master keys.
+const cekAlgorithmRSAOAEP = "RSA_OAEP"
+
+// cekValueVersion is the version of the format of encrypted column
+// encryption keys.
+const cekValueVersion = 0x01
+
+// decryptCEKValue decrypts an encrypted column encryption key with the
+// RSA column master key at masterKeyPath, after checking that it was
+// signed with that key.
+func decryptCEKValue(key *rsa.PrivateKey, masterKeyPath, algorithm string, encryptedKey []byte) ([]byte, error) {
+	if !strings.EqualFold(algorithm, cekAlgorithmRSAOAEP) {
+		return nil, fmt.Errorf("key encryption algorithm %s is not supported", algorithm)
+	}
+	if len(encryptedKey) < 5 ||
+		len(encryptedKey) < 5+int(binary.LittleEndian.Uint16(encryptedKey[1:]))+int(binary.LittleEndian.Uint16(encryptedKey[3:])) {
+		return nil, errors.New("the encrypted column encryption key is too short")
+	}
+	cekv := alwaysencrypted.LoadCEKV(encryptedKey)
+	hash := sha256.Sum256(cekv.DataToSign)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], cekv.SignedHash); err != nil {
+		return nil, fmt.Errorf("the column encryption key was not signed with the column master key %s", masterKeyPath)
+	}
+	return rsa.DecryptOAEP(sha1.New(), rand.Reader, key, cekv.Ciphertext, nil)
+}
+
+// encryptCEKValue encrypts a column encryption key with the RSA column
+// master key at masterKeyPath and signs it.
+func encryptCEKValue(key *rsa.PrivateKey, masterKeyPath, algorithm string, cek []byte) ([]byte, error) {
+	if !strings.EqualFold(algorithm, cekAlgorithmRSAOAEP) {
+		return nil, fmt.Errorf("key encryption algorithm %s is not supported", algorithm)
+	}
+	ciphertext, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &key.PublicKey, cek, nil)
+	if err != nil {
+		return nil, err
+	}
+	keyPath := str2ucs2(strings.ToLower(masterKeyPath))
+	res := make([]byte, 5, 5+len(keyPath)+len(ciphertext)+key.Size())
+	res[0] = cekValueVersion
+	binary.LittleEndian.PutUint16(res[1:], uint16(len(keyPath)))
+	binary.LittleEndian.PutUint16(res[3:], uint16(len(ciphertext)))
+	res = append(res, keyPath...)
+	res = append(res, ciphertext...)
+	hash := sha256.Sum256(res)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return append(res, signature...), nil
+}
+
+// MemoryKeyStoreProvider holds RSA column master keys in memory, by key
+// path. It is meant for tests.
+type MemoryKeyStoreProvider struct {
+	mu   sync.RWMutex
+	keys map[string]*rsa.PrivateKey
+}
+
+// NewMemoryKeyStoreProvider returns a provider without keys, they are
+// added with AddKey.
+func NewMemoryKeyStoreProvider() *MemoryKeyStoreProvider {
+	return &MemoryKeyStoreProvider{keys: make(map[string]*rsa.PrivateKey)}
+}
+
+// AddKey sets the column master key at masterKeyPath. Key paths are not
+// case sensitive.
+func (p *MemoryKeyStoreProvider) AddKey(masterKeyPath string, key *rsa.PrivateKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[strings.ToLower(masterKeyPath)] = key
+}
+
+func (p *MemoryKeyStoreProvider) key(masterKeyPath string) (*rsa.PrivateKey, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	key, ok := p.keys[strings.ToLower(masterKeyPath)]
+	if !ok {
+		return nil, fmt.Errorf("column master key %s not found", masterKeyPath)
+	}
+	return key, nil
+}
+
+func (p *MemoryKeyStoreProvider) DecryptColumnEncryptionKey(masterKeyPath string, algorithm string, encryptedKey []byte) ([]byte, error) {
+	key, err := p.key(masterKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return decryptCEKValue(key, masterKeyPath, algorithm, encryptedKey)
+}
+
+func (p *MemoryKeyStoreProvider) EncryptColumnEncryptionKey(masterKeyPath string, algorithm string, columnEncryptionKey []byte) ([]byte, error) {
+	key, err := p.key(masterKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return encryptCEKValue(key, masterKeyPath, algorithm, columnEncryptionKey)
+}
+
+// PEMKeyStoreProvider reads RSA column master keys from PEM files, in
+// PKCS#8 ("PRIVATE KEY") or PKCS#1 ("RSA PRIVATE KEY") form. The key path
+// of a column master key is the name of its file, relative to the
+// directory of the provider, with / or \ as separator. Keys are read
+// once and cached by their key path without case.
+type PEMKeyStoreProvider struct {
+	dir  string
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+// NewPEMKeyStoreProvider returns a provider reading the keys in dir.
+func NewPEMKeyStoreProvider(dir string) *PEMKeyStoreProvider {
+	return &PEMKeyStoreProvider{dir: dir, keys: make(map[string]*rsa.PrivateKey)}
+}
+
+func (p *PEMKeyStoreProvider) key(masterKeyPath string) (*rsa.PrivateKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name := strings.ToLower(masterKeyPath)
+	if key, ok := p.keys[name]; ok {
+		return key, nil
+	}
+	// key paths cannot point out of the directory, with either separator
+	file := filepath.Join(p.dir, filepath.FromSlash(path.Clean("/"+strings.Replace(masterKeyPath, `\`, "/", -1))))
+	if rel, err := filepath.Rel(p.dir, file); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("column master key %s is not in the key directory", masterKeyPath)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseRSAPrivateKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading column master key %s failed: %v", masterKeyPath, err)
+	}
+	p.keys[name] = key
+	return key, nil
+}
+
+func (p *PEMKeyStoreProvider) DecryptColumnEncryptionKey(masterKeyPath string, algorithm string, encryptedKey []byte) ([]byte, error) {
+	key, err := p.key(masterKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return decryptCEKValue(key, masterKeyPath, algorithm, encryptedKey)
+}
+
+func (p *PEMKeyStoreProvider) EncryptColumnEncryptionKey(masterKeyPath string, algorithm string, columnEncryptionKey []byte) ([]byte, error) {
+	key, err := p.key(masterKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return encryptCEKValue(key, masterKeyPath, algorithm, columnEncryptionKey)
+}
+
+// parseRSAPrivateKeyPEM returns the RSA private key of the first PEM
+// block holding a private key.
+func parseRSAPrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("private key of type %T is not supported", key)
+			}
+			return rsaKey, nil
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		}
+	}
+}
+
+// pfxKeyStoreProvider uses the key of the PKCS#12 key store given by the
+// connection string for every column master key.
+type pfxKeyStoreProvider struct {
+	location string
+	secret   string
+
+	mu  sync.Mutex
+	key *rsa.PrivateKey
+}
+
+func (p *pfxKeyStoreProvider) loadKey() (*rsa.PrivateKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.key != nil {
+		return p.key, nil
+	}
+	pfxBytes, err := ioutil.ReadFile(p.location)
+	if err != nil {
+		return nil, err
+	}
+	pk, _, err := pkcs12.Decode(pfxBytes, p.secret)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pk.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T is not supported", pk)
+	}
+	p.key = key
+	return key, nil
+}
+
+func (p *pfxKeyStoreProvider) DecryptColumnEncryptionKey(masterKeyPath string, algorithm string, encryptedKey []byte) ([]byte, error) {
+	key, err := p.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	return decryptCEKValue(key, masterKeyPath, algorithm, encryptedKey)
+}
+
+func (p *pfxKeyStoreProvider) EncryptColumnEncryptionKey(masterKeyPath string, algorithm string, columnEncryptionKey []byte) ([]byte, error) {
+	key, err := p.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	return encryptCEKValue(key, masterKeyPath, algorithm, columnEncryptionKey)
+}
@@ -0,0 +1,151 @@
+package mssql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
+)
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("GenerateKey failed:", err)
+	}
+	return key
+}
+
+func TestMemoryKeyStoreProvider(t *testing.T) {
+	p := NewMemoryKeyStoreProvider()
+	p.AddKey("CurrentUser/My/Key1", testRSAKey(t))
+	p.AddKey("CurrentUser/My/Key2", testRSAKey(t))
+	cek := testRootKey()
+
+	encrypted, err := p.EncryptColumnEncryptionKey("CurrentUser/My/Key1", "RSA_OAEP", cek)
+	if err != nil {
+		t.Fatal("EncryptColumnEncryptionKey failed:", err)
+	}
+	decrypted, err := p.DecryptColumnEncryptionKey("currentuser/my/key1", "RSA_OAEP", encrypted)
+	if err != nil {
+		t.Fatal("DecryptColumnEncryptionKey failed:", err)
+	}
+	if !bytes.Equal(decrypted, cek) {
+		t.Errorf("decrypted % x", decrypted)
+	}
+
+	if _, err = p.DecryptColumnEncryptionKey("CurrentUser/My/Key2", "RSA_OAEP", encrypted); err == nil {
+		t.Error("a key encrypted with another master key should not be decrypted")
+	}
+	if _, err = p.DecryptColumnEncryptionKey("CurrentUser/My/Key3", "RSA_OAEP", encrypted); err == nil {
+		t.Error("decrypting with an unknown master key should fail")
+	}
+	if _, err = p.DecryptColumnEncryptionKey("CurrentUser/My/Key1", "RSA_OAEP", encrypted[:10]); err == nil {
+		t.Error("decrypting a truncated key should fail")
+	}
+	if _, err = p.EncryptColumnEncryptionKey("CurrentUser/My/Key1", "RSA_PKCS1", cek); err == nil {
+		t.Error("encrypting with an unsupported algorithm should fail")
+	}
+}
+
+func TestPEMKeyStoreProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mssql-keys")
+	if err != nil {
+		t.Fatal("TempDir failed:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkcs8Key := testRSAKey(t)
+	der, err := x509.MarshalPKCS8PrivateKey(pkcs8Key)
+	if err != nil {
+		t.Fatal("MarshalPKCS8PrivateKey failed:", err)
+	}
+	pkcs1Key := testRSAKey(t)
+	files := map[string]*pem.Block{
+		"pkcs8.pem": {Type: "PRIVATE KEY", Bytes: der},
+		"pkcs1.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pkcs1Key)},
+	}
+	for name, block := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal("WriteFile failed:", err)
+		}
+	}
+
+	mem := NewMemoryKeyStoreProvider()
+	mem.AddKey("pkcs8.pem", pkcs8Key)
+	mem.AddKey("pkcs1.pem", pkcs1Key)
+	p := NewPEMKeyStoreProvider(dir)
+	cek := testRootKey()
+	for name := range files {
+		encrypted, err := mem.EncryptColumnEncryptionKey(name, "RSA_OAEP", cek)
+		if err != nil {
+			t.Fatal("EncryptColumnEncryptionKey failed:", err)
+		}
+		decrypted, err := p.DecryptColumnEncryptionKey(name, "RSA_OAEP", encrypted)
+		if err != nil {
+			t.Fatalf("DecryptColumnEncryptionKey of %s failed: %v", name, err)
+		}
+		if !bytes.Equal(decrypted, cek) {
+			t.Errorf("%s: decrypted % x", name, decrypted)
+		}
+	}
+	if _, err = p.DecryptColumnEncryptionKey("PKCS8.pem", "RSA_OAEP", nil); err == nil || os.IsNotExist(err) {
+		t.Errorf("key paths should be cached without case, got %v", err)
+	}
+}
+
+func TestPEMKeyStoreProviderOutOfDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mssql-keys")
+	if err != nil {
+		t.Fatal("TempDir failed:", err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir := filepath.Join(dir, "keys")
+	if err = os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatal("Mkdir failed:", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(testRSAKey(t))
+	if err != nil {
+		t.Fatal("MarshalPKCS8PrivateKey failed:", err)
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(filepath.Join(dir, "secret.pem"), block, 0600); err != nil {
+		t.Fatal("WriteFile failed:", err)
+	}
+
+	p := NewPEMKeyStoreProvider(keyDir)
+	for _, keyPath := range []string{"../secret.pem", `..\secret.pem`, `..\..\keys\..\secret.pem`, "/../secret.pem"} {
+		if _, err = p.key(keyPath); err == nil {
+			t.Errorf("key path %s out of the directory was read", keyPath)
+		}
+	}
+}
+
+func TestRegisterKeyStoreProvider(t *testing.T) {
+	key := testRSAKey(t)
+	mem := NewMemoryKeyStoreProvider()
+	mem.AddKey("key", key)
+	encrypted, err := mem.EncryptColumnEncryptionKey("key", "RSA_OAEP", testRootKey())
+	if err != nil {
+		t.Fatal("EncryptColumnEncryptionKey failed:", err)
+	}
+	value := encryptionKeyInfo{encryptedKey: encrypted, keyStoreName: "CUSTOM_HSM", keyPath: "key", algorithmName: "RSA_OAEP"}
+
+	c := NewConnectorConfig(msdsn.Config{})
+	settings := newAESettings(c, c.params)
+	if _, err = settings.decryptCEK(value); err == nil {
+		t.Error("decrypting without a provider should fail")
+	}
+
+	c.RegisterKeyStoreProvider("CUSTOM_HSM", mem)
+	settings = newAESettings(c, c.params)
+	if cek, err := settings.decryptCEK(value); err != nil || !bytes.Equal(cek, testRootKey()) {
+		t.Errorf("decryptCEK returned % x, %v", cek, err)
+	}
+}
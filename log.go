@@ -1,7 +1,10 @@
 package mssql
 
 import (
+	"context"
 	"log"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 type Logger interface {
@@ -9,22 +12,48 @@ type Logger interface {
 	Println(v ...interface{})
 }
 
+// ContextLogger is a logger which receives the context of the request
+// a message belongs to, and the category it was logged for. Messages
+// not belonging to a request, like the ones of the login, get the
+// context of the connection attempt.
+//
+// Only the categories enabled by the log flags of the connection string
+// are logged, except for a few warnings about the connection string.
+type ContextLogger interface {
+	Log(ctx context.Context, category msdsn.Log, msg string)
+}
+
+// optionalLogger passes messages on to a ContextLogger, or to the
+// standard logger when none is set.
 type optionalLogger struct {
-	logger Logger
+	logger ContextLogger
 }
 
-func (o optionalLogger) Printf(format string, v ...interface{}) {
+func (o optionalLogger) Log(ctx context.Context, category msdsn.Log, msg string) {
 	if o.logger != nil {
-		o.logger.Printf(format, v...)
+		o.logger.Log(ctx, category, msg)
 	} else {
-		log.Printf(format, v...)
+		log.Println(categoryPrefix(category) + msg)
 	}
 }
 
-func (o optionalLogger) Println(v ...interface{}) {
-	if o.logger != nil {
-		o.logger.Println(v...)
-	} else {
-		log.Println(v...)
+// loggerAdapter makes a Logger a ContextLogger.
+type loggerAdapter struct {
+	logger Logger
+}
+
+func (la loggerAdapter) Log(_ context.Context, category msdsn.Log, msg string) {
+	la.logger.Println(categoryPrefix(category) + msg)
+}
+
+// categoryPrefix returns the prefix of the messages of a category
+// logged by a Logger.
+func categoryPrefix(category msdsn.Log) string {
+	switch category {
+	case msdsn.LogErrors:
+		return "ERROR: "
+	case msdsn.LogRetries:
+		return "RETRY: "
 	}
+	return ""
 }
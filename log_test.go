@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/wang-xuemin/go-mssqldb/msdsn"
@@ -217,3 +218,88 @@ func TestLogger(t *testing.T) {
 		}
 	}
 }
+
+// recordingLogger implements the ContextLogger interface for testing purposes.
+// It records the messages with their context and category.
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []loggedEntry
+}
+
+type loggedEntry struct {
+	ctx      context.Context
+	category msdsn.Log
+	msg      string
+}
+
+func (l *recordingLogger) Log(ctx context.Context, category msdsn.Log, msg string) {
+	l.mu.Lock()
+	l.entries = append(l.entries, loggedEntry{ctx, category, msg})
+	l.mu.Unlock()
+}
+
+type logTestKey struct{}
+
+func TestLoggerAdapterPrefixes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := loggerAdapter{bufLogger{&buf}}
+	logger.Log(context.Background(), msdsn.LogErrors, "failed")
+	logger.Log(context.Background(), msdsn.LogRetries, "retrying")
+	logger.Log(context.Background(), msdsn.LogSQL, "select 1")
+	if expected := "ERROR: failed\nRETRY: retrying\nselect 1\n"; buf.String() != expected {
+		t.Errorf("logged %q, expected %q", buf.String(), expected)
+	}
+}
+
+func TestContextLoggerReceivesRequestContext(t *testing.T) {
+	rec := &recordingLogger{}
+	sess := &tdsSession{
+		buf:      replyBuffer(messageToken(tokenInfo, 0, "hello"), doneToken(doneCount, 1)),
+		logger:   optionalLogger{rec},
+		logFlags: uint64(msdsn.LogMessages | msdsn.LogRows),
+	}
+	ctx := context.WithValue(context.Background(), logTestKey{}, "request")
+	if err := startReading(sess, ctx, outputs{}).iterateResponse(); err != nil {
+		t.Fatal("iterateResponse failed:", err)
+	}
+	expected := []struct {
+		category msdsn.Log
+		msg      string
+	}{
+		{msdsn.LogMessages, "hello"},
+		{msdsn.LogRows, "(1 row(s) affected)"},
+	}
+	if len(rec.entries) != len(expected) {
+		t.Fatalf("logged %+v", rec.entries)
+	}
+	for i, e := range rec.entries {
+		if e.category != expected[i].category || e.msg != expected[i].msg || e.ctx.Value(logTestKey{}) != "request" {
+			t.Errorf("entry %d is %v %q, expected %v %q with the request context", i, e.category, e.msg, expected[i].category, expected[i].msg)
+		}
+	}
+}
+
+func TestConnectorContextLogger(t *testing.T) {
+	c, err := NewConnector("server=10.0.0.1;failoverpartner=10.0.0.2;dial timeout=1;log=128")
+	if err != nil {
+		t.Fatal("NewConnector failed:", err)
+	}
+	c.Dialer = &addrDialer{fail: map[string]bool{"10.0.0.1:1433": true, "10.0.0.2:1433": true}}
+	rec := &recordingLogger{}
+	c.SetContextLogger(rec)
+
+	ctx := context.WithValue(context.Background(), logTestKey{}, "connect")
+	if _, err = c.Connect(ctx); err == nil {
+		t.Fatal("Connect should fail when both servers fail")
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.entries) == 0 {
+		t.Fatal("the failed attempts were not logged to the connector's logger")
+	}
+	for _, e := range rec.entries {
+		if e.category != msdsn.LogRetries || !strings.HasPrefix(e.msg, "connecting to 10.0.0.") || e.ctx.Value(logTestKey{}) != "connect" {
+			t.Errorf("unexpected entry %v %q", e.category, e.msg)
+		}
+	}
+}
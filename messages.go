@@ -0,0 +1,236 @@
+package mssql
+
+import (
+	"database/sql/driver"
+	"io"
+	"reflect"
+)
+
+// Rowsq is returned for queries passed a *sqlexp.ReturnMessage argument.
+// The response is then delivered as messages in the order the server sent
+// it: sqlexp.MsgNotice for PRINT output and other informational messages,
+// sqlexp.MsgError for errors, sqlexp.MsgRowsAffected for row counts,
+// sqlexp.MsgNext when the rows of a result set can be read with Next and
+// sqlexp.MsgNextResultSet after a result set or the request ended.
+//
+//	retmsg := &sqlexp.ReturnMessage{}
+//	rows, err := db.QueryContext(ctx, query, retmsg)
+//	...
+//	for active := true; active; {
+//		switch m := retmsg.Message(ctx).(type) {
+//		case sqlexp.MsgNotice:
+//			fmt.Println(m.Message)
+//		case sqlexp.MsgNext:
+//			for rows.Next() {
+//				...
+//			}
+//		case sqlexp.MsgNextResultSet:
+//			active = rows.NextResultSet()
+//		}
+//	}
+//
+// SQL errors are not returned by Next, only errors of the connection and
+// ErrColumnDecryption are.
+// After MsgNext the rows must be read until Next returns false, and each
+// MsgNextResultSet must be followed by a call of NextResultSet, reading
+// the response stops otherwise. Messages are only read ahead a few at a
+// time, a long running request is read as its messages are processed.
+type Rowsq struct {
+	stmt   *Stmt
+	sess   *tdsSession
+	cols   []columnStruct
+	reader *tokenProcessor
+	cancel func()
+
+	// ended is set once the end of the current result set was read,
+	// requestDone once the end of the response was read.
+	ended       bool
+	requestDone bool
+	err         error
+
+	classification *DataClassification
+
+	// blob is the BlobReader of the current row.
+	blob *BlobReader
+}
+
+// nextToken reads the response up to the next columns, row or end of
+// a result set. The tokens in between are handled on the way, errors
+// found in them were already passed on as messages.
+func (rc *Rowsq) nextToken() tokenStruct {
+	if rc.err != nil {
+		return nil
+	}
+	for {
+		tok, err := rc.reader.nextToken()
+		if err != nil {
+			rc.err = rc.stmt.c.checkBadConn(rc.reader.ctx, err, false)
+			return nil
+		}
+		switch token := tok.(type) {
+		case nil:
+			rc.requestDone = true
+			return nil
+		case []columnStruct, []interface{}, resultSetEnd:
+			return tok
+		case *DataClassification:
+			rc.classification = token
+		case ReturnStatus:
+			rc.sess.setReturnStatus(token)
+		case namedValue:
+			rc.stmt.gotReturnValue(token)
+		}
+	}
+}
+
+// gotEnd records the end of the current result set.
+func (rc *Rowsq) gotEnd(tok tokenStruct) {
+	rc.ended = true
+	if end, ok := tok.(resultSetEnd); !ok || end.last {
+		rc.requestDone = true
+	}
+}
+
+func (rc *Rowsq) releaseBlob() {
+	if rc.blob != nil {
+		rc.blob.release()
+		rc.blob = nil
+	}
+}
+
+func (rc *Rowsq) Close() error {
+	rc.releaseBlob()
+	rc.cancel()
+	defer func() {
+		rc.stmt.c.releaseSession(rc.sess)
+		rc.sess = nil
+	}()
+
+	for {
+		tok, err := rc.reader.nextToken()
+		if err == nil {
+			if tok == nil {
+				return nil
+			} else if nv, ok := tok.(namedValue); ok {
+				rc.stmt.gotReturnValue(nv)
+			}
+			releaseBlob(tok)
+			// continue consuming tokens
+		} else {
+			if err == rc.reader.ctx.Err() {
+				return nil
+			} else {
+				return err
+			}
+		}
+	}
+}
+
+// Columns returns the columns of the current result set, it reads them
+// when the application did not wait for MsgNext.
+func (rc *Rowsq) Columns() (res []string) {
+	if rc.cols == nil && !rc.ended {
+		switch tok := rc.nextToken().(type) {
+		case []columnStruct:
+			rc.cols = tok
+		case resultSetEnd, nil:
+			rc.gotEnd(tok)
+		}
+	}
+	res = make([]string, len(rc.cols))
+	for i, col := range rc.cols {
+		res[i] = col.ColName
+	}
+	return
+}
+
+func (rc *Rowsq) Next(dest []driver.Value) error {
+	if !rc.stmt.c.connectionGood {
+		return driver.ErrBadConn
+	}
+	rc.releaseBlob()
+	if rc.cols == nil {
+		rc.Columns()
+	}
+	for !rc.ended {
+		switch tok := rc.nextToken().(type) {
+		case []interface{}:
+			rc.blob = rowBlob(tok)
+			if err := rowDecryptionError(tok); err != nil {
+				return err
+			}
+			for i := range dest {
+				dest[i] = tok[i]
+			}
+			return nil
+		case []columnStruct:
+			// a result set without end, like the ones of cursors
+			rc.cols = tok
+		case resultSetEnd, nil:
+			rc.gotEnd(tok)
+		}
+	}
+	if rc.err != nil {
+		return rc.err
+	}
+	return io.EOF
+}
+
+// HasNextResultSet reports whether the request may have more result sets,
+// it does not know before the response was read up to its end.
+func (rc *Rowsq) HasNextResultSet() bool {
+	return !rc.requestDone
+}
+
+// NextResultSet skips what was not read of the current result set, up to
+// the end MsgNextResultSet was sent for. The columns of the next result
+// set are read once MsgNext was received.
+func (rc *Rowsq) NextResultSet() error {
+	rc.releaseBlob()
+	for !rc.ended {
+		switch tok := rc.nextToken().(type) {
+		case []interface{}:
+			releaseBlob(tok)
+		case resultSetEnd, nil:
+			rc.gotEnd(tok)
+		}
+	}
+	if rc.err != nil {
+		return rc.err
+	}
+	if rc.requestDone {
+		return io.EOF
+	}
+	rc.cols = nil
+	rc.ended = false
+	rc.classification = nil
+	return nil
+}
+
+// DataClassification returns the sensitivity classification of the
+// current result set, or nil if the server did not send one.
+func (rc *Rowsq) DataClassification() *DataClassification {
+	return rc.classification
+}
+
+func (r *Rowsq) ColumnTypeScanType(index int) reflect.Type {
+	return makeGoLangScanType(r.cols[index].ti)
+}
+
+func (r *Rowsq) ColumnTypeDatabaseTypeName(index int) string {
+	return makeGoLangTypeName(r.cols[index].ti)
+}
+
+func (r *Rowsq) ColumnTypeLength(index int) (int64, bool) {
+	return makeGoLangTypeLength(r.cols[index].ti)
+}
+
+func (r *Rowsq) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	return makeGoLangTypePrecisionScale(r.cols[index].ti)
+}
+
+func (r *Rowsq) ColumnTypeNullable(index int) (nullable, ok bool) {
+	nullable = r.cols[index].Flags&colFlagNullable != 0
+	ok = true
+	return
+}
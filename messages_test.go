@@ -0,0 +1,275 @@
+//go:build go1.9
+// +build go1.9
+
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-sql/sqlexp"
+)
+
+// replyBuffer returns a buffer holding a reply made of the given tokens.
+func replyBuffer(tokens ...[]byte) *tdsBuffer {
+	body := bytes.Join(tokens, nil)
+	packet := []byte{byte(packReply), 1, 0, 0, 0, 0, 1, 0}
+	binary.BigEndian.PutUint16(packet[2:], uint16(8+len(body)))
+	return makeBuf(4096, append(packet, body...))
+}
+
+func messageToken(tok token, class uint8, text string) []byte {
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, int32(50000))
+	body.Write([]byte{1, class})
+	binary.Write(&body, binary.LittleEndian, uint16(len(text)))
+	body.Write(str2ucs2(text))
+	body.Write([]byte{0, 0}) // server and procedure name
+	binary.Write(&body, binary.LittleEndian, int32(1))
+	res := []byte{byte(tok), 0, 0}
+	binary.LittleEndian.PutUint16(res[1:], uint16(body.Len()))
+	return append(res, body.Bytes()...)
+}
+
+func intColumnToken(name string) []byte {
+	res := []byte{byte(tokenColMetadata), 1, 0, 0, 0, 0, 0, 0, 0, typeInt4, byte(len(name))}
+	return append(res, str2ucs2(name)...)
+}
+
+func intRowToken(v int32) []byte {
+	res := []byte{byte(tokenRow), 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(res[1:], uint32(v))
+	return res
+}
+
+func doneToken(status uint16, count uint64) []byte {
+	res := make([]byte, 13)
+	res[0] = byte(tokenDone)
+	binary.LittleEndian.PutUint16(res[1:], status)
+	binary.LittleEndian.PutUint64(res[5:], count)
+	return res
+}
+
+// readMessages reads a response in messages mode the way applications
+// do and returns what it went through.
+func readMessages(t *testing.T, buf *tdsBuffer) (log []string, err error) {
+	sess := &tdsSession{buf: buf}
+	stmt := &Stmt{c: &Conn{sess: sess, connectionGood: true}}
+	msgq := &sqlexp.ReturnMessage{}
+	sqlexp.ReturnMessageInit(msgq)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows := &Rowsq{stmt: stmt, sess: sess, reader: startReading(sess, ctx, outputs{msgq: msgq}), cancel: cancel}
+	defer rows.Close()
+
+	for {
+		switch m := msgq.Message(ctx).(type) {
+		case sqlexp.MsgNotice:
+			log = append(log, "notice "+m.Message.String())
+		case sqlexp.MsgError:
+			log = append(log, "error "+m.Error.Error())
+		case sqlexp.MsgRowsAffected:
+			log = append(log, fmt.Sprint("rows affected ", m.Count))
+		case sqlexp.MsgNext:
+			log = append(log, fmt.Sprint("next ", rows.Columns()))
+			dest := make([]driver.Value, 1)
+			for {
+				if err = rows.Next(dest); err == io.EOF {
+					break
+				} else if err != nil {
+					return log, err
+				}
+				log = append(log, fmt.Sprint("row ", dest[0]))
+			}
+		case sqlexp.MsgNextResultSet:
+			if err = rows.NextResultSet(); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return log, err
+			}
+			log = append(log, "next result set")
+		}
+	}
+}
+
+func TestMessagesOrder(t *testing.T) {
+	buf := replyBuffer(
+		messageToken(tokenInfo, 0, "starting"),
+		intColumnToken("n"),
+		intRowToken(7),
+		intRowToken(8),
+		doneToken(doneCount|doneMore, 2),
+		messageToken(tokenError, 16, "failed"),
+		doneToken(doneError|doneMore, 0),
+		intColumnToken("m"),
+		doneToken(doneCount|doneMore, 0),
+		messageToken(tokenInfo, 0, "finished"),
+		doneToken(0, 0),
+	)
+	log, err := readMessages(t, buf)
+	if err != nil {
+		t.Fatal("reading messages failed:", err)
+	}
+	expected := []string{
+		"notice starting",
+		"next [n]",
+		"row 7",
+		"row 8",
+		"rows affected 2",
+		"next result set",
+		"error mssql: failed",
+		"next [m]",
+		"rows affected 0",
+		"next result set",
+		"notice finished",
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("unexpected messages\n%q\nexpected\n%q", log, expected)
+	}
+}
+
+func TestMessagesSkipUnreadRows(t *testing.T) {
+	buf := replyBuffer(
+		intColumnToken("n"),
+		intRowToken(1),
+		intRowToken(2),
+		doneToken(doneCount|doneMore, 2),
+		intColumnToken("m"),
+		intRowToken(3),
+		doneToken(doneCount, 1),
+	)
+	sess := &tdsSession{buf: buf}
+	msgq := &sqlexp.ReturnMessage{}
+	sqlexp.ReturnMessageInit(msgq)
+	ctx := context.Background()
+	rows := &Rowsq{stmt: &Stmt{c: &Conn{sess: sess, connectionGood: true}}, sess: sess,
+		reader: startReading(sess, ctx, outputs{msgq: msgq}), cancel: func() {}}
+	defer rows.Close()
+
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil || dest[0] != int64(1) {
+		t.Fatalf("Next returned %v %v", dest[0], err)
+	}
+	if err := rows.NextResultSet(); err != nil {
+		t.Fatal("NextResultSet failed:", err)
+	}
+	if !rows.HasNextResultSet() {
+		t.Error("HasNextResultSet should be true before the response ended")
+	}
+	if err := rows.Next(dest); err != nil || dest[0] != int64(3) || rows.Columns()[0] != "m" {
+		t.Fatalf("Next returned %v %v in result set %v", dest[0], err, rows.Columns())
+	}
+	if err := rows.NextResultSet(); err != io.EOF {
+		t.Errorf("NextResultSet at the end of the response returned %v", err)
+	}
+}
+
+func TestMessagesReadError(t *testing.T) {
+	// the response ends within the result set
+	buf := replyBuffer(
+		intColumnToken("n"),
+		intRowToken(1),
+	)
+	log, err := readMessages(t, buf)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if expected := []string{"next [n]", "row 1"}; !reflect.DeepEqual(log, expected) {
+		t.Errorf("unexpected messages %q", log)
+	}
+}
+
+const mixedQuery = `select 'name' as Name
+PRINT N'This is a message'
+select 199
+RAISERROR (N'Testing!' , 11, 1)
+select 300
+RAISERROR (N'Progress' , 0, 1) WITH NOWAIT
+select 'last'
+`
+
+// testMixedQuery runs mixedQuery with a message queue and counts the
+// messages, errors, result sets and row counts received.
+func testMixedQuery(conn *sql.DB, b testing.TB) (msgs, errs, results, rowcounts int) {
+	ctx := context.Background()
+	retmsg := &sqlexp.ReturnMessage{}
+	r, err := conn.QueryContext(ctx, mixedQuery, retmsg)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer r.Close()
+	active := true
+	for active {
+		msg := retmsg.Message(ctx)
+		switch m := msg.(type) {
+		case sqlexp.MsgNotice:
+			b.Logf("MsgNotice:%s", m.Message)
+			msgs++
+		case sqlexp.MsgNext:
+			b.Logf("MsgNext")
+			results++
+			for r.Next() {
+				var d interface{}
+				if err = r.Scan(&d); err != nil {
+					b.Fatal("Scan failed:", err)
+				}
+			}
+		case sqlexp.MsgNextResultSet:
+			b.Logf("MsgNextResultSet")
+			active = r.NextResultSet()
+		case sqlexp.MsgError:
+			b.Logf("MsgError:%v", m.Error)
+			errs++
+		case sqlexp.MsgRowsAffected:
+			b.Logf("MsgRowsAffected:%d", m.Count)
+			rowcounts++
+		}
+	}
+	if err = r.Err(); err != nil {
+		b.Fatal("Rows failed:", err)
+	}
+	return
+}
+
+func TestMessageQueue(t *testing.T) {
+	conn := open(t)
+	defer conn.Close()
+
+	msgs, errs, results, rowcounts := testMixedQuery(conn, t)
+	if msgs != 2 || errs != 1 || results != 4 || rowcounts != 4 {
+		t.Errorf("got %d messages, %d errors, %d results and %d row counts, expected 2, 1, 4 and 4",
+			msgs, errs, results, rowcounts)
+	}
+}
+
+func TestMessageQueueNowait(t *testing.T) {
+	conn := open(t)
+	defer conn.Close()
+
+	ctx := context.Background()
+	retmsg := &sqlexp.ReturnMessage{}
+	start := time.Now()
+	rows, err := conn.QueryContext(ctx, `RAISERROR (N'step 1', 0, 1) WITH NOWAIT
+WAITFOR DELAY '00:00:02'
+select 1`, retmsg)
+	if err != nil {
+		t.Fatal("QueryContext failed:", err)
+	}
+	defer rows.Close()
+	msg, ok := retmsg.Message(ctx).(sqlexp.MsgNotice)
+	if !ok || msg.Message.String() != "step 1" {
+		t.Fatalf("expected the notice first, got %#v", msg)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the notice took %v, it should not wait for the batch to end", elapsed)
+	}
+}
@@ -24,6 +24,22 @@ const (
 	EncryptionOff      = 0
 	EncryptionRequired = 1
 	EncryptionDisabled = 3
+	// EncryptionStrict negotiates TLS before the prelogin (TDS 8.0),
+	// the server certificate is always validated.
+	EncryptionStrict = 4
+)
+
+// default packet size for TDS buffer
+const defaultPacketSize = 4096
+
+const defaultServerPort = 1433
+
+// defaults of the settings a DSN leaves out
+const (
+	defaultDialTimeout          = 15 * time.Second
+	defaultKeepAlive            = 30 * time.Second
+	defaultConnectRetryInterval = 10 * time.Second
+	defaultAppName              = "go-mssqldb"
 )
 
 const (
@@ -45,7 +61,10 @@ type Config struct {
 	User       string
 	Password   string
 	Encryption Encryption
-	TLSConfig  *tls.Config
+	// TLSConfig is used when the connection is encrypted. When nil, the
+	// certificate of the server is checked against Host, unless Encryption
+	// is EncryptionOff which only encrypts the login.
+	TLSConfig *tls.Config
 
 	FailOverPartner string
 	FailOverPort    uint64
@@ -67,6 +86,32 @@ type Config struct {
 	// that start on bad connections.
 	DisableRetry bool
 
+	// ColumnEncryption enables Always Encrypted. The column master keys
+	// are read from the key store at KeyStoreLocation, KeyStoreAuthentication
+	// tells how to open it, "pfx" being the only one supported.
+	ColumnEncryption       bool
+	KeyStoreAuthentication string
+	KeyStoreLocation       string
+	KeyStoreSecret         string
+
+	// MultipleActiveResultSets enables MARS, several requests may then be
+	// active at once on a connection.
+	MultipleActiveResultSets bool
+
+	// MultiSubnetFailover dials all the addresses a host name resolves to
+	// at once, instead of one after another.
+	MultiSubnetFailover bool
+
+	// ConnectRetryCount is the number of attempts made to restore a session
+	// dropped by the server, ConnectRetryInterval is the time between them.
+	// Zero disables session recovery.
+	ConnectRetryCount    int
+	ConnectRetryInterval time.Duration
+
+	// DisablePrepare sends queries with parameters through sp_executesql
+	// instead of preparing them.
+	DisablePrepare bool
+
 	// Do not use the following.
 
 	DialTimeout time.Duration // DialTimeout defaults to 15s. Set negative to disable.
@@ -107,6 +152,22 @@ func SetupTLS(certificate string, insecureSkipVerify bool, hostInCertificate str
 
 var skipSetup = errors.New("skip setting up TLS")
 
+// DefaultConfig returns a Config holding the defaults Parse uses for the
+// settings a DSN leaves out, a starting point for a Config built in code.
+// The settings which depend on the server, like TLSConfig and ServerSPN,
+// are left to the caller.
+func DefaultConfig() Config {
+	return Config{
+		PacketSize:           defaultPacketSize,
+		DialTimeout:          defaultDialTimeout,
+		KeepAlive:            defaultKeepAlive,
+		AppName:              defaultAppName,
+		DisableRetry:         disableRetryDefault,
+		MultiSubnetFailover:  true,
+		ConnectRetryInterval: defaultConnectRetryInterval,
+	}
+}
+
 func Parse(dsn string) (Config, map[string]string, error) {
 	p := Config{}
 
@@ -159,7 +220,8 @@ func Parse(dsn string) (Config, map[string]string, error) {
 		}
 	}
 
-	// https://docs.microsoft.com/en-us/sql/database-engine/configure-windows/configure-the-network-packet-size-server-configuration-option\
+	// https://docs.microsoft.com/en-us/sql/database-engine/configure-windows/configure-the-network-packet-size-server-configuration-option
+	p.PacketSize = defaultPacketSize
 	strpsize, ok := params["packet size"]
 	if ok {
 		var err error
@@ -193,7 +255,7 @@ func Parse(dsn string) (Config, map[string]string, error) {
 		}
 		p.ConnTimeout = time.Duration(timeout) * time.Second
 	}
-	p.DialTimeout = 15 * time.Second
+	p.DialTimeout = defaultDialTimeout
 	if strdialtimeout, ok := params["dial timeout"]; ok {
 		timeout, err := strconv.ParseUint(strdialtimeout, 10, 64)
 		if err != nil {
@@ -201,11 +263,16 @@ func Parse(dsn string) (Config, map[string]string, error) {
 			return p, params, fmt.Errorf(f, strdialtimeout, err.Error())
 		}
 		p.DialTimeout = time.Duration(timeout) * time.Second
+		if timeout == 0 {
+			// a negative DialTimeout disables the timeout,
+			// a zero one stands for the default
+			p.DialTimeout = -1
+		}
 	}
 
 	// default keep alive should be 30 seconds according to spec:
 	// https://msdn.microsoft.com/en-us/library/dd341108.aspx
-	p.KeepAlive = 30 * time.Second
+	p.KeepAlive = defaultKeepAlive
 	if keepAlive, ok := params["keepalive"]; ok {
 		timeout, err := strconv.ParseUint(keepAlive, 10, 64)
 		if err != nil {
@@ -213,6 +280,11 @@ func Parse(dsn string) (Config, map[string]string, error) {
 			return p, params, fmt.Errorf(f, keepAlive, err.Error())
 		}
 		p.KeepAlive = time.Duration(timeout) * time.Second
+		if timeout == 0 {
+			// a negative KeepAlive disables keep alive probes,
+			// a zero one stands for the default
+			p.KeepAlive = -1
+		}
 	}
 
 	var (
@@ -224,6 +296,9 @@ func Parse(dsn string) (Config, map[string]string, error) {
 	if ok {
 		if strings.EqualFold(encrypt, "DISABLE") {
 			p.Encryption = EncryptionDisabled
+		} else if strings.EqualFold(encrypt, "STRICT") {
+			// TDS 8.0, TLS is negotiated before prelogin
+			p.Encryption = EncryptionStrict
 		} else {
 			e, err := strconv.ParseBool(encrypt)
 			if err != nil {
@@ -255,19 +330,59 @@ func Parse(dsn string) (Config, map[string]string, error) {
 		p.HostInCertificateProvided = false
 	}
 
+	if p.Encryption == EncryptionStrict {
+		// strict encryption always validates the server certificate
+		trustServerCert = false
+	}
 	if p.Encryption != EncryptionDisabled {
 		var err error
 		p.TLSConfig, err = SetupTLS(certificate, trustServerCert, hostInCertificate)
 		if err != nil {
 			return p, params, fmt.Errorf("failed to setup TLS: %w", err)
 		}
+		if p.Encryption == EncryptionStrict {
+			p.TLSConfig.NextProtos = []string{"tds/8.0"}
+			p.TLSConfig.MinVersion = tls.VersionTLS12
+		}
+	}
+
+	columnEncryption, ok := params["columnencryption"]
+	if ok {
+		var err error
+		p.ColumnEncryption, err = strconv.ParseBool(columnEncryption)
+		if err != nil {
+			f := "invalid columnEncryption '%s': %s"
+			return p, params, fmt.Errorf(f, columnEncryption, err.Error())
+		}
+	}
+
+	ksAuth, ok := params["keystoreauthentication"]
+	if ok {
+		switch strings.ToLower(ksAuth) {
+		case "pfx":
+			p.KeyStoreAuthentication = "pfx"
+		default:
+			return p, params, fmt.Errorf("invalid keystoreAuthentication '%s'", ksAuth)
+		}
+	}
+
+	ksLocation, ok := params["keystorelocation"]
+	if ok {
+		if ksLocation == "" {
+			return p, params, fmt.Errorf("invalid keystore location provided: '%s'", ksLocation)
+		}
+		if _, err := os.Stat(ksLocation); err != nil {
+			return p, params, fmt.Errorf("unable to find keystore %s: %v", ksLocation, err)
+		}
+		p.KeyStoreLocation = ksLocation
 	}
+	p.KeyStoreSecret = params["keystoresecret"]
 
 	serverSPN, ok := params["serverspn"]
 	if ok {
 		p.ServerSPN = serverSPN
 	} else {
-		p.ServerSPN = generateSpn(p.Host, p.Port)
+		p.ServerSPN = generateSpn(p.Host, resolveServerPort(p.Port))
 	}
 
 	workstation, ok := params["workstation id"]
@@ -282,7 +397,7 @@ func Parse(dsn string) (Config, map[string]string, error) {
 
 	appname, ok := params["app name"]
 	if !ok {
-		appname = "go-mssqldb"
+		appname = defaultAppName
 	}
 	p.AppName = appname
 
@@ -323,6 +438,55 @@ func Parse(dsn string) (Config, map[string]string, error) {
 		p.DisableRetry = disableRetryDefault
 	}
 
+	p.MultiSubnetFailover = true
+	multiSubnetFailover, ok := params["multisubnetfailover"]
+	if ok {
+		var err error
+		p.MultiSubnetFailover, err = strconv.ParseBool(multiSubnetFailover)
+		if err != nil {
+			f := "invalid multiSubnetFailover '%s': %s"
+			return p, params, fmt.Errorf(f, multiSubnetFailover, err.Error())
+		}
+	}
+
+	// https://docs.microsoft.com/en-us/sql/connect/odbc/connection-resiliency
+	// Session recovery is only requested when retries are enabled.
+	if retryCount, ok := params["connectretrycount"]; ok {
+		count, err := strconv.ParseUint(retryCount, 10, 8)
+		if err != nil {
+			f := "invalid connectRetryCount '%s': %s"
+			return p, params, fmt.Errorf(f, retryCount, err.Error())
+		}
+		p.ConnectRetryCount = int(count)
+	}
+	p.ConnectRetryInterval = defaultConnectRetryInterval
+	if retryInterval, ok := params["connectretryinterval"]; ok {
+		interval, err := strconv.ParseUint(retryInterval, 10, 8)
+		if err != nil || interval < 1 || interval > 60 {
+			f := "invalid connectRetryInterval '%s': must be a number of seconds between 1 and 60"
+			return p, params, fmt.Errorf(f, retryInterval)
+		}
+		p.ConnectRetryInterval = time.Duration(interval) * time.Second
+	}
+
+	if mars, ok := params["multipleactiveresultsets"]; ok {
+		var err error
+		p.MultipleActiveResultSets, err = strconv.ParseBool(mars)
+		if err != nil {
+			f := "invalid multipleactiveresultsets '%s': %s"
+			return p, params, fmt.Errorf(f, mars, err.Error())
+		}
+	}
+
+	if disablePrepare, ok := params["disableprepare"]; ok {
+		var err error
+		p.DisablePrepare, err = strconv.ParseBool(disablePrepare)
+		if err != nil {
+			f := "invalid disablePrepare '%s': %s"
+			return p, params, fmt.Errorf(f, disablePrepare, err.Error())
+		}
+	}
+
 	return p, params, nil
 }
 
@@ -341,6 +505,21 @@ func (p Config) URL() *url.URL {
 		host = fmt.Sprintf("%s:%d", p.Host, p.Port)
 	}
 	q.Add("disableRetry", fmt.Sprintf("%t", p.DisableRetry))
+	if p.ColumnEncryption {
+		q.Add("columnEncryption", "true")
+	}
+	if p.KeyStoreAuthentication != "" {
+		q.Add("keyStoreAuthentication", p.KeyStoreAuthentication)
+	}
+	if p.KeyStoreLocation != "" {
+		q.Add("keyStoreLocation", p.KeyStoreLocation)
+	}
+	if p.KeyStoreSecret != "" {
+		q.Add("keyStoreSecret", p.KeyStoreSecret)
+	}
+	if p.MultipleActiveResultSets {
+		q.Add("multipleactiveresultsets", "true")
+	}
 	res := url.URL{
 		Scheme: "sqlserver",
 		Host:   host,
@@ -605,6 +784,14 @@ func normalizeOdbcKey(s string) string {
 	return strings.ToLower(strings.TrimRightFunc(s, unicode.IsSpace))
 }
 
+func resolveServerPort(port uint64) uint64 {
+	if port == 0 {
+		return defaultServerPort
+	}
+
+	return port
+}
+
 func generateSpn(host string, port uint64) string {
 	return fmt.Sprintf("MSSQLSvc/%s:%d", host, port)
 }
@@ -19,6 +19,15 @@ func TestInvalidConnectionString(t *testing.T) {
 		"failoverport=invalid",
 		"applicationintent=ReadOnly",
 		"disableretry=invalid",
+		"columnencryption=invalid",
+		"keystoreauthentication=invalid",
+		"keystorelocation=",
+		"multisubnetfailover=invalid",
+		"connectretrycount=invalid",
+		"connectretryinterval=0",
+		"connectretryinterval=61",
+		"multipleactiveresultsets=invalid",
+		"disableprepare=invalid",
 
 		// ODBC mode
 		"odbc:password={",
@@ -61,9 +70,13 @@ func TestValidConnectionString(t *testing.T) {
 		{"encrypt=disable", func(p Config) bool { return p.Encryption == EncryptionDisabled }},
 		{"encrypt=true", func(p Config) bool { return p.Encryption == EncryptionRequired }},
 		{"encrypt=false", func(p Config) bool { return p.Encryption == EncryptionOff }},
+		{"encrypt=strict;trustservercertificate=true", func(p Config) bool {
+			return p.Encryption == EncryptionStrict && !p.TLSConfig.InsecureSkipVerify && p.TLSConfig.NextProtos[0] == "tds/8.0"
+		}},
 		{"connection timeout=3;dial timeout=4;keepalive=5", func(p Config) bool {
 			return p.ConnTimeout == 3*time.Second && p.DialTimeout == 4*time.Second && p.KeepAlive == 5*time.Second
 		}},
+		{"dial timeout=0;keepalive=0", func(p Config) bool { return p.DialTimeout < 0 && p.KeepAlive < 0 }},
 		{"log=63", func(p Config) bool { return p.LogFlags == 63 && p.Port == 0 }},
 		{"log=63;port=1000", func(p Config) bool { return p.LogFlags == 63 && p.Port == 1000 }},
 		{"log=64", func(p Config) bool { return p.LogFlags == 64 }},
@@ -75,7 +88,19 @@ func TestValidConnectionString(t *testing.T) {
 		{"disableretry=false", func(p Config) bool { return !p.DisableRetry }},
 		{"disableretry=1", func(p Config) bool { return p.DisableRetry }},
 		{"disableretry=0", func(p Config) bool { return !p.DisableRetry }},
-		{"", func(p Config) bool { return p.DisableRetry == disableRetryDefault }},
+		{"", func(p Config) bool {
+			return p.DisableRetry == disableRetryDefault && p.PacketSize == 4096 && p.MultiSubnetFailover &&
+				p.ConnectRetryInterval == 10*time.Second && !p.MultipleActiveResultSets && !p.DisablePrepare
+		}},
+		{"columnencryption=true;keystoreauthentication=pfx;keystoresecret=secret", func(p Config) bool {
+			return p.ColumnEncryption && p.KeyStoreAuthentication == "pfx" && p.KeyStoreSecret == "secret"
+		}},
+		{"multisubnetfailover=false;multipleactiveresultsets=true;disableprepare=true", func(p Config) bool {
+			return !p.MultiSubnetFailover && p.MultipleActiveResultSets && p.DisablePrepare
+		}},
+		{"connectretrycount=3;connectretryinterval=5", func(p Config) bool {
+			return p.ConnectRetryCount == 3 && p.ConnectRetryInterval == 5*time.Second
+		}},
 
 		// those are supported currently, but maybe should not be
 		{"someparam", func(p Config) bool { return true }},
@@ -175,6 +200,19 @@ func TestValidConnectionString(t *testing.T) {
 	}
 }
 
+func TestDefaultConfig(t *testing.T) {
+	p, _, err := Parse("server=somehost")
+	if err != nil {
+		t.Fatal("Parse failed:", err)
+	}
+	d := DefaultConfig()
+	if d.PacketSize != p.PacketSize || d.DialTimeout != p.DialTimeout || d.KeepAlive != p.KeepAlive ||
+		d.AppName != p.AppName || d.DisableRetry != p.DisableRetry || d.MultiSubnetFailover != p.MultiSubnetFailover ||
+		d.ConnectRetryInterval != p.ConnectRetryInterval {
+		t.Errorf("DefaultConfig returned %+v, Parse %+v", d, p)
+	}
+}
+
 func TestSplitConnectionStringURL(t *testing.T) {
 	_, err := splitConnectionStringURL("http://bad")
 	if err == nil {
@@ -16,6 +16,7 @@ import (
 	"unicode"
 
 	"github.com/wang-xuemin/go-mssqldb/internal/querytext"
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 // ReturnStatus may be used to return the return value from a proc.
@@ -31,12 +32,12 @@ var driverInstanceNoProcess = &Driver{processQueryText: false}
 func init() {
 	sql.Register("mssql", driverInstance)
 	sql.Register("sqlserver", driverInstanceNoProcess)
-	createDialer = func(p *connectParams) Dialer {
-		return netDialer{&net.Dialer{KeepAlive: p.keepAlive}}
+	createDialer = func(p *msdsn.Config) Dialer {
+		return netDialer{&net.Dialer{KeepAlive: p.KeepAlive}}
 	}
 }
 
-var createDialer func(p *connectParams) Dialer
+var createDialer func(p *msdsn.Config) Dialer
 
 type netDialer struct {
 	nd *net.Dialer
@@ -47,21 +48,22 @@ func (d netDialer) DialContext(ctx context.Context, network string, addr string)
 }
 
 type Driver struct {
-	log optionalLogger
+	logger optionalLogger
 
 	processQueryText bool
 }
 
 // OpenConnector opens a new connector. Useful to dial with a context.
 func (d *Driver) OpenConnector(dsn string) (*Connector, error) {
-	params, err := parseConnectParams(dsn)
+	params, _, err := msdsn.Parse(dsn)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Connector{
-		params: params,
-		driver: d,
+		params:         params,
+		driver:         d,
+		fedAuthLibrary: FedAuthLibraryReserved,
 	}, nil
 }
 
@@ -75,32 +77,79 @@ func SetLogger(logger Logger) {
 }
 
 func (d *Driver) SetLogger(logger Logger) {
-	d.log = optionalLogger{logger}
+	d.logger = optionalLogger{loggerAdapter{logger}}
+}
+
+// SetContextLogger sets the logger of the connections opened by both
+// the mssql and the sqlserver driver, unless their Connector has a
+// logger of its own.
+func SetContextLogger(ctxLogger ContextLogger) {
+	driverInstance.SetContextLogger(ctxLogger)
+	driverInstanceNoProcess.SetContextLogger(ctxLogger)
+}
+
+func (d *Driver) SetContextLogger(ctxLogger ContextLogger) {
+	d.logger = optionalLogger{ctxLogger}
 }
 
 // NewConnector creates a new connector from a DSN.
 // The returned connector may be used with sql.OpenDB.
 func NewConnector(dsn string) (*Connector, error) {
-	params, err := parseConnectParams(dsn)
+	params, _, err := msdsn.Parse(dsn)
 	if err != nil {
 		return nil, err
 	}
-	c := &Connector{
-		params: params,
-		driver: driverInstanceNoProcess,
+	return NewConnectorConfig(params), nil
+}
+
+// NewConnectorConfig creates a new connector from a Config, like the one
+// msdsn.Parse returns for a DSN. Settings which cannot be passed through
+// a DSN, like a prebuilt TLSConfig, can be set on the Config, while a
+// custom Dialer is set on the returned connector.
+//
+// The settings left zero which have a default in a DSN, like DialTimeout
+// and ConnectRetryInterval, take that default. Flags cannot be told apart
+// from being switched off, so a Config built in code should start from
+// msdsn.DefaultConfig to get all defaults, MultiSubnetFailover included.
+// The returned connector may be used with sql.OpenDB.
+func NewConnectorConfig(config msdsn.Config) *Connector {
+	defaults := msdsn.DefaultConfig()
+	if config.PacketSize == 0 {
+		config.PacketSize = defaults.PacketSize
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaults.DialTimeout
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = defaults.KeepAlive
+	}
+	if config.AppName == "" {
+		config.AppName = defaults.AppName
+	}
+	if config.ConnectRetryInterval == 0 {
+		config.ConnectRetryInterval = defaults.ConnectRetryInterval
+	}
+	return &Connector{
+		params:         config,
+		driver:         driverInstanceNoProcess,
+		fedAuthLibrary: FedAuthLibraryReserved,
 	}
-	return c, nil
 }
 
 // Connector holds the parsed DSN and is ready to make a new connection
 // at any time.
 //
-// In the future, settings that cannot be passed through a string DSN
-// may be set directly on the connector.
+// Settings that cannot be passed through a string DSN may be set
+// directly on the connector.
 type Connector struct {
-	params connectParams
+	params msdsn.Config
 	driver *Driver
 
+	// fedAuthLibrary is the federated authentication scheme used at login,
+	// fedAuthADALWorkflow the workflow of the ADAL one.
+	fedAuthLibrary      int
+	fedAuthADALWorkflow byte
+
 	// callback that can provide a security token during login
 	securityTokenProvider func(ctx context.Context) (string, error)
 
@@ -133,13 +182,73 @@ type Connector struct {
 	// Dialer sets a custom dialer for all network operations.
 	// If Dialer is not set, normal net dialers are used.
 	Dialer Dialer
+
+	// ReturnCiphertextOnDecryptionError returns the values of columns
+	// encrypted with Always Encrypted which cannot be decrypted as their
+	// ciphertext, a []byte, in place of failing the row with an
+	// ErrColumnDecryption.
+	ReturnCiphertextOnDecryptionError bool
+
+	// ColumnEncryptionKeyCacheTTL is how long the column encryption keys
+	// decrypted by the connections of the connector are kept. It is two
+	// hours when zero, keys are not kept when negative.
+	ColumnEncryptionKeyCacheTTL time.Duration
+
+	// CacheBulkMetadata keeps the metadata of the destination tables of
+	// the bulk copies of the connections of the connector, so that it is
+	// queried once for each table. The metadata of a table is queried
+	// again after a bulk copy to it was refused.
+	CacheBulkMetadata bool
+
+	// mirror tracks the database mirroring principal and partner.
+	mirror mirrorState
+
+	// logger overrides the logger of the driver when set.
+	logger ContextLogger
+
+	// keyStoreProviders are the providers of column master keys, by key
+	// store name. The map is replaced when a provider is registered.
+	keyStoreProviders map[string]ColumnEncryptionKeyStoreProvider
+
+	// cekCache holds the column encryption keys decrypted by the
+	// connections of the connector.
+	cekCache cekCache
+
+	// bulkMetadata holds the metadata cached for CacheBulkMetadata.
+	bulkMetadata bulkMetadataCache
+}
+
+// RegisterKeyStoreProvider sets the provider of the column master keys
+// of the key store name, the KEY_STORE_PROVIDER_NAME of their definition,
+// for the connections opened by the connector from now on. Keys of key
+// stores without a provider are decrypted with the key store given by
+// the connection string.
+func (c *Connector) RegisterKeyStoreProvider(name string, provider ColumnEncryptionKeyStoreProvider) {
+	providers := make(map[string]ColumnEncryptionKeyStoreProvider, len(c.keyStoreProviders)+1)
+	for n, p := range c.keyStoreProviders {
+		providers[n] = p
+	}
+	providers[name] = provider
+	c.keyStoreProviders = providers
+}
+
+// SetLogger sets the logger of the connections opened by the connector
+// from now on, in place of the one set for the driver.
+func (c *Connector) SetLogger(logger Logger) {
+	c.logger = loggerAdapter{logger}
+}
+
+// SetContextLogger sets the logger of the connections opened by the
+// connector from now on, in place of the one set for the driver.
+func (c *Connector) SetContextLogger(ctxLogger ContextLogger) {
+	c.logger = ctxLogger
 }
 
 type Dialer interface {
 	DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
 }
 
-func (c *Connector) getDialer(p *connectParams) Dialer {
+func (c *Connector) getDialer(p *msdsn.Config) Dialer {
 	if c != nil && c.Dialer != nil {
 		return c.Dialer
 	}
@@ -148,33 +257,99 @@ func (c *Connector) getDialer(p *connectParams) Dialer {
 
 type Conn struct {
 	connector      *Connector
+	params         msdsn.Config
 	sess           *tdsSession
 	transactionCtx context.Context
 	resetSession   bool
 
+	// prepareGen changes whenever the server drops prepared statements,
+	// handles prepared before are not valid anymore.
+	prepareGen int
+
 	processQueryText bool
 	connectionGood   bool
 
-	outs map[string]interface{}
+	outs outputs
+	// streamBlobs is set by the StreamBlobs argument of the next query.
+	streamBlobs bool
+
+	// idleSessions holds MARS sessions without an active request,
+	// they are reused before new ones are opened.
+	idleSessions []*tdsSession
+
+	// paramEncryptions remembers which parameters of a statement are
+	// encrypted, by statement and parameter declarations.
+	paramEncryptions map[string][]*paramEncryption
+}
+
+// acquireSession returns the session the next request is sent on.
+// Without MARS every request shares the connection's session. With MARS
+// each request gets a logical session of its own, so results of one
+// request can still be read while another request is executed.
+func (c *Conn) acquireSession() (*tdsSession, error) {
+	if c.sess.mux == nil {
+		return c.sess, nil
+	}
+	var sess *tdsSession
+	if n := len(c.idleSessions); n > 0 {
+		sess = c.idleSessions[n-1]
+		c.idleSessions = c.idleSessions[:n-1]
+	} else {
+		smp, err := c.sess.mux.openSession()
+		if err != nil {
+			return nil, err
+		}
+		buf := newTdsBuffer(uint16(len(c.sess.buf.wbuf)), smp)
+		buf.ResizeBuffer(c.sess.buf.PackageSize())
+		sess = &tdsSession{
+			buf:                       buf,
+			loginAck:                  c.sess.loginAck,
+			alwaysEncrypted:           c.sess.alwaysEncrypted,
+			alwaysEncryptedSettings:   c.sess.alwaysEncryptedSettings,
+			utf8Support:               c.sess.utf8Support,
+			dataClassificationVersion: c.sess.dataClassificationVersion,
+			logFlags:                  c.sess.logFlags,
+			logger:                    c.sess.logger,
+		}
+	}
+	sess.database = c.sess.database
+	sess.tranid = c.sess.tranid
+	sess.marsTranid = c.sess.tranid
+	sess.returnStatus = c.sess.returnStatus
+	return sess, nil
 }
 
-func (c *Conn) checkBadConn(err error) error {
-	// this is a hack to address Issue #275
-	// we set connectionGood flag to false if
-	// error indicates that connection is not usable
-	// but we return actual error instead of ErrBadConn
-	// this will cause connection to stay in a pool
-	// but next request to this connection will return ErrBadConn
+// releaseSession makes a session acquired with acquireSession available
+// for the next request. Transaction changes made by the request are
+// carried over to the connection's session.
+func (c *Conn) releaseSession(sess *tdsSession) {
+	if sess == nil || sess == c.sess {
+		return
+	}
+	if sess.tranid != sess.marsTranid {
+		c.sess.tranid = sess.tranid
+	}
+	if !c.connectionGood {
+		sess.buf.transport.Close()
+		return
+	}
+	c.idleSessions = append(c.idleSessions, sess)
+}
 
-	// it might be possible to revise this hack after
-	// https://github.com/golang/go/issues/20807
-	// is implemented
+// checkBadConn marks the connection bad when err shows it is not usable.
+// mayRetry tells whether the request could not have reached the server, it
+// is then returned as a RetryableError for database/sql to retry it on
+// another connection, unless retries are disabled.
+//
+// Otherwise the actual error is returned instead of ErrBadConn, see
+// Issue #275. The connection stays in the pool but the next request on it
+// returns ErrBadConn.
+func (c *Conn) checkBadConn(ctx context.Context, err error, mayRetry bool) error {
 	switch err {
 	case nil:
 		return nil
 	case io.EOF:
 		c.connectionGood = false
-		return driver.ErrBadConn
 	case driver.ErrBadConn:
 		// It is an internal programming error if driver.ErrBadConn
 		// is ever passed to this function. driver.ErrBadConn should
@@ -186,17 +361,30 @@ func (c *Conn) checkBadConn(err error) error {
 	switch err.(type) {
 	case net.Error:
 		c.connectionGood = false
-		return err
 	case StreamError:
 		c.connectionGood = false
+	case ServerError:
+		c.connectionGood = false
+	}
+
+	if c.connectionGood {
 		return err
-	default:
-		return err
 	}
+	if mayRetry && c.connector != nil && !c.connector.params.DisableRetry {
+		if c.sess.logFlags&logRetries != 0 {
+			c.sess.logger.Log(ctx, msdsn.LogRetries, err.Error())
+		}
+		return newRetryableError(err)
+	}
+	if err == io.EOF {
+		// io.EOF would end the rows being read as if nothing was wrong
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 func (c *Conn) clearOuts() {
-	c.outs = nil
+	c.outs = outputs{}
 }
 
 func (c *Conn) simpleProcessResp(ctx context.Context) error {
@@ -206,7 +394,7 @@ func (c *Conn) simpleProcessResp(ctx context.Context) error {
 	var resultError error
 	err := reader.iterateResponse()
 	if err != nil {
-		return c.checkBadConn(err)
+		return c.checkBadConn(ctx, err, false)
 	}
 	return resultError
 }
@@ -216,7 +404,7 @@ func (c *Conn) Commit() error {
 		return driver.ErrBadConn
 	}
 	if err := c.sendCommitRequest(); err != nil {
-		return c.checkBadConn(err)
+		return c.checkBadConn(c.transactionCtx, err, false)
 	}
 	return c.simpleProcessResp(c.transactionCtx)
 }
@@ -230,7 +418,7 @@ func (c *Conn) sendCommitRequest() error {
 	c.resetSession = false
 	if err := sendCommitXact(c.sess.buf, headers, "", 0, 0, "", reset); err != nil {
 		if c.sess.logFlags&logErrors != 0 {
-			c.sess.log.Printf("Failed to send CommitXact with %v", err)
+			c.sess.logger.Log(c.transactionCtx, msdsn.LogErrors, fmt.Sprintf("Failed to send CommitXact with %v", err))
 		}
 		c.connectionGood = false
 		return fmt.Errorf("faild to send CommitXact: %v", err)
@@ -243,7 +431,7 @@ func (c *Conn) Rollback() error {
 		return driver.ErrBadConn
 	}
 	if err := c.sendRollbackRequest(); err != nil {
-		return c.checkBadConn(err)
+		return c.checkBadConn(c.transactionCtx, err, false)
 	}
 	return c.simpleProcessResp(c.transactionCtx)
 }
@@ -257,7 +445,7 @@ func (c *Conn) sendRollbackRequest() error {
 	c.resetSession = false
 	if err := sendRollbackXact(c.sess.buf, headers, "", 0, 0, "", reset); err != nil {
 		if c.sess.logFlags&logErrors != 0 {
-			c.sess.log.Printf("Failed to send RollbackXact with %v", err)
+			c.sess.logger.Log(c.transactionCtx, msdsn.LogErrors, fmt.Sprintf("Failed to send RollbackXact with %v", err))
 		}
 		c.connectionGood = false
 		return fmt.Errorf("failed to send RollbackXact: %v", err)
@@ -273,9 +461,9 @@ func (c *Conn) begin(ctx context.Context, tdsIsolation isoLevel) (tx driver.Tx,
 	if !c.connectionGood {
 		return nil, driver.ErrBadConn
 	}
-	err = c.sendBeginRequest(ctx, tdsIsolation)
+	err = c.sendWithRecovery(ctx, true, func() error { return c.sendBeginRequest(ctx, tdsIsolation) })
 	if err != nil {
-		return nil, c.checkBadConn(err)
+		return nil, c.checkBadConn(ctx, err, true)
 	}
 	tx, err = c.processBeginResponse(ctx)
 	if err != nil {
@@ -294,7 +482,7 @@ func (c *Conn) sendBeginRequest(ctx context.Context, tdsIsolation isoLevel) erro
 	c.resetSession = false
 	if err := sendBeginXact(c.sess.buf, headers, tdsIsolation, "", reset); err != nil {
 		if c.sess.logFlags&logErrors != 0 {
-			c.sess.log.Printf("Failed to send BeginXact with %v", err)
+			c.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send BeginXact with %v", err))
 		}
 		c.connectionGood = false
 		return fmt.Errorf("failed to send BeginXact: %v", err)
@@ -312,36 +500,27 @@ func (c *Conn) processBeginResponse(ctx context.Context) (driver.Tx, error) {
 }
 
 func (d *Driver) open(ctx context.Context, dsn string) (*Conn, error) {
-	params, err := parseConnectParams(dsn)
+	c, err := d.OpenConnector(dsn)
 	if err != nil {
 		return nil, err
 	}
-	return d.connect(ctx, nil, params)
+	return d.connect(ctx, c, c.params)
 }
 
 // connect to the server, using the provided context for dialing only.
-func (d *Driver) connect(ctx context.Context, c *Connector, params connectParams) (*Conn, error) {
-	sess, err := connect(ctx, c, d.log, params)
+func (d *Driver) connect(ctx context.Context, c *Connector, params msdsn.Config) (*Conn, error) {
+	logger := d.logger
+	if c != nil && c.logger != nil {
+		logger = optionalLogger{c.logger}
+	}
+	sess, params, err := connectMirror(ctx, c, logger, params, nil)
 	if err != nil {
-		// main server failed, try fail-over partner
-		if params.failOverPartner == "" {
-			return nil, err
-		}
-
-		params.host = params.failOverPartner
-		if params.failOverPort != 0 {
-			params.port = params.failOverPort
-		}
-
-		sess, err = connect(ctx, c, d.log, params)
-		if err != nil {
-			// fail-over partner also failed, now fail
-			return nil, err
-		}
+		return nil, err
 	}
 
 	conn := &Conn{
 		connector:        c,
+		params:           params,
 		sess:             sess,
 		transactionCtx:   context.Background(),
 		processQueryText: d.processQueryText,
@@ -352,6 +531,9 @@ func (d *Driver) connect(ctx context.Context, c *Connector, params connectParams
 }
 
 func (c *Conn) Close() error {
+	if c.sess.mux != nil {
+		return c.sess.mux.Close()
+	}
 	return c.sess.buf.transport.Close()
 }
 
@@ -360,6 +542,22 @@ type Stmt struct {
 	query      string
 	paramCount int
 	notifSub   *queryNotifSub
+
+	// sess is the session the last request was sent on.
+	sess *tdsSession
+
+	// handle is the server handle of the prepared statement, 0 while
+	// not prepared. It was prepared with the parameter declarations in
+	// handleDecls and is only valid while handleGen matches the
+	// connection's prepareGen.
+	handle      int32
+	handleDecls string
+	handleGen   int
+	// preparing is set while the handle of sp_prepexec is expected.
+	preparing bool
+	// executed is set by the first execution with parameters, which
+	// is not prepared.
+	executed bool
 }
 
 type queryNotifSub struct {
@@ -383,11 +581,97 @@ func (c *Conn) prepareContext(ctx context.Context, query string) (*Stmt, error)
 	if c.processQueryText {
 		query, paramCount = querytext.ParseParams(query)
 	}
-	return &Stmt{c, query, paramCount, nil}, nil
+	return &Stmt{c: c, query: query, paramCount: paramCount}, nil
 }
 
 func (s *Stmt) Close() error {
-	return nil
+	if !s.prepared() || !s.c.connectionGood {
+		return nil
+	}
+	handle := s.handle
+	s.handle = 0
+	sess, err := s.c.acquireSession()
+	if err != nil {
+		s.c.connectionGood = false
+		return fmt.Errorf("failed to open MARS session: %v", err)
+	}
+	defer s.c.releaseSession(sess)
+	return s.c.checkBadConn(context.Background(), s.c.unprepare(sess, handle), false)
+}
+
+// prepared reports whether the statement has a valid server handle.
+func (s *Stmt) prepared() bool {
+	return s.handle != 0 && s.handleGen == s.c.prepareGen
+}
+
+// gotReturnValue takes the handle from the first output parameter of
+// sp_prepexec.
+func (s *Stmt) gotReturnValue(nv namedValue) {
+	if !s.preparing {
+		return
+	}
+	s.preparing = false
+	if handle, ok := nv.Value.(int64); ok {
+		s.handle = int32(handle)
+		s.handleGen = s.c.prepareGen
+	}
+}
+
+// preparedCall returns the procedure and parameters executing the
+// statement with the arguments in params[2:]. The first execution runs
+// the statement with sp_executesql, so statements executed only once,
+// like the ones of db.Exec, need no sp_unprepare when closed. The second
+// execution prepares the statement with sp_prepexec, later ones reuse
+// its handle with sp_execute as long as the parameter declarations stay
+// the same.
+func (s *Stmt) preparedCall(sess *tdsSession, params []param) (procId, []param, error) {
+	decls := make([]string, len(params)-2)
+	for i, p := range params[2:] {
+		decls[i] = fmt.Sprintf("%s %s", p.Name, makePrepareDecl(p.ti))
+	}
+	declText := strings.Join(decls, ",")
+	s.preparing = false
+	if !s.executed {
+		s.executed = true
+		params[0] = makeStrParam(s.query)
+		params[1] = makeStrParam(declText)
+		return sp_ExecuteSql, params, nil
+	}
+	if s.prepared() {
+		if s.handleDecls == declText {
+			params[1] = makeIntParam(s.handle)
+			return sp_Execute, params[1:], nil
+		}
+		// the parameter types changed, the handle is of no use anymore
+		handle := s.handle
+		s.handle = 0
+		if err := s.c.unprepare(sess, handle); err != nil {
+			return procId{}, nil, err
+		}
+	}
+	// the handle is returned as output parameter, sent as NULL
+	handle := makeOutIntParam(0)
+	handle.buffer = nil
+	params = append([]param{handle}, params...)
+	params[1] = makeStrParam(declText)
+	params[2] = makeStrParam(s.query)
+	s.handleDecls = declText
+	s.preparing = true
+	return sp_PrepExec, params, nil
+}
+
+// unprepare releases a prepared statement handle on the server.
+func (c *Conn) unprepare(sess *tdsSession, handle int32) error {
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{sess.tranid, 1}.pack()},
+	}
+	if err := sendRpc(sess.buf, headers, sp_Unprepare, 0, []param{makeIntParam(handle)}, false); err != nil {
+		c.connectionGood = false
+		return fmt.Errorf("failed to send RPC: %v", err)
+	}
+	reader := startReading(sess, context.Background(), outputs{})
+	return reader.iterateResponse()
 }
 
 func (s *Stmt) SetQueryNotification(id, options string, timeout time.Duration) {
@@ -405,10 +689,19 @@ func (s *Stmt) NumInput() int {
 	return s.paramCount
 }
 
-func (s *Stmt) sendQuery(args []namedValue) (err error) {
+func (s *Stmt) sendQuery(ctx context.Context, args []namedValue) (err error) {
+	conn := s.c
+	s.sess = nil
+	sess, err := conn.acquireSession()
+	if err != nil {
+		conn.connectionGood = false
+		return fmt.Errorf("failed to open MARS session: %v", err)
+	}
+	s.sess = sess
+
 	headers := []headerStruct{
 		{hdrtype: dataStmHdrTransDescr,
-			data: transDescrHdr{s.c.sess.tranid, 1}.pack()},
+			data: transDescrHdr{sess.tranid, 1}.pack()},
 	}
 
 	if s.notifSub != nil {
@@ -423,28 +716,26 @@ func (s *Stmt) sendQuery(args []namedValue) (err error) {
 			})
 	}
 
-	conn := s.c
-
 	// no need to check number of parameters here, it is checked by database/sql
 	if conn.sess.logFlags&logSQL != 0 {
-		conn.sess.log.Println(s.query)
+		conn.sess.logger.Log(ctx, msdsn.LogSQL, s.query)
 	}
 	if conn.sess.logFlags&logParams != 0 && len(args) > 0 {
 		for i := 0; i < len(args); i++ {
 			if len(args[i].Name) > 0 {
-				s.c.sess.log.Printf("\t@%s\t%v\n", args[i].Name, args[i].Value)
+				s.c.sess.logger.Log(ctx, msdsn.LogParams, fmt.Sprintf("\t@%s\t%v", args[i].Name, args[i].Value))
 			} else {
-				s.c.sess.log.Printf("\t@p%d\t%v\n", i+1, args[i].Value)
+				s.c.sess.logger.Log(ctx, msdsn.LogParams, fmt.Sprintf("\t@p%d\t%v", i+1, args[i].Value))
 			}
 		}
 	}
 
-	reset := conn.resetSession
-	conn.resetSession = false
 	if len(args) == 0 {
-		if err = sendSqlBatch72(conn.sess.buf, s.query, headers, reset); err != nil {
+		reset := conn.resetSession
+		conn.resetSession = false
+		if err = sendSqlBatch72(sess.buf, s.query, headers, reset); err != nil {
 			if conn.sess.logFlags&logErrors != 0 {
-				conn.sess.log.Printf("Failed to send SqlBatch with %v", err)
+				conn.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send SqlBatch with %v", err))
 			}
 			conn.connectionGood = false
 			return fmt.Errorf("failed to send SQL Batch: %v", err)
@@ -458,18 +749,53 @@ func (s *Stmt) sendQuery(args []namedValue) (err error) {
 			if err != nil {
 				return
 			}
+			if sess.alwaysEncrypted {
+				tsql, decls := procCallText(s.query, params)
+				if _, err = conn.encryptParams(ctx, sess, tsql, decls, params); err != nil {
+					return
+				}
+			}
 		} else {
 			var decls []string
 			params, decls, err = s.makeRPCParams(args, false)
 			if err != nil {
 				return
 			}
-			params[0] = makeStrParam(s.query)
-			params[1] = makeStrParam(strings.Join(decls, ","))
+			// statements with encrypted parameters are not prepared, the
+			// declarations must be the ones they were described with
+			encrypted := false
+			if sess.alwaysEncrypted {
+				encrypted, err = conn.encryptParams(ctx, sess, s.query, strings.Join(decls, ","), params[2:])
+				if err != nil {
+					return
+				}
+			}
+			if conn.params.DisablePrepare || encrypted {
+				params[0] = makeStrParam(s.query)
+				params[1] = makeStrParam(strings.Join(decls, ","))
+			} else {
+				proc, params, err = s.preparedCall(sess, params)
+				if err != nil {
+					return
+				}
+			}
+		}
+		reset := conn.resetSession
+		conn.resetSession = false
+		for i := range params {
+			if params[i].reader != nil {
+				params[i].reader = contextReader{ctx, params[i].reader}
+			}
 		}
-		if err = sendRpc(conn.sess.buf, headers, proc, 0, params, reset); err != nil {
+		if err = sendRpc(sess.buf, headers, proc, 0, params, reset); err != nil {
+			if perr, ok := err.(paramReadError); ok {
+				if conn.sess.logFlags&logErrors != 0 {
+					conn.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to read parameter with %v", perr.err))
+				}
+				return conn.abortRequest(sess, reset, perr.err)
+			}
 			if conn.sess.logFlags&logErrors != 0 {
-				conn.sess.log.Printf("Failed to send Rpc with %v", err)
+				conn.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send Rpc with %v", err))
 			}
 			conn.connectionGood = false
 			return fmt.Errorf("failed to send RPC: %v", err)
@@ -478,6 +804,21 @@ func (s *Stmt) sendQuery(args []namedValue) (err error) {
 	return
 }
 
+// abortRequest ends a request which could not be written completely
+// because reading a parameter failed. When a part of the request was
+// already sent, the server is told to ignore it and the connection is not
+// used anymore.
+func (c *Conn) abortRequest(sess *tdsSession, reset bool, err error) error {
+	sent, aerr := sess.buf.AbortPacket()
+	if sent || aerr != nil {
+		c.connectionGood = false
+	} else {
+		// the session reset was not sent, it is left for the next request
+		c.resetSession = reset
+	}
+	return err
+}
+
 // isProc takes the query text in s and determines if it is a stored proc name
 // or SQL text.
 func isProc(s string) bool {
@@ -579,21 +920,34 @@ func (s *Stmt) Query(args []driver.Value) (driver.Rows, error) {
 }
 
 func (s *Stmt) queryContext(ctx context.Context, args []namedValue) (rows driver.Rows, err error) {
+	// StreamBlobs applies to this request only, also when it fails
+	defer func() { s.c.streamBlobs = false }()
 	if !s.c.connectionGood {
 		return nil, driver.ErrBadConn
 	}
-	if err = s.sendQuery(args); err != nil {
-		return nil, s.c.checkBadConn(err)
+	resend := !hasStreamArgs(args)
+	err = s.c.sendWithRecovery(ctx, resend, func() error { return s.sendQuery(ctx, args) })
+	if err != nil {
+		s.c.releaseSession(s.sess)
+		return nil, s.c.checkBadConn(ctx, err, resend)
 	}
 	return s.processQueryResponse(ctx)
 }
 
 func (s *Stmt) processQueryResponse(ctx context.Context) (res driver.Rows, err error) {
 	ctx, cancel := context.WithCancel(ctx)
-	reader := startReading(s.c.sess, ctx, s.c.outs)
+	sess := s.session()
+	sess.streamBlobs, s.c.streamBlobs = s.c.streamBlobs, false
+	reader := startReading(sess, ctx, s.c.outs)
 	s.c.clearOuts()
+	// With a message queue the response is read as the application
+	// goes through the messages, errors are delivered as messages too.
+	if reader.outs.msgq != nil {
+		return &Rowsq{stmt: s, sess: sess, reader: reader, cancel: cancel}, nil
+	}
 	// process metadata
 	var cols []columnStruct
+	var classification *DataClassification
 loop:
 	for {
 		tok, err := reader.nextToken()
@@ -609,6 +963,8 @@ loop:
 				// see TestIgnoreEmptyResults test
 				//case doneStruct:
 				//break loop
+				case *DataClassification:
+					classification = token
 				case []columnStruct:
 					cols = token
 					break loop
@@ -616,19 +972,25 @@ loop:
 					if token.isError() {
 						// need to cleanup cancellable context
 						cancel()
-						return nil, s.c.checkBadConn(token.getError())
+						err = s.c.checkBadConn(ctx, token.getError(), false)
+						s.c.releaseSession(sess)
+						return nil, err
 					}
 				case ReturnStatus:
-					s.c.sess.setReturnStatus(token)
+					sess.setReturnStatus(token)
+				case namedValue:
+					s.gotReturnValue(token)
 				}
 			}
 		} else {
 			// need to cleanup cancellable context
 			cancel()
-			return nil, s.c.checkBadConn(err)
+			err = s.c.checkBadConn(ctx, err, false)
+			s.c.releaseSession(sess)
+			return nil, err
 		}
 	}
-	res = &Rows{stmt: s, reader: reader, cols: cols, cancel: cancel}
+	res = &Rows{stmt: s, sess: sess, reader: reader, cols: cols, classification: classification, cancel: cancel}
 	return
 }
 
@@ -637,51 +999,94 @@ func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
 }
 
 func (s *Stmt) exec(ctx context.Context, args []namedValue) (res driver.Result, err error) {
+	// StreamBlobs applies to this request only, also when it fails
+	defer func() { s.c.streamBlobs = false }()
 	if !s.c.connectionGood {
 		return nil, driver.ErrBadConn
 	}
-	if err = s.sendQuery(args); err != nil {
-		return nil, s.c.checkBadConn(err)
+	resend := !hasStreamArgs(args)
+	err = s.c.sendWithRecovery(ctx, resend, func() error { return s.sendQuery(ctx, args) })
+	if err != nil {
+		s.c.releaseSession(s.sess)
+		return nil, s.c.checkBadConn(ctx, err, resend)
 	}
 	if res, err = s.processExec(ctx); err != nil {
-		return nil, s.c.checkBadConn(err)
+		return nil, err
 	}
 	return
 }
 
 func (s *Stmt) processExec(ctx context.Context) (res driver.Result, err error) {
-	reader := startReading(s.c.sess, ctx, s.c.outs)
+	sess := s.session()
+	// messages are only delivered to queries, see Rowsq
+	reader := startReading(sess, ctx, outputs{params: s.c.outs.params})
 	s.c.clearOuts()
 	err = reader.iterateResponse()
+	for _, nv := range reader.returnValues {
+		s.gotReturnValue(nv)
+	}
+	err = s.c.checkBadConn(ctx, err, false)
+	s.c.releaseSession(sess)
 	if err != nil {
-		return nil, s.c.checkBadConn(err)
+		return nil, err
 	}
 	return &Result{s.c, reader.rowCount}, nil
 }
 
+// session returns the session the response of the last request
+// is read from.
+func (s *Stmt) session() *tdsSession {
+	if s.sess != nil {
+		return s.sess
+	}
+	return s.c.sess
+}
+
 type Rows struct {
 	stmt     *Stmt
+	sess     *tdsSession
 	cols     []columnStruct
 	reader   *tokenProcessor
 	nextCols []columnStruct
 
+	classification     *DataClassification
+	nextClassification *DataClassification
+
+	// blob is the BlobReader of the current row.
+	blob *BlobReader
+
 	cancel func()
 }
 
+// releaseBlob lets the response go on after the current row,
+// skipping the unread part of its BlobReader.
+func (rc *Rows) releaseBlob() {
+	if rc.blob != nil {
+		rc.blob.release()
+		rc.blob = nil
+	}
+}
+
 func (rc *Rows) Close() error {
 	// need to add a test which returns lots of rows
 	// and check closing after reading only few rows
+	rc.releaseBlob()
 	rc.cancel()
+	defer func() {
+		rc.stmt.c.releaseSession(rc.sess)
+		rc.sess = nil
+	}()
 
 	for {
 		tok, err := rc.reader.nextToken()
 		if err == nil {
 			if tok == nil {
 				return nil
-			} else {
-				// continue consuming tokens
-				continue
+			} else if nv, ok := tok.(namedValue); ok {
+				rc.stmt.gotReturnValue(nv)
 			}
+			releaseBlob(tok)
+			// continue consuming tokens
 		} else {
 			if err == rc.reader.ctx.Err() {
 				return nil
@@ -704,6 +1109,7 @@ func (rc *Rows) Next(dest []driver.Value) error {
 	if !rc.stmt.c.connectionGood {
 		return driver.ErrBadConn
 	}
+	rc.releaseBlob()
 	if rc.nextCols != nil {
 		return io.EOF
 	}
@@ -714,25 +1120,33 @@ func (rc *Rows) Next(dest []driver.Value) error {
 				return io.EOF
 			} else {
 				switch tokdata := tok.(type) {
+				case *DataClassification:
+					rc.nextClassification = tokdata
 				case []columnStruct:
 					rc.nextCols = tokdata
 					return io.EOF
 				case []interface{}:
+					rc.blob = rowBlob(tokdata)
+					if err := rowDecryptionError(tokdata); err != nil {
+						return err
+					}
 					for i := range dest {
 						dest[i] = tokdata[i]
 					}
 					return nil
 				case doneStruct:
 					if tokdata.isError() {
-						return rc.stmt.c.checkBadConn(tokdata.getError())
+						return rc.stmt.c.checkBadConn(rc.reader.ctx, tokdata.getError(), false)
 					}
 				case ReturnStatus:
-					rc.stmt.c.sess.setReturnStatus(tokdata)
+					rc.sess.setReturnStatus(tokdata)
+				case namedValue:
+					rc.stmt.gotReturnValue(tokdata)
 				}
 			}
 
 		} else {
-			return rc.stmt.c.checkBadConn(err)
+			return rc.stmt.c.checkBadConn(rc.reader.ctx, err, false)
 		}
 	}
 }
@@ -744,12 +1158,21 @@ func (rc *Rows) HasNextResultSet() bool {
 func (rc *Rows) NextResultSet() error {
 	rc.cols = rc.nextCols
 	rc.nextCols = nil
+	rc.classification = rc.nextClassification
+	rc.nextClassification = nil
 	if rc.cols == nil {
 		return io.EOF
 	}
 	return nil
 }
 
+// DataClassification returns the sensitivity classification of the
+// current result set, or nil if the server did not send one.
+// Data classification requires SQL Server 2019 or Azure SQL Database.
+func (rc *Rows) DataClassification() *DataClassification {
+	return rc.classification
+}
+
 // It should return
 // the value type that can be used to scan types into. For example, the database
 // column type "bigint" this should return "reflect.TypeOf(int64(0))".
@@ -821,6 +1244,30 @@ func (s *Stmt) makeParam(val driver.Value) (res param, err error) {
 		res.buffer = make([]byte, 8)
 		res.ti.Size = 8
 		binary.LittleEndian.PutUint64(res.buffer, uint64(val))
+	// sized integers and float32 only get here for Always Encrypted
+	// connections, where they declare the parameter as the type of the
+	// encrypted column
+	case int32:
+		res.ti.TypeId = typeIntN
+		res.buffer = make([]byte, 4)
+		res.ti.Size = 4
+		binary.LittleEndian.PutUint32(res.buffer, uint32(val))
+	case int16:
+		res.ti.TypeId = typeIntN
+		res.buffer = make([]byte, 2)
+		res.ti.Size = 2
+		binary.LittleEndian.PutUint16(res.buffer, uint16(val))
+	case int8:
+		if val < 0 {
+			return res, fmt.Errorf("mssql: int8 value %d is out of range for tinyint", val)
+		}
+		res.ti.TypeId = typeIntN
+		res.buffer = []byte{byte(val)}
+		res.ti.Size = 1
+	case uint8:
+		res.ti.TypeId = typeIntN
+		res.buffer = []byte{val}
+		res.ti.Size = 1
 	case sql.NullInt64:
 		// only null values should be getting here
 		res.ti.TypeId = typeIntN
@@ -832,6 +1279,11 @@ func (s *Stmt) makeParam(val driver.Value) (res param, err error) {
 		res.ti.Size = 8
 		res.buffer = make([]byte, 8)
 		binary.LittleEndian.PutUint64(res.buffer, math.Float64bits(val))
+	case float32:
+		res.ti.TypeId = typeFltN
+		res.ti.Size = 4
+		res.buffer = make([]byte, 4)
+		binary.LittleEndian.PutUint32(res.buffer, math.Float32bits(val))
 	case sql.NullFloat64:
 		// only null values should be getting here
 		res.ti.TypeId = typeFltN
@@ -895,7 +1347,7 @@ func (c *Conn) Ping(ctx context.Context) error {
 	if !c.connectionGood {
 		return driver.ErrBadConn
 	}
-	stmt := &Stmt{c, `select 1;`, 0, nil}
+	stmt := &Stmt{c: c, query: `select 1;`}
 	_, err := stmt.ExecContext(ctx, nil)
 	return err
 }
@@ -16,6 +16,8 @@ func (c *Conn) ResetSession(ctx context.Context) error {
 		return driver.ErrBadConn
 	}
 	c.resetSession = true
+	// resetting the session unprepares all statements
+	c.prepareGen++
 
 	if c.connector == nil || len(c.connector.SessionInitSQL) == 0 {
 		return nil
@@ -0,0 +1,11 @@
+// +build go1.18
+
+package mssql
+
+// newRetryableError returns an error that allows the database/sql package
+// to automatically retry the failed query. Versions of Go 1.18 and higher
+// use errors.Is to determine whether or not a failed query can be retried,
+// so the error is wrapped in a RetryableError which keeps its details.
+func newRetryableError(err error) error {
+	return RetryableError{err: err}
+}
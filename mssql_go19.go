@@ -7,11 +7,16 @@ import (
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"time"
 
 	// "github.com/cockroachdb/apd"
 	"github.com/golang-sql/civil"
+	"github.com/golang-sql/sqlexp"
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
 // Type alias provided for compatibility.
@@ -27,6 +32,7 @@ type MssqlStmt = Stmt               // Deprecated: users should transition to th
 var _ driver.NamedValueChecker = &Conn{}
 
 // VarChar parameter types.
+// Values are sent as UTF-8 when the server supports UTF-8 collations.
 type VarChar string
 
 type NVarCharMax string
@@ -56,9 +62,16 @@ func convertInputParameter(val interface{}) (interface{}, error) {
 		return val, nil
 	case civil.Time:
 		return val, nil
+	case StreamParam:
+		return val, nil
 		// case *apd.Decimal:
 		// 	return nil
 	default:
+		if r, ok := v.(io.Reader); ok {
+			if _, ok = v.(driver.Valuer); !ok {
+				return StreamParam{Reader: r}, nil
+			}
+		}
 		return driver.DefaultParameterConverter.ConvertValue(v)
 	}
 }
@@ -66,10 +79,10 @@ func convertInputParameter(val interface{}) (interface{}, error) {
 func (c *Conn) CheckNamedValue(nv *driver.NamedValue) error {
 	switch v := nv.Value.(type) {
 	case sql.Out:
-		if c.outs == nil {
-			c.outs = make(map[string]interface{})
+		if c.outs.params == nil {
+			c.outs.params = make(map[string]interface{})
 		}
-		c.outs[nv.Name] = v.Dest
+		c.outs.params[nv.Name] = v.Dest
 
 		if v.Dest == nil {
 			return errors.New("destination is a nil pointer")
@@ -112,9 +125,41 @@ func (c *Conn) CheckNamedValue(nv *driver.NamedValue) error {
 		*v = 0 // By default the return value should be zero.
 		c.sess.returnStatus = v
 		return driver.ErrRemoveArgument
+	case StreamBlobs:
+		c.streamBlobs = true
+		return driver.ErrRemoveArgument
+	case *sqlexp.ReturnMessage:
+		sqlexp.ReturnMessageInit(v)
+		c.outs.msgq = v
+		return driver.ErrRemoveArgument
 	case TVP:
 		return nil
 	default:
+		if c.sess.alwaysEncrypted {
+			// the server does not convert encrypted values, keep the size
+			// of integers and floats for int, smallint, tinyint and real
+			// columns, and the type of NULL values
+			switch v := nv.Value.(type) {
+			case int32, int16, int8, uint8, float32:
+				return nil
+			case sql.NullInt64:
+				if !v.Valid {
+					return nil
+				}
+			case sql.NullFloat64:
+				if !v.Valid {
+					return nil
+				}
+			case sql.NullString:
+				if !v.Valid {
+					return nil
+				}
+			case sql.NullBool:
+				if !v.Valid {
+					return nil
+				}
+			}
+		}
 		var err error
 		nv.Value, err = convertInputParameter(nv.Value)
 		return err
@@ -127,10 +172,12 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 		res.ti.TypeId = typeBigVarChar
 		res.buffer = []byte(val)
 		res.ti.Size = len(res.buffer)
+		res.ti.Collation = s.varcharCollation()
 	case VarCharMax:
 		res.ti.TypeId = typeBigVarChar
 		res.buffer = []byte(val)
 		res.ti.Size = 0 // currently zero forces varchar(max)
+		res.ti.Collation = s.varcharCollation()
 	case NVarCharMax:
 		res.ti.TypeId = typeNVarChar
 		res.buffer = str2ucs2(string(val))
@@ -159,6 +206,21 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 		res.ti.Scale = 7
 		res.buffer = encodeTime(val.Hour, val.Minute, val.Second, val.Nanosecond, int(res.ti.Scale))
 		res.ti.Size = len(res.buffer)
+	case StreamParam:
+		res.reader = val.Reader
+		res.ti.Size = 0 // zero forces (max)
+		switch val.Type {
+		case StreamVarBinary:
+			res.ti.TypeId = typeBigVarBin
+		case StreamNVarChar:
+			res.ti.TypeId = typeNVarChar
+			res.reader = transform.NewReader(val.Reader, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder())
+		case StreamVarChar:
+			res.ti.TypeId = typeBigVarChar
+			res.ti.Collation = s.varcharCollation()
+		default:
+			err = fmt.Errorf("mssql: unknown StreamParam type %d", val.Type)
+		}
 	case sql.Out:
 		res, err = s.makeParam(val.Dest)
 		res.Flags = fByRevValue
@@ -174,6 +236,11 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 		res.ti.UdtInfo.TypeName = name
 		res.ti.UdtInfo.SchemaName = schema
 		res.ti.TypeId = typeTvp
+		if val.hasRows() {
+			res.buffer, err = val.encodeRows(schema, name, s.varcharCollation(), s.c.sess.collation)
+			res.ti.Size = len(res.buffer)
+			return
+		}
 		columnStr, tvpFieldIndexes, errCalTypes := val.columnTypes()
 		if errCalTypes != nil {
 			err = errCalTypes
@@ -191,6 +258,16 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 	return
 }
 
+// varcharCollation returns the collation varchar parameters are sent with.
+// When the server supports UTF-8 the parameter bytes are sent as UTF-8,
+// otherwise the server interprets them in the database code page.
+func (s *Stmt) varcharCollation() cp.Collation {
+	if s.c.sess.utf8Support {
+		return utf8Collation
+	}
+	return cp.Collation{}
+}
+
 func scanIntoOut(name string, fromServer, scanInto interface{}) error {
 	return convertAssign(scanInto, fromServer)
 }
@@ -207,6 +207,6 @@ func BenchmarkSelectParser(b *testing.B) {
 		if err != nil {
 			b.Fatal(err)
 		}
-		processSingleResponse(sess, ch, nil)
+		processSingleResponse(context.Background(), sess, ch, outputs{})
 	}
 }
\ No newline at end of file
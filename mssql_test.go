@@ -3,7 +3,11 @@ package mssql
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"testing"
+	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 func TestBadOpen(t *testing.T) {
@@ -14,6 +18,20 @@ func TestBadOpen(t *testing.T) {
 	}
 }
 
+func TestNewConnectorConfigDefaults(t *testing.T) {
+	c := NewConnectorConfig(msdsn.Config{})
+	d := msdsn.DefaultConfig()
+	if c.params.DialTimeout != d.DialTimeout || c.params.KeepAlive != d.KeepAlive || c.params.PacketSize != d.PacketSize ||
+		c.params.AppName != d.AppName || c.params.ConnectRetryInterval != d.ConnectRetryInterval {
+		t.Errorf("zero settings did not take their defaults: %+v", c.params)
+	}
+
+	c = NewConnectorConfig(msdsn.Config{DialTimeout: -1, ConnectRetryInterval: time.Second})
+	if c.params.DialTimeout != -1 || c.params.ConnectRetryInterval != time.Second {
+		t.Errorf("settings were overwritten: %+v", c.params)
+	}
+}
+
 func TestIsProc(t *testing.T) {
 	list := []struct {
 		s  string
@@ -68,4 +86,77 @@ func TestConvertIsolationLevel(t *testing.T) {
 	if err == nil {
 		t.Fatal("must fail but it didn't")
 	}
-}
\ No newline at end of file
+}
+
+func TestStreamBlobsClearedOnError(t *testing.T) {
+	c := &Conn{streamBlobs: true}
+	s := &Stmt{c: c, query: "select 1"}
+	if _, err := s.queryContext(context.Background(), nil); err != driver.ErrBadConn {
+		t.Fatalf("query on a bad connection returned %v", err)
+	}
+	if c.streamBlobs {
+		t.Error("StreamBlobs of a failed query should not apply to the next one")
+	}
+	c.streamBlobs = true
+	if _, err := s.exec(context.Background(), nil); err != driver.ErrBadConn {
+		t.Fatalf("exec on a bad connection returned %v", err)
+	}
+	if c.streamBlobs {
+		t.Error("StreamBlobs of a failed exec should not apply to the next request")
+	}
+}
+
+func TestPreparedCall(t *testing.T) {
+	c := &Conn{}
+	s := &Stmt{c: c, query: "select @p1"}
+	args := []namedValue{{Ordinal: 1, Value: "abc"}}
+	params, _, err := s.makeRPCParams(args, false)
+	if err != nil {
+		t.Fatal("makeRPCParams failed:", err)
+	}
+
+	proc, firstParams, err := s.preparedCall(nil, params)
+	if err != nil {
+		t.Fatal("preparedCall failed:", err)
+	}
+	if proc != sp_ExecuteSql || len(firstParams) != 3 || s.prepared() {
+		t.Fatalf("first execution should call sp_executesql, got %v with %d params", proc, len(firstParams))
+	}
+
+	params, _, _ = s.makeRPCParams(args, false)
+	proc, prepParams, err := s.preparedCall(nil, params)
+	if err != nil {
+		t.Fatal("preparedCall failed:", err)
+	}
+	if proc != sp_PrepExec || len(prepParams) != 4 || prepParams[0].Flags != fByRevValue {
+		t.Fatalf("second execution should call sp_prepexec, got %v with %d params", proc, len(prepParams))
+	}
+	if s.handleDecls != "@p1 nvarchar(4000)" {
+		t.Errorf("unexpected declarations %q", s.handleDecls)
+	}
+	s.gotReturnValue(namedValue{Value: int64(7)})
+	s.gotReturnValue(namedValue{Name: "@out", Value: int64(9)})
+	if !s.prepared() || s.handle != 7 {
+		t.Fatalf("handle %d was not taken from the first output parameter", s.handle)
+	}
+
+	args[0].Value = "a longer value"
+	params, _, _ = s.makeRPCParams(args, false)
+	proc, execParams, err := s.preparedCall(nil, params)
+	if err != nil {
+		t.Fatal("preparedCall failed:", err)
+	}
+	if proc != sp_Execute || len(execParams) != 2 {
+		t.Fatalf("executions after the second should call sp_execute, got %v with %d params", proc, len(execParams))
+	}
+
+	// a session reset drops the handle
+	c.prepareGen++
+	if s.prepared() {
+		t.Error("handle should not be valid after a session reset")
+	}
+	proc, _, _ = s.preparedCall(nil, params)
+	if proc != sp_PrepExec {
+		t.Errorf("execution after a session reset should prepare again, got %v", proc)
+	}
+}
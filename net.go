@@ -9,6 +9,7 @@ import (
 type timeoutConn struct {
 	c             net.Conn
 	timeout       time.Duration
+	lastUse       time.Time
 }
 
 func newTimeoutConn(conn net.Conn, timeout time.Duration) *timeoutConn {
@@ -19,6 +20,7 @@ func newTimeoutConn(conn net.Conn, timeout time.Duration) *timeoutConn {
 }
 
 func (c *timeoutConn) Read(b []byte) (n int, err error) {
+	c.lastUse = time.Now()
 	if c.timeout > 0 {
 		err = c.c.SetDeadline(time.Now().Add(c.timeout))
 		if err != nil {
@@ -29,6 +31,7 @@ func (c *timeoutConn) Read(b []byte) (n int, err error) {
 }
 
 func (c *timeoutConn) Write(b []byte) (n int, err error) {
+	c.lastUse = time.Now()
 	if c.timeout > 0 {
 		err = c.c.SetDeadline(time.Now().Add(c.timeout))
 		if err != nil {
@@ -38,6 +41,20 @@ func (c *timeoutConn) Write(b []byte) (n int, err error) {
 	return c.c.Write(b)
 }
 
+// idleCheckAfter is how long a connection has to be idle before
+// peerClosed checks whether the server closed it.
+const idleCheckAfter = time.Second
+
+// peerClosed reports whether the server closed a connection which has
+// been idle for a while. It does not block, and data received on the
+// connection is left for the next Read.
+func (c *timeoutConn) peerClosed() bool {
+	if time.Since(c.lastUse) < idleCheckAfter {
+		return false
+	}
+	return connClosed(c.c)
+}
+
 func (c timeoutConn) Close() error {
 	return c.c.Close()
 }
@@ -0,0 +1,39 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package mssql
+
+import (
+	"net"
+	"syscall"
+)
+
+// connCheckSupported tells whether connClosed can tell closed connections.
+const connCheckSupported = true
+
+// connClosed reports whether the peer closed conn, without blocking and
+// without consuming the data received on it.
+func connClosed(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	closed := false
+	err = raw.Read(func(fd uintptr) bool {
+		var b [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case n > 0:
+		case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR:
+		default:
+			// end of stream or a socket error
+			closed = true
+		}
+		// never wait for the socket to be readable
+		return true
+	})
+	return err != nil || closed
+}
@@ -0,0 +1,14 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package mssql
+
+import "net"
+
+// connCheckSupported tells whether connClosed can tell closed connections.
+const connCheckSupported = false
+
+// connClosed cannot check connections on this platform, a connection
+// closed by the peer is only noticed when a request fails.
+func connClosed(conn net.Conn) bool {
+	return false
+}
@@ -0,0 +1,356 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/swisscom/mssql-always-encrypted/pkg/encryption"
+	"github.com/swisscom/mssql-always-encrypted/pkg/keys"
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
+)
+
+// Parameters sent to columns encrypted with Always Encrypted are encrypted
+// by the driver. The server tells which parameters are, and with which
+// column encryption keys, when asked with sp_describe_parameter_encryption.
+// https://docs.microsoft.com/en-us/sql/relational-databases/system-stored-procedures/sp-describe-parameter-encryption-transact-sql
+
+var sp_DescribeParameterEncryption = procId{0, "sp_describe_parameter_encryption"}
+
+// maxParamEncryptions is the number of statements the encryption of
+// the parameters is remembered for on a connection.
+const maxParamEncryptions = 100
+
+// aeadVersion is the version byte of AEAD_AES_256_CBC_HMAC_SHA256 values.
+const aeadVersion = 0x01
+
+// paramEncryption is how the value of a parameter is encrypted.
+type paramEncryption struct {
+	cek         encryptionKeyInfo
+	rootKey     []byte
+	algorithmId byte
+	encType     byte
+	normRuleVer byte
+}
+
+// paramCipherInfo is sent after the value of an encrypted parameter,
+// ti is the type of the value before it was encrypted.
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-tds/619c43b6-9495-4a58-9e49-a4950db245b3
+type paramCipherInfo struct {
+	ti  typeInfo
+	enc *paramEncryption
+}
+
+func (c *paramCipherInfo) write(w io.Writer) (err error) {
+	ti := c.ti
+	if err = writeTypeInfo(w, &ti); err != nil {
+		return
+	}
+	if _, err = w.Write([]byte{c.enc.algorithmId, c.enc.encType}); err != nil {
+		return
+	}
+	ids := []uint32{uint32(c.enc.cek.databaseID), uint32(c.enc.cek.cekID), uint32(c.enc.cek.cekVersion)}
+	if err = binary.Write(w, binary.LittleEndian, ids); err != nil {
+		return
+	}
+	if _, err = w.Write(c.enc.cek.cekMdVersion); err != nil {
+		return
+	}
+	_, err = w.Write([]byte{c.enc.normRuleVer})
+	return
+}
+
+// encryptParams encrypts the parameters sent to encrypted columns by
+// a statement. tsql and decls are the statement and the declarations of
+// its parameters as sp_executesql takes them. It reports whether any
+// parameter was encrypted.
+func (c *Conn) encryptParams(ctx context.Context, sess *tdsSession, tsql, decls string, params []param) (bool, error) {
+	key := tsql + "\x00" + decls
+	encs, ok := c.paramEncryptions[key]
+	if !ok {
+		var err error
+		encs, err = c.describeParameterEncryption(ctx, sess, tsql, decls, len(params))
+		if err != nil {
+			return false, err
+		}
+		if c.paramEncryptions == nil || len(c.paramEncryptions) >= maxParamEncryptions {
+			c.paramEncryptions = make(map[string][]*paramEncryption)
+		}
+		c.paramEncryptions[key] = encs
+	}
+	encrypted := false
+	for i, enc := range encs {
+		if enc == nil {
+			continue
+		}
+		p, err := encryptParam(params[i], enc)
+		if err != nil {
+			return false, err
+		}
+		params[i] = p
+		encrypted = true
+	}
+	return encrypted, nil
+}
+
+// procCallText returns the statement and the parameter declarations a
+// call of the stored procedure name is described with.
+func procCallText(name string, params []param) (tsql, decls string) {
+	args := make([]string, len(params))
+	declList := make([]string, len(params))
+	for i, p := range params {
+		pname := p.Name
+		if pname == "" {
+			pname = fmt.Sprintf("@p%d", i+1)
+			args[i] = pname
+		} else {
+			args[i] = pname + "=" + pname
+		}
+		if p.Flags&fByRevValue != 0 {
+			args[i] += " output"
+		}
+		declList[i] = pname + " " + makeDecl(p.ti)
+	}
+	return "exec " + name + " " + strings.Join(args, ", "), strings.Join(declList, ",")
+}
+
+// describeParameterEncryption asks the server which of the count
+// parameters of a statement are encrypted, and decrypts their column
+// encryption keys. The parameters which are not encrypted get nil.
+func (c *Conn) describeParameterEncryption(ctx context.Context, sess *tdsSession, tsql, decls string, count int) ([]*paramEncryption, error) {
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{sess.tranid, 1}.pack()},
+	}
+	reset := c.resetSession
+	c.resetSession = false
+	params := []param{makeStrParam(tsql), makeStrParam(decls)}
+	if err := sendRpc(sess.buf, headers, sp_DescribeParameterEncryption, 0, params, reset); err != nil {
+		if sess.logFlags&logErrors != 0 {
+			sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send Rpc with %v", err))
+		}
+		c.connectionGood = false
+		return nil, fmt.Errorf("failed to send RPC: %v", err)
+	}
+
+	// The first result set holds the column encryption keys, the second
+	// one the parameters which are encrypted.
+	ceks := make(map[int64]*cekTableEntry)
+	var paramRows [][]interface{}
+	resultSet := 0
+	reader := startReading(sess, ctx, outputs{})
+	var firstError error
+	for {
+		tok, err := reader.nextToken()
+		if err != nil {
+			return nil, c.checkBadConn(ctx, err, false)
+		}
+		if tok == nil {
+			break
+		}
+		switch token := tok.(type) {
+		case []columnStruct:
+			resultSet++
+		case []interface{}:
+			switch resultSet {
+			case 1:
+				ordinal, _ := token[0].(int64)
+				entry := ceks[ordinal]
+				if entry == nil {
+					entry = &cekTableEntry{}
+					ceks[ordinal] = entry
+				}
+				entry.cekValues = append(entry.cekValues, readCekRow(token))
+			case 2:
+				paramRows = append(paramRows, token)
+			}
+		case doneStruct:
+			if token.isError() && firstError == nil {
+				firstError = token.getError()
+			}
+		}
+	}
+	if firstError != nil {
+		return nil, firstError
+	}
+
+	res := make([]*paramEncryption, count)
+	for _, row := range paramRows {
+		ordinal, _ := row[0].(int64)
+		name, _ := row[1].(string)
+		algorithmId, _ := row[2].(int64)
+		encType, _ := row[3].(int64)
+		cekOrdinal, _ := row[4].(int64)
+		normRuleVer, _ := row[5].(int64)
+		if encType == int64(encryption.Plaintext.Value) {
+			continue
+		}
+		if ordinal < 1 || int(ordinal) > count {
+			return nil, fmt.Errorf("mssql: invalid ordinal %d of encrypted parameter %s", ordinal, name)
+		}
+		if algorithmId != cipherAlgAeadAes256CbcHmacSha256 {
+			return nil, fmt.Errorf("mssql: encryption algorithm %d of parameter %s is not supported", algorithmId, name)
+		}
+		entry := ceks[cekOrdinal]
+		if entry == nil {
+			return nil, fmt.Errorf("mssql: no column encryption key was returned for parameter %s", name)
+		}
+		enc := &paramEncryption{
+			algorithmId: byte(algorithmId),
+			encType:     byte(encType),
+			normRuleVer: byte(normRuleVer),
+		}
+		var err error
+		enc.cek, enc.rootKey, err = sess.decryptCEKEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("mssql: decrypting the column encryption key of parameter %s failed: %v", name, err)
+		}
+		res[ordinal-1] = enc
+	}
+	return res, nil
+}
+
+// readCekRow reads a row of the column encryption keys returned by
+// sp_describe_parameter_encryption.
+func readCekRow(row []interface{}) encryptionKeyInfo {
+	databaseID, _ := row[1].(int64)
+	cekID, _ := row[2].(int64)
+	cekVersion, _ := row[3].(int64)
+	mdVersion, _ := row[4].([]byte)
+	encryptedKey, _ := row[5].([]byte)
+	keyStoreName, _ := row[6].(string)
+	keyPath, _ := row[7].(string)
+	algorithmName, _ := row[8].(string)
+	return encryptionKeyInfo{
+		encryptedKey:  encryptedKey,
+		databaseID:    int(databaseID),
+		cekID:         int(cekID),
+		cekVersion:    int(cekVersion),
+		cekMdVersion:  mdVersion,
+		keyPath:       keyPath,
+		keyStoreName:  keyStoreName,
+		algorithmName: algorithmName,
+	}
+}
+
+// encryptParam returns the parameter p encrypted as enc tells.
+func encryptParam(p param, enc *paramEncryption) (param, error) {
+	if p.reader != nil {
+		return p, fmt.Errorf("mssql: parameter %s of an encrypted column cannot be read from a stream", p.Name)
+	}
+	if p.Flags&fByRevValue != 0 {
+		return p, fmt.Errorf("mssql: output parameter %s of an encrypted column is not supported", p.Name)
+	}
+	if p.ti.TypeId == typeNull {
+		// NULL must be sent with the type of the column
+		return p, fmt.Errorf("mssql: parameter %s of an encrypted column is an untyped nil, use a typed null like sql.NullInt64", p.Name)
+	}
+	if p.ti.TypeId == typeTvp {
+		// the columns of table-valued parameters have no crypto metadata
+		return p, fmt.Errorf("mssql: table-valued parameter %s cannot be encrypted, use bulk copy to load encrypted columns", p.Name)
+	}
+	res := param{
+		Name:       p.Name,
+		Flags:      p.Flags | fEncrypted,
+		cipherInfo: &paramCipherInfo{ti: p.ti, enc: enc},
+	}
+	res.ti.TypeId = typeBigVarBin
+	if isNullParam(p) {
+		res.ti.Size = 8000
+		return res, nil
+	}
+	value, err := encryptAead(enc.rootKey, enc.encType, normalizeForEncryption(p.ti, p.buffer))
+	if err != nil {
+		return p, err
+	}
+	res.buffer = value
+	res.ti.Size = len(value)
+	return res, nil
+}
+
+// isNullParam reports whether the value of a parameter is NULL.
+func isNullParam(p param) bool {
+	if p.buffer == nil || p.ti.TypeId == typeNull {
+		return true
+	}
+	switch p.ti.TypeId {
+	case typeIntN, typeBitN, typeFltN, typeMoneyN, typeDateTimeN, typeDecimalN, typeNumericN,
+		typeDateN, typeTimeN, typeDateTime2N, typeDateTimeOffsetN, typeGuid:
+		// byte length types send NULL as an empty value
+		return len(p.buffer) == 0
+	}
+	return false
+}
+
+// normalizeForEncryption returns a value the way it is encrypted, which
+// does not depend on the size of its type: integers and bits are encrypted
+// as 8 bytes, decimals with 16 bytes after the sign.
+func normalizeForEncryption(ti typeInfo, buf []byte) []byte {
+	switch ti.TypeId {
+	case typeInt1, typeInt2, typeInt4, typeIntN, typeBit, typeBitN:
+		var v int64
+		switch len(buf) {
+		case 1:
+			v = int64(buf[0])
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(buf)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(buf)))
+		default:
+			return buf
+		}
+		res := make([]byte, 8)
+		binary.LittleEndian.PutUint64(res, uint64(v))
+		return res
+	case typeDecimal, typeDecimalN, typeNumeric, typeNumericN:
+		if len(buf) == 0 || len(buf) >= 17 {
+			return buf
+		}
+		res := make([]byte, 17)
+		copy(res, buf)
+		return res
+	}
+	return buf
+}
+
+// encryptAead encrypts plaintext with AEAD_AES_256_CBC_HMAC_SHA256 using
+// the column encryption key rootKey. Deterministic encryption derives the
+// IV from the plaintext, so that equal values can be compared on the
+// server, randomized encryption uses a random IV.
+func encryptAead(rootKey []byte, encType byte, plaintext []byte) ([]byte, error) {
+	k := keys.NewAeadAes256CbcHmac256(rootKey)
+	iv := make([]byte, aes.BlockSize)
+	if encryption.From(encType).Deterministic {
+		mac := hmac.New(sha256.New, k.IvKey())
+		mac.Write(plaintext)
+		copy(iv, mac.Sum(nil))
+	} else if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k.EncryptionKey())
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	ciphertext := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	mac := hmac.New(sha256.New, k.MacKey())
+	mac.Write([]byte{aeadVersion})
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	mac.Write([]byte{1}) // size of the version
+	res := make([]byte, 0, 1+sha256.Size+len(iv)+len(ciphertext))
+	res = append(res, aeadVersion)
+	res = mac.Sum(res)
+	res = append(res, iv...)
+	return append(res, ciphertext...), nil
+}
@@ -0,0 +1,199 @@
+package mssql
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"testing"
+
+	"github.com/swisscom/mssql-always-encrypted/pkg/algorithms"
+	"github.com/swisscom/mssql-always-encrypted/pkg/encryption"
+	"github.com/swisscom/mssql-always-encrypted/pkg/keys"
+)
+
+func testRootKey() []byte {
+	return bytes.Repeat([]byte{0x5a}, 32)
+}
+
+func decryptAead(t *testing.T, rootKey []byte, encType byte, value []byte) []byte {
+	alg := algorithms.NewAeadAes256CbcHmac256Algorithm(keys.NewAeadAes256CbcHmac256(rootKey), encryption.From(encType), aeadVersion)
+	d, err := alg.Decrypt(value)
+	if err != nil {
+		t.Fatal("Decrypt failed:", err)
+	}
+	return d
+}
+
+func TestEncryptAead(t *testing.T) {
+	plaintext := str2ucs2("123-45-6789")
+	for _, encType := range []byte{encryption.Deterministic.Value, encryption.Randomized.Value} {
+		first, err := encryptAead(testRootKey(), encType, plaintext)
+		if err != nil {
+			t.Fatal("encryptAead failed:", err)
+		}
+		second, _ := encryptAead(testRootKey(), encType, plaintext)
+		if got := decryptAead(t, testRootKey(), encType, first); !bytes.Equal(got, plaintext) {
+			t.Errorf("encryption type %d: decrypted % x", encType, got)
+		}
+		if deterministic := bytes.Equal(first, second); deterministic != (encType == encryption.Deterministic.Value) {
+			t.Errorf("encryption type %d: equal values encrypted equally is %v", encType, deterministic)
+		}
+	}
+}
+
+func TestEncryptParam(t *testing.T) {
+	enc := &paramEncryption{
+		cek:         encryptionKeyInfo{databaseID: 5, cekID: 2, cekVersion: 1, cekMdVersion: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		rootKey:     testRootKey(),
+		algorithmId: cipherAlgAeadAes256CbcHmacSha256,
+		encType:     encryption.Deterministic.Value,
+		normRuleVer: 1,
+	}
+	p := makeStrParam("secret")
+	p.Name = "@p1"
+	res, err := encryptParam(p, enc)
+	if err != nil {
+		t.Fatal("encryptParam failed:", err)
+	}
+	if res.Flags&fEncrypted == 0 || res.ti.TypeId != typeBigVarBin || res.ti.Size != len(res.buffer) {
+		t.Errorf("unexpected encrypted parameter %+v", res)
+	}
+	if got := decryptAead(t, enc.rootKey, enc.encType, res.buffer); !bytes.Equal(got, p.buffer) {
+		t.Errorf("decrypted % x", got)
+	}
+
+	var b bytes.Buffer
+	if err = res.cipherInfo.write(&b); err != nil {
+		t.Fatal("write failed:", err)
+	}
+	var expected bytes.Buffer
+	ti := p.ti
+	_ = writeTypeInfo(&expected, &ti)
+	expected.Write([]byte{cipherAlgAeadAes256CbcHmacSha256, encryption.Deterministic.Value})
+	_ = binary.Write(&expected, binary.LittleEndian, []uint32{5, 2, 1})
+	expected.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 1})
+	if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+		t.Errorf("cipher info is % x, expected % x", b.Bytes(), expected.Bytes())
+	}
+
+	null := param{Name: "@p2", ti: typeInfo{TypeId: typeIntN, Size: 4}, buffer: []byte{}}
+	if res, err = encryptParam(null, enc); err != nil || res.buffer != nil {
+		t.Errorf("NULL encrypted as % x, %v", res.buffer, err)
+	}
+
+	out := makeStrParam("x")
+	out.Flags = fByRevValue
+	if _, err = encryptParam(out, enc); err == nil {
+		t.Error("encrypting an output parameter should fail")
+	}
+
+	tvp := param{Name: "@p3", ti: typeInfo{TypeId: typeTvp}, buffer: []byte{0}}
+	if _, err = encryptParam(tvp, enc); err == nil {
+		t.Error("encrypting a table-valued parameter should fail")
+	}
+
+	untyped := param{Name: "@p4", ti: typeInfo{TypeId: typeNull}}
+	if _, err = encryptParam(untyped, enc); err == nil {
+		t.Error("encrypting an untyped nil should fail")
+	}
+}
+
+func TestEncryptedParamDecl(t *testing.T) {
+	c := &Conn{sess: &tdsSession{alwaysEncrypted: true}}
+	s := &Stmt{c: c}
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{int32(5), "int"},
+		{int16(5), "smallint"},
+		{uint8(5), "tinyint"},
+		{float32(1.5), "real"},
+		{int64(5), "bigint"},
+		{int(5), "bigint"},
+		{sql.NullInt64{}, "bigint"},
+	}
+	for _, test := range tests {
+		nv := driver.NamedValue{Value: test.value}
+		if err := c.CheckNamedValue(&nv); err != nil {
+			t.Fatalf("CheckNamedValue of %T failed: %v", test.value, err)
+		}
+		p, err := s.makeParam(nv.Value)
+		if err != nil {
+			t.Fatalf("makeParam of %T failed: %v", test.value, err)
+		}
+		if decl := makeDecl(p.ti); decl != test.expected {
+			t.Errorf("%T declared as %s, expected %s", test.value, decl, test.expected)
+		}
+	}
+
+	c.sess.alwaysEncrypted = false
+	nv := driver.NamedValue{Value: int32(5)}
+	if err := c.CheckNamedValue(&nv); err != nil {
+		t.Fatal("CheckNamedValue failed:", err)
+	}
+	if _, ok := nv.Value.(int64); !ok {
+		t.Errorf("int32 converted to %T without Always Encrypted, expected int64", nv.Value)
+	}
+}
+
+func TestProcCallText(t *testing.T) {
+	params := []param{
+		{Name: "@a", ti: typeInfo{TypeId: typeIntN, Size: 4}},
+		{Name: "@b", Flags: fByRevValue, ti: typeInfo{TypeId: typeNVarChar, Size: 20}},
+	}
+	tsql, decls := procCallText("dbo.proc", params)
+	if tsql != "exec dbo.proc @a=@a, @b=@b output" || decls != "@a int,@b nvarchar(10)" {
+		t.Errorf("got %q %q", tsql, decls)
+	}
+
+	params[0].Name, params[1].Name = "", ""
+	tsql, decls = procCallText("dbo.proc", params)
+	if tsql != "exec dbo.proc @p1, @p2 output" || decls != "@p1 int,@p2 nvarchar(10)" {
+		t.Errorf("got %q %q", tsql, decls)
+	}
+}
+
+func TestDecryptCEKEntry(t *testing.T) {
+	keyStore := &pfxKeyStoreProvider{location: "resources/test/always-encrypted/ae-1.pfx", secret: "password"}
+	sess := &tdsSession{
+		alwaysEncrypted:         true,
+		alwaysEncryptedSettings: &aeSettings{keyStore: keyStore},
+	}
+	cek := testRootKey()
+	encrypted, err := keyStore.EncryptColumnEncryptionKey("CurrentUser/My/ae-1", cekAlgorithmRSAOAEP, cek)
+	if err != nil {
+		t.Fatal("EncryptColumnEncryptionKey failed:", err)
+	}
+	entry := &cekTableEntry{cekValues: []encryptionKeyInfo{
+		{encryptedKey: []byte{1, 0, 0, 0, 0}, keyPath: "unknown", algorithmName: cekAlgorithmRSAOAEP},
+		{encryptedKey: encrypted, keyPath: "CurrentUser/My/ae-1", algorithmName: cekAlgorithmRSAOAEP, cekID: 7},
+	}}
+	value, rootKey, err := sess.decryptCEKEntry(entry)
+	if err != nil {
+		t.Fatal("decryptCEKEntry failed:", err)
+	}
+	if value.cekID != 7 || !bytes.Equal(rootKey, cek) {
+		t.Errorf("decrypted key %d % x", value.cekID, rootKey)
+	}
+}
+
+func TestNormalizeForEncryption(t *testing.T) {
+	tests := []struct {
+		ti       typeInfo
+		value    []byte
+		expected []byte
+	}{
+		{typeInfo{TypeId: typeIntN}, []byte{0xfe, 0xff}, []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{typeInfo{TypeId: typeIntN}, []byte{0xff}, []byte{0xff, 0, 0, 0, 0, 0, 0, 0}},
+		{typeInfo{TypeId: typeBitN}, []byte{1}, []byte{1, 0, 0, 0, 0, 0, 0, 0}},
+		{typeInfo{TypeId: typeDecimalN}, []byte{1, 7, 0, 0, 0}, append([]byte{1, 7}, make([]byte, 15)...)},
+		{typeInfo{TypeId: typeNVarChar}, []byte{'a', 0}, []byte{'a', 0}},
+	}
+	for _, test := range tests {
+		if got := normalizeForEncryption(test.ti, test.value); !bytes.Equal(got, test.expected) {
+			t.Errorf("type %#x % x normalized as % x", test.ti.TypeId, test.value, got)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"database/sql/driver"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net"
@@ -15,11 +16,13 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 func driverWithProcess(t *testing.T) *Driver {
 	return &Driver{
-		log:              optionalLogger{testLogger{t}},
+		logger:           optionalLogger{loggerAdapter{testLogger{t}}},
 		processQueryText: true,
 	}
 }
@@ -572,6 +575,179 @@ func TestShortTimeout(t *testing.T) {
 	}
 }
 
+func TestMultipleActiveResultSets(t *testing.T) {
+	checkConnStr(t)
+	SetLogger(testLogger{t})
+	dsn := makeConnStr(t)
+	dsnParams := dsn.Query()
+	dsnParams.Set("multipleactiveresultsets", "true")
+	dsn.RawQuery = dsnParams.Encode()
+	conn, err := sql.Open("mssql", dsn.String())
+	if err != nil {
+		t.Fatal("Open connection failed:", err.Error())
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatal("Begin failed:", err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("create table #mars (id int primary key, val int)"); err != nil {
+		t.Fatal("create table failed:", err)
+	}
+	if _, err = tx.Exec("insert into #mars (id, val) values (1, 0), (2, 0), (3, 0)"); err != nil {
+		t.Fatal("insert failed:", err)
+	}
+
+	rows, err := tx.Query("select id from #mars order by id")
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	count := 0
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			t.Fatal("Scan failed:", err)
+		}
+		// Update while the result set is still open.
+		if _, err = tx.Exec("update #mars set val = @p1 where id = @p1", id); err != nil {
+			t.Fatal("update failed:", err)
+		}
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal("Rows failed:", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 rows, got %d", count)
+	}
+
+	var sum int
+	if err = tx.QueryRow("select sum(val) from #mars").Scan(&sum); err != nil {
+		t.Fatal("select failed:", err)
+	}
+	if sum != 6 {
+		t.Errorf("expected sum of updated values to be 6, got %d", sum)
+	}
+}
+
+func TestPreparedStatementReuse(t *testing.T) {
+	conn := open(t)
+	defer conn.Close()
+
+	ctx := context.Background()
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		t.Fatal("Conn failed:", err)
+	}
+	defer c.Close()
+	if _, err = c.ExecContext(ctx, "create table #prep (id int, name nvarchar(50))"); err != nil {
+		t.Fatal("create table failed:", err)
+	}
+	stmt, err := c.PrepareContext(ctx, "insert into #prep (id, name) values (@p1, @p2)")
+	if err != nil {
+		t.Fatal("Prepare failed:", err)
+	}
+	// strings of different lengths and a change of the parameter types
+	values := []interface{}{"a", "longer name", 3.5, "b"}
+	for i, v := range values {
+		if _, err = stmt.ExecContext(ctx, i, v); err != nil {
+			t.Fatalf("Exec %d failed: %v", i, err)
+		}
+	}
+	if err = stmt.Close(); err != nil {
+		t.Fatal("Close failed:", err)
+	}
+
+	var count int
+	if err = c.QueryRowContext(ctx, "select count(*) from #prep where id >= @p1", 0).Scan(&count); err != nil {
+		t.Fatal("select failed:", err)
+	}
+	if count != len(values) {
+		t.Errorf("expected %d rows, got %d", len(values), count)
+	}
+}
+
+func TestStreamBlobs(t *testing.T) {
+	conn := open(t)
+	defer conn.Close()
+
+	const size = 100000
+	rows, err := conn.Query(`select n, cast(replicate(cast(N'ab' as nvarchar(max)), n * @p1) as nvarchar(max))
+		from (values (1), (2), (3)) t(n) order by n`, size/2, StreamBlobs{})
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	for rows.Next() {
+		var n int
+		var r io.Reader
+		if err = rows.Scan(&n, &r); err != nil {
+			t.Fatal("Scan failed:", err)
+		}
+		switch n {
+		case 1:
+			// read only a part, the rest is skipped
+			var p [10]byte
+			if _, err = io.ReadFull(r, p[:]); err != nil || string(p[:]) != "ababababab" {
+				t.Errorf("read %q %v", p, err)
+			}
+		case 2:
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal("ReadAll failed:", err)
+			}
+			if len(b) != 2*size || !strings.HasPrefix(string(b), "abab") {
+				t.Errorf("read %d bytes, expected %d", len(b), 2*size)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal("Rows failed:", err)
+	}
+
+	// the connection is usable afterwards
+	var one int
+	if err = conn.QueryRow("select 1").Scan(&one); err != nil || one != 1 {
+		t.Errorf("select 1 returned %d %v", one, err)
+	}
+}
+
+func TestStreamParam(t *testing.T) {
+	conn := open(t)
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4}, 50000)
+	text := strings.Repeat("héllo ", 20000)
+	var bin []byte
+	var ntext, vtext string
+	err := conn.QueryRow("select @p1, @p2, @p3",
+		bytes.NewReader(data),
+		StreamParam{Reader: strings.NewReader(text), Type: StreamNVarChar},
+		StreamParam{Reader: strings.NewReader("abc"), Type: StreamVarChar},
+	).Scan(&bin, &ntext, &vtext)
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	if !bytes.Equal(bin, data) {
+		t.Errorf("varbinary value has %d bytes, expected %d", len(bin), len(data))
+	}
+	if ntext != text {
+		t.Errorf("nvarchar value has %d characters, expected %d", len(ntext), len(text))
+	}
+	if vtext != "abc" {
+		t.Errorf("varchar value is %q", vtext)
+	}
+
+	// a failing reader aborts the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = conn.ExecContext(ctx, "select @p1", bytes.NewReader(data))
+	if err == nil {
+		t.Error("Exec with a cancelled context should fail")
+	}
+}
+
 func TestTwoQueries(t *testing.T) {
 	conn := open(t)
 	defer conn.Close()
@@ -1279,7 +1455,7 @@ func TestProcessQueryErrors(t *testing.T) {
 	if err != nil {
 		t.Fatal("prepareContext expected to succeed, but it failed with", err)
 	}
-	err = stmt.sendQuery([]namedValue{})
+	err = stmt.sendQuery(context.Background(), []namedValue{})
 	if err != nil {
 		t.Fatal("sendQuery expected to succeed, but it failed with", err)
 	}
@@ -1866,7 +2042,7 @@ func TestQueryCancelLowLevel(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Prepare failed with error %v", err)
 	}
-	err = stmt.sendQuery([]namedValue{})
+	err = stmt.sendQuery(context.Background(), []namedValue{})
 	if err != nil {
 		t.Fatalf("sendQuery failed with error %v", err)
 	}
@@ -2125,8 +2301,8 @@ func TestDisconnect1(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 	defer cancel()
 
-	createDialer = func(p *connectParams) Dialer {
-		nd := netDialer{&net.Dialer{Timeout: p.dial_timeout, KeepAlive: p.keepAlive}}
+	createDialer = func(p *msdsn.Config) Dialer {
+		nd := netDialer{&net.Dialer{Timeout: p.DialTimeout, KeepAlive: p.KeepAlive}}
 		di := &dialerInterrupt{nd: nd}
 		go func() {
 			<-waitDisrupt
@@ -2188,8 +2364,8 @@ func TestDisconnect2(t *testing.T) {
 		ctx, cancel = context.WithTimeout(ctx, time.Second*2)
 		defer cancel()
 
-		createDialer = func(p *connectParams) Dialer {
-			nd := netDialer{&net.Dialer{Timeout: p.dial_timeout, KeepAlive: p.keepAlive}}
+		createDialer = func(p *msdsn.Config) Dialer {
+			nd := netDialer{&net.Dialer{Timeout: p.DialTimeout, KeepAlive: p.KeepAlive}}
 			di := &dialerInterrupt{nd: nd}
 			go func() {
 				<-waitDisrupt
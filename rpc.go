@@ -2,6 +2,7 @@ package mssql
 
 import (
 	"encoding/binary"
+	"io"
 )
 
 type procId struct {
@@ -13,6 +14,7 @@ type procId struct {
 const (
 	fByRevValue   = 1
 	fDefaultValue = 2
+	fEncrypted    = 8
 )
 
 type param struct {
@@ -20,6 +22,11 @@ type param struct {
 	Flags  uint8
 	ti     typeInfo
 	buffer []byte
+	// reader is read for the value instead of buffer, see StreamParam.
+	reader io.Reader
+	// cipherInfo is set when the value is encrypted for a column using
+	// Always Encrypted.
+	cipherInfo *paramCipherInfo
 }
 
 var (
@@ -34,6 +41,7 @@ var (
 	sp_CursorClose     = procId{9, ""}
 	sp_ExecuteSql      = procId{10, ""}
 	sp_Prepare         = procId{11, ""}
+	sp_Execute         = procId{12, ""}
 	sp_PrepExec        = procId{13, ""}
 	sp_PrepExecRpc     = procId{14, ""}
 	sp_Unprepare       = procId{15, ""}
@@ -74,10 +82,19 @@ func sendRpc(buf *tdsBuffer, headers []headerStruct, proc procId, flags uint16,
 		if err != nil {
 			return
 		}
-		err = param.ti.Writer(buf, param.ti, param.buffer)
+		if param.reader != nil {
+			err = writePLPReader(buf, param.reader)
+		} else {
+			err = param.ti.Writer(buf, param.ti, param.buffer)
+		}
 		if err != nil {
 			return
 		}
+		if param.cipherInfo != nil {
+			if err = param.cipherInfo.write(buf); err != nil {
+				return
+			}
+		}
 	}
 	return buf.FinishPacket()
 }
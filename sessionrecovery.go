@@ -0,0 +1,275 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
+)
+
+// Connection resiliency, also known as idle connection recovery.
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-tds/0e4d2b94-a9e1-4d48-b2c9-fd64ad2a1e53
+
+// sessionState holds the session state the server needs to rebuild a session.
+type sessionState struct {
+	database  string
+	collation []byte
+	language  string
+	// states are the opaque state values sent by the server, keyed by state id.
+	states map[byte][]byte
+}
+
+func (s sessionState) clone() sessionState {
+	c := s
+	c.collation = append([]byte(nil), s.collation...)
+	c.states = make(map[byte][]byte, len(s.states))
+	for id, v := range s.states {
+		c.states[id] = v
+	}
+	return c
+}
+
+// sessionRecovery tracks the state of a session for which the server
+// acknowledged the SESSIONRECOVERY feature extension.
+type sessionRecovery struct {
+	// initial is the state right after the first login of the connection,
+	// current is the state right now.
+	initial sessionState
+	current sessionState
+
+	// acked is set once the server acknowledged session recovery.
+	acked bool
+	// recoverable is the fRecoverable flag of the last SESSIONSTATE token.
+	recoverable bool
+}
+
+func newSessionRecovery() *sessionRecovery {
+	return &sessionRecovery{
+		current: sessionState{states: map[byte][]byte{}},
+	}
+}
+
+func (r *sessionRecovery) clone() *sessionRecovery {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	c.initial = r.initial.clone()
+	c.current = r.current.clone()
+	return &c
+}
+
+// featureExtSessionRecovery requests session recovery support at login.
+// When recovery is set the login re-establishes a dropped session and
+// the feature data carries the state to restore.
+type featureExtSessionRecovery struct {
+	recovery *sessionRecovery
+}
+
+func (e *featureExtSessionRecovery) featureID() byte {
+	return featExtSESSIONRECOVERY
+}
+
+func (e *featureExtSessionRecovery) toBytes() []byte {
+	if e.recovery == nil {
+		return nil
+	}
+	var d bytes.Buffer
+	initial := e.recovery.initial
+	writeSessionRecoveryData(&d, initial.database, initial.collation, initial.language, initial.states)
+
+	// Only what changed since the initial login is sent for the current state.
+	current := e.recovery.current
+	var database, language string
+	var collation []byte
+	if current.database != initial.database {
+		database = current.database
+	}
+	if !bytes.Equal(current.collation, initial.collation) {
+		collation = current.collation
+	}
+	if current.language != initial.language {
+		language = current.language
+	}
+	writeSessionRecoveryData(&d, database, collation, language, current.states)
+	return d.Bytes()
+}
+
+// writeSessionRecoveryData writes a length prefixed
+// RecoveryDatabase, RecoveryCollation, RecoveryLanguage and
+// SessionStateDataSet sequence.
+func writeSessionRecoveryData(w *bytes.Buffer, database string, collation []byte, language string, states map[byte][]byte) {
+	var d bytes.Buffer
+	_ = writeBVarChar(&d, database)
+	d.WriteByte(byte(len(collation)))
+	d.Write(collation)
+	_ = writeBVarChar(&d, language)
+	for id := 0; id < 256; id++ {
+		v, ok := states[byte(id)]
+		if !ok {
+			continue
+		}
+		d.WriteByte(byte(id))
+		if len(v) < 0xff {
+			d.WriteByte(byte(len(v)))
+		} else {
+			d.WriteByte(0xff)
+			_ = binary.Write(&d, binary.LittleEndian, uint32(len(v)))
+		}
+		d.Write(v)
+	}
+	_ = binary.Write(w, binary.LittleEndian, uint32(d.Len()))
+	w.Write(d.Bytes())
+}
+
+// parseSessionStateDataSet parses a SessionStateDataSet into states.
+func parseSessionStateDataSet(data []byte, states map[byte][]byte) error {
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return errors.New("invalid session state data: truncated state header")
+		}
+		id := data[0]
+		length := uint32(data[1])
+		data = data[2:]
+		if length == 0xff {
+			if len(data) < 4 {
+				return errors.New("invalid session state data: truncated state length")
+			}
+			length = binary.LittleEndian.Uint32(data)
+			data = data[4:]
+		}
+		if uint32(len(data)) < length {
+			return fmt.Errorf("invalid session state data: state %d is %d bytes long, only %d bytes left", id, length, len(data))
+		}
+		v := make([]byte, length)
+		copy(v, data)
+		states[id] = v
+		data = data[length:]
+	}
+	return nil
+}
+
+// sessionRecoveryAckStruct holds the initial session state
+// acknowledged by the server at login.
+type sessionRecoveryAckStruct struct {
+	States map[byte][]byte
+}
+
+type sessionStateStruct struct {
+	SeqNo       uint32
+	Recoverable bool
+	States      map[byte][]byte
+}
+
+// SESSIONSTATE stream
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-tds/626b8fa3-0b47-4bd6-b9b5-c3e3a6cb8c6f
+func parseSessionState(r *tdsBuffer) sessionStateStruct {
+	length := r.uint32()
+	if length < 5 {
+		badStreamPanicf("invalid SESSIONSTATE token length %d", length)
+	}
+	data := make([]byte, length)
+	r.ReadFull(data)
+	st := sessionStateStruct{
+		SeqNo:       binary.LittleEndian.Uint32(data),
+		Recoverable: data[4]&1 != 0,
+		States:      map[byte][]byte{},
+	}
+	if err := parseSessionStateDataSet(data[5:], st.States); err != nil {
+		badStreamPanic(err)
+	}
+	return st
+}
+
+func (sess *tdsSession) updateSessionState(st sessionStateStruct) {
+	if sess.recovery == nil {
+		return
+	}
+	sess.recovery.recoverable = st.Recoverable
+	for id, v := range st.States {
+		sess.recovery.current.states[id] = v
+	}
+}
+
+var errSessionNotRecoverable = errors.New("session can not be recovered")
+
+// canRecover reports whether a broken connection may be re-established
+// transparently. The server must have acknowledged session recovery and
+// declared the session recoverable, and no transaction may be active.
+// MARS connections are not recovered.
+func (c *Conn) canRecover() bool {
+	rec := c.sess.recovery
+	return rec != nil && rec.acked && rec.recoverable &&
+		c.sess.tranid == 0 && c.sess.mux == nil && c.params.ConnectRetryCount > 0
+}
+
+// recoverSession replaces a connection that was dropped by the server
+// with a new one, replaying the session state of the dropped session.
+// It makes up to ConnectRetryCount attempts, ConnectRetryInterval apart.
+func (c *Conn) recoverSession(ctx context.Context) error {
+	if !c.canRecover() {
+		return errSessionNotRecoverable
+	}
+	old := c.sess
+	old.buf.transport.Close()
+	if old.logFlags&logRetries != 0 {
+		old.logger.Log(ctx, msdsn.LogRetries, "connection was closed by the server, recovering session")
+	}
+	var err error
+	for i := 0; i < c.params.ConnectRetryCount; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(c.params.ConnectRetryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var sess *tdsSession
+		var params msdsn.Config
+		// the mirroring partner may have taken over the session
+		sess, params, err = connectMirror(ctx, c.connector, old.logger, c.params, old.recovery)
+		if err == nil {
+			sess.returnStatus = old.returnStatus
+			c.sess = sess
+			c.params = params
+			// prepared statements are not part of the recovered state
+			c.prepareGen++
+			c.connectionGood = true
+			return nil
+		}
+		if old.logFlags&logRetries != 0 {
+			old.logger.Log(ctx, msdsn.LogRetries, fmt.Sprintf("session recovery attempt %d failed: %v", i+1, err))
+		}
+	}
+	return err
+}
+
+// sendWithRecovery sends a request using send. If the server dropped the
+// connection while it was idle and the session can be recovered, the
+// connection is re-established and the request is sent on the new one.
+// Requests are only retried when they could not have reached the server,
+// and resend is set, it is not for requests streaming parameters from
+// readers, which cannot be read again.
+func (c *Conn) sendWithRecovery(ctx context.Context, resend bool, send func() error) error {
+	if c.canRecover() && c.sess.conn != nil && c.sess.conn.peerClosed() {
+		if err := c.recoverSession(ctx); err != nil {
+			c.connectionGood = false
+			return err
+		}
+	}
+	reset := c.resetSession
+	err := send()
+	// send marks the connection bad only when writing to it failed.
+	if err != nil && resend && !c.connectionGood && c.canRecover() {
+		if rerr := c.recoverSession(ctx); rerr != nil {
+			return err
+		}
+		c.resetSession = reset
+		err = send()
+	}
+	return err
+}
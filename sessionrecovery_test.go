@@ -0,0 +1,170 @@
+package mssql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionRecoveryFeatureData(t *testing.T) {
+	fe := &featureExtSessionRecovery{}
+	if d := fe.toBytes(); len(d) != 0 {
+		t.Errorf("initial login should not send recovery data, got % x", d)
+	}
+
+	long := bytes.Repeat([]byte{7}, 300)
+	fe.recovery = &sessionRecovery{
+		initial: sessionState{
+			database:  "master",
+			collation: []byte{9, 4, 208, 0, 52},
+			language:  "us_english",
+			states:    map[byte][]byte{1: {1, 2}},
+		},
+		current: sessionState{
+			database:  "tempdb",
+			collation: []byte{9, 4, 208, 0, 52},
+			language:  "us_english",
+			states:    map[byte][]byte{1: {3}, 2: long},
+		},
+		acked: true,
+	}
+	d := fe.toBytes()
+
+	readSet := func(name string) (database string, collation []byte, language string, states map[byte][]byte) {
+		length := binary.LittleEndian.Uint32(d)
+		set := bytes.NewReader(d[4 : 4+length])
+		d = d[4+length:]
+		var err error
+		if database, err = readBVarChar(set); err != nil {
+			t.Fatalf("%s: reading database failed: %v", name, err)
+		}
+		if collation, err = readBVarByte(set); err != nil {
+			t.Fatalf("%s: reading collation failed: %v", name, err)
+		}
+		if language, err = readBVarChar(set); err != nil {
+			t.Fatalf("%s: reading language failed: %v", name, err)
+		}
+		rest := make([]byte, set.Len())
+		set.Read(rest)
+		states = map[byte][]byte{}
+		if err = parseSessionStateDataSet(rest, states); err != nil {
+			t.Fatalf("%s: parsing states failed: %v", name, err)
+		}
+		return
+	}
+
+	database, collation, language, states := readSet("initial")
+	if database != "master" || !bytes.Equal(collation, []byte{9, 4, 208, 0, 52}) || language != "us_english" {
+		t.Errorf("unexpected initial state %q %v %q", database, collation, language)
+	}
+	if !reflect.DeepEqual(states, map[byte][]byte{1: {1, 2}}) {
+		t.Errorf("unexpected initial session states %v", states)
+	}
+
+	database, collation, language, states = readSet("current")
+	if database != "tempdb" || len(collation) != 0 || language != "" {
+		t.Errorf("only changed values should be sent for current state, got %q %v %q", database, collation, language)
+	}
+	if !reflect.DeepEqual(states, map[byte][]byte{1: {3}, 2: long}) {
+		t.Errorf("unexpected current session states %v", states)
+	}
+	if len(d) != 0 {
+		t.Errorf("unexpected trailing data % x", d)
+	}
+}
+
+func TestParseSessionState(t *testing.T) {
+	b := []byte{
+		10, 0, 0, 0, // length
+		5, 0, 0, 0, // sequence number
+		1,          // recoverable
+		3, 1, 0xAA, // state 3
+		4, 0, // empty state 4
+	}
+	r := &tdsBuffer{
+		packetSize: len(b),
+		rbuf:       b,
+		rpos:       0,
+		rsize:      len(b),
+		final:      true,
+	}
+	st := parseSessionState(r)
+	if st.SeqNo != 5 || !st.Recoverable {
+		t.Errorf("unexpected session state header %+v", st)
+	}
+	if !reflect.DeepEqual(st.States, map[byte][]byte{3: {0xAA}, 4: {}}) {
+		t.Errorf("unexpected session states %v", st.States)
+	}
+
+	sess := &tdsSession{recovery: newSessionRecovery()}
+	sess.updateSessionState(st)
+	if !sess.recovery.recoverable || !bytes.Equal(sess.recovery.current.states[3], []byte{0xAA}) {
+		t.Errorf("session state was not updated: %+v", sess.recovery)
+	}
+
+	if err := parseSessionStateDataSet([]byte{1, 5, 0}, map[byte][]byte{}); err == nil {
+		t.Error("parseSessionStateDataSet should fail for truncated data")
+	}
+}
+
+func tcpConnPair(t *testing.T) (client, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start a listener", err)
+	}
+	defer listener.Close()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Dial failed", err)
+	}
+	server, err = listener.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal("Accept failed", err)
+	}
+	return client, server
+}
+
+func TestTimeoutConnPeerClosed(t *testing.T) {
+	if !connCheckSupported {
+		t.Skip("closed connections cannot be checked on this platform")
+	}
+	client, server := tcpConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	conn := newTimeoutConn(client, 0)
+	if conn.peerClosed() {
+		t.Fatal("idle connection reported as closed")
+	}
+
+	// Data received must be left for Read.
+	if _, err := server.Write([]byte{42}); err != nil {
+		t.Fatal("Write failed", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if conn.peerClosed() {
+		t.Fatal("connection with pending data reported as closed")
+	}
+	var b [1]byte
+	if n, err := conn.Read(b[:]); n != 1 || err != nil || b[0] != 42 {
+		t.Fatalf("Read returned %d %v %v, expected the pending byte", n, err, b)
+	}
+
+	server.Close()
+	if conn.peerClosed() {
+		t.Fatal("recently used connection should not be checked")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	closed := false
+	for !closed && time.Now().Before(deadline) {
+		conn.lastUse = time.Time{}
+		closed = conn.peerClosed()
+	}
+	if !closed {
+		t.Error("closed connection not detected")
+	}
+}
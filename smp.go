@@ -0,0 +1,324 @@
+package mssql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Session Multiplexing Protocol is used to carry several logical TDS
+// sessions over a single transport when MARS is enabled.
+// [MC-SMP]: https://docs.microsoft.com/en-us/openspecs/windows_protocols/mc-smp/
+const (
+	smpID         = 0x53
+	smpHeaderSize = 16
+
+	smpSYN  = 0x01
+	smpACK  = 0x02
+	smpFIN  = 0x04
+	smpDATA = 0x08
+
+	// smpWindow is the number of DATA packets a session allows its peer
+	// to send ahead of what was consumed by the reader.
+	smpWindow = 4
+
+	// smpMaxLength limits the size of a single SMP packet, TDS packets
+	// can not be larger than 32767 bytes.
+	smpMaxLength = 1 << 16
+)
+
+var errSmpSessionClosed = errors.New("mars session is closed")
+
+type smpHeader struct {
+	Flags  uint8
+	SID    uint16
+	Length uint32
+	SeqNum uint32
+	Window uint32
+}
+
+func (h smpHeader) encode(buf []byte) {
+	buf[0] = smpID
+	buf[1] = h.Flags
+	binary.LittleEndian.PutUint16(buf[2:], h.SID)
+	binary.LittleEndian.PutUint32(buf[4:], h.Length)
+	binary.LittleEndian.PutUint32(buf[8:], h.SeqNum)
+	binary.LittleEndian.PutUint32(buf[12:], h.Window)
+}
+
+func decodeSmpHeader(buf []byte) (h smpHeader, err error) {
+	if buf[0] != smpID {
+		return h, fmt.Errorf("invalid SMP packet id %#x", buf[0])
+	}
+	h.Flags = buf[1]
+	h.SID = binary.LittleEndian.Uint16(buf[2:])
+	h.Length = binary.LittleEndian.Uint32(buf[4:])
+	h.SeqNum = binary.LittleEndian.Uint32(buf[8:])
+	h.Window = binary.LittleEndian.Uint32(buf[12:])
+	if h.Length < smpHeaderSize || h.Length > smpMaxLength {
+		return h, fmt.Errorf("invalid SMP packet length %d", h.Length)
+	}
+	return h, nil
+}
+
+// seqAfter reports whether sequence number a comes after b,
+// taking wrap around into account.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// smpMux multiplexes SMP sessions over a transport.
+//
+// There is no background reader. Whichever session needs data from the
+// transport, either to read a response or to wait for the peer to open
+// its receive window, reads the next SMP packet and hands it to the
+// session it belongs to. This keeps read timeouts of the underlying
+// connection meaningful and makes it possible to switch transports
+// after login when only the login packet is encrypted.
+type smpMux struct {
+	transport io.ReadWriteCloser
+
+	// wmu serializes writes to the transport.
+	wmu  sync.Mutex
+	wbuf []byte
+
+	// mu guards all remaining fields as well as the state of all sessions.
+	mu       sync.Mutex
+	cond     *sync.Cond
+	sessions map[uint16]*smpSession
+	nextSID  uint16
+	reading  bool
+	err      error
+}
+
+func newSmpMux(transport io.ReadWriteCloser) *smpMux {
+	m := &smpMux{
+		transport: transport,
+		sessions:  make(map[uint16]*smpSession),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// setTransport replaces the transport, it is used to stop encrypting
+// traffic after the login packet when encryption is off.
+func (m *smpMux) setTransport(transport io.ReadWriteCloser) {
+	m.wmu.Lock()
+	m.transport = transport
+	m.wmu.Unlock()
+}
+
+// Close closes the transport and fails all sessions.
+func (m *smpMux) Close() error {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = errSmpSessionClosed
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	return m.transport.Close()
+}
+
+// openSession allocates a new session id and sends SYN for it.
+func (m *smpMux) openSession() (*smpSession, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	for {
+		if _, used := m.sessions[m.nextSID]; !used {
+			break
+		}
+		m.nextSID++
+	}
+	s := &smpSession{
+		mux:        m,
+		id:         m.nextSID,
+		peerWindow: smpWindow,
+		recvWindow: smpWindow,
+	}
+	m.nextSID++
+	m.sessions[s.id] = s
+	m.mu.Unlock()
+
+	err := m.writePacket(smpHeader{Flags: smpSYN, SID: s.id, Window: s.recvWindow}, nil)
+	if err != nil {
+		m.removeSession(s.id)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *smpMux) removeSession(id uint16) {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+}
+
+func (m *smpMux) writePacket(h smpHeader, payload []byte) error {
+	h.Length = uint32(smpHeaderSize + len(payload))
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	// SMP header and payload are written with a single call,
+	// otherwise they would end up in separate TLS records.
+	if cap(m.wbuf) < int(h.Length) {
+		m.wbuf = make([]byte, h.Length)
+	}
+	buf := m.wbuf[:h.Length]
+	h.encode(buf)
+	copy(buf[smpHeaderSize:], payload)
+	_, err := m.transport.Write(buf)
+	return err
+}
+
+func (m *smpMux) readPacket() (h smpHeader, payload []byte, err error) {
+	var hdr [smpHeaderSize]byte
+	if _, err = io.ReadFull(m.transport, hdr[:]); err != nil {
+		return
+	}
+	if h, err = decodeSmpHeader(hdr[:]); err != nil {
+		return
+	}
+	payload = make([]byte, h.Length-smpHeaderSize)
+	_, err = io.ReadFull(m.transport, payload)
+	return
+}
+
+// waitLocked blocks until done returns true. While waiting it reads
+// packets from the transport unless another session already does.
+// Must be called with m.mu held.
+func (m *smpMux) waitLocked(s *smpSession, done func() bool) error {
+	for !done() {
+		if s.err != nil {
+			return s.err
+		}
+		if m.err != nil {
+			return m.err
+		}
+		if m.reading {
+			m.cond.Wait()
+			continue
+		}
+		m.reading = true
+		m.mu.Unlock()
+		h, payload, err := m.readPacket()
+		m.mu.Lock()
+		m.reading = false
+		if err != nil {
+			m.err = err
+		} else {
+			m.dispatchLocked(h, payload)
+		}
+		m.cond.Broadcast()
+	}
+	return nil
+}
+
+func (m *smpMux) dispatchLocked(h smpHeader, payload []byte) {
+	s, ok := m.sessions[h.SID]
+	if !ok {
+		// Session was already closed on our side, drop the packet.
+		return
+	}
+	switch h.Flags {
+	case smpDATA:
+		s.queue = append(s.queue, payload)
+		s.peerWindow = h.Window
+	case smpACK:
+		s.peerWindow = h.Window
+	case smpFIN:
+		s.err = io.EOF
+	}
+}
+
+// smpSession is a logical session of a MARS connection. It satisfies
+// io.ReadWriteCloser so it can be used as the transport of a tdsBuffer.
+// Each Write call is sent as a single SMP DATA packet, which matches
+// the way tdsBuffer writes whole TDS packets.
+type smpSession struct {
+	mux *smpMux
+	id  uint16
+
+	// Fields below are guarded by mux.mu.
+
+	// seqNum is the sequence number of the last DATA packet sent and
+	// peerWindow is the highest sequence number the peer accepts.
+	seqNum     uint32
+	peerWindow uint32
+
+	// consumed counts DATA packets handed to the reader and recvWindow
+	// is the highest sequence number advertised to the peer.
+	consumed   uint32
+	recvWindow uint32
+
+	queue [][]byte
+	cur   []byte
+	err   error
+}
+
+func (s *smpSession) Read(p []byte) (n int, err error) {
+	m := s.mux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(s.cur) == 0 {
+		err = m.waitLocked(s, func() bool { return len(s.queue) > 0 })
+		if err != nil {
+			return 0, err
+		}
+		s.cur, s.queue = s.queue[0], s.queue[1:]
+		s.consumed++
+		if s.recvWindow-s.consumed < smpWindow/2 {
+			s.recvWindow = s.consumed + smpWindow
+			ack := smpHeader{Flags: smpACK, SID: s.id, SeqNum: s.seqNum, Window: s.recvWindow}
+			m.mu.Unlock()
+			err = m.writePacket(ack, nil)
+			m.mu.Lock()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	n = copy(p, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+func (s *smpSession) Write(p []byte) (n int, err error) {
+	m := s.mux
+	m.mu.Lock()
+	err = m.waitLocked(s, func() bool { return !seqAfter(s.seqNum+1, s.peerWindow) })
+	if err != nil {
+		m.mu.Unlock()
+		return 0, err
+	}
+	s.seqNum++
+	h := smpHeader{Flags: smpDATA, SID: s.id, SeqNum: s.seqNum, Window: s.recvWindow}
+	m.mu.Unlock()
+	if err = m.writePacket(h, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends FIN for the session. The transport stays open.
+func (s *smpSession) Close() error {
+	m := s.mux
+	m.mu.Lock()
+	if s.err == errSmpSessionClosed {
+		m.mu.Unlock()
+		return nil
+	}
+	s.err = errSmpSessionClosed
+	delete(m.sessions, s.id)
+	h := smpHeader{Flags: smpFIN, SID: s.id, SeqNum: s.seqNum, Window: s.recvWindow}
+	failed := m.err != nil
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	if failed {
+		return nil
+	}
+	return m.writePacket(h, nil)
+}
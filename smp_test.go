@@ -0,0 +1,154 @@
+package mssql
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func readSmpTestPacket(t *testing.T, r io.Reader) (smpHeader, []byte) {
+	var hdr [smpHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal("reading SMP header failed:", err)
+	}
+	h, err := decodeSmpHeader(hdr[:])
+	if err != nil {
+		t.Fatal("decoding SMP header failed:", err)
+	}
+	payload := make([]byte, h.Length-smpHeaderSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal("reading SMP payload failed:", err)
+	}
+	return h, payload
+}
+
+func writeSmpTestPacket(t *testing.T, w io.Writer, h smpHeader, payload []byte) {
+	h.Length = uint32(smpHeaderSize + len(payload))
+	buf := make([]byte, h.Length)
+	h.encode(buf)
+	copy(buf[smpHeaderSize:], payload)
+	if _, err := w.Write(buf); err != nil {
+		t.Error("writing SMP packet failed:", err)
+	}
+}
+
+func TestSmpHeaderEncodeDecode(t *testing.T) {
+	h := smpHeader{Flags: smpDATA, SID: 3, Length: 20, SeqNum: 7, Window: 10}
+	buf := make([]byte, smpHeaderSize)
+	h.encode(buf)
+	expected := []byte{0x53, 0x08, 3, 0, 20, 0, 0, 0, 7, 0, 0, 0, 10, 0, 0, 0}
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("encoded header is % x, expected % x", buf, expected)
+	}
+	decoded, err := decodeSmpHeader(buf)
+	if err != nil {
+		t.Fatal("decodeSmpHeader failed:", err)
+	}
+	if decoded != h {
+		t.Errorf("decoded header is %+v, expected %+v", decoded, h)
+	}
+
+	buf[0] = 0x12
+	if _, err = decodeSmpHeader(buf); err == nil {
+		t.Error("decodeSmpHeader should fail for an invalid SMID")
+	}
+	buf[0] = smpID
+	buf[4] = 4
+	if _, err = decodeSmpHeader(buf); err == nil {
+		t.Error("decodeSmpHeader should fail for a length shorter than the header")
+	}
+}
+
+func TestSmpSessionsAreDemultiplexed(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	mux := newSmpMux(client)
+	defer mux.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sid := uint16(0); sid < 2; sid++ {
+			h, _ := readSmpTestPacket(t, server)
+			if h.Flags != smpSYN || h.SID != sid || h.Window != smpWindow {
+				t.Errorf("expected SYN for session %d, got %+v", sid, h)
+			}
+		}
+		// Answer the second session first, its data must be queued until read.
+		writeSmpTestPacket(t, server, smpHeader{Flags: smpDATA, SID: 1, SeqNum: 1, Window: smpWindow}, []byte("second"))
+		writeSmpTestPacket(t, server, smpHeader{Flags: smpDATA, SID: 0, SeqNum: 1, Window: smpWindow}, []byte("first"))
+	}()
+
+	s0, err := mux.openSession()
+	if err != nil {
+		t.Fatal("openSession failed:", err)
+	}
+	s1, err := mux.openSession()
+	if err != nil {
+		t.Fatal("openSession failed:", err)
+	}
+
+	buf := make([]byte, 10)
+	n, err := s0.Read(buf)
+	if err != nil {
+		t.Fatal("reading session 0 failed:", err)
+	}
+	if string(buf[:n]) != "first" {
+		t.Errorf("session 0 read %q, expected %q", buf[:n], "first")
+	}
+	n, err = s1.Read(buf)
+	if err != nil {
+		t.Fatal("reading session 1 failed:", err)
+	}
+	if string(buf[:n]) != "second" {
+		t.Errorf("session 1 read %q, expected %q", buf[:n], "second")
+	}
+	<-done
+}
+
+func TestSmpSessionWaitsForPeerWindow(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	mux := newSmpMux(client)
+	defer mux.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readSmpTestPacket(t, server) // SYN
+		for seq := uint32(1); seq <= smpWindow; seq++ {
+			h, _ := readSmpTestPacket(t, server)
+			if h.Flags != smpDATA || h.SeqNum != seq {
+				t.Errorf("expected DATA with sequence number %d, got %+v", seq, h)
+			}
+		}
+		// The window is exhausted, the client may only continue after ACK.
+		writeSmpTestPacket(t, server, smpHeader{Flags: smpACK, SID: 0, Window: smpWindow + 1}, nil)
+		h, payload := readSmpTestPacket(t, server)
+		if h.Flags != smpDATA || h.SeqNum != smpWindow+1 || string(payload) != "last" {
+			t.Errorf("unexpected packet after ACK %+v %q", h, payload)
+		}
+		h, _ = readSmpTestPacket(t, server)
+		if h.Flags != smpFIN || h.SID != 0 {
+			t.Errorf("expected FIN, got %+v", h)
+		}
+	}()
+
+	s, err := mux.openSession()
+	if err != nil {
+		t.Fatal("openSession failed:", err)
+	}
+	for i := 0; i < smpWindow; i++ {
+		if _, err = s.Write([]byte("data")); err != nil {
+			t.Fatal("Write failed:", err)
+		}
+	}
+	if _, err = s.Write([]byte("last")); err != nil {
+		t.Fatal("Write failed:", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal("Close failed:", err)
+	}
+	<-done
+}
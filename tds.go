@@ -3,7 +3,6 @@ package mssql
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,8 +12,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf16"
 	"unicode/utf8"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 func parseInstances(msg []byte) map[string]map[string]string {
@@ -140,20 +143,72 @@ type tdsSession struct {
 	columns                 []columnStruct
 	tranid                  uint64
 	logFlags                uint64
-	log                     optionalLogger
+	logger                  optionalLogger
 	routedServer            string
 	routedPort              uint16
 	returnStatus            *ReturnStatus
+	// mux is set when MARS is enabled, buf then writes
+	// to the first logical session of the connection.
+	mux *smpMux
+	// marsTranid is the transaction a MARS session was acquired in.
+	marsTranid uint64
+	// conn is the network connection of the session.
+	conn *timeoutConn
+	// recovery is set when session recovery was requested at login.
+	recovery *sessionRecovery
+	// utf8Support is set when the server acknowledged UTF-8 support.
+	utf8Support bool
+	// collation is the collation of the current database.
+	collation cp.Collation
+	// dataClassificationVersion is the version of data classification
+	// acknowledged by the server, 0 when it is not enabled.
+	dataClassificationVersion int
+	// streamBlobs makes the next response stream the last column
+	// of its result sets, see StreamBlobs.
+	streamBlobs bool
 }
 
+type KeyStoreAuthentication string
+
+const (
+	PFXKeystoreAuth = "pfx"
+)
+
 type aeSettings struct {
-	ksLocation string
-	ksSecret   string
-	ksAuth     KeyStoreAuthentication
-	pKey       interface{}
-	cert       *x509.Certificate
+	// providers are the key store providers registered on the connector,
+	// by key store name.
+	providers map[string]ColumnEncryptionKeyStoreProvider
+	// keyStore is the key store of the connection string, nil if it has none.
+	keyStore ColumnEncryptionKeyStoreProvider
+	// cache holds the decrypted column encryption keys of the connector
+	// for cacheTTL, it is nil for connections opened without one.
+	cache    *cekCache
+	cacheTTL time.Duration
+	// returnCiphertext returns the values which cannot be decrypted as
+	// their ciphertext in place of an ErrColumnDecryption.
+	returnCiphertext bool
+}
+
+func newAESettings(c *Connector, p msdsn.Config) *aeSettings {
+	s := &aeSettings{}
+	if c != nil {
+		s.providers = c.keyStoreProviders
+		s.cache = &c.cekCache
+		s.cacheTTL = c.ColumnEncryptionKeyCacheTTL
+		s.returnCiphertext = c.ReturnCiphertextOnDecryptionError
+	}
+	switch KeyStoreAuthentication(p.KeyStoreAuthentication) {
+	case PFXKeystoreAuth:
+		s.keyStore = &pfxKeyStoreProvider{location: p.KeyStoreLocation, secret: p.KeyStoreSecret}
+	}
+	return s
 }
 
+// default packet size for TDS buffer
+const defaultPacketSize = 4096
+
+const defaultServerPort = 1433
+
 const (
 	logErrors      = 1
 	logMessages    = 2
@@ -162,6 +217,7 @@ const (
 	logParams      = 16
 	logTransaction = 32
 	logDebug       = 64
+	logRetries     = 128
 )
 
 type columnStruct struct {
@@ -177,7 +233,7 @@ func (c columnStruct) isEncrypted() bool {
 }
 
 func isEncryptedFlag(flags uint16) bool {
-	return 0x0800 == (flags & 0x0800)
+	return flags&colFlagEncrypted != 0
 }
 
 type keySlice []uint8
@@ -348,9 +404,16 @@ func (e featureExts) toBytes() []byte {
 	if len(e.features) == 0 {
 		return nil
 	}
+	// Features are written ordered by id to keep the login deterministic.
+	ids := make([]int, 0, len(e.features))
+	for featureID := range e.features {
+		ids = append(ids, int(featureID))
+	}
+	sort.Ints(ids)
 	var d []byte
-	for featureID, f := range e.features {
-		featureData := f.toBytes()
+	for _, id := range ids {
+		featureID := byte(id)
+		featureData := e.features[featureID].toBytes()
 
 		hdr := make([]byte, 5)
 		hdr[0] = featureID                                               // FedAuth feature extension BYTE
@@ -406,7 +469,7 @@ func (e *featureExtFedAuth) toBytes() []byte {
 	var d []byte
 
 	switch e.FedAuthLibrary {
-	case fedAuthLibrarySecurityToken:
+	case FedAuthLibrarySecurityToken:
 		d = make([]byte, 5)
 		d[0] = options
 
@@ -420,7 +483,7 @@ func (e *featureExtFedAuth) toBytes() []byte {
 			d = append(d, e.Nonce...)
 		}
 
-	case fedAuthLibraryADAL:
+	case FedAuthLibraryADAL:
 		d = []byte{options, e.ADALWorkflow}
 	}
 
@@ -444,6 +507,19 @@ func (f *featureExtColumnEncryption) toBytes() []byte {
 
 var _ featureExt = &featureExtColumnEncryption{}
 
+// featureExtUTF8Support tells the server the client can handle
+// data in UTF-8 collations.
+type featureExtUTF8Support struct {
+}
+
+func (f *featureExtUTF8Support) featureID() byte {
+	return featExtUTF8SUPPORT
+}
+
+func (f *featureExtUTF8Support) toBytes() []byte {
+	return nil
+}
+
 type loginHeader struct {
 	Length               uint32
 	TDSVersion           uint32
@@ -880,98 +956,160 @@ type auth interface {
 // SQL Server AlwaysOn Availability Group Listeners are bound by DNS to a
 // list of IP addresses.  So if there is more than one, try them all and
 // use the first one that allows a connection.
-func dialConnection(ctx context.Context, c *Connector, p connectParams) (conn net.Conn, err error) {
+func dialConnection(ctx context.Context, c *Connector, p msdsn.Config) (conn net.Conn, err error) {
 	var ips []net.IP
-	ip := net.ParseIP(p.host)
+	ip := net.ParseIP(p.Host)
 	if ip == nil {
-		ips, err = net.LookupIP(p.host)
+		ips, err = net.LookupIP(p.Host)
 		if err != nil {
 			return
 		}
 	} else {
 		ips = []net.IP{ip}
 	}
-	if len(ips) == 1 {
-		d := c.getDialer(&p)
-		addr := net.JoinHostPort(ips[0].String(), strconv.Itoa(int(resolveServerPort(p.port))))
-		conn, err = d.DialContext(ctx, "tcp", addr)
-
+	portStr := strconv.Itoa(int(resolveServerPort(p.Port)))
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), portStr)
+	}
+	d := c.getDialer(&p)
+	if p.MultiSubnetFailover && len(addrs) > 1 {
+		conn, err = dialParallel(ctx, d, addrs)
 	} else {
-		//Try Dials in parallel to avoid waiting for timeouts.
-		connChan := make(chan net.Conn, len(ips))
-		errChan := make(chan error, len(ips))
-		portStr := strconv.Itoa(int(resolveServerPort(p.port)))
-		for _, ip := range ips {
-			go func(ip net.IP) {
-				d := c.getDialer(&p)
-				addr := net.JoinHostPort(ip.String(), portStr)
-				conn, err := d.DialContext(ctx, "tcp", addr)
-				if err == nil {
-					connChan <- conn
-				} else {
-					errChan <- err
-				}
-			}(ip)
+		conn, err = dialSequential(ctx, d, addrs)
+	}
+	if err != nil {
+		f := "unable to open tcp connection with host '%v:%v': %v"
+		return nil, fmt.Errorf(f, p.Host, resolveServerPort(p.Port), err.Error())
+	}
+	return conn, nil
+}
+
+func resolveServerPort(port uint64) uint64 {
+	if port == 0 {
+		return defaultServerPort
+	}
+
+	return port
+}
+
+func generateSpn(host string, port uint64) string {
+	return fmt.Sprintf("MSSQLSvc/%s:%d", host, port)
+}
+
+// dialSequential dials addrs one after another and returns
+// the first connection which could be established.
+func dialSequential(ctx context.Context, d Dialer, addrs []string) (net.Conn, error) {
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
 		}
-		// Wait for either the *first* successful connection, or all the errors
-	wait_loop:
-		for i := range ips {
-			select {
-			case conn = <-connChan:
-				// Got a connection to use, close any others
-				go func(n int) {
-					for i := 0; i < n; i++ {
-						select {
-						case conn := <-connChan:
-							conn.Close()
-						case <-errChan:
-						}
-					}
-				}(len(ips) - i - 1)
-				// Remove any earlier errors we may have collected
-				err = nil
-				break wait_loop
-			case err = <-errChan:
+		errs = append(errs, addrError(addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, joinDialErrors(errs)
+}
+
+// dialParallel dials all addrs at once to avoid waiting for timeouts of
+// addresses which do not respond, like the inactive subnets of a
+// multi-subnet availability group listener. The first connection
+// established wins, the remaining dials are cancelled.
+func dialParallel(ctx context.Context, d Dialer, addrs []string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan dialResult, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				err = addrError(addr, err)
 			}
+			results <- dialResult{conn, err}
+		}(addr)
+	}
+	var errs []error
+	for i := range addrs {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
 		}
+		cancel()
+		// Close connections of dials which completed despite the cancellation.
+		go func(n int) {
+			for ; n > 0; n-- {
+				if res := <-results; res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}(len(addrs) - i - 1)
+		return res.conn, nil
 	}
-	// Can't do the usual err != nil check, as it is possible to have gotten an error before a successful connection
-	if conn == nil {
-		f := "unable to open tcp connection with host '%v:%v': %v"
-		return nil, fmt.Errorf(f, p.host, resolveServerPort(p.port), err.Error())
+	cancel()
+	return nil, joinDialErrors(errs)
+}
+
+// addrError makes sure err mentions the address it occurred for.
+func addrError(addr string, err error) error {
+	if strings.Contains(err.Error(), addr) {
+		return err
+	}
+	return fmt.Errorf("%s: %v", addr, err)
+}
+
+func joinDialErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
 	}
-	return conn, err
+	return errors.New(strings.Join(msgs, "; "))
 }
 
-func preparePreloginFields(p connectParams, fe *featureExtFedAuth) map[uint8][]byte {
-	instance_buf := []byte(p.instance)
+func preparePreloginFields(p msdsn.Config, fe *featureExtFedAuth) map[uint8][]byte {
+	instance_buf := []byte(p.Instance)
 	instance_buf = append(instance_buf, 0) // zero terminate instance name
 
 	var encrypt byte
-	if p.disableEncryption {
+	switch p.Encryption {
+	case msdsn.EncryptionDisabled:
 		encrypt = encryptNotSup
-	} else if p.encrypt {
+	case msdsn.EncryptionRequired, msdsn.EncryptionStrict:
 		encrypt = encryptOn
-	} else {
+	default:
 		encrypt = encryptOff
 	}
 
+	var mars byte
+	if p.MultipleActiveResultSets {
+		mars = 1
+	}
+
 	fields := map[uint8][]byte{
 		preloginVERSION:    {0, 0, 0, 0, 0, 0},
 		preloginENCRYPTION: {encrypt},
 		preloginINSTOPT:    instance_buf,
 		preloginTHREADID:   {0, 0, 0, 0},
-		preloginMARS:       {0}, // MARS disabled
+		preloginMARS:       {mars},
 	}
 
-	if fe.FedAuthLibrary != fedAuthLibraryReserved {
+	if fe.FedAuthLibrary != FedAuthLibraryReserved {
 		fields[preloginFEDAUTHREQUIRED] = []byte{1}
 	}
 
 	return fields
 }
 
-func interpretPreloginResponse(p connectParams, fe *featureExtFedAuth, fields map[uint8][]byte) (encrypt byte, err error) {
+func interpretPreloginResponse(p msdsn.Config, fe *featureExtFedAuth, fields map[uint8][]byte) (encrypt byte, err error) {
 	// If the server returns the preloginFEDAUTHREQUIRED field, then federated authentication
 	// is supported. The actual value may be 0 or 1, where 0 means either SSPI or federated
 	// authentication is allowed, while 1 means only federated authentication is allowed.
@@ -982,7 +1120,7 @@ func interpretPreloginResponse(p connectParams, fe *featureExtFedAuth, fields ma
 
 		// We need to be able to echo the value back to the server
 		fe.FedAuthEcho = fedAuthSupport[0] != 0
-	} else if fe.FedAuthLibrary != fedAuthLibraryReserved {
+	} else if fe.FedAuthLibrary != FedAuthLibraryReserved {
 		return 0, fmt.Errorf("federated authentication is not supported by the server")
 	}
 
@@ -991,56 +1129,78 @@ func interpretPreloginResponse(p connectParams, fe *featureExtFedAuth, fields ma
 		return 0, fmt.Errorf("encrypt negotiation failed")
 	}
 	encrypt = encryptBytes[0]
-	if p.encrypt && (encrypt == encryptNotSup || encrypt == encryptOff) {
+	// With strict encryption the connection is already encrypted.
+	if p.Encryption == msdsn.EncryptionRequired && (encrypt == encryptNotSup || encrypt == encryptOff) {
 		return 0, fmt.Errorf("server does not support encryption")
 	}
 
+	if p.MultipleActiveResultSets {
+		mars, ok := fields[preloginMARS]
+		if !ok || len(mars) != 1 || mars[0] != 1 {
+			return 0, fmt.Errorf("server does not support MARS")
+		}
+	}
+
 	return
 }
 
-func prepareLogin(ctx context.Context, c *Connector, p connectParams, log optionalLogger, auth auth, fe *featureExtFedAuth, packetSize uint32) (l *login, err error) {
+func prepareLogin(ctx context.Context, c *Connector, p msdsn.Config, logger optionalLogger, auth auth, fe *featureExtFedAuth, packetSize uint32, recovery *sessionRecovery) (l *login, err error) {
 	l = &login{
 		TDSVersion:   verTDS74,
 		PacketSize:   packetSize,
-		Database:     p.database,
+		Database:     p.Database,
 		OptionFlags2: fODBC, // to get unlimited TEXTSIZE
-		HostName:     p.workstation,
-		ServerName:   p.host,
-		AppName:      p.appname,
-		TypeFlags:    p.typeFlags,
+		HostName:     p.Workstation,
+		ServerName:   p.Host,
+		AppName:      p.AppName,
+	}
+	if p.ReadOnlyIntent {
+		l.TypeFlags |= fReadOnlyIntent
 	}
 
-	if p.columnEncryption {
+	if p.ColumnEncryption {
 		// Support Always Encrypted
 		_ = l.FeatureExt.Add(&featureExtColumnEncryption{})
 	}
 
+	_ = l.FeatureExt.Add(&featureExtUTF8Support{})
+	_ = l.FeatureExt.Add(&featureExtDataClassification{})
+
+	if p.ConnectRetryCount > 0 {
+		// Only a session that was acknowledged before carries state to restore.
+		fe := &featureExtSessionRecovery{}
+		if recovery != nil && recovery.acked {
+			fe.recovery = recovery
+		}
+		_ = l.FeatureExt.Add(fe)
+	}
+
 	switch {
-	case fe.FedAuthLibrary == fedAuthLibrarySecurityToken:
-		if p.logFlags&logDebug != 0 {
-			log.Println("Starting federated authentication using security token")
+	case fe.FedAuthLibrary == FedAuthLibrarySecurityToken:
+		if p.LogFlags&msdsn.LogDebug != 0 {
+			logger.Log(ctx, msdsn.LogDebug, "Starting federated authentication using security token")
 		}
 
 		fe.FedAuthToken, err = c.securityTokenProvider(ctx)
 		if err != nil {
-			if p.logFlags&logDebug != 0 {
-				log.Printf("Failed to retrieve service principal token for federated authentication security token library: %v", err)
+			if p.LogFlags&msdsn.LogDebug != 0 {
+				logger.Log(ctx, msdsn.LogDebug, fmt.Sprintf("Failed to retrieve service principal token for federated authentication security token library: %v", err))
 			}
 			return nil, err
 		}
 
 		_ = l.FeatureExt.Add(fe)
 
-	case fe.FedAuthLibrary == fedAuthLibraryADAL:
-		if p.logFlags&logDebug != 0 {
-			log.Println("Starting federated authentication using ADAL")
+	case fe.FedAuthLibrary == FedAuthLibraryADAL:
+		if p.LogFlags&msdsn.LogDebug != 0 {
+			logger.Log(ctx, msdsn.LogDebug, "Starting federated authentication using ADAL")
 		}
 
 		_ = l.FeatureExt.Add(fe)
 
 	case auth != nil:
-		if p.logFlags&logDebug != 0 {
-			log.Println("Starting SSPI login")
+		if p.LogFlags&msdsn.LogDebug != 0 {
+			logger.Log(ctx, msdsn.LogDebug, "Starting SSPI login")
 		}
 
 		l.SSPI, err = auth.InitialBytes()
@@ -1053,46 +1213,85 @@ func prepareLogin(ctx context.Context, c *Connector, p connectParams, log option
 
 	default:
 		// Default to SQL server authentication with user and password
-		l.UserName = p.user
-		l.Password = p.password
+		l.UserName = p.User
+		l.Password = p.Password
 	}
 
 	return l, nil
 }
 
-func connect(ctx context.Context, c *Connector, log optionalLogger, p connectParams) (res *tdsSession, err error) {
+func connect(ctx context.Context, c *Connector, logger optionalLogger, p msdsn.Config) (res *tdsSession, err error) {
+	return connectSession(ctx, c, logger, p, nil)
+}
+
+// getTLSConfig returns the TLS configuration for encrypting the connection.
+func getTLSConfig(p msdsn.Config) (*tls.Config, error) {
+	config := p.TLSConfig
+	if config == nil {
+		var err error
+		config, err = msdsn.SetupTLS("", p.Encryption == msdsn.EncryptionOff, p.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.Encryption == msdsn.EncryptionStrict {
+		// the certificate is always validated in strict mode, whatever
+		// the configuration given
+		config = config.Clone()
+		config.InsecureSkipVerify = false
+		config.NextProtos = []string{"tds/8.0"}
+		if config.MinVersion < tls.VersionTLS12 {
+			config.MinVersion = tls.VersionTLS12
+		}
+	}
+	return config, nil
+}
+
+// setHost makes p connect to host, whose certificate is expected to be
+// issued for host unless the connection string named its host.
+func setHost(p *msdsn.Config, host string) {
+	if !p.HostInCertificateProvided && p.TLSConfig != nil && p.TLSConfig.ServerName != host {
+		p.TLSConfig = p.TLSConfig.Clone()
+		p.TLSConfig.ServerName = host
+	}
+	p.Host = host
+}
+
+// connectSession opens a new session. When recovery holds the state of a
+// session dropped by the server, the state is restored in the new session.
+func connectSession(ctx context.Context, c *Connector, logger optionalLogger, p msdsn.Config, recovery *sessionRecovery) (res *tdsSession, err error) {
 	dialCtx := ctx
-	if p.dial_timeout > 0 {
+	if p.DialTimeout > 0 {
 		var cancel func()
-		dialCtx, cancel = context.WithTimeout(ctx, p.dial_timeout)
+		dialCtx, cancel = context.WithTimeout(ctx, p.DialTimeout)
 		defer cancel()
 	}
 	// if instance is specified use instance resolution service
-	if p.instance != "" && p.port != 0 {
+	if p.Instance != "" && p.Port != 0 {
 		// both instance name and port specified
 		// when port is specified instance name is not used
 		// you should not provide instance name when you provide port
-		log.Println("WARN: You specified both instance name and port in the connection string, port will be used and instance name will be ignored")
+		logger.Log(ctx, msdsn.LogMessages, "WARN: You specified both instance name and port in the connection string, port will be used and instance name will be ignored")
 	}
-	if p.instance != "" && p.port == 0 {
-		p.instance = strings.ToUpper(p.instance)
+	if p.Instance != "" && p.Port == 0 {
+		p.Instance = strings.ToUpper(p.Instance)
 		d := c.getDialer(&p)
-		instances, err := getInstances(dialCtx, d, p.host)
+		instances, err := getInstances(dialCtx, d, p.Host)
 		if err != nil {
 			f := "unable to get instances from Sql Server Browser on host %v: %v"
-			return nil, fmt.Errorf(f, p.host, err.Error())
+			return nil, fmt.Errorf(f, p.Host, err.Error())
 		}
-		strport, ok := instances[p.instance]["tcp"]
+		strport, ok := instances[p.Instance]["tcp"]
 		if !ok {
 			f := "no instance matching '%v' returned from host '%v'"
-			return nil, fmt.Errorf(f, p.instance, p.host)
+			return nil, fmt.Errorf(f, p.Instance, p.Host)
 		}
 		port, err := strconv.ParseUint(strport, 0, 16)
 		if err != nil {
 			f := "invalid tcp port returned from Sql Server Browser '%v': %v"
 			return nil, fmt.Errorf(f, strport, err.Error())
 		}
-		p.port = port
+		p.Port = port
 	}
 
 initiate_connection:
@@ -1101,18 +1300,51 @@ initiate_connection:
 		return nil, err
 	}
 
-	toconn := newTimeoutConn(conn, p.conn_timeout)
+	toconn := newTimeoutConn(conn, p.ConnTimeout)
+
+	var transport io.ReadWriteCloser = toconn
+	if p.Encryption == msdsn.EncryptionStrict {
+		// TDS 8.0: TLS is negotiated directly on the connection,
+		// prelogin and everything after it is encrypted.
+		config, err := getTLSConfig(p)
+		if err != nil {
+			toconn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(toconn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			toconn.Close()
+			return nil, fmt.Errorf("TLS Handshake failed: %v", err)
+		}
+		transport = tlsConn
+	}
 
-	outbuf := newTdsBuffer(p.packetSize, toconn)
+	packetSize := p.PacketSize
+	if packetSize == 0 {
+		packetSize = defaultPacketSize
+	}
+	outbuf := newTdsBuffer(packetSize, transport)
 	sess := tdsSession{
 		buf:      outbuf,
-		log:      log,
-		logFlags: p.logFlags,
+		logger:   logger,
+		logFlags: uint64(p.LogFlags),
+		conn:     toconn,
+	}
+	if p.ConnectRetryCount > 0 {
+		if recovery != nil {
+			sess.recovery = recovery.clone()
+			sess.recovery.acked = false
+		} else {
+			sess.recovery = newSessionRecovery()
+		}
 	}
 
 	fedAuth := &featureExtFedAuth{
-		FedAuthLibrary: p.fedAuthLibrary,
-		ADALWorkflow:   p.fedAuthADALWorkflow,
+		FedAuthLibrary: FedAuthLibraryReserved,
+	}
+	if c != nil {
+		fedAuth.FedAuthLibrary = c.fedAuthLibrary
+		fedAuth.ADALWorkflow = c.fedAuthADALWorkflow
 	}
 
 	fields := preparePreloginFields(p, fedAuth)
@@ -1132,30 +1364,15 @@ initiate_connection:
 		return nil, err
 	}
 
-	if encrypt != encryptNotSup {
-		var config tls.Config
-		if p.certificate != "" {
-			pem, err := ioutil.ReadFile(p.certificate)
-			if err != nil {
-				return nil, fmt.Errorf("cannot read certificate %q: %v", p.certificate, err)
-			}
-			certs := x509.NewCertPool()
-			certs.AppendCertsFromPEM(pem)
-			config.RootCAs = certs
-		}
-		if p.trustServerCertificate {
-			config.InsecureSkipVerify = true
+	if encrypt != encryptNotSup && p.Encryption != msdsn.EncryptionStrict {
+		config, err := getTLSConfig(p)
+		if err != nil {
+			return nil, err
 		}
-		config.ServerName = p.hostInCertificate
-		// fix for https://github.com/wang-xuemin/go-mssqldb/issues/166
-		// Go implementation of TLS payload size heuristic algorithm splits single TDS package to multiple TCP segments,
-		// while SQL Server seems to expect one TCP segment per encrypted TDS package.
-		// Setting DynamicRecordSizingDisabled to true disables that algorithm and uses 16384 bytes per TLS package
-		config.DynamicRecordSizingDisabled = true
 		// setting up connection handler which will allow wrapping of TLS handshake packets inside TDS stream
 		handshakeConn := tlsHandshakeConn{buf: outbuf}
 		passthrough := passthroughConn{c: &handshakeConn}
-		tlsConn := tls.Client(&passthrough, &config)
+		tlsConn := tls.Client(&passthrough, config)
 		err = tlsConn.Handshake()
 		passthrough.c = toconn
 		outbuf.transport = tlsConn
@@ -1164,19 +1381,36 @@ initiate_connection:
 		}
 		if encrypt == encryptOff {
 			outbuf.afterFirst = func() {
-				outbuf.transport = toconn
+				if sess.mux != nil {
+					sess.mux.setTransport(toconn)
+				} else {
+					outbuf.transport = toconn
+				}
 			}
 		}
 	}
 
-	auth, authOk := getAuth(p.user, p.password, p.serverSPN, p.workstation)
+	if p.MultipleActiveResultSets {
+		// Login and everything after it is sent inside SMP packets.
+		sess.mux = newSmpMux(outbuf.transport)
+		outbuf.transport, err = sess.mux.openSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	spn := p.ServerSPN
+	if spn == "" {
+		spn = generateSpn(p.Host, resolveServerPort(p.Port))
+	}
+	auth, authOk := getAuth(p.User, p.Password, spn, p.Workstation)
 	if authOk {
 		defer auth.Free()
 	} else {
 		auth = nil
 	}
 
-	login, err := prepareLogin(ctx, c, p, log, auth, fedAuth, uint32(outbuf.PackageSize()))
+	login, err := prepareLogin(ctx, c, p, logger, auth, fedAuth, uint32(outbuf.PackageSize()), recovery)
 	if err != nil {
 		return nil, err
 	}
@@ -1190,7 +1424,7 @@ initiate_connection:
 	// SSPI and federated authentication scenarios may require multiple
 	// packet exchanges to complete the login sequence.
 	for loginAck := false; !loginAck; {
-		reader := startReading(&sess, ctx, nil)
+		reader := startReading(&sess, ctx, outputs{})
 
 		for {
 			tok, err := reader.nextToken()
@@ -1251,10 +1485,23 @@ initiate_connection:
 					case colAckStruct:
 						if v.Version <= 2 && v.Version > 0 {
 							sess.alwaysEncrypted = true
-							sess.alwaysEncryptedSettings = &aeSettings{
-								ksSecret:   p.keyStoreSecret,
-								ksLocation: p.keyStoreLocation,
-								ksAuth:     p.keyStoreAuthentication,
+							sess.alwaysEncryptedSettings = newAESettings(c, p)
+						}
+					case dataClassificationAckStruct:
+						if v.Enabled {
+							sess.dataClassificationVersion = v.Version
+						}
+					case utf8SupportAckStruct:
+						sess.utf8Support = v.Supported
+					case sessionRecoveryAckStruct:
+						if sess.recovery != nil {
+							sess.recovery.acked = true
+							sess.recovery.recoverable = true
+							if recovery == nil {
+								sess.recovery.initial.states = v.States
+								for id, state := range v.States {
+									sess.recovery.current.states[id] = state
+								}
 							}
 						}
 					}
@@ -1270,13 +1517,22 @@ initiate_connection:
 		}
 	}
 
+	if sess.recovery != nil {
+		if !sess.recovery.acked {
+			// The server does not support session recovery.
+			sess.recovery = nil
+		} else if recovery == nil {
+			// State set up by the login is the initial state of the session.
+			sess.recovery.initial.database = sess.recovery.current.database
+			sess.recovery.initial.collation = sess.recovery.current.collation
+			sess.recovery.initial.language = sess.recovery.current.language
+		}
+	}
+
 	if sess.routedServer != "" {
 		toconn.Close()
-		p.host = sess.routedServer
-		p.port = uint64(sess.routedPort)
-		if !p.hostInCertificateProvided {
-			p.hostInCertificate = sess.routedServer
-		}
+		setHost(&p, sess.routedServer)
+		p.Port = uint64(sess.routedPort)
 		goto initiate_connection
 	}
 	return &sess, nil
@@ -10,6 +10,8 @@ import (
 	"regexp"
 	"sync/atomic"
 	"testing"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 type MockTransportDialer struct {
@@ -120,18 +122,19 @@ func TestLoginWithSQLServerAuth(t *testing.T) {
 			"  12 01 00 2f 00 00 01 00  00 00 1a 00 06 01 00 20\n" +
 				"00 01 02 00 21 00 01 03  00 22 00 04 04 00 26 00\n" +
 				"01 ff 00 00 00 00 00 00  00 00 00 00 00 00 00\n",
-			"  10 01 00 b2 00 00 01 00  aa 00 00 00 04 00 00 74\n" +
+			"  10 01 00 c2 00 00 01 00  ba 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
-				"00 02 00 00 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
+				"00 02 00 10 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
 				"70 00 04 00 78 00 06 00  84 00 0a 00 98 00 09 00\n" +
-				"00 00 00 00 aa 00 00 00  aa 00 00 00 aa 00 00 00\n" +
+				"aa 00 04 00 aa 00 00 00  aa 00 00 00 aa 00 00 00\n" +
 				"00 00 00 00 00 00 aa 00  00 00 aa 00 00 00 aa 00\n" +
 				"00 00 00 00 00 00 6c 00  6f 00 63 00 61 00 6c 00\n" +
 				"68 00 6f 00 73 00 74 00  74 00 65 00 73 00 74 00\n" +
 				"92 a5 f3 a5 93 a5 82 a5  f3 a5 e2 a5 67 00 6f 00\n" +
 				"2d 00 6d 00 73 00 73 00  71 00 6c 00 64 00 62 00\n" +
 				"6c 00 6f 00 63 00 61 00  6c 00 68 00 6f 00 73 00\n" +
-				"74 00\n",
+				"74 00 ae 00 00 00 09 01  00 00 00 02 0a 00 00 00\n" +
+				"00 ff\n",
 		},
 		[]string{
 			"  04 01 00 20  00 00 01 00   00 00 10 00  06 01 00 16\n" +
@@ -146,7 +149,7 @@ func TestLoginWithSQLServerAuth(t *testing.T) {
 
 	conn.Dialer = mock
 
-	_, err = connect(context.Background(), conn, driverInstanceNoProcess.log, conn.params)
+	_, err = connect(context.Background(), conn, driverInstanceNoProcess.logger, conn.params)
 
 	err = <-mock.result
 	if err != nil {
@@ -155,7 +158,8 @@ func TestLoginWithSQLServerAuth(t *testing.T) {
 }
 
 func TestLoginWithSecurityTokenAuth(t *testing.T) {
-	conn, err := newSecurityTokenConnector("sqlserver://localhost:1433?Workstation ID=localhost&log=128",
+	config, _, _ := msdsn.Parse("sqlserver://localhost:1433?Workstation ID=localhost&log=128")
+	conn, err := NewSecurityTokenConnector(config,
 		func(ctx context.Context) (string, error) {
 			return "<token>", nil
 		},
@@ -172,18 +176,19 @@ func TestLoginWithSecurityTokenAuth(t *testing.T) {
 				"00 01 02 00 26 00 01 03  00 27 00 04 04 00 2B 00\n" +
 				"01 06 00 2c 00 01 ff 00  00 00 00 00 00 00 00 00\n" +
 				"00 00 00 00 01\n",
-			"  10 01 00 BB 00 00 01 00  B3 00 00 00 04 00 00 74\n" +
+			"  10 01 00 c6 00 00 01 00  be 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
-				"00 02 00 10 00 00 00 00  00 00 00 00 5E 00 09 00\n" +
-				"70 00 00 00 70 00 00 00  70 00 0A 00 84 00 09 00\n" +
+				"00 02 00 10 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
+				"70 00 00 00 70 00 00 00  70 00 0a 00 84 00 09 00\n" +
 				"96 00 04 00 96 00 00 00  96 00 00 00 96 00 00 00\n" +
 				"00 00 00 00 00 00 96 00  00 00 96 00 00 00 96 00\n" +
-				"00 00 00 00 00 00 6C 00  6F 00 63 00 61 00 6C 00\n" +
-				"68 00 6F 00 73 00 74 00  67 00 6F 00 2D 00 6D 00\n" +
-				"73 00 73 00 71 00 6C 00  64 00 62 00 6C 00 6F 00\n" +
-				"63 00 61 00 6C 00 68 00  6F 00 73 00 74 00 9A 00\n" +
-				"00 00 02 13 00 00 00 03  0E 00 00 00 3C 00 74 00\n" +
-				"6F 00 6B 00 65 00 6E 00  3E 00 FF\n",
+				"00 00 00 00 00 00 6c 00  6f 00 63 00 61 00 6c 00\n" +
+				"68 00 6f 00 73 00 74 00  67 00 6f 00 2d 00 6d 00\n" +
+				"73 00 73 00 71 00 6c 00  64 00 62 00 6c 00 6f 00\n" +
+				"63 00 61 00 6c 00 68 00  6f 00 73 00 74 00 9a 00\n" +
+				"00 00 02 13 00 00 00 03  0e 00 00 00 3c 00 74 00\n" +
+				"6f 00 6b 00 65 00 6e 00  3e 00 09 01 00 00 00 02\n" +
+				"0a 00 00 00 00 ff\n",
 		},
 		[]string{
 			"  04 01 00 20  00 00 01 00   00 00 10 00  06 01 00 16\n" +
@@ -198,7 +203,7 @@ func TestLoginWithSecurityTokenAuth(t *testing.T) {
 
 	conn.Dialer = mock
 
-	_, err = connect(context.Background(), conn, driverInstanceNoProcess.log, conn.params)
+	_, err = connect(context.Background(), conn, driverInstanceNoProcess.logger, conn.params)
 
 	err = <-mock.result
 	if err != nil {
@@ -207,9 +212,10 @@ func TestLoginWithSecurityTokenAuth(t *testing.T) {
 }
 
 func TestLoginWithADALUsernamePasswordAuth(t *testing.T) {
-	conn, err := newActiveDirectoryTokenConnector(
-		"sqlserver://localhost:1433?Workstation ID=localhost&log=128",
-		fedAuthADALWorkflowPassword,
+	config, _, _ := msdsn.Parse("sqlserver://localhost:1433?Workstation ID=localhost&log=128")
+	conn, err := NewActiveDirectoryTokenConnector(
+		config,
+		FedAuthADALWorkflowPassword,
 		func(ctx context.Context, serverSPN, stsURL string) (string, error) {
 			return "<token>", nil
 		},
@@ -226,7 +232,7 @@ func TestLoginWithADALUsernamePasswordAuth(t *testing.T) {
 				"00 01 02 00 26 00 01 03  00 27 00 04 04 00 2B 00\n" +
 				"01 06 00 2C 00 01 ff 00  00 00 00 00 00 00 00 00\n" +
 				"00 00 00 00 01\n",
-			"  10 01 00 aa 00 00 01 00  a2 00 00 00 04 00 00 74\n" +
+			"  10 01 00 b5 00 00 01 00  ad 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
 				"00 02 00 10 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
 				"70 00 00 00 70 00 00 00  70 00 0a 00 84 00 09 00\n" +
@@ -236,7 +242,8 @@ func TestLoginWithADALUsernamePasswordAuth(t *testing.T) {
 				"68 00 6f 00 73 00 74 00  67 00 6f 00 2d 00 6d 00\n" +
 				"73 00 73 00 71 00 6c 00  64 00 62 00 6c 00 6f 00\n" +
 				"63 00 61 00 6c 00 68 00  6f 00 73 00 74 00 9a 00\n" +
-				"00 00 02 02 00 00 00 05  01 ff\n",
+				"00 00 02 02 00 00 00 05  01 09 01 00 00 00 02 0a\n" +
+				"00 00 00 00 ff\n",
 			"  08 01 00 1e 00 00 01 00  12 00 00 00 0e 00 00 00\n" +
 				"3c 00 74 00 6f 00 6b 00  65 00 6e 00 3e 00\n",
 		},
@@ -263,7 +270,7 @@ func TestLoginWithADALUsernamePasswordAuth(t *testing.T) {
 
 	conn.Dialer = mock
 
-	_, err = connect(context.Background(), conn, driverInstanceNoProcess.log, conn.params)
+	_, err = connect(context.Background(), conn, driverInstanceNoProcess.logger, conn.params)
 
 	err = <-mock.result
 	if err != nil {
@@ -272,9 +279,10 @@ func TestLoginWithADALUsernamePasswordAuth(t *testing.T) {
 }
 
 func TestLoginWithADALManagedIdentityAuth(t *testing.T) {
-	conn, err := newActiveDirectoryTokenConnector(
-		"sqlserver://localhost:1433?Workstation ID=localhost&log=128",
-		fedAuthADALWorkflowMSI,
+	config, _, _ := msdsn.Parse("sqlserver://localhost:1433?Workstation ID=localhost&log=128")
+	conn, err := NewActiveDirectoryTokenConnector(
+		config,
+		FedAuthADALWorkflowMSI,
 		func(ctx context.Context, serverSPN, stsURL string) (string, error) {
 			return "<token>", nil
 		},
@@ -291,7 +299,7 @@ func TestLoginWithADALManagedIdentityAuth(t *testing.T) {
 				"00 01 02 00 26 00 01 03  00 27 00 04 04 00 2B 00\n" +
 				"01 06 00 2C 00 01 ff 00  00 00 00 00 00 00 00 00\n" +
 				"00 00 00 00 01\n",
-			"  10 01 00 aa 00 00 01 00  a2 00 00 00 04 00 00 74\n" +
+			"  10 01 00 b5 00 00 01 00  ad 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
 				"00 02 00 10 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
 				"70 00 00 00 70 00 00 00  70 00 0a 00 84 00 09 00\n" +
@@ -301,7 +309,8 @@ func TestLoginWithADALManagedIdentityAuth(t *testing.T) {
 				"68 00 6f 00 73 00 74 00  67 00 6f 00 2d 00 6d 00\n" +
 				"73 00 73 00 71 00 6c 00  64 00 62 00 6c 00 6f 00\n" +
 				"63 00 61 00 6c 00 68 00  6f 00 73 00 74 00 9a 00\n" +
-				"00 00 02 02 00 00 00 05  03 ff\n",
+				"00 00 02 02 00 00 00 05  03 09 01 00 00 00 02 0a\n" +
+				"00 00 00 00 ff\n",
 			"  08 01 00 1e 00 00 01 00  12 00 00 00 0e 00 00 00\n" +
 				"3c 00 74 00 6f 00 6b 00  65 00 6e 00 3e 00\n",
 		},
@@ -328,7 +337,7 @@ func TestLoginWithADALManagedIdentityAuth(t *testing.T) {
 
 	conn.Dialer = mock
 
-	_, err = connect(context.Background(), conn, driverInstanceNoProcess.log, conn.params)
+	_, err = connect(context.Background(), conn, driverInstanceNoProcess.logger, conn.params)
 
 	err = <-mock.result
 	if err != nil {
@@ -3,12 +3,31 @@ package mssql
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/url"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 )
 
 type MockTransport struct {
@@ -32,7 +51,7 @@ func TestConstantsDefined(t *testing.T) {
 	}
 
 	for _, i := range []int{
-		fedAuthLibraryLiveIDCompactToken, fChangePassword, fSendYukonBinaryXML,
+		FedAuthLibraryLiveIDCompactToken, fChangePassword, fSendYukonBinaryXML,
 	} {
 		if i < 0 {
 			t.Fail()
@@ -111,7 +130,7 @@ func TestSendLoginWithFeatureExt(t *testing.T) {
 		ClientLCID:     0x204,
 	}
 	login.FeatureExt.Add(&featureExtFedAuth{
-		FedAuthLibrary: fedAuthLibrarySecurityToken,
+		FedAuthLibrary: FedAuthLibrarySecurityToken,
 		FedAuthToken:   "fedauthtoken",
 	})
 	err := sendLogin(buf, &login)
@@ -145,13 +164,13 @@ func TestSendLoginWithFeatureExt(t *testing.T) {
 
 func TestSendSqlBatch(t *testing.T) {
 	checkConnStr(t)
-	p, err := parseConnectParams(makeConnStr(t).String())
+	p, _, err := msdsn.Parse(makeConnStr(t).String())
 	if err != nil {
-		t.Error("parseConnectParams failed:", err.Error())
+		t.Error("msdsn.Parse failed:", err.Error())
 		return
 	}
 
-	conn, err := connect(context.Background(), nil, optionalLogger{testLogger{t}}, p)
+	conn, err := connect(context.Background(), nil, optionalLogger{loggerAdapter{testLogger{t}}}, p)
 	if err != nil {
 		t.Error("Open connection failed:", err.Error())
 		return
@@ -168,7 +187,7 @@ func TestSendSqlBatch(t *testing.T) {
 		return
 	}
 
-	reader := startReading(conn, context.Background(), nil)
+	reader := startReading(conn, context.Background(), outputs{})
 
 	err = reader.iterateResponse()
 	if err != nil {
@@ -195,7 +214,7 @@ func checkConnStr(t testing.TB) {
 // makeConnStr returns a URL struct so it may be modified by various
 // tests before used as a DSN.
 func makeConnStr(t testing.TB) *url.URL {
-	return testConnParams(t).toUrl()
+	return testConnParams(t).URL()
 }
 
 type testLogger struct {
@@ -231,21 +250,21 @@ func testConnection(t *testing.T, connStr string) {
 func TestConnect(t *testing.T) {
 	params := testConnParams(t)
 	SetLogger(testLogger{t})
-	testConnection(t, params.toUrl().String())
+	testConnection(t, params.URL().String())
 }
 
 func TestConnectViaIp(t *testing.T) {
 	params := testConnParams(t)
-	if params.encrypt {
+	if params.Encryption == msdsn.EncryptionRequired {
 		t.Skip("Unable to test connection to IP for servers that expect encryption")
 	}
 
-	ips, err := net.LookupIP(params.host)
+	ips, err := net.LookupIP(params.Host)
 	if err != nil {
 		t.Fatal("Unable to lookup IP", err)
 	}
-	params.host = ips[0].String()
-	testConnection(t, params.toUrl().String())
+	params.Host = ips[0].String()
+	testConnection(t, params.URL().String())
 }
 
 func simpleQuery(conn *sql.DB, t *testing.T) (stmt *sql.Stmt) {
@@ -424,18 +443,230 @@ func TestSecureConnection(t *testing.T) {
 	}
 }
 
+// startStrictTLSServer starts a server which expects TDS 8.0 strict encryption.
+// It reports the ALPN protocol and the type of the first packet it receives.
+func startStrictTLSServer(t *testing.T) (addr string, certFile string, result chan string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateKey failed:", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("CreateCertificate failed:", err)
+	}
+	f, err := ioutil.TempFile("", "mssql-cert")
+	if err != nil {
+		t.Fatal("TempFile failed:", err)
+	}
+	_ = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	f.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start a listener", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"tds/8.0"},
+	}
+	result = make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer conn.Close()
+		tlsConn := tls.Server(conn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			result <- err.Error()
+			return
+		}
+		var header [8]byte
+		if _, err = io.ReadFull(tlsConn, header[:]); err != nil {
+			result <- err.Error()
+			return
+		}
+		result <- fmt.Sprintf("%s %d", tlsConn.ConnectionState().NegotiatedProtocol, header[0])
+	}()
+	return listener.Addr().String(), f.Name(), result
+}
+
+func TestStrictEncryption(t *testing.T) {
+	addr, certFile, result := startStrictTLSServer(t)
+	defer os.Remove(certFile)
+
+	conn, err := NewConnector(fmt.Sprintf("sqlserver://%s?encrypt=strict&certificate=%s&hostnameincertificate=localhost", addr, url.QueryEscape(certFile)))
+	if err != nil {
+		t.Fatal("NewConnector failed:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The server closes the connection after prelogin, so connect fails.
+	_, _ = connect(ctx, conn, driverInstanceNoProcess.logger, conn.params)
+
+	if res := <-result; res != fmt.Sprintf("tds/8.0 %d", packPrelogin) {
+		t.Errorf("expected prelogin sent over TLS with ALPN tds/8.0, server got %q", res)
+	}
+}
+
+func TestStrictEncryptionValidatesCertificate(t *testing.T) {
+	addr, certFile, _ := startStrictTLSServer(t)
+	defer os.Remove(certFile)
+
+	// TrustServerCertificate must not disable certificate validation in strict mode.
+	conn, err := NewConnector(fmt.Sprintf("sqlserver://%s?encrypt=strict&trustservercertificate=true&hostnameincertificate=localhost", addr))
+	if err != nil {
+		t.Fatal("NewConnector failed:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = connect(ctx, conn, driverInstanceNoProcess.logger, conn.params)
+	if err == nil {
+		t.Fatal("connected to a server with an untrusted certificate")
+	}
+	if !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected certificate validation error, got %v", err)
+	}
+}
+
+func TestStrictEncryptionConfig(t *testing.T) {
+	addr, certFile, result := startStrictTLSServer(t)
+	defer os.Remove(certFile)
+
+	pemData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal("ReadFile failed:", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemData)
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.ParseUint(port, 10, 16)
+	// The driver adds the ALPN protocol missing from the prebuilt TLS config.
+	conn := NewConnectorConfig(msdsn.Config{
+		Host:       host,
+		Port:       portNum,
+		Encryption: msdsn.EncryptionStrict,
+		TLSConfig:  &tls.Config{RootCAs: roots, ServerName: "localhost"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _ = connect(ctx, conn, driverInstanceNoProcess.logger, conn.params)
+
+	if res := <-result; res != fmt.Sprintf("tds/8.0 %d", packPrelogin) {
+		t.Errorf("expected prelogin sent over TLS with ALPN tds/8.0, server got %q", res)
+	}
+}
+
+func TestGetTLSConfigStrict(t *testing.T) {
+	given := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}, MinVersion: tls.VersionTLS10}
+	config, err := getTLSConfig(msdsn.Config{Encryption: msdsn.EncryptionStrict, TLSConfig: given})
+	if err != nil {
+		t.Fatal("getTLSConfig failed:", err)
+	}
+	if config.InsecureSkipVerify || len(config.NextProtos) != 1 || config.NextProtos[0] != "tds/8.0" || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("strict TLS config skips verification %v, protocols %v, minimum version %#x",
+			config.InsecureSkipVerify, config.NextProtos, config.MinVersion)
+	}
+	if !given.InsecureSkipVerify || given.NextProtos[0] != "h2" {
+		t.Error("the given TLS config was changed")
+	}
+}
+
+// addrDialer fails, blocks or connects depending on the address dialed.
+type addrDialer struct {
+	fail  map[string]bool
+	block map[string]bool
+
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *addrDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	if d.fail[addr] {
+		return nil, errors.New("connection refused")
+	}
+	if d.block[addr] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func TestDialParallel(t *testing.T) {
+	d := &addrDialer{
+		fail:  map[string]bool{"10.0.0.1:1433": true},
+		block: map[string]bool{"10.0.0.2:1433": true},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialParallel(ctx, d, []string{"10.0.0.1:1433", "10.0.0.2:1433", "10.0.0.3:1433"})
+	if err != nil {
+		t.Fatal("dialParallel failed:", err)
+	}
+	conn.Close()
+	if ctx.Err() != nil {
+		t.Error("dialParallel waited for the blocked address")
+	}
+
+	// the blocked dial of the first call may still be running
+	d = &addrDialer{
+		fail: map[string]bool{"10.0.0.1:1433": true, "10.0.0.2:1433": true},
+	}
+	_, err = dialParallel(ctx, d, []string{"10.0.0.1:1433", "10.0.0.2:1433"})
+	if err == nil {
+		t.Fatal("dialParallel should fail when all addresses fail")
+	}
+	for _, addr := range []string{"10.0.0.1:1433", "10.0.0.2:1433"} {
+		if !strings.Contains(err.Error(), addr) {
+			t.Errorf("error %q does not mention %s", err, addr)
+		}
+	}
+}
+
+func TestDialSequential(t *testing.T) {
+	d := &addrDialer{
+		fail: map[string]bool{"10.0.0.1:1433": true},
+	}
+	conn, err := dialSequential(context.Background(), d, []string{"10.0.0.1:1433", "10.0.0.2:1433", "10.0.0.3:1433"})
+	if err != nil {
+		t.Fatal("dialSequential failed:", err)
+	}
+	conn.Close()
+	if len(d.dialed) != 2 || d.dialed[1] != "10.0.0.2:1433" {
+		t.Errorf("expected addresses to be dialed in order until one succeeds, dialed %v", d.dialed)
+	}
+}
+
 func TestBadCredentials(t *testing.T) {
 	params := testConnParams(t)
-	params.password = "padpwd"
-	params.user = "baduser"
-	testConnectionBad(t, params.toUrl().String())
+	params.Password = "padpwd"
+	params.User = "baduser"
+	testConnectionBad(t, params.URL().String())
 }
 
 func TestBadHost(t *testing.T) {
 	params := testConnParams(t)
-	params.host = "badhost"
-	params.instance = ""
-	testConnectionBad(t, params.toUrl().String())
+	params.Host = "badhost"
+	params.Instance = ""
+	testConnectionBad(t, params.URL().String())
 }
 
 func TestSSPIAuth(t *testing.T) {
@@ -547,9 +778,9 @@ func TestReadBVarByte(t *testing.T) {
 
 func BenchmarkPacketSize(b *testing.B) {
 	checkConnStr(b)
-	p, err := parseConnectParams(makeConnStr(b).String())
+	p, _, err := msdsn.Parse(makeConnStr(b).String())
 	if err != nil {
-		b.Error("parseConnectParams failed:", err.Error())
+		b.Error("msdsn.Parse failed:", err.Error())
 		return
 	}
 
@@ -566,15 +797,15 @@ func BenchmarkPacketSize(b *testing.B) {
 	for _, bm := range benchmarks {
 		b.Run(bm.name, func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				p.packetSize = bm.packetSize
+				p.PacketSize = bm.packetSize
 				runBatch(b, p)
 			}
 		})
 	}
 }
 
-func runBatch(t testing.TB, p connectParams) {
-	conn, err := connect(context.Background(), nil, optionalLogger{testLogger{t}}, p)
+func runBatch(t testing.TB, p msdsn.Config) {
+	conn, err := connect(context.Background(), nil, optionalLogger{loggerAdapter{testLogger{t}}}, p)
 	if err != nil {
 		t.Error("Open connection failed:", err.Error())
 		return
@@ -591,7 +822,7 @@ func runBatch(t testing.TB, p connectParams) {
 		return
 	}
 
-	reader := startReading(conn, context.Background(), nil)
+	reader := startReading(conn, context.Background(), outputs{})
 
 	err = reader.iterateResponse()
 	if err != nil {
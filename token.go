@@ -3,20 +3,18 @@ package mssql
 import (
 	"bytes"
 	"context"
-	"crypto/rsa"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	alwaysencrypted "github.com/swisscom/mssql-always-encrypted/pkg"
+	"github.com/golang-sql/sqlexp"
 	"github.com/swisscom/mssql-always-encrypted/pkg/algorithms"
 	"github.com/swisscom/mssql-always-encrypted/pkg/encryption"
 	"github.com/swisscom/mssql-always-encrypted/pkg/keys"
-	"golang.org/x/crypto/pkcs12"
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+	"github.com/wang-xuemin/go-mssqldb/msdsn"
 	"golang.org/x/text/encoding/unicode"
 	"io"
 	"io/ioutil"
-	"os"
 	"strconv"
 )
 
@@ -26,22 +24,24 @@ type token byte
 
 // token ids
 const (
-	tokenReturnStatus  token = 121 // 0x79
-	tokenColMetadata   token = 129 // 0x81
-	tokenOrder         token = 169 // 0xA9
-	tokenError         token = 170 // 0xAA
-	tokenInfo          token = 171 // 0xAB
-	tokenReturnValue   token = 0xAC
-	tokenLoginAck      token = 173 // 0xad
-	tokenFeatureExtAck token = 174 // 0xae
-	tokenRow           token = 209 // 0xd1
-	tokenNbcRow        token = 210 // 0xd2
-	tokenEnvChange     token = 227 // 0xE3
-	tokenSSPI          token = 237 // 0xED
-	tokenFedAuthInfo   token = 238 // 0xEE
-	tokenDone          token = 253 // 0xFD
-	tokenDoneProc      token = 254
-	tokenDoneInProc    token = 255
+	tokenReturnStatus       token = 121 // 0x79
+	tokenColMetadata        token = 129 // 0x81
+	tokenDataClassification token = 163 // 0xA3
+	tokenOrder              token = 169 // 0xA9
+	tokenError              token = 170 // 0xAA
+	tokenInfo               token = 171 // 0xAB
+	tokenReturnValue        token = 0xAC
+	tokenLoginAck           token = 173 // 0xad
+	tokenFeatureExtAck      token = 174 // 0xae
+	tokenRow                token = 209 // 0xd1
+	tokenNbcRow             token = 210 // 0xd2
+	tokenEnvChange          token = 227 // 0xE3
+	tokenSessionState       token = 228 // 0xE4
+	tokenSSPI               token = 237 // 0xED
+	tokenFedAuthInfo        token = 238 // 0xEE
+	tokenDone               token = 253 // 0xFD
+	tokenDoneProc           token = 254
+	tokenDoneInProc         token = 255
 )
 
 // done flags
@@ -86,13 +86,16 @@ const (
 )
 
 const (
-	cipherAlgCustom = 0x00
+	cipherAlgCustom                  = 0x00
+	cipherAlgAeadAes256CbcHmacSha256 = 0x02
 )
 
 // COLMETADATA flags
 // https://msdn.microsoft.com/en-us/library/dd357363.aspx
 const (
-	colFlagNullable = 1
+	colFlagNullable  = 1
+	colFlagEncrypted = 0x0800
+	colFlagHidden    = 0x2000
 	// TODO implement more flags
 )
 
@@ -129,7 +132,7 @@ type doneInProcStruct doneStruct
 
 // ENVCHANGE stream
 // http://msdn.microsoft.com/en-us/library/dd303449.aspx
-func processEnvChg(sess *tdsSession) {
+func processEnvChg(ctx context.Context, sess *tdsSession) {
 	size := sess.buf.uint16()
 	r := &io.LimitedReader{R: sess.buf, N: int64(size)}
 	for {
@@ -152,12 +155,18 @@ func processEnvChg(sess *tdsSession) {
 			if err != nil {
 				badStreamPanic(err)
 			}
+			if sess.recovery != nil {
+				sess.recovery.current.database = sess.database
+			}
 		case envTypLanguage:
-			// currently ignored
-			// new value
-			if _, err = readBVarChar(r); err != nil {
+			// new value, only kept for session recovery
+			language, err := readBVarChar(r)
+			if err != nil {
 				badStreamPanic(err)
 			}
+			if sess.recovery != nil {
+				sess.recovery.current.language = language
+			}
 			// old value
 			if _, err = readBVarChar(r); err != nil {
 				badStreamPanic(err)
@@ -207,7 +216,8 @@ func processEnvChg(sess *tdsSession) {
 				badStreamPanic(err)
 			}
 		case envSqlCollation:
-			// currently ignored
+			// the collation of the database, used by bulk copy and
+			// session recovery
 			var collationSize uint8
 			err = binary.Read(r, binary.LittleEndian, &collationSize)
 			if err != nil {
@@ -220,18 +230,18 @@ func processEnvChg(sess *tdsSession) {
 			}
 
 			// 4 bytes, contains: LCID ColFlags Version
-			var info uint32
-			err = binary.Read(r, binary.LittleEndian, &info)
-			if err != nil {
-				badStreamPanic(err)
-			}
-
 			// 1 byte, contains: sortID
-			var sortID uint8
-			err = binary.Read(r, binary.LittleEndian, &sortID)
-			if err != nil {
+			collation := make([]byte, collationSize)
+			if _, err = io.ReadFull(r, collation); err != nil {
 				badStreamPanic(err)
 			}
+			sess.collation = cp.Collation{
+				LcidAndFlags: binary.LittleEndian.Uint32(collation),
+				SortId:       collation[4],
+			}
+			if sess.recovery != nil {
+				sess.recovery.current.collation = collation
+			}
 
 			// old value, should be 0
 			if _, err = readBVarChar(r); err != nil {
@@ -247,7 +257,7 @@ func processEnvChg(sess *tdsSession) {
 				badStreamPanic(err)
 			}
 			if sess.logFlags&logTransaction != 0 {
-				sess.log.Printf("BEGIN TRANSACTION %x\n", sess.tranid)
+				sess.logger.Log(ctx, msdsn.LogTransaction, fmt.Sprintf("BEGIN TRANSACTION %x", sess.tranid))
 			}
 			_, err = readBVarByte(r)
 			if err != nil {
@@ -264,9 +274,9 @@ func processEnvChg(sess *tdsSession) {
 			}
 			if sess.logFlags&logTransaction != 0 {
 				if envtype == envTypCommitTran {
-					sess.log.Printf("COMMIT TRANSACTION %x\n", sess.tranid)
+					sess.logger.Log(ctx, msdsn.LogTransaction, fmt.Sprintf("COMMIT TRANSACTION %x", sess.tranid))
 				} else {
-					sess.log.Printf("ROLLBACK TRANSACTION %x\n", sess.tranid)
+					sess.logger.Log(ctx, msdsn.LogTransaction, fmt.Sprintf("ROLLBACK TRANSACTION %x", sess.tranid))
 				}
 			}
 			sess.tranid = 0
@@ -381,7 +391,7 @@ func processEnvChg(sess *tdsSession) {
 			sess.routedPort = newPort
 		default:
 			// ignore rest of records because we don't know how to skip those
-			sess.log.Printf("WARN: Unknown ENVCHANGE record detected with type id = %d\n", envtype)
+			sess.logger.Log(ctx, msdsn.LogMessages, fmt.Sprintf("WARN: Unknown ENVCHANGE record detected with type id = %d", envtype))
 			return
 		}
 	}
@@ -531,6 +541,10 @@ type colAckStruct struct {
 	Version int
 }
 
+type utf8SupportAckStruct struct {
+	Supported bool
+}
+
 type featureExtAck map[byte]interface{}
 
 func parseFeatureExtAck(r *tdsBuffer) featureExtAck {
@@ -555,6 +569,27 @@ func parseFeatureExtAck(r *tdsBuffer) featureExtAck {
 				length -= 32
 			}
 			ack[feature] = fedAuthAck
+		case featExtSESSIONRECOVERY:
+			data := make([]byte, length)
+			r.ReadFull(data)
+			length = 0
+			// An acknowledgement which can not be parsed leaves session recovery off.
+			recoveryAck := sessionRecoveryAckStruct{States: map[byte][]byte{}}
+			if err := parseSessionStateDataSet(data, recoveryAck.States); err == nil {
+				ack[feature] = recoveryAck
+			}
+		case featExtDATACLASSIFICATION:
+			if length >= 2 {
+				version := r.byte()
+				enabled := r.byte()
+				length -= 2
+				ack[feature] = dataClassificationAckStruct{Version: int(version), Enabled: enabled != 0}
+			}
+		case featExtUTF8SUPPORT:
+			if length >= 1 {
+				ack[feature] = utf8SupportAckStruct{Supported: r.byte()&1 != 0}
+				length--
+			}
 		case featExtCOLUMNENCRYPTION:
 			colAck := colAckStruct{}
 			colAck.Version = int(r.byte())
@@ -591,36 +626,6 @@ func parseColMetadata72(r *tdsBuffer, s *tdsSession) (columns []columnStruct) {
 	if s.alwaysEncrypted {
 		// CEK table
 		cekTable = readCEKTable(r)
-
-		if s.alwaysEncryptedSettings == nil {
-			panic("alwaysEncryptedSettings are nil!")
-		}
-
-		if s.alwaysEncryptedSettings.pKey == nil {
-			// Load Keystore
-			f, err := os.Open(s.alwaysEncryptedSettings.ksLocation)
-			if err != nil {
-				panic(err)
-			}
-
-			switch s.alwaysEncryptedSettings.ksAuth {
-			case PFXKeystoreAuth:
-				pfxBytes, err := ioutil.ReadAll(f)
-				if err != nil {
-					panic(err)
-				}
-
-				pk, cert, err := pkcs12.Decode(pfxBytes, s.alwaysEncryptedSettings.ksSecret)
-				if err != nil {
-					panic(err)
-				}
-
-				s.alwaysEncryptedSettings.pKey = pk
-				s.alwaysEncryptedSettings.cert = cert
-			default:
-				panic(fmt.Sprintf("ksAuth %v is unimplemented", s.alwaysEncryptedSettings.ksAuth))
-			}
-		}
 	}
 
 	dec := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder()
@@ -832,47 +837,65 @@ func parseRow(r *tdsBuffer, s *tdsSession, columns []columnStruct, row []interfa
 		}
 
 		if column.isEncrypted() && s.alwaysEncrypted {
-			buffer := decryptColumn(column, s, columnContent)
-			// Decrypt
-			row[i] = column.cryptoMeta.typeInfo.Reader(&column.cryptoMeta.typeInfo, &buffer, column.cryptoMeta)
+			row[i] = decryptColumnValue(column, s, columnContent)
 		} else {
 			row[i] = columnContent
 		}
 	}
 }
 
-func decryptColumn(column columnStruct, s *tdsSession, columnContent interface{}) tdsBuffer {
-	// Decrypt
-	cekValue := column.cryptoMeta.entry.cekValues[column.cryptoMeta.ordinal]
-	algVer := cekValue.cekVersion
-	encType := encryption.From(column.cryptoMeta.encType)
+// decryptColumnValue returns the decrypted value of an encrypted column.
+// A value which cannot be decrypted is returned as an ErrColumnDecryption,
+// which is reported by rowDecryptionError, or as its ciphertext when the
+// connector asks for it.
+func decryptColumnValue(column columnStruct, s *tdsSession, columnContent interface{}) interface{} {
+	buffer, err := decryptColumn(column, s, columnContent)
+	if err != nil {
+		if s.alwaysEncryptedSettings != nil && s.alwaysEncryptedSettings.returnCiphertext {
+			return columnContent
+		}
+		return err
+	}
+	return column.cryptoMeta.typeInfo.Reader(&column.cryptoMeta.typeInfo, &buffer, column.cryptoMeta)
+}
 
-	// Get pKey
-	if s.alwaysEncryptedSettings.pKey == nil {
-		panic("alwaysEncrypted pKey not set: this should never happen")
+// rowDecryptionError returns the error of the first column of a row
+// which could not be decrypted, or nil.
+func rowDecryptionError(row []interface{}) error {
+	for _, v := range row {
+		if err, ok := v.(ErrColumnDecryption); ok {
+			return err
+		}
 	}
+	return nil
+}
 
-	cekv := alwaysencrypted.LoadCEKV(column.cryptoMeta.entry.cekValues[0].encryptedKey)
-	if !cekv.Verify(s.alwaysEncryptedSettings.cert) {
-		panic(fmt.Errorf("invalid certificate being used to decrypt: %v requested but %v provided",
-			cekv.KeyPath,
-			fmt.Sprintf("%02x", sha1.Sum(s.alwaysEncryptedSettings.cert.Raw)),
-		))
+func decryptColumn(column columnStruct, s *tdsSession, columnContent interface{}) (tdsBuffer, error) {
+	decryptionError := func(keyPath string, err error) (tdsBuffer, error) {
+		return tdsBuffer{}, ErrColumnDecryption{Column: column.ColName, KeyPath: keyPath, Err: err}
+	}
+	entry := column.cryptoMeta.entry
+	if entry == nil {
+		return decryptionError("", errors.New("the column has no column encryption key"))
 	}
+	keyPath := ""
+	if len(entry.cekValues) > 0 {
+		keyPath = entry.cekValues[0].keyPath
+	}
+	encType := encryption.From(column.cryptoMeta.encType)
 
-	// TODO: Support other private keys
-	rootKey, err := cekv.Decrypt(s.alwaysEncryptedSettings.pKey.(*rsa.PrivateKey))
+	cekValue, rootKey, err := s.decryptCEKEntry(entry)
 	if err != nil {
-		panic(err)
+		return decryptionError(keyPath, err)
 	}
 
 	// Derive Root Key from encryptedKey
 	k := keys.NewAeadAes256CbcHmac256(rootKey)
-	alg := algorithms.NewAeadAes256CbcHmac256Algorithm(k, encType, byte(algVer))
+	alg := algorithms.NewAeadAes256CbcHmac256Algorithm(k, encType, aeadVersion)
 
 	d, err := alg.Decrypt(columnContent.([]byte))
 	if err != nil {
-		panic(err)
+		return decryptionError(cekValue.keyPath, err)
 	}
 
 	// Dirty workaround to keep compatibility with original types
@@ -886,7 +909,7 @@ func decryptColumn(column columnStruct, s *tdsSession, columnContent interface{}
 
 	column.cryptoMeta.typeInfo.Buffer = d
 	buffer := tdsBuffer{rpos: 0, rsize: len(newBuff), rbuf: newBuff, transport: rwc}
-	return buffer
+	return buffer, nil
 }
 
 // http://msdn.microsoft.com/en-us/library/dd304783.aspx
@@ -901,9 +924,7 @@ func parseNbcRow(r *tdsBuffer, s *tdsSession, columns []columnStruct, row []inte
 		}
 		columnContent := col.ti.Reader(&col.ti, r, nil)
 		if col.isEncrypted() && s.alwaysEncrypted {
-			buffer := decryptColumn(col, s, columnContent)
-			// Decrypt
-			row[i] = col.cryptoMeta.typeInfo.Reader(&col.cryptoMeta.typeInfo, &buffer, col.cryptoMeta)
+			row[i] = decryptColumnValue(col, s, columnContent)
 		} else {
 			row[i] = columnContent
 		}
@@ -968,21 +989,64 @@ func parseReturnValue(r *tdsBuffer, s *tdsSession) (nv namedValue) {
 	return
 }
 
-func processSingleResponse(sess *tdsSession, ch chan tokenStruct, outs map[string]interface{}) {
+// outputs are the destinations of a response besides the token channel.
+type outputs struct {
+	// params are the output parameters, by name.
+	params map[string]interface{}
+	// msgq receives the messages of the response, see Rowsq.
+	msgq *sqlexp.ReturnMessage
+}
+
+// resultSetEnd is passed on in messages mode after a result set or the
+// response ended, each is followed by a sqlexp.MsgNextResultSet message.
+type resultSetEnd struct {
+	// last is set at the end of the response.
+	last bool
+}
+
+func processSingleResponse(ctx context.Context, sess *tdsSession, ch chan tokenStruct, outs outputs) {
+	// colsReceived is set while a result set is not ended, ended once
+	// the end of the response was passed on.
+	colsReceived, ended := false, false
+	// enqueue passes a message on in messages mode. A message is dropped
+	// when ctx is done, nobody is reading them anymore.
+	enqueue := func(msg sqlexp.RawMessage) {
+		if outs.msgq != nil {
+			_ = sqlexp.ReturnMessageEnqueue(ctx, outs.msgq, msg)
+		}
+	}
+	endResultSet := func(done doneStruct) {
+		if outs.msgq == nil {
+			return
+		}
+		if done.Status&doneCount != 0 {
+			enqueue(sqlexp.MsgRowsAffected{Count: int64(done.RowCount)})
+		}
+		last := done.Status&doneMore == 0
+		if colsReceived || last {
+			ch <- resultSetEnd{last: last}
+			enqueue(sqlexp.MsgNextResultSet{})
+			colsReceived, ended = false, last
+		}
+	}
 	defer func() {
 		if err := recover(); err != nil {
 			if sess.logFlags&logErrors != 0 {
-				sess.log.Printf("ERROR: Intercepted panic %v", err)
+				sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Intercepted panic %v", err))
 			}
 			ch <- err
 		}
+		// the reader of the messages finds the error by moving on
+		if !ended {
+			enqueue(sqlexp.MsgNextResultSet{})
+		}
 		close(ch)
 	}()
 
 	packet_type, err := sess.buf.BeginRead()
 	if err != nil {
 		if sess.logFlags&logErrors != 0 {
-			sess.log.Printf("ERROR: BeginRead failed %v", err)
+			sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("BeginRead failed %v", err))
 		}
 		ch <- err
 		return
@@ -992,10 +1056,12 @@ func processSingleResponse(sess *tdsSession, ch chan tokenStruct, outs map[strin
 	}
 	var columns []columnStruct
 	errs := make([]Error, 0, 5)
+	streamBlobs := sess.streamBlobs
+	sess.streamBlobs = false
 	for tokens := 0; ; tokens += 1 {
 		token := token(sess.buf.byte())
 		if sess.logFlags&logDebug != 0 {
-			sess.log.Printf("got token %v", token)
+			sess.logger.Log(ctx, msdsn.LogDebug, fmt.Sprintf("got token %v", token))
 		}
 		switch token {
 		case tokenSSPI:
@@ -1019,61 +1085,80 @@ func processSingleResponse(sess *tdsSession, ch chan tokenStruct, outs map[strin
 		case tokenDoneInProc:
 			done := parseDoneInProc(sess.buf)
 			if sess.logFlags&logRows != 0 && done.Status&doneCount != 0 {
-				sess.log.Printf("(%d row(s) affected)\n", done.RowCount)
+				sess.logger.Log(ctx, msdsn.LogRows, fmt.Sprintf("(%d row(s) affected)", done.RowCount))
 			}
 			ch <- done
+			endResultSet(doneStruct(done))
 		case tokenDone, tokenDoneProc:
 			done := parseDone(sess.buf)
 			done.errors = errs
 			if sess.logFlags&logDebug != 0 {
-				sess.log.Printf("got DONE or DONEPROC status=%d", done.Status)
+				sess.logger.Log(ctx, msdsn.LogDebug, fmt.Sprintf("got DONE or DONEPROC status=%d", done.Status))
 			}
 			if done.Status&doneSrvError != 0 {
-				ch <- errors.New("SQL Server had internal error")
+				ch <- ServerError{done.getError()}
 				return
 			}
 			if sess.logFlags&logRows != 0 && done.Status&doneCount != 0 {
-				sess.log.Printf("(%d row(s) affected)\n", done.RowCount)
+				sess.logger.Log(ctx, msdsn.LogRows, fmt.Sprintf("(%d row(s) affected)", done.RowCount))
 			}
 			ch <- done
+			endResultSet(done)
 			if done.Status&doneMore == 0 {
 				return
 			}
 		case tokenColMetadata:
 			columns = parseColMetadata72(sess.buf, sess)
+			// The classification follows the metadata it describes, but is
+			// passed on first so it is known when the result set starts.
+			if sess.dataClassificationVersion > 0 && sess.buf.peekByte() == byte(tokenDataClassification) {
+				sess.buf.byte()
+				ch <- parseDataClassification(sess.buf, sess.dataClassificationVersion)
+			}
+			if streamBlobs {
+				streamLastColumn(columns)
+			}
 			ch <- columns
+			colsReceived = true
+			enqueue(sqlexp.MsgNext{})
 		case tokenRow:
 			row := make([]interface{}, len(columns))
 			parseRow(sess.buf, sess, columns, row)
 			ch <- row
+			waitBlob(row)
 		case tokenNbcRow:
 			row := make([]interface{}, len(columns))
 			parseNbcRow(sess.buf, sess, columns, row)
 			ch <- row
+			waitBlob(row)
 		case tokenEnvChange:
-			processEnvChg(sess)
+			processEnvChg(ctx, sess)
+		case tokenSessionState:
+			sess.updateSessionState(parseSessionState(sess.buf))
 		case tokenError:
 			err := parseError72(sess.buf)
 			if sess.logFlags&logDebug != 0 {
-				sess.log.Printf("got ERROR %d %s", err.Number, err.Message)
+				sess.logger.Log(ctx, msdsn.LogDebug, fmt.Sprintf("got ERROR %d %s", err.Number, err.Message))
 			}
 			errs = append(errs, err)
 			if sess.logFlags&logErrors != 0 {
-				sess.log.Println(err.Message)
+				sess.logger.Log(ctx, msdsn.LogErrors, err.Message)
 			}
+			enqueue(sqlexp.MsgError{Error: err})
 		case tokenInfo:
 			info := parseInfo(sess.buf)
 			if sess.logFlags&logDebug != 0 {
-				sess.log.Printf("got INFO %d %s", info.Number, info.Message)
+				sess.logger.Log(ctx, msdsn.LogDebug, fmt.Sprintf("got INFO %d %s", info.Number, info.Message))
 			}
 			if sess.logFlags&logMessages != 0 {
-				sess.log.Println(info.Message)
+				sess.logger.Log(ctx, msdsn.LogMessages, info.Message)
 			}
+			enqueue(sqlexp.MsgNotice{Message: info})
 		case tokenReturnValue:
 			nv := parseReturnValue(sess.buf, sess)
 			if len(nv.Name) > 0 {
 				name := nv.Name[1:] // Remove the leading "@".
-				if ov, has := outs[name]; has {
+				if ov, has := outs.params[name]; has {
 					err = scanIntoOut(name, nv.Value, ov)
 					if err != nil {
 						fmt.Println("scan error", err)
@@ -1081,6 +1166,8 @@ func processSingleResponse(sess *tdsSession, ch chan tokenStruct, outs map[strin
 					}
 				}
 			}
+			// passed on for callers reading output parameters by position
+			ch <- nv
 		default:
 			badStreamPanic(fmt.Errorf("unknown token type returned: %v", token))
 		}
@@ -1091,15 +1178,17 @@ type tokenProcessor struct {
 	tokChan    chan tokenStruct
 	ctx        context.Context
 	sess       *tdsSession
-	outs       map[string]interface{}
+	outs       outputs
 	lastRow    []interface{}
 	rowCount   int64
 	firstError error
+	// returnValues are the output parameters in the order received.
+	returnValues []namedValue
 }
 
-func startReading(sess *tdsSession, ctx context.Context, outs map[string]interface{}) *tokenProcessor {
+func startReading(sess *tdsSession, ctx context.Context, outs outputs) *tokenProcessor {
 	tokChan := make(chan tokenStruct, 5)
-	go processSingleResponse(sess, tokChan, outs)
+	go processSingleResponse(ctx, sess, tokChan, outs)
 	return &tokenProcessor{
 		tokChan: tokChan,
 		ctx:     ctx,
@@ -1119,6 +1208,7 @@ func (t *tokenProcessor) iterateResponse() error {
 				case []columnStruct:
 					t.sess.columns = token
 				case []interface{}:
+					releaseBlob(token)
 					t.lastRow = token
 				case doneInProcStruct:
 					if token.Status&doneCount != 0 {
@@ -1133,6 +1223,8 @@ func (t *tokenProcessor) iterateResponse() error {
 					}
 				case ReturnStatus:
 					t.sess.setReturnStatus(token)
+				case namedValue:
+					t.returnValues = append(t.returnValues, token)
 					/*case error:
 					if resultError == nil {
 						resultError = token
@@ -1197,7 +1289,7 @@ func (t tokenProcessor) nextToken() (tokenStruct, error) {
 		// we did not get cancellation confirmation in the current response
 		// read one more response, it must be there
 		t.tokChan = make(chan tokenStruct, 5)
-		go processSingleResponse(t.sess, t.tokChan, t.outs)
+		go processSingleResponse(t.ctx, t.sess, t.tokChan, t.outs)
 		if readCancelConfirmation(t.tokChan) {
 			return nil, t.ctx.Err()
 		}
@@ -1209,6 +1301,7 @@ func (t tokenProcessor) nextToken() (tokenStruct, error) {
 
 func readCancelConfirmation(tokChan chan tokenStruct) bool {
 	for tok := range tokChan {
+		releaseBlob(tok)
 		switch tok := tok.(type) {
 		default:
 		// just skip token
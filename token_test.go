@@ -21,6 +21,8 @@ func TestParseFeatureExtAck(t *testing.T) {
 			"1B 1C 1D 1E 1F 20 21 22  23 24 25 26 27 28 29 2A\n" +
 			"2B 2C 2D 2E 2F 30 31 32  33 34 35 36 37 38 39 3A\n" +
 			"3B 3C 3D 3E 3F FF\n",
+		"  0A 01 00 00 00 01 FF\n",
+		"  09 02 00 00 00 02 01 FF\n",
 	}
 
 	for _, tst := range tests {
@@ -40,3 +42,19 @@ func TestParseFeatureExtAck(t *testing.T) {
 		parseFeatureExtAck(r)
 	}
 }
+
+func TestParseFeatureExtAckUTF8Support(t *testing.T) {
+	b := []byte{featExtUTF8SUPPORT, 1, 0, 0, 0, 1, featExtTERMINATOR}
+	r := &tdsBuffer{
+		packetSize: len(b),
+		rbuf:       b,
+		rpos:       0,
+		rsize:      len(b),
+	}
+
+	ack := parseFeatureExtAck(r)
+	utf8Ack, ok := ack[featExtUTF8SUPPORT].(utf8SupportAckStruct)
+	if !ok || !utf8Ack.Supported {
+		t.Errorf("expected UTF-8 support to be acknowledged, got %v", ack)
+	}
+}
@@ -27,6 +27,7 @@ var (
 	ErrorSkip             = errors.New("all fields mustn't skip")
 	ErrorObjectName       = errors.New("wrong tvp name")
 	ErrorWrongTyping      = errors.New("the number of elements in columnStr and tvpFieldIndexes do not align")
+	ErrorTVPColumns       = errors.New("TVP of rows must declare its Columns")
 )
 
 //TVP is driver type, which allows supporting Table Valued Parameters (TVP) in SQL Server
@@ -35,6 +36,13 @@ type TVP struct {
 	TypeName string
 	//Value must be the slice, mustn't be nil
 	Value interface{}
+	//Columns declares the columns of the table type, in their order. With
+	//Columns, Value holds the rows as a [][]interface{} of their values, a
+	//BulkIterator of []interface{} rows or a *sql.Rows. A *sql.Rows can be
+	//given without Columns, the columns are then those of its result.
+	//The *sql.Rows is read while the request is sent, so it must not be
+	//open on the connection of the request unless MARS is enabled.
+	Columns []BulkColumn
 }
 
 func (tvp TVP) check() error {
@@ -47,6 +55,9 @@ func (tvp TVP) check() error {
 	if sepCount := getCountSQLSeparators(tvp.TypeName); sepCount > 1 {
 		return ErrorObjectName
 	}
+	if tvp.hasRows() {
+		return tvp.checkRows()
+	}
 	valueOf := reflect.ValueOf(tvp.Value)
 	if valueOf.Kind() != reflect.Slice {
 		return ErrorTypeSlice
@@ -64,26 +75,11 @@ func (tvp TVP) encode(schema, name string, columnStr []columnStruct, tvpFieldInd
 	if len(columnStr) != len(tvpFieldIndexes) {
 		return nil, ErrorWrongTyping
 	}
-	preparedBuffer := make([]byte, 0, 20+(10*len(columnStr)))
-	buf := bytes.NewBuffer(preparedBuffer)
-	err := writeBVarChar(buf, "")
+	buf, err := tvpHeader(schema, name, columnStr)
 	if err != nil {
 		return nil, err
 	}
 
-	writeBVarChar(buf, schema)
-	writeBVarChar(buf, name)
-	binary.Write(buf, binary.LittleEndian, uint16(len(columnStr)))
-
-	for i, column := range columnStr {
-		binary.Write(buf, binary.LittleEndian, uint32(column.UserType))
-		binary.Write(buf, binary.LittleEndian, uint16(column.Flags))
-		writeTypeInfo(buf, &columnStr[i].ti)
-		writeBVarChar(buf, "")
-	}
-	// The returned error is always nil
-	buf.WriteByte(_TVP_END_TOKEN)
-
 	conn := new(Conn)
 	conn.sess = new(tdsSession)
 	conn.sess.loginAck = loginAckStruct{TDSVersion: verTDS73}
@@ -133,6 +129,31 @@ func (tvp TVP) encode(schema, name string, columnStr []columnStruct, tvpFieldInd
 	return buf.Bytes(), nil
 }
 
+// tvpHeader returns a buffer holding the type name and the metadata of
+// the columns of a TVP, which sets the writers of their values.
+func tvpHeader(schema, name string, columnStr []columnStruct) (*bytes.Buffer, error) {
+	preparedBuffer := make([]byte, 0, 20+(10*len(columnStr)))
+	buf := bytes.NewBuffer(preparedBuffer)
+	err := writeBVarChar(buf, "")
+	if err != nil {
+		return nil, err
+	}
+
+	writeBVarChar(buf, schema)
+	writeBVarChar(buf, name)
+	binary.Write(buf, binary.LittleEndian, uint16(len(columnStr)))
+
+	for i, column := range columnStr {
+		binary.Write(buf, binary.LittleEndian, uint32(column.UserType))
+		binary.Write(buf, binary.LittleEndian, uint16(column.Flags))
+		writeTypeInfo(buf, &columnStr[i].ti)
+		writeBVarChar(buf, "")
+	}
+	// The returned error is always nil
+	buf.WriteByte(_TVP_END_TOKEN)
+	return buf, nil
+}
+
 func (tvp TVP) columnTypes() ([]columnStruct, []int, error) {
 	val := reflect.ValueOf(tvp.Value)
 	var firstRow interface{}
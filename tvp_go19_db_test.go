@@ -1149,3 +1149,37 @@ func TestTVPObject(t *testing.T) {
 		})
 	}
 }
+
+func TestTVPSQLRowsBinary(t *testing.T) {
+	checkConnStr(t)
+	SetLogger(testLogger{t})
+
+	db, err := sql.Open("sqlserver", makeConnStr(t).String())
+	if err != nil {
+		t.Fatal("Open connection failed:", err)
+	}
+	defer db.Close()
+
+	if _, err = db.Exec("CREATE TYPE dbo.tvpRowsBinary AS TABLE (id int, data binary(4))"); err != nil {
+		t.Fatal("CREATE TYPE failed:", err)
+	}
+	defer db.Exec("DROP TYPE dbo.tvpRowsBinary")
+
+	// the rows are read on another connection of the pool than the one
+	// the TVP is sent on
+	rows, err := db.Query("select 1 as id, cast(0x0102 as binary(4)) as data")
+	if err != nil {
+		t.Fatal("Query failed:", err)
+	}
+	defer rows.Close()
+
+	var id int
+	var data []byte
+	err = db.QueryRow("select id, data from @p1", TVP{TypeName: "dbo.tvpRowsBinary", Value: rows}).Scan(&id, &data)
+	if err != nil {
+		t.Fatal("Query with the TVP failed:", err)
+	}
+	if id != 1 || !reflect.DeepEqual(data, []byte{1, 2, 0, 0}) {
+		t.Errorf("read %d, % x", id, data)
+	}
+}
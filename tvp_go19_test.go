@@ -3,6 +3,7 @@
 package mssql
 
 import (
+	"io"
 	"reflect"
 	"testing"
 	"time"
@@ -577,3 +578,56 @@ func TestTVP_encode(t *testing.T) {
 		})
 	}
 }
+
+func TestTVP_encodeRows(t *testing.T) {
+	columns := []BulkColumn{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "nvarchar", Length: 10, Nullable: true},
+	}
+	rows := [][]interface{}{{1, "ab"}, {int64(2), nil}}
+	want := []byte{
+		// type name, 2 columns
+		0, 3, 'd', 0, 'b', 0, 'o', 0, 1, 't', 0, 2, 0,
+		// int
+		0, 0, 0, 0, 0, 0, typeIntN, 4, 0,
+		// nullable nvarchar(10)
+		0, 0, 0, 0, colFlagNullable, 0, typeNVarChar, 20, 0, 0, 0, 0, 0, 0, 0,
+		_TVP_END_TOKEN,
+		_TVP_ROW_TOKEN, 4, 1, 0, 0, 0, 4, 0, 'a', 0, 'b', 0,
+		_TVP_ROW_TOKEN, 4, 2, 0, 0, 0, 0xff, 0xff,
+		_TVP_END_TOKEN,
+	}
+	s := &Stmt{c: &Conn{sess: &tdsSession{}}}
+	p, err := s.makeParam(TVP{TypeName: "dbo.t", Value: rows, Columns: columns})
+	if err != nil {
+		t.Fatal("makeParam failed:", err)
+	}
+	if p.ti.TypeId != typeTvp || p.ti.UdtInfo.SchemaName != "dbo" || p.ti.UdtInfo.TypeName != "t" {
+		t.Errorf("unexpected TVP parameter type %+v", p.ti)
+	}
+	if !reflect.DeepEqual(p.buffer, want) {
+		t.Errorf("TVP encoded as % x, want % x", p.buffer, want)
+	}
+
+	i := 0
+	it := BulkIteratorFunc(func() (interface{}, error) {
+		if i == len(rows) {
+			return nil, io.EOF
+		}
+		i++
+		return rows[i-1], nil
+	})
+	if p, err = s.makeParam(TVP{TypeName: "dbo.t", Value: it, Columns: columns}); err != nil || !reflect.DeepEqual(p.buffer, want) {
+		t.Errorf("TVP of an iterator encoded as % x, %v", p.buffer, err)
+	}
+
+	if _, err = s.makeParam(TVP{TypeName: "dbo.t", Value: [][]interface{}{{1}}, Columns: columns}); err == nil {
+		t.Error("a row missing a value should fail")
+	}
+	if _, err = s.makeParam(TVP{TypeName: "dbo.t", Value: it}); err != ErrorTypeSlice {
+		t.Errorf("rows without columns failed with %v", err)
+	}
+	if _, err = s.makeParam(TVP{TypeName: "dbo.t", Value: []int{1}, Columns: columns}); err == nil {
+		t.Error("rows of ints should fail")
+	}
+}
@@ -0,0 +1,168 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
+)
+
+// hasRows tells whether the rows of the TVP are given as values rather
+// than structs.
+func (tvp TVP) hasRows() bool {
+	if len(tvp.Columns) > 0 {
+		return true
+	}
+	_, ok := tvp.Value.(*sql.Rows)
+	return ok
+}
+
+func (tvp TVP) checkRows() error {
+	switch value := tvp.Value.(type) {
+	case *sql.Rows:
+		if value == nil {
+			return ErrorTypeSliceIsEmpty
+		}
+	case [][]interface{}, BulkIterator:
+		if len(tvp.Columns) == 0 {
+			return ErrorTVPColumns
+		}
+	default:
+		return fmt.Errorf("mssql: TVP with Columns cannot take rows of type %T", tvp.Value)
+	}
+	return nil
+}
+
+// rowColumns returns the metadata of the declared columns, or of the
+// columns of the *sql.Rows.
+func (tvp TVP) rowColumns(collation cp.Collation) ([]columnStruct, error) {
+	columns := tvp.Columns
+	if rows, ok := tvp.Value.(*sql.Rows); ok && len(columns) == 0 {
+		types, err := rows.ColumnTypes()
+		if err != nil {
+			return nil, err
+		}
+		for _, ct := range types {
+			columns = append(columns, sqlRowsColumn(ct))
+		}
+	}
+	return declaredMetadata(columns, collation)
+}
+
+// sqlRowsColumn returns the column of a result as a declared column.
+// The scale of time values is not known, it is 7. Neither is the length
+// of binary values, which is only reported for variable length types,
+// they are declared varbinary(8000) and the server pads them.
+func sqlRowsColumn(ct *sql.ColumnType) BulkColumn {
+	c := BulkColumn{Name: ct.Name(), Type: strings.ToLower(ct.DatabaseTypeName())}
+	if length, ok := ct.Length(); ok {
+		c.Length = int(length)
+	}
+	switch c.Type {
+	case "binary":
+		if c.Length == 0 {
+			c.Type, c.Length = "varbinary", 8000
+		}
+	case "decimal", "numeric":
+		if precision, scale, ok := ct.DecimalSize(); ok {
+			c.Precision, c.Scale = uint8(precision), uint8(scale)
+		}
+	case "time", "datetime2", "datetimeoffset":
+		c.Scale = 7
+	}
+	c.Nullable, _ = ct.Nullable()
+	return c
+}
+
+// rowIterator returns a function returning the rows of the TVP one at a
+// time, and io.EOF after the last one.
+func (tvp TVP) rowIterator(count int) func() ([]interface{}, error) {
+	switch value := tvp.Value.(type) {
+	case [][]interface{}:
+		i := 0
+		return func() ([]interface{}, error) {
+			if i == len(value) {
+				return nil, io.EOF
+			}
+			i++
+			return value[i-1], nil
+		}
+	case BulkIterator:
+		return func() ([]interface{}, error) {
+			row, err := value.Next()
+			if err != nil {
+				return nil, err
+			}
+			values, ok := row.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("mssql: TVP row of type %T is not a []interface{}", row)
+			}
+			return values, nil
+		}
+	case *sql.Rows:
+		return func() ([]interface{}, error) {
+			if !value.Next() {
+				if err := value.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			values := make([]interface{}, count)
+			dest := make([]interface{}, count)
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			if err := value.Scan(dest...); err != nil {
+				return nil, err
+			}
+			return values, nil
+		}
+	}
+	return func() ([]interface{}, error) {
+		return nil, fmt.Errorf("mssql: TVP cannot take rows of type %T", tvp.Value)
+	}
+}
+
+// encodeRows encodes a TVP of declared columns, or of the columns of a
+// *sql.Rows. Values are converted like by Bulk.AddRow, strings in
+// sql_variant columns are sent with variantCollation.
+func (tvp TVP) encodeRows(schema, name string, collation, variantCollation cp.Collation) ([]byte, error) {
+	columnStr, err := tvp.rowColumns(collation)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := tvpHeader(schema, name, columnStr)
+	if err != nil {
+		return nil, err
+	}
+	next := tvp.rowIterator(len(columnStr))
+	bulk := &Bulk{collation: variantCollation}
+	for n := 0; ; n++ {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) != len(columnStr) {
+			return nil, fmt.Errorf("mssql: TVP row %d has %d values, not %d", n, len(row), len(columnStr))
+		}
+		buf.WriteByte(_TVP_ROW_TOKEN)
+		for i, col := range columnStr {
+			param, err := bulk.makeParam(row[i], col)
+			if err != nil {
+				return nil, fmt.Errorf("failed to make tvp parameter row %d col %s: %s", n, col.ColName, err)
+			}
+			if err = col.ti.Writer(buf, param.ti, param.buffer); err != nil {
+				return nil, err
+			}
+		}
+	}
+	buf.WriteByte(_TVP_END_TOKEN)
+	return buf.Bytes(), nil
+}
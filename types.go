@@ -212,8 +212,25 @@ func writeVarLen(w io.Writer, ti *typeInfo) (err error) {
 			return
 		}
 		ti.Writer = writeByteLenType
+	case typeXml:
+		// PARTLENTYPE without a length
+		if err = binary.Write(w, binary.LittleEndian, ti.XmlInfo.SchemaPresent); err != nil {
+			return
+		}
+		if ti.XmlInfo.SchemaPresent != 0 {
+			if err = writeBVarChar(w, ti.XmlInfo.DBName); err != nil {
+				return
+			}
+			if err = writeBVarChar(w, ti.XmlInfo.OwningSchema); err != nil {
+				return
+			}
+			if err = writeUsVarChar(w, ti.XmlInfo.XmlSchemaCollection); err != nil {
+				return
+			}
+		}
+		ti.Writer = writePLPType
 	case typeBigVarBin, typeBigVarChar, typeBigBinary, typeBigChar,
-		typeNVarChar, typeNChar, typeXml, typeUdt:
+		typeNVarChar, typeNChar, typeUdt:
 
 		// short len types
 		if ti.Size > 8000 || ti.Size == 0 {
@@ -232,20 +249,23 @@ func writeVarLen(w io.Writer, ti *typeInfo) (err error) {
 			if err = writeCollation(w, ti.Collation); err != nil {
 				return
 			}
-		case typeXml:
-			if err = binary.Write(w, binary.LittleEndian, ti.XmlInfo.SchemaPresent); err != nil {
-				return
-			}
 		}
 	case typeText, typeImage, typeNText, typeVariant:
 		// LONGLEN_TYPE
 		if err = binary.Write(w, binary.LittleEndian, uint32(ti.Size)); err != nil {
 			return
 		}
-		if err = writeCollation(w, ti.Collation); err != nil {
-			return
+		switch ti.TypeId {
+		case typeText, typeNText:
+			if err = writeCollation(w, ti.Collation); err != nil {
+				return
+			}
+		}
+		if ti.TypeId == typeVariant {
+			ti.Writer = writeVariantType
+		} else {
+			ti.Writer = writeLongLenType
 		}
-		ti.Writer = writeLongLenType
 	default:
 		panic("Invalid type")
 	}
@@ -389,7 +409,8 @@ func readByteLenType(ti *typeInfo, r *tdsBuffer, c *cryptoMetadata) interface{}
 	case typeDecimal, typeNumeric, typeDecimalN, typeNumericN:
 		return decodeDecimal(ti.Prec, ti.Scale, buf)
 	case typeBitN:
-		if len(buf) != 1 {
+		// encrypted bits are decrypted as 8 bytes
+		if len(buf) != 1 && (c == nil || len(buf) != 8) {
 			badStreamPanicf("Invalid size for BITNTYPE")
 		}
 		return buf[0] != 0
@@ -533,6 +554,11 @@ func readLongLenType(ti *typeInfo, r *tdsBuffer, c *cryptoMetadata) interface{}
 	panic("shoulnd't get here")
 }
 func writeLongLenType(w io.Writer, ti typeInfo, buf []byte) (err error) {
+	if buf == nil {
+		// NULL has no textptr
+		err = binary.Write(w, binary.LittleEndian, byte(0))
+		return
+	}
 	//textptr
 	err = binary.Write(w, binary.LittleEndian, byte(0x10))
 	if err != nil {
@@ -560,6 +586,20 @@ func writeLongLenType(w io.Writer, ti typeInfo, buf []byte) (err error) {
 	return
 }
 
+// writeVariantType writes a sql_variant value, buf holds its base type,
+// its properties and its data.
+// http://msdn.microsoft.com/en-us/library/dd303302.aspx
+func writeVariantType(w io.Writer, ti typeInfo, buf []byte) (err error) {
+	if err = binary.Write(w, binary.LittleEndian, uint32(len(buf))); err != nil {
+		return
+	}
+	_, err = w.Write(buf)
+	return
+}
+
+// utf8Collation is Latin1_General_100_CI_AS_SC_UTF8.
+var utf8Collation = cp.Collation{LcidAndFlags: 0x24d00409}
+
 func readCollation(r *tdsBuffer) (res cp.Collation) {
 	res.LcidAndFlags = r.uint32()
 	res.SortId = r.byte()
@@ -846,6 +886,22 @@ func decodeMoney4(buf []byte) []byte {
 	return decimal.ScaleBytes(strconv.FormatInt(int64(money), 10), 4)
 }
 
+// encodeMoney encodes a money value given in ten-thousandths,
+// the high 4 bytes first.
+func encodeMoney(money int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(uint64(money)>>32))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(money))
+	return buf
+}
+
+// encodeMoney4 encodes a smallmoney value given in ten-thousandths.
+func encodeMoney4(money int32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(money))
+	return buf
+}
+
 func decodeGuid(buf []byte) []byte {
 	res := make([]byte, 16)
 	copy(res, buf)
@@ -1134,6 +1190,28 @@ func makeGoLangScanType(ti typeInfo) reflect.Type {
 	}
 }
 
+// makePrepareDecl is makeDecl for prepared statements. Variable length
+// types are declared with their largest size below max and decimals with
+// the largest precision, so that values of different lengths and numbers
+// of digits can be passed to the same prepared statement.
+func makePrepareDecl(ti typeInfo) string {
+	switch ti.TypeId {
+	case typeDecimal, typeDecimalN:
+		return fmt.Sprintf("decimal(38, %d)", ti.Scale)
+	}
+	if ti.Size > 0 && ti.Size <= 8000 {
+		switch ti.TypeId {
+		case typeBigVarBin:
+			return "varbinary(8000)"
+		case typeBigVarChar, typeVarChar:
+			return "varchar(8000)"
+		case typeNVarChar:
+			return "nvarchar(4000)"
+		}
+	}
+	return makeDecl(ti)
+}
+
 func makeDecl(ti typeInfo) string {
 	switch ti.TypeId {
 	case typeNull:
@@ -1242,6 +1320,12 @@ func makeDecl(ti typeInfo) string {
 		return "text"
 	case typeNText:
 		return "ntext"
+	case typeImage:
+		return "image"
+	case typeXml:
+		return "xml"
+	case typeVariant:
+		return "sql_variant"
 	case typeUdt:
 		return ti.UdtInfo.TypeName
 	case typeGuid:
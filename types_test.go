@@ -4,6 +4,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/wang-xuemin/go-mssqldb/internal/cp"
 )
 
 func TestMakeGoLangScanType(t *testing.T) {
@@ -143,6 +145,37 @@ func TestMakeDecl(t *testing.T) {
 	}
 }
 
+func TestMakePrepareDecl(t *testing.T) {
+	tests := []struct {
+		ti   typeInfo
+		decl string
+	}{
+		{typeInfo{TypeId: typeNVarChar, Size: 6}, "nvarchar(4000)"},
+		{typeInfo{TypeId: typeNVarChar, Size: 0xffff}, "nvarchar(max)"},
+		{typeInfo{TypeId: typeDecimalN, Size: 5, Prec: 3, Scale: 2}, "decimal(38, 2)"},
+		{typeInfo{TypeId: typeDecimalN, Size: 9, Prec: 12, Scale: 2}, "decimal(38, 2)"},
+	}
+	for _, tt := range tests {
+		if decl := makePrepareDecl(tt.ti); decl != tt.decl {
+			t.Errorf("makePrepareDecl(%+v) returned %s, expected %s", tt.ti, decl, tt.decl)
+		}
+	}
+}
+
+func TestDecodeCharUTF8Collation(t *testing.T) {
+	s := "árvíztűrő 日本"
+	if res := decodeChar(utf8Collation, []byte(s)); res != s {
+		t.Errorf("decodeChar with UTF-8 collation returned %q, expected %q", res, s)
+	}
+	if !utf8Collation.IsUTF8() {
+		t.Error("utf8Collation should be a UTF-8 collation")
+	}
+	latin1 := cp.Collation{LcidAndFlags: 0x00d00409, SortId: 52}
+	if latin1.IsUTF8() {
+		t.Error("SQL_Latin1_General_CP1_CI_AS should not be a UTF-8 collation")
+	}
+}
+
 func handlePanic(t *testing.T) {
 	if r := recover(); r != nil {
 		t.Errorf("recovered panic")